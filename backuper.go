@@ -4,9 +4,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/n-boy/backuper/base"
 	"github.com/n-boy/backuper/cmds"
@@ -16,80 +21,316 @@ import (
 func main() {
 	base.InitApp(base.DefaultAppConfig)
 
-	parseCmd()
+	ctx, stop := notifyInterrupt()
+	exitCode := parseCmd(ctx, os.Args[1:])
+	stop()
 
 	base.FinishApp()
+	os.Exit(exitCode)
 }
 
-func parseCmd() {
-	var planName = flag.String("plan", "", "")
-	var createPlan = flag.Bool("create-plan", false, "")
-	cmd_flags := make(map[string]*bool)
-	cmd_list := []string{"edit", "view", "status", "backup", "restore", "sync", "web-ui"}
-	for _, cmd := range cmd_list {
-		cmd_flags[cmd] = flag.Bool(cmd, false, "")
+const (
+	exitCodeOk    = 0
+	exitCodeError = 1
+	exitCodeUsage = 2
+	// the same as shell uses for process terminated by SIGINT
+	exitCodeInterrupted = 130
+)
+
+// returns context canceled on the first SIGINT/SIGTERM, so the running command stops gracefully:
+// partly created files are removed, uploads to storage are aborted, op locks are released.
+// The second signal terminates application immediately
+func notifyInterrupt() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigChan
+		signal.Stop(sigChan)
+		base.LogErr.Printf("Got %v signal, interrupting... Send it again to terminate immediately\n", sig)
+		cancel()
+	}()
+	return ctx, func() {
+		signal.Stop(sigChan)
+		cancel()
 	}
+}
+
+var planCmdList = []string{"create", "edit", "show", "delete"}
+var cmdList = []string{"backup", "restore", "sync", "status", "verify", "prune", "change-passphrase", "webui"}
 
-	flag.Usage = func() {
-		fmt.Printf("usage: %s --create-plan\n", os.Args[0])
-		fmt.Printf("       %s --plan my_plan_name --<command>\n", os.Args[0])
-		fmt.Println("possible commands:")
-		for _, cmd := range cmd_list {
-			fmt.Printf("    --%v\n", cmd)
+// returns exit code of application
+func parseCmd(ctx context.Context, args []string) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage()
+		if len(args) == 0 {
+			return exitCodeUsage
 		}
-		// flag.PrintDefaults()
-		os.Exit(0)
+		return exitCodeOk
+	}
+	if strings.HasPrefix(args[0], "-") {
+		return parseLegacyCmd(ctx, args)
 	}
 
-	flag.Parse()
+	cmd := args[0]
+	args = args[1:]
+	if cmd == "plan" {
+		if len(args) == 0 {
+			printUsage()
+			return exitCodeUsage
+		}
+		cmd = "plan " + args[0]
+		args = args[1:]
+	}
 
-	if *createPlan {
-		cmds.Create()
-	} else if *planName != "" {
-		plan, err := core.GetBackupPlan(*planName)
+	fs := flag.NewFlagSet(os.Args[0]+" "+cmd, flag.ContinueOnError)
+	noInput := fs.Bool("no-input", false, "do not ask values interactively, fail if required value is not provided")
+	var planName, identityFile *string
+	switch cmd {
+	case "plan create", "plan edit":
+		planName = fs.String("name", "", "plan name")
+		addPlanFlags(fs)
+	case "plan show":
+		planName = fs.String("name", "", "plan name")
+	case "plan delete":
+		planName = fs.String("name", "", "plan name")
+		fs.Bool("yes", false, "delete plan without confirmation")
+	case "restore":
+		fs.Var(&cmds.ListFlag{}, "path", "path to restore (repeatable)")
+		fs.String("point", "", "restore point: its number, date (YYYY-MM-DD hh:mm:ss) or \"last\"")
+		fs.String("target", "", "absolute path to restore to, or "+core.OriginTargetPath+" to restore to origin pathes")
+		fs.Bool("no-progress", false, "do not show progress bar, print log instead")
+	case "sync":
+		fs.Bool("clean-local", false, "delete local metafiles and get them from storage")
+	case "change-passphrase":
+		fs.String("new-passphrase", "", "new encryption passphrase")
+		fs.String("new-passphrase-file", "", "file with new encryption passphrase")
+	case "backup":
+		fs.Bool("no-progress", false, "do not show progress bar, print log instead")
+	case "status", "verify", "prune", "webui":
+	default:
+		fmt.Printf("Unknown command: %v\n\n", cmd)
+		printUsage()
+		return exitCodeUsage
+	}
+	if planName == nil {
+		planName = fs.String("plan", "", "plan name")
+	}
+	switch cmd {
+	case "restore", "sync", "verify", "prune":
+		identityFile = fs.String("identity-file", "", "file with private key to decrypt data encrypted to public keys")
+	}
+	if cmd != "webui" {
+		fs.String("output", cmds.TextOutput, "output format: "+cmds.TextOutput+" or "+cmds.JsonOutput+" (json implies --no-input)")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitCodeOk
+		}
+		return exitCodeUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Printf("Unexpected arguments: %v\n", strings.Join(fs.Args(), " "))
+		return exitCodeUsage
+	}
+	opts, err := cmds.NewOptions(fs, *noInput)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		return exitCodeUsage
+	}
+	if opts.IsJsonOutput() {
+		// log messages are kept in history log only, stdout holds json result
+		base.SetLogToStdout(false)
+	}
+
+	if cmd == "plan create" {
+		return getExitCode(ctx, cmds.Create(opts), opts)
+	}
+	if *planName == "" {
+		fmt.Print("Plan name must be provided\n\n")
+		fs.Usage()
+		return exitCodeUsage
+	}
+	plan, err := loadPlan(*planName, identityFile)
+	if err != nil {
+		cmds.PrintError(opts, cmd, *planName, err)
+		return exitCodeError
+	}
+
+	switch cmd {
+	case "plan edit":
+		err = cmds.Edit(plan, opts)
+	case "plan show":
+		cmds.View(plan, opts)
+	case "plan delete":
+		err = cmds.Delete(plan, opts)
+	case "backup":
+		err = cmds.Backup(ctx, plan, opts)
+	case "restore":
+		err = cmds.Restore(ctx, plan, opts)
+	case "sync":
+		err = cmds.Sync(ctx, plan, opts)
+	case "status":
+		cmds.Status(plan, opts)
+	case "verify":
+		err = cmds.Verify(ctx, plan, opts)
+	case "prune":
+		err = cmds.Prune(ctx, plan, opts)
+	case "change-passphrase":
+		err = cmds.ChangePassphrase(ctx, plan, opts)
+	case "webui":
+		cmds.WebUI(plan)
+	}
+	return getExitCode(ctx, err, opts)
+}
+
+func addPlanFlags(fs *flag.FlagSet) {
+	fs.String("chunk-size-mb", "", "limit size of one archive (MB)")
+	fs.String("tmp-space-mb", "", "limit size of archives waiting for upload, to create next archive while previous one is uploaded (MB)")
+	fs.String("encrypt", "", "encrypt data (yes/no)")
+	fs.String("passphrase", "", "encryption passphrase")
+	fs.String("passphrase-file", "", "file with encryption passphrase, to keep it out of process list and shell history")
+	fs.Var(&cmds.ListFlag{}, "recipient", "public key (age1...) to encrypt data to (repeatable)")
+	fs.String("obfuscate-names", "", "obfuscate names in storage and in archives (yes/no)")
+	fs.String("dedup", "", "deduplicate file contents (yes/no)")
+	fs.String("compression", "", "compression of files in archives: store, deflate or zstd, incompressible files are stored")
+	fs.String("compression-level", "", "compression level (deflate 1-9, zstd 1-22, 0 - default)")
+	fs.String("archive-format", "", "archive format: zip or tar, tar archive is compressed as a whole (tar.gz by deflate, tar.zst by zstd)")
+	fs.Var(&cmds.ListFlag{}, "path", "absolute path to backup (repeatable)")
+	fs.Var(&cmds.ListFlag{}, "exclude", "exclusion mask to skip and not backup (repeatable)")
+	fs.String("keep-last", "", "keep last revisions of each file")
+	fs.String("keep-daily", "", "keep daily restore points (days)")
+	fs.String("keep-weekly", "", "keep weekly restore points (weeks)")
+	fs.String("keep-monthly", "", "keep monthly restore points (months)")
+	fs.String("deleted-files-days", "", "drop revisions of locally deleted files older than (days)")
+	fs.String("repack-threshold-pct", "", "repack archives holding less than (% of needed data)")
+	fs.String("upload-rate-limit-kb", "", "limit rate of upload to storage (KB/s, 0 - unlimited)")
+	fs.String("download-rate-limit-kb", "", "limit rate of download from storage (KB/s, 0 - unlimited)")
+	fs.Var(&cmds.ListFlag{}, "upload-window", "window of time archives are uploaded within, e.g. \"22:00-06:00 mon-fri\" (repeatable)")
+	fs.String("retry-attempts", "", "attempts of each request to storage failed with transient error (0 - default)")
+	fs.String("retry-initial-delay-sec", "", "pause before the first repeat of failed request, doubled for each next one (seconds, 0 - default)")
+	fs.String("retry-max-delay-sec", "", "limit of pause between repeats of failed request (seconds, 0 - default)")
+	fs.Var(&cmds.ListFlag{}, "storage", "storage config value as key=value, e.g. type=localfs, path=/backup, 1.type=s3 for mirror (repeatable)")
+	fs.Var(&cmds.ListFlag{}, "storage-file", "storage config value read from file as key=path, e.g. password=/run/secrets/sftp (repeatable)")
+}
+
+func loadPlan(planName string, identityFile *string) (core.BackupPlan, error) {
+	plan, err := core.GetBackupPlan(planName)
+	if err != nil {
+		return plan, err
+	}
+	if identityFile != nil && *identityFile != "" {
+		identity, err := ioutil.ReadFile(*identityFile)
 		if err != nil {
-			fmt.Println(err)
-			return
-		} else {
-			cmd_selected := ""
-			for cmd, sel := range cmd_flags {
-				if *sel {
-					if cmd_selected == "" {
-						cmd_selected = cmd
-					} else {
-						fmt.Println("Only one command must be selected to run for plan\n")
-						flag.Usage()
-						return
-					}
-				}
-			}
-			switch cmd_selected {
-			case "edit":
-				cmds.Edit(plan)
-			case "view":
-				cmds.View(plan)
-			case "status":
-				cmds.Status(plan)
-			case "backup":
-				cmds.Backup(plan)
-			case "restore":
-				cmds.Restore(plan)
-			case "sync":
-				cmds.Sync(plan)
-			case "web-ui":
-				cmds.WebUI(plan)
-			case "":
-				fmt.Println("One command must be selected to run for plan\n")
-				flag.Usage()
-				return
-			}
+			return plan, err
+		}
+		plan.Decrypt_identity = string(identity)
+	}
+	return plan, nil
+}
 
+// in json output mode errors are printed in result of command
+// errors of storages interrupted by signal do not always wrap context error, so the context itself is checked
+func getExitCode(ctx context.Context, err error, opts cmds.Options) int {
+	if err != nil && ctx.Err() != nil {
+		if !opts.IsJsonOutput() {
+			fmt.Println("[ERROR] Interrupted, the command could be run again: backup continues with archives left in tmp dir, " +
+				"restore of the same files skips ones restored already, sync downloads metafiles again")
+		}
+		return exitCodeInterrupted
+	} else if err != nil {
+		if err != cmds.ErrVerifyProblems && !opts.IsJsonOutput() {
+			fmt.Printf("[ERROR] %v\n", err)
 		}
-	} else {
-		flag.Usage()
-		return
+		return exitCodeError
 	}
+	return exitCodeOk
+}
 
+func printUsage() {
+	fmt.Printf("usage: %s plan <%v> --name my_plan_name [options]\n", os.Args[0], strings.Join(planCmdList, "|"))
+	fmt.Printf("       %s <command> --plan my_plan_name [options]\n", os.Args[0])
+	fmt.Println("possible commands:")
+	for _, cmd := range cmdList {
+		fmt.Printf("    %v\n", cmd)
+	}
+	fmt.Printf("options of command are listed by: %s <command> --help\n", os.Args[0])
+	fmt.Println("values not provided by options are asked interactively, unless --no-input is set")
+	fmt.Println("")
+	fmt.Printf("legacy usage: %s --create-plan\n", os.Args[0])
+	fmt.Printf("              %s --plan my_plan_name --<command> [--identity-file path_to_private_key]\n", os.Args[0])
+}
+
+// interactive commands of previous versions
+func parseLegacyCmd(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	var planName = fs.String("plan", "", "")
+	var createPlan = fs.Bool("create-plan", false, "")
+	var identityFile = fs.String("identity-file", "", "")
+	cmd_flags := make(map[string]*bool)
+	cmd_list := []string{"edit", "view", "status", "backup", "restore", "sync", "verify", "prune", "change-passphrase", "web-ui"}
+	for _, cmd := range cmd_list {
+		cmd_flags[cmd] = fs.Bool(cmd, false, "")
+	}
+	fs.Usage = printUsage
+
+	if err := fs.Parse(args); err != nil {
+		return exitCodeUsage
+	}
+
+	opts := cmds.InteractiveOptions()
+	if *createPlan {
+		return getExitCode(ctx, cmds.Create(opts), opts)
+	} else if *planName == "" {
+		printUsage()
+		return exitCodeUsage
+	}
+
+	plan, err := loadPlan(*planName, identityFile)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		return exitCodeError
+	}
+	cmd_selected := ""
+	for cmd, sel := range cmd_flags {
+		if *sel {
+			if cmd_selected == "" {
+				cmd_selected = cmd
+			} else {
+				fmt.Print("Only one command must be selected to run for plan\n\n")
+				printUsage()
+				return exitCodeUsage
+			}
+		}
+	}
+	switch cmd_selected {
+	case "edit":
+		err = cmds.Edit(plan, opts)
+	case "view":
+		cmds.View(plan, opts)
+	case "status":
+		cmds.Status(plan, opts)
+	case "backup":
+		err = cmds.Backup(ctx, plan, opts)
+	case "restore":
+		err = cmds.Restore(ctx, plan, opts)
+	case "sync":
+		err = cmds.Sync(ctx, plan, opts)
+	case "verify":
+		err = cmds.Verify(ctx, plan, opts)
+	case "prune":
+		err = cmds.Prune(ctx, plan, opts)
+	case "change-passphrase":
+		err = cmds.ChangePassphrase(ctx, plan, opts)
+	case "web-ui":
+		cmds.WebUI(plan)
+	case "":
+		fmt.Print("One command must be selected to run for plan\n\n")
+		printUsage()
+		return exitCodeUsage
+	}
+	return getExitCode(ctx, err, opts)
 }
 
 // command-line interface
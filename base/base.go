@@ -30,6 +30,7 @@ var (
 	appLock lockfile.Lockfile
 
 	appConfig AppConfig
+	logDest   io.Writer
 )
 var ErrStorageRequestInProgress = errors.New("Request to storage is in progress")
 var ErrLocalMetaExists = errors.New("Can't start synchronizing metadata. Local metafiles exists in plan directory")
@@ -90,7 +91,19 @@ func InitLogToDestination(dwref *io.Writer) {
 	} else {
 		dw = *dwref
 	}
+	logDest = dw
+	initLoggers()
+}
+
+// with output to stdout disabled, messages are written to log file only
+// (e.g. when stdout is used for machine-readable output)
+func SetLogToStdout(enabled bool) {
+	appConfig.LogToStdout = enabled
+	initLoggers()
+}
 
+func initLoggers() {
+	dw := logDest
 	w := io.MultiWriter(dw)
 
 	if appConfig.LogToStdout {
@@ -99,7 +112,7 @@ func InitLogToDestination(dwref *io.Writer) {
 	Log = log.New(w, "[INFO] ", log.LstdFlags)
 
 	w = io.MultiWriter(dw)
-	if appConfig.LogToStdout {
+	if appConfig.LogErrToStderr {
 		w = io.MultiWriter(dw, os.Stderr)
 	}
 	LogErr = log.New(w, "[ERROR] ", log.LstdFlags)
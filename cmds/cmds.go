@@ -1,8 +1,9 @@
 package cmds
 
 import (
-	"bufio"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -12,22 +13,33 @@ import (
 
 	"github.com/n-boy/backuper/base"
 	"github.com/n-boy/backuper/core"
+	"github.com/n-boy/backuper/crypter"
 	"github.com/n-boy/backuper/storage"
+	"github.com/n-boy/backuper/storage/tomirror"
 	"github.com/n-boy/backuper/webui"
 )
 
-func Create() {
-	plan := core.BackupPlan{}
-	createOrEdit(plan, true)
+func Create(opts Options) error {
+	plan, err := createOrEdit(core.BackupPlan{}, true, opts)
+	return opts.printJson("plan create", plan.Name, getPlanResult(plan, err), err)
 }
 
-func Edit(plan core.BackupPlan) {
-	createOrEdit(plan, false)
+func Edit(plan core.BackupPlan, opts Options) error {
+	plan, err := createOrEdit(plan, false, opts)
+	return opts.printJson("plan edit", plan.Name, getPlanResult(plan, err), err)
 }
 
-func createOrEdit(plan core.BackupPlan, is_new bool) {
+func getPlanResult(plan core.BackupPlan, err error) interface{} {
+	if err != nil {
+		return nil
+	}
+	return getPlanOutput(plan)
+}
+
+func createOrEdit(plan core.BackupPlan, is_new bool, opts Options) (core.BackupPlan, error) {
+	var err error
 	if is_new {
-		plan.Name = getInput("Plan name", "",
+		plan.Name, err = opts.getInput("name", "Plan name", "",
 			func(planName string) (err error) {
 				if planName == "" {
 					err = fmt.Errorf("Plan name can not be empty")
@@ -36,52 +48,188 @@ func createOrEdit(plan core.BackupPlan, is_new bool) {
 				}
 				return
 			})
+		if err != nil {
+			return plan, err
+		}
 	}
 
 	defaultChunkSizeMB := core.DefaultChunkSizeMB
 	if !is_new {
 		defaultChunkSizeMB = plan.ChunkSize / 1024 / 1024
 	}
-	chunkSizeMB, _ := strconv.ParseInt(getInput("Limit size of one archive (MB)", strconv.FormatInt(defaultChunkSizeMB, 10),
+	chunkSizeMBText, err := opts.getInput("chunk-size-mb", "Limit size of one archive (MB)", strconv.FormatInt(defaultChunkSizeMB, 10),
 		func(text string) error {
 			return checkInt(text, 0, 100*1024)
-		}), 10, 64)
+		})
+	if err != nil {
+		return plan, err
+	}
+	chunkSizeMB, _ := strconv.ParseInt(chunkSizeMBText, 10, 64)
 	plan.ChunkSize = chunkSizeMB * 1024 * 1024
 
-	defaultEncrypt := ""
+	tmpSpaceMBText, err := opts.getInput("tmp-space-mb",
+		"Limit size of archives waiting for upload in tmp dir, next archive is created while previous one is uploaded, if it fits (MB)",
+		strconv.FormatInt(plan.TmpSpaceLimit/1024/1024, 10),
+		func(text string) error {
+			return checkInt(text, 0, 10*1024*1024)
+		})
+	if err != nil {
+		return plan, err
+	}
+	tmpSpaceMB, _ := strconv.ParseInt(tmpSpaceMBText, 10, 64)
+	plan.TmpSpaceLimit = tmpSpaceMB * 1024 * 1024
+
+	rateInputs := []struct {
+		name  string
+		title string
+		value *int64
+	}{
+		{"upload-rate-limit-kb", "Limit rate of upload to storage (KB/s, 0 - unlimited)", &plan.UploadRateLimit},
+		{"download-rate-limit-kb", "Limit rate of download from storage (KB/s, 0 - unlimited)", &plan.DownloadRateLimit},
+	}
+	for _, ri := range rateInputs {
+		rateKBText, err := opts.getInput(ri.name, ri.title, strconv.FormatInt(*ri.value/1024, 10),
+			func(text string) error {
+				return checkInt(text, 0, 10*1024*1024)
+			})
+		if err != nil {
+			return plan, err
+		}
+		rateKB, _ := strconv.ParseInt(rateKBText, 10, 64)
+		*ri.value = rateKB * 1024
+	}
+
+	editWindows := is_new
 	if !is_new {
-		if plan.Encrypt {
-			defaultEncrypt = "Yes"
-		} else {
-			defaultEncrypt = "No"
+		windows := make([]string, 0, len(plan.UploadWindows))
+		for _, w := range plan.UploadWindows {
+			windows = append(windows, w.String())
+		}
+		editWindows, err = opts.isListToEdit("upload-window", "Current list of upload windows", windows,
+			"Do you want set up new list of upload windows?")
+		if err != nil {
+			return plan, err
 		}
 	}
-	plan.Encrypt, _ = parseCmdsBool(getInput("Encrypt data [Y/N]", defaultEncrypt,
-		func(text string) error {
-			return checkCmdsBool(text)
-		}))
-	plan.Encrypt_passphrase = getInput("Encryption/Decryption passphrase (24-32 symbols)", plan.Encrypt_passphrase,
-		func(passphrase string) error {
-			if plan.Encrypt && !(len(passphrase) >= 24 && len(passphrase) <= 40) {
-				return fmt.Errorf("Passphrase length should be between 24 and 32 symbols")
+	if editWindows {
+		windows, err := opts.getInputList("upload-window", "Provide windows of time archives are uploaded within, "+
+			"e.g. 22:00-06:00 mon-fri (empty list to upload any time)", "one more window", false,
+			func(text string) error {
+				if text != "" {
+					_, err := core.ParseUploadWindow(text)
+					return err
+				}
+				return nil
+			})
+		if err != nil {
+			return plan, err
+		}
+		plan.UploadWindows = nil
+		for _, text := range windows {
+			if w, err := core.ParseUploadWindow(text); err == nil {
+				plan.UploadWindows = append(plan.UploadWindows, w)
 			}
-			return nil
-		})
+		}
+	}
 
-	editPathes := false
-	if !is_new {
-		fmt.Println("Currenct list of pathes to backup:")
-		for _, path := range plan.NodesToArchive {
-			fmt.Printf("    %v\n", path)
+	if plan.Encrypt, err = opts.getInputBool("encrypt", "Encrypt data [Y/N]", formatCmdsBool(plan.Encrypt)); err != nil {
+		return plan, err
+	}
+	editRecipients := is_new
+	if plan.Encrypt && !is_new {
+		editRecipients, err = opts.isListToEdit("recipient", "Currenct list of recipient public keys", plan.Encrypt_recipients,
+			"Do you want set up new list of recipient public keys?")
+		if err != nil {
+			return plan, err
 		}
-		editPathes, _ = parseCmdsBool(getInput("Do you want set up new list of pathes to backup? [Y/N]", "",
+	}
+	if plan.Encrypt && editRecipients {
+		plan.Encrypt_recipients, err = opts.getInputList("recipient", "Provide recipient public keys (age1...) to encrypt data to, "+
+			"private key is required to restore data then (empty list for passphrase encryption)", "one more public key", false,
+			func(recipient string) error {
+				if recipient != "" {
+					return crypter.CheckRecipient(recipient)
+				}
+				return nil
+			})
+		if err != nil {
+			return plan, err
+		}
+	}
+
+	// passphrase is not asked with public key encryption, previous one is kept to decrypt old data
+	if plan.IsPublicKeyEncryption() {
+		opts.printText("Private key of one of recipients will be required to restore data\n")
+	} else if !is_new && plan.IsMasterKeyExists() {
+		// master key is wrapped with current passphrase, so it is changed by separate command only
+		opts.printText("Use change-passphrase command to change encryption passphrase\n")
+	} else {
+		plan.Encrypt_passphrase, err = opts.getInput("passphrase", "Encryption/Decryption passphrase (24-32 symbols)", plan.Encrypt_passphrase,
+			checkPassphrase(plan.Encrypt))
+		if err != nil {
+			return plan, err
+		}
+	}
+
+	if plan.Encrypt {
+		plan.Obfuscate_names, err = opts.getInputBool("obfuscate-names", "Obfuscate names of archives in storage and file paths in archives [Y/N]",
+			formatCmdsBool(plan.Obfuscate_names))
+		if err != nil {
+			return plan, err
+		}
+	}
+
+	plan.Dedup, err = opts.getInputBool("dedup", "Deduplicate file contents (store identical data only once) [Y/N]", formatCmdsBool(plan.Dedup))
+	if err != nil {
+		return plan, err
+	}
+
+	// content of deduplicated files is stored in packs without compression
+	if !plan.Dedup {
+		plan.ArchiveFormat, err = opts.getInput("archive-format", fmt.Sprintf("Archive format (%v), tar keeps ownership, "+
+			"permissions and links of files", strings.Join(core.GetArchiveFormats(), ", ")), getArchiveFormat(plan),
+			core.CheckArchiveFormat)
+		if err != nil {
+			return plan, err
+		}
+		compressionPrompt := "Compression of files in archives (%v), incompressible files are stored"
+		if plan.ArchiveFormat == core.TarArchiveFormat {
+			compressionPrompt = "Compression of tar archive as a whole (%v)"
+		}
+		plan.Compression.Method, err = opts.getInput("compression", fmt.Sprintf(compressionPrompt,
+			strings.Join(core.GetCompressionMethods(), ", ")), plan.Compression.GetMethod(),
+			func(method string) error {
+				return core.Compression{Method: method}.Check()
+			})
+		if err != nil {
+			return plan, err
+		}
+		levelText, err := opts.getInput("compression-level", "Compression level (deflate 1-9, zstd 1-22, 0 - default)",
+			strconv.Itoa(plan.Compression.Level),
 			func(text string) error {
-				return checkCmdsBool(text)
-			}))
+				level, err := strconv.Atoi(text)
+				if err != nil {
+					return fmt.Errorf("The value should be integer number")
+				}
+				return core.Compression{Method: plan.Compression.Method, Level: level}.Check()
+			})
+		if err != nil {
+			return plan, err
+		}
+		plan.Compression.Level, _ = strconv.Atoi(levelText)
+	}
+
+	editPathes := is_new
+	if !is_new {
+		editPathes, err = opts.isListToEdit("path", "Currenct list of pathes to backup", plan.NodesToArchive,
+			"Do you want set up new list of pathes to backup?")
+		if err != nil {
+			return plan, err
+		}
 	}
 
-	if is_new || editPathes {
-		plan.NodesToArchive = getInputList("Provide pathes you want to backup", "one more path", false,
+	if editPathes {
+		plan.NodesToArchive, err = opts.getInputList("path", "Provide pathes you want to backup", "one more path", false,
 			func(path string) error {
 				if path != "" {
 					_, err := os.Stat(path)
@@ -91,100 +239,190 @@ func createOrEdit(plan core.BackupPlan, is_new bool) {
 				}
 				return nil
 			})
+		if err != nil {
+			return plan, err
+		}
 	}
 
-	editExclusions := false
+	editExclusions := is_new
 	if !is_new {
-		fmt.Println("Currenct list of exclusion masks to skip and not backup:")
-		for _, path := range plan.ExcludeMasks {
-			fmt.Printf("    %v\n", path)
+		editExclusions, err = opts.isListToEdit("exclude", "Currenct list of exclusion masks to skip and not backup", plan.ExcludeMasks,
+			"Do you want set up new list of exclusion masks to skip and not backup?")
+		if err != nil {
+			return plan, err
 		}
-		editExclusions, _ = parseCmdsBool(getInput("Do you want set up new list of exclusion masks to skip and not backup? [Y/N]", "",
-			func(text string) error {
-				return checkCmdsBool(text)
-			}))
 	}
 
-	if is_new || editExclusions {
-		plan.ExcludeMasks = getInputList("Provide exclusion masks you want to skip and not backup", "one more mask", false,
+	if editExclusions {
+		plan.ExcludeMasks, err = opts.getInputList("exclude", "Provide exclusion masks you want to skip and not backup", "one more mask", false,
 			func(mask string) error {
 				if mask != "" {
 					// additional validations for mask can be added
 				}
 				return nil
 			})
+		if err != nil {
+			return plan, err
+		}
 	}
 
-	defaultStorageType := ""
-	if !is_new && plan.Storage != nil {
-		defaultStorageType = plan.Storage.GetType()
+	if !opts.noInput {
+		fmt.Println("Retention policy of old archives (0 - keep all)")
 	}
-	storageType := getInput("Storage type ["+strings.Join(storage.GetStorageTypes(), "/")+"]", defaultStorageType,
-		func(stype string) error {
-			if !storage.GetStorageTypesMap()[stype] {
-				return fmt.Errorf("Storage type is not supported")
-			}
-			return nil
-		})
+	retentionInputs := []struct {
+		name  string
+		title string
+		value *int
+	}{
+		{"keep-last", "    Keep last revisions of each file", &plan.Retention.KeepLast},
+		{"keep-daily", "    Keep daily restore points (days)", &plan.Retention.KeepDaily},
+		{"keep-weekly", "    Keep weekly restore points (weeks)", &plan.Retention.KeepWeekly},
+		{"keep-monthly", "    Keep monthly restore points (months)", &plan.Retention.KeepMonthly},
+		{"deleted-files-days", "    Drop revisions of locally deleted files older than (days)", &plan.Retention.DeletedFilesDays},
+		{"repack-threshold-pct", "    Repack archives holding less than (% of needed data)", &plan.Retention.RepackThresholdPct},
+	}
+	for _, ri := range retentionInputs {
+		if *ri.value, err = opts.getInputInt(ri.name, ri.title, *ri.value); err != nil {
+			return plan, err
+		}
+	}
+
+	if !opts.noInput {
+		fmt.Println("Retry policy of requests to storage failed with transient errors (0 - default)")
+	}
+	if plan.Retry.Attempts, err = opts.getInputInt("retry-attempts",
+		fmt.Sprintf("    Attempts of each request (default %v)", core.DefaultRetryPolicy.Attempts), plan.Retry.Attempts); err != nil {
+		return plan, err
+	}
+	retryDelayInputs := []struct {
+		name  string
+		title string
+		value *time.Duration
+	}{
+		{"retry-initial-delay-sec", fmt.Sprintf("    Pause before the first repeat, doubled for each next one (seconds, default %v)",
+			core.DefaultRetryPolicy.InitialDelay.Seconds()), &plan.Retry.InitialDelay},
+		{"retry-max-delay-sec", fmt.Sprintf("    Limit of pause between repeats (seconds, default %v)",
+			core.DefaultRetryPolicy.MaxDelay.Seconds()), &plan.Retry.MaxDelay},
+	}
+	for _, ri := range retryDelayInputs {
+		seconds, err := opts.getInputInt(ri.name, ri.title, int(*ri.value/time.Second))
+		if err != nil {
+			return plan, err
+		}
+		*ri.value = time.Duration(seconds) * time.Second
+	}
+
 	storageOldConfig := make(map[string]string)
-	if !is_new && plan.Storage != nil && storageType == plan.Storage.GetType() {
+	if !is_new && plan.Storage != nil {
 		storageOldConfig = plan.Storage.GetStorageConfig()
+		storageOldConfig["type"] = plan.Storage.GetType()
 	}
-	storageFields, err := storage.GetStorageConfigFields(storageType)
+	storageConfig, err := opts.getStorageConfigInput("", "", storageOldConfig, storage.GetStorageTypes())
 	if err != nil {
-		base.LogErr.Fatalln(err)
-	}
-	storageConfig := make(map[string]string)
-	storageConfig["type"] = storageType
-	for _, cf := range storageFields {
-		storageConfig[cf.Name] = getInput(cf.Title, storageOldConfig[cf.Name],
-			func(value string) error {
-				return nil
-			})
+		return plan, err
 	}
 	if plan.Storage, err = storage.NewStorage(storageConfig); err != nil {
-		base.LogErr.Fatalln(err)
+		return plan, err
 	}
 
 	if err = plan.SavePlan(!is_new); err != nil {
-		base.LogErr.Fatalln(err)
+		return plan, err
 	}
 
 	if is_new {
-		fmt.Println("\nPlan successfully created\n")
+		opts.printText("\nPlan successfully created\n\n")
 	} else {
-		fmt.Println("\nPlan successfully edited\n")
+		opts.printText("\nPlan successfully edited\n\n")
 	}
-
-	// name               string
-	// baseDir            string
-	// tmpDir             string
-	// chunkSize          int64
-	// encrypt            bool
-	// encrypt_passphrase string
-	// nodesToArchive     []string
-	// excludeMasks     []string
-	// storage            storage.GenericStorage
-
+	return plan, nil
 }
 
-// func delete(plan core.BackupPlan) {
-
-// }
+// 	удаляем план локально, данные в хранилище не удаляются
+func Delete(plan core.BackupPlan, opts Options) error {
+	confirmed, err := opts.getInputBool("yes", fmt.Sprintf("Delete plan %v (data in storage is kept) [Y/N]", plan.Name), "")
+	if err == nil && !confirmed {
+		err = fmt.Errorf("Deletion of plan is not confirmed")
+	}
+	if err == nil {
+		err = plan.DeletePlan()
+	}
+	if err == nil {
+		opts.printText("Plan successfully deleted\n")
+	}
+	return opts.printJson("plan delete", plan.Name, nil, err)
+}
 
 // 	выводим все поля плана
-func View(plan core.BackupPlan) {
+func View(plan core.BackupPlan, opts Options) {
+	if opts.IsJsonOutput() {
+		opts.printJson("plan show", plan.Name, getPlanOutput(plan), nil)
+		return
+	}
+
 	fmt.Printf("Plan name: %v\n", plan.Name)
 	fmt.Printf("Limit size of one archive (MB): %v\n", plan.ChunkSize/1024/1024)
+	fmt.Printf("Limit size of archives waiting for upload (MB): %v\n", plan.TmpSpaceLimit/1024/1024)
+	fmt.Printf("Limit rate of upload to storage (KB/s): %v\n", formatRateLimit(plan.UploadRateLimit))
+	fmt.Printf("Limit rate of download from storage (KB/s): %v\n", formatRateLimit(plan.DownloadRateLimit))
+	fmt.Print("Upload windows: ")
+	if len(plan.UploadWindows) > 0 {
+		fmt.Println("")
+		for _, w := range plan.UploadWindows {
+			fmt.Printf("    %v\n", w)
+		}
+	} else {
+		fmt.Println("any time")
+	}
 
 	fmt.Print("Encrypt data: ")
 	if plan.Encrypt {
 		fmt.Println("Yes")
-		fmt.Printf("Encryption/Decryption passphrase: %v\n", plan.Encrypt_passphrase)
+		if plan.IsPublicKeyEncryption() {
+			fmt.Println("Recipient public keys:")
+			for _, recipient := range plan.Encrypt_recipients {
+				fmt.Printf("    %v\n", recipient)
+			}
+		} else {
+			fmt.Printf("Encryption/Decryption passphrase: %v\n", plan.Encrypt_passphrase)
+		}
+		fmt.Print("Obfuscate names: ")
+		if plan.Obfuscate_names {
+			fmt.Println("Yes")
+		} else {
+			fmt.Println("No")
+		}
+	} else {
+		fmt.Println("No")
+	}
+
+	fmt.Print("Deduplicate file contents: ")
+	if plan.Dedup {
+		fmt.Println("Yes")
 	} else {
 		fmt.Println("No")
+		fmt.Printf("Archive format: %v\n", getArchiveFormat(plan))
+		fmt.Printf("Compression of files in archives: %v\n", plan.Compression)
+	}
+
+	fmt.Print("Retention policy: ")
+	if plan.Retention.IsEnabled() {
+		fmt.Println("")
+		fmt.Printf("    Keep last revisions of each file: %v\n", plan.Retention.KeepLast)
+		fmt.Printf("    Keep daily restore points (days): %v\n", plan.Retention.KeepDaily)
+		fmt.Printf("    Keep weekly restore points (weeks): %v\n", plan.Retention.KeepWeekly)
+		fmt.Printf("    Keep monthly restore points (months): %v\n", plan.Retention.KeepMonthly)
+		fmt.Printf("    Drop revisions of locally deleted files older than (days): %v\n", plan.Retention.DeletedFilesDays)
+		fmt.Printf("    Repack archives holding less than (%% of needed data): %v\n", plan.Retention.RepackThresholdPct)
+	} else {
+		fmt.Println("keep all")
 	}
 
+	retry := plan.Retry.WithDefaults()
+	fmt.Println("Retry policy of failed requests to storage:")
+	fmt.Printf("    Attempts of each request: %v\n", retry.Attempts)
+	fmt.Printf("    Pause before the first repeat (seconds): %v\n", retry.InitialDelay.Seconds())
+	fmt.Printf("    Limit of pause between repeats (seconds): %v\n", retry.MaxDelay.Seconds())
+
 	fmt.Println("Pathes to backup:")
 	for _, path := range plan.NodesToArchive {
 		fmt.Printf("    %v\n", path)
@@ -195,65 +433,109 @@ func View(plan core.BackupPlan) {
 		fmt.Printf("    %v\n", mask)
 	}
 
-	fmt.Printf("\nStorage type: %v\n", plan.Storage.GetType())
-
-	storageFields, err := storage.GetStorageConfigFields(plan.Storage.GetType())
-	if err != nil {
-		base.LogErr.Fatalln(err)
-	}
 	storageConfig := plan.Storage.GetStorageConfig()
-	for _, cf := range storageFields {
-		fmt.Printf("%v: %v\n", cf.Title, storageConfig[cf.Name])
-	}
+	storageConfig["type"] = plan.Storage.GetType()
+	fmt.Println("")
+	printStorageConfig("", storageConfig)
 
 	fmt.Println("")
 }
 
 // 	выводим текущую выполняемую планом команду
-func Status(plan core.BackupPlan) {
+func Status(plan core.BackupPlan, opts Options) {
+	locks := plan.GetOpLocks()
+	if opts.IsJsonOutput() {
+		opts.printJson("status", plan.Name, statusOutput{Locks: locks}, nil)
+		return
+	}
+
 	if plan.CheckOpLocked("restore") {
 		fmt.Println("Data restoring is in progress")
 	} else if plan.CheckOpLocked("sync") {
 		fmt.Println("Synchronizing of metadata with storage is in progress")
+	} else if plan.CheckOpLocked("prune") {
+		fmt.Println("Pruning of archives in storage is in progress")
 	} else {
 		fmt.Println("No operations in progress")
 	}
 }
 
 // 	запускаем процесс бекапа согласно настроек плана
-func Backup(plan core.BackupPlan) {
-	err := plan.DoBackup()
-	if err != nil {
-		fmt.Printf("[ERROR] %v\n", err)
+func Backup(ctx context.Context, plan core.BackupPlan, opts Options) error {
+	bar := opts.newProgressBar()
+	if bar != nil {
+		plan.Observer = bar
+	}
+	result, err := plan.DoBackup(ctx)
+	if bar != nil {
+		bar.Finish()
+	}
+	output := backupOutput{
+		Archives:      emptyIfNil(result.Archives),
+		FilesArchived: result.FilesArchived,
+		BytesUploaded: result.BytesUploaded,
+		Skipped:       []nodeErrorOutput{},
 	}
+	for _, nodeErr := range result.Skipped {
+		output.Skipped = append(output.Skipped, nodeErrorOutput{Path: nodeErr.Path, Error: nodeErr.Err.Error()})
+	}
+	if len(result.Skipped) > 0 {
+		opts.printText("Files skipped, they will be retried by the next backup: %v\n", len(result.Skipped))
+		for _, nodeErr := range result.Skipped {
+			opts.printText("    %v\n", nodeErr)
+		}
+	}
+	return opts.printJson("backup", plan.Name, output, err)
+}
+
+func Restore(ctx context.Context, plan core.BackupPlan, opts Options) error {
+	var output restoreOutput
+	err := doRestore(ctx, plan, opts, &output)
+	return opts.printJson("restore", plan.Name, output, err)
 }
 
-func Restore(plan core.BackupPlan) {
+func doRestore(ctx context.Context, plan core.BackupPlan, opts Options, output *restoreOutput) error {
+	plan, err := getIdentityInput(plan, opts)
+	if err != nil {
+		return err
+	}
 	if !plan.CheckOpLocked("restore") {
-		pathList := getInputList("Provide pathes you want to restore", "one more path", true,
+		pathList, err := opts.getInputList("path", "Provide pathes you want to restore", "one more path", true,
 			func(path string) error {
 				// if path != "" && !filepath.IsAbs(path) {
 				// 	return fmt.Errorf("Path should be absolute path to directory or file")
 				// }
 				return nil
 			})
-		restorePoints := plan.GetRestorePoints(pathList)
+		if err != nil {
+			return err
+		}
+		restorePoints, err := plan.GetRestorePoints(pathList)
+		if err != nil {
+			return err
+		}
 		if len(restorePoints) == 0 {
-			fmt.Printf("[ERROR] There are no restore points available for selected pathes\n")
-			return
+			return fmt.Errorf("There are no restore points available for selected pathes")
 		}
 
-		fmt.Println("Restore points available for selected pathes:")
-		for i, rp := range restorePoints {
-			fmt.Printf("%v) %v\n", i+1, rp.GetMetaFileCreateDate().Format("2006-01-02 15:04:05"))
+		if _, provided := opts.values["point"]; !provided && !opts.noInput {
+			fmt.Println("Restore points available for selected pathes:")
+			for i, rp := range restorePoints {
+				fmt.Printf("%v) %v\n", i+1, rp.GetMetaFileCreateDate().Format("2006-01-02 15:04:05"))
+			}
 		}
 
-		restorePointInd, _ := strconv.ParseInt(getInput("Select one of restore point", "",
-			func(text string) error {
-				return checkInt(text, 1, int64(len(restorePoints)))
-			}), 10, 64)
+		restorePointInd := 0
+		_, err = opts.getInput("point", "Select one of restore point", "",
+			func(text string) (err error) {
+				restorePointInd, err = getRestorePointIndex(text, restorePoints)
+				return
+			})
+		if err != nil {
+			return err
+		}
 
-		targetPath := getInput("Provide target path to restore ("+core.OriginTargetPath+" for restore to each file/directory origin path)", "",
+		targetPath, err := opts.getInput("target", "Provide target path to restore ("+core.OriginTargetPath+" for restore to each file/directory origin path)", "",
 			func(path string) error {
 				if path != core.OriginTargetPath {
 					fi, err := os.Stat(path)
@@ -263,103 +545,316 @@ func Restore(plan core.BackupPlan) {
 				}
 				return nil
 			})
+		if err != nil {
+			return err
+		}
 
-		if err := plan.InitRestore(pathList, &restorePoints[restorePointInd-1], targetPath); err != nil {
-			fmt.Printf("[ERROR] %v\n", err)
-			return
+		if err := plan.InitRestore(pathList, &restorePoints[restorePointInd], targetPath); err != nil {
+			return err
 		}
 	}
 
+	bar := opts.newProgressBar()
+	if bar != nil {
+		plan.Observer = bar
+		defer bar.Finish()
+	}
 	for {
-		err := plan.DoRestore()
-		if err != nil {
-			if err == base.ErrStorageRequestInProgress {
-				fmt.Printf("Request to storage is in progress. Waiting for %v seconds...\n", base.StorageRequestInProgressRetrySeconds)
-				time.Sleep(time.Duration(base.StorageRequestInProgressRetrySeconds) * time.Second)
-			} else {
-				fmt.Printf("[ERROR] %v\n", err)
-				return
+		result, err := plan.DoRestore(ctx)
+		output.FilesRestored += result.FilesRestored
+		if err != base.ErrStorageRequestInProgress {
+			return err
+		} else if err = waitForStorageRequest(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// restore point is selected by number in list, by creation date or as the last one
+func getRestorePointIndex(text string, restorePoints []core.ArchiveMetafile) (int, error) {
+	if text == "last" {
+		return len(restorePoints) - 1, nil
+	}
+	if err := checkInt(text, 1, int64(len(restorePoints))); err == nil {
+		ind, _ := strconv.Atoi(text)
+		return ind - 1, nil
+	}
+	for i, rp := range restorePoints {
+		if rp.GetMetaFileCreateDate().Format("2006-01-02 15:04:05") == text {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("The value should be number of restore point between 1 and %v, its date or \"last\"", len(restorePoints))
+}
+
+func Sync(ctx context.Context, plan core.BackupPlan, opts Options) error {
+	output := syncOutput{MetaFiles: []string{}}
+	err := doSync(ctx, plan, opts, &output)
+	return opts.printJson("sync", plan.Name, output, err)
+}
+
+func doSync(ctx context.Context, plan core.BackupPlan, opts Options, output *syncOutput) error {
+	plan, err := getIdentityInput(plan, opts)
+	if err != nil {
+		return err
+	}
+	deleteLocalMetafiles := false
+	if _, provided := opts.values["clean-local"]; provided {
+		if deleteLocalMetafiles, err = opts.getInputBool("clean-local", "", ""); err != nil {
+			return err
+		}
+	}
+	for {
+		result, err := plan.SyncMeta(ctx, deleteLocalMetafiles)
+		output.MetaFiles = append(output.MetaFiles, result.MetaFiles...)
+		if err == base.ErrStorageRequestInProgress {
+			if err = waitForStorageRequest(ctx); err != nil {
+				return err
+			}
+		} else if err == base.ErrLocalMetaExists && !deleteLocalMetafiles && !opts.noInput {
+			fmt.Printf("[ERROR] %v\n", err)
+			deleteLocalMetafiles, err = opts.getInputBool("clean-local", "Do you want to delete local metafiles and completely get them from storage [Y/N]", "")
+			if err != nil {
+				return err
+			} else if !deleteLocalMetafiles {
+				return base.ErrLocalMetaExists
 			}
 		} else {
+			return err
+		}
+	}
+}
+
+var ErrVerifyProblems = fmt.Errorf("Problems are found in storage")
+
+// 	проверяем архивы в хранилище на соответствие метафайлам, возвращаем ошибку при найденных проблемах
+func Verify(ctx context.Context, plan core.BackupPlan, opts Options) error {
+	plan, err := getIdentityInput(plan, opts)
+	if err != nil {
+		return opts.printJson("verify", plan.Name, nil, err)
+	}
+	report, err := plan.Verify(ctx, nil)
+	for err == nil && len(report.InProgress) > 0 {
+		if err = waitForStorageRequest(ctx); err != nil {
 			break
 		}
+		var nextReport core.VerifyReport
+		nextReport, err = plan.Verify(ctx, report.InProgress)
+		report.Merge(nextReport)
+	}
+	if err != nil {
+		return opts.printJson("verify", plan.Name, nil, err)
+	}
+
+	if opts.IsJsonOutput() {
+		output := verifyOutput{ArchivesChecked: report.ArchivesChecked, FilesChecked: report.FilesChecked, Problems: []string{}}
+		for _, problem := range report.Problems {
+			output.Problems = append(output.Problems, problem.String())
+		}
+		if !report.IsOk() {
+			err = ErrVerifyProblems
+		}
+		return opts.printJson("verify", plan.Name, output, err)
 	}
 
+	fmt.Printf("Archives checked: %v, files checked: %v\n", report.ArchivesChecked, report.FilesChecked)
+	if report.IsOk() {
+		fmt.Println("No problems found")
+		return nil
+	}
+	fmt.Printf("Problems found: %v\n", len(report.Problems))
+	for _, problem := range report.Problems {
+		fmt.Printf("    %v\n", problem)
+	}
+	return ErrVerifyProblems
 }
 
-func Sync(plan core.BackupPlan) {
-	deleteLocalMetafiles := false
+// 	удаляем из хранилища архивы, не нужные согласно политике хранения
+func Prune(ctx context.Context, plan core.BackupPlan, opts Options) error {
 	for {
-		err := plan.SyncMeta(deleteLocalMetafiles)
+		result, err := plan.DoPrune(ctx)
+		if err == base.ErrStorageRequestInProgress {
+			err = waitForStorageRequest(ctx)
+			if err == nil {
+				continue
+			}
+		}
 		if err != nil {
-			if err == base.ErrStorageRequestInProgress {
-				fmt.Printf("Request to storage is in progress. Waiting for %v seconds...\n", base.StorageRequestInProgressRetrySeconds)
-				time.Sleep(time.Duration(base.StorageRequestInProgressRetrySeconds) * time.Second)
-			} else if err == base.ErrLocalMetaExists {
-				fmt.Printf("[ERROR] %v\n", err)
-				deleteLocalMetafiles, _ = parseCmdsBool(getInput("Do you want to delete local metafiles and completely get them from storage [Y/N]", "",
-					func(text string) error {
-						return checkCmdsBool(text)
-					}))
-				if !deleteLocalMetafiles {
-					return
+			return opts.printJson("prune", plan.Name, nil, err)
+		}
+
+		if opts.IsJsonOutput() {
+			return opts.printJson("prune", plan.Name, pruneOutput{
+				Deleted:  getArchNames(result.Deleted),
+				Repacked: getArchNames(result.Repacked),
+			}, nil)
+		}
+		fmt.Printf("Archives deleted: %v\n", len(result.Deleted))
+		for _, metaFile := range result.Deleted {
+			fmt.Printf("    %v\n", core.GetArchName(metaFile))
+		}
+		fmt.Printf("Archives repacked: %v\n", len(result.Repacked))
+		for _, metaFile := range result.Repacked {
+			fmt.Printf("    %v\n", core.GetArchName(metaFile))
+		}
+		return nil
+	}
+}
+
+// 	меняем пароль, которым зашифрован мастер-ключ плана
+func ChangePassphrase(ctx context.Context, plan core.BackupPlan, opts Options) error {
+	err := changePassphrase(ctx, plan, opts)
+	if err == nil {
+		opts.printText("Passphrase is changed\n")
+	}
+	return opts.printJson("change-passphrase", plan.Name, nil, err)
+}
+
+func changePassphrase(ctx context.Context, plan core.BackupPlan, opts Options) error {
+	newPassphrase, err := opts.getInput("new-passphrase", "New encryption/decryption passphrase (24-32 symbols)", "", checkPassphrase(true))
+	if err != nil {
+		return err
+	}
+	if _, provided := opts.values["new-passphrase"]; !provided {
+		_, err = opts.getInput("", "Repeat new passphrase", "",
+			func(passphrase string) error {
+				if passphrase != newPassphrase {
+					return fmt.Errorf("Passphrases do not match")
 				}
-			} else {
-				fmt.Printf("[ERROR] %v\n", err)
-				return
-			}
-		} else {
-			break
+				return nil
+			})
+		if err != nil {
+			return err
 		}
 	}
+	return plan.ChangePassphrase(ctx, newPassphrase)
 }
 
 func WebUI(plan core.BackupPlan) {
 	webui.Init(plan.Name)
 }
 
-func getInput(title string, defaultValue string, checkFunc func(string) error) string {
-	reader := bufio.NewReader(os.Stdin)
-	for {
-		if defaultValue == "" {
-			fmt.Print(title + ": ")
-		} else {
-			fmt.Printf("%v (default: %v): ", title, defaultValue)
+// returns context error, if waiting is interrupted
+func waitForStorageRequest(ctx context.Context) error {
+	base.Log.Printf("Request to storage is in progress. Waiting for %v seconds...\n", base.StorageRequestInProgressRetrySeconds)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(base.StorageRequestInProgressRetrySeconds) * time.Second):
+		return nil
+	}
+}
+
+// private key is required to decrypt data encrypted to recipients, it is asked if not provided by --identity-file
+func getIdentityInput(plan core.BackupPlan, opts Options) (core.BackupPlan, error) {
+	if !plan.IsPublicKeyEncryption() || plan.Decrypt_identity != "" {
+		return plan, nil
+	}
+	_, err := opts.getInput("identity-file", "Provide path to file with private key (identity) to decrypt data", "",
+		func(path string) error {
+			identity, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			plan.Decrypt_identity = string(identity)
+			return nil
+		})
+	return plan, err
+}
+
+func (opts Options) getStorageConfigInput(titlePrefix string, keyPrefix string, oldConfig map[string]string,
+	storageTypes []string) (map[string]string, error) {
+
+	storageTypesMap := make(map[string]bool)
+	for _, stype := range storageTypes {
+		storageTypesMap[stype] = true
+	}
+	storageType, err := opts.getStorageInput(keyPrefix+"type", titlePrefix+"Storage type ["+strings.Join(storageTypes, "/")+"]", oldConfig["type"],
+		func(stype string) error {
+			if !storageTypesMap[stype] {
+				return fmt.Errorf("Storage type is not supported")
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	if storageType != oldConfig["type"] {
+		oldConfig = make(map[string]string)
+	}
+
+	storageConfig := make(map[string]string)
+	storageConfig["type"] = storageType
+
+	if storageType == "mirror" {
+		oldChildConfigs := tomirror.GetChildConfigs(oldConfig)
+		defaultQty := strconv.Itoa(tomirror.MinStoragesQty)
+		if len(oldChildConfigs) > 0 {
+			defaultQty = strconv.Itoa(len(oldChildConfigs))
 		}
-		inputBytes, _, err := reader.ReadLine()
+		qtyText, err := opts.getStorageInput(keyPrefix+"qty", titlePrefix+"Number of mirrored storages", defaultQty,
+			func(text string) error {
+				return checkInt(text, tomirror.MinStoragesQty, 10)
+			})
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
+		qty, _ := strconv.Atoi(qtyText)
 
-		input := string(inputBytes)
-		if input == "" && defaultValue != "" {
-			return defaultValue
-		} else if err = checkFunc(input); err != nil {
-			fmt.Printf("[ERROR] %v\n", err)
-		} else {
-			return input
+		childStorageTypes := make([]string, 0)
+		for _, stype := range storageTypes {
+			if stype != "mirror" {
+				childStorageTypes = append(childStorageTypes, stype)
+			}
+		}
+		for i := 1; i <= qty; i++ {
+			oldChildConfig := make(map[string]string)
+			if i <= len(oldChildConfigs) {
+				oldChildConfig = oldChildConfigs[i-1]
+			}
+			childConfig, err := opts.getStorageConfigInput(fmt.Sprintf("%vMirror %v. ", titlePrefix, i), fmt.Sprintf("%v%v.", keyPrefix, i),
+				oldChildConfig, childStorageTypes)
+			if err != nil {
+				return nil, err
+			}
+			tomirror.SetChildConfig(storageConfig, i, childConfig)
+		}
+		return storageConfig, nil
+	}
+
+	storageFields, err := storage.GetStorageConfigFields(storageType)
+	if err != nil {
+		return nil, err
+	}
+	for _, cf := range storageFields {
+		storageConfig[cf.Name], err = opts.getStorageInput(keyPrefix+cf.Name, titlePrefix+cf.Title, oldConfig[cf.Name],
+			func(value string) error {
+				return nil
+			})
+		if err != nil {
+			return nil, err
 		}
 	}
+	return storageConfig, nil
 }
 
-func getInputList(title string, oneItemTitle string, notEmpty bool, checkFunc func(string) error) []string {
-	list := make([]string, 0)
+func printStorageConfig(titlePrefix string, storageConfig map[string]string) {
+	fmt.Printf("%vStorage type: %v\n", titlePrefix, storageConfig["type"])
 
-	fmt.Println(title + ": ")
-	for {
-		itemText := getInput("    "+oneItemTitle, "", checkFunc)
-		if itemText != "" {
-			list = append(list, itemText)
-		} else {
-			if notEmpty && len(list) == 0 {
-				fmt.Printf("[ERROR] Values list should not be empty\n")
-			} else {
-				break
-			}
+	if storageConfig["type"] == "mirror" {
+		for i, childConfig := range tomirror.GetChildConfigs(storageConfig) {
+			printStorageConfig(fmt.Sprintf("%vMirror %v. ", titlePrefix, i+1), childConfig)
 		}
+		return
 	}
 
-	return list
+	storageFields, err := storage.GetStorageConfigFields(storageConfig["type"])
+	if err != nil {
+		base.LogErr.Fatalln(err)
+	}
+	for _, cf := range storageFields {
+		fmt.Printf("%v%v: %v\n", titlePrefix, cf.Title, storageConfig[cf.Name])
+	}
 }
 
 func checkInt(text string, min, max int64) error {
@@ -371,9 +866,18 @@ func checkInt(text string, min, max int64) error {
 	return nil
 }
 
+func checkPassphrase(required bool) func(string) error {
+	return func(passphrase string) error {
+		if required && !(len(passphrase) >= 24 && len(passphrase) <= 40) {
+			return fmt.Errorf("Passphrase length should be between 24 and 32 symbols")
+		}
+		return nil
+	}
+}
+
 func parseCmdsBool(text string) (bool, error) {
-	true_values := []string{"Y", "y", "Yes", "yes"}
-	false_values := []string{"N", "n", "No", "no"}
+	true_values := []string{"Y", "y", "Yes", "yes", "true"}
+	false_values := []string{"N", "n", "No", "no", "false"}
 
 	if regexp.MustCompile("^(" + strings.Join(true_values, "|") + ")$").MatchString(text) {
 		return true, nil
@@ -384,7 +888,29 @@ func parseCmdsBool(text string) (bool, error) {
 	}
 }
 
+// format set by plan, zip if it is not set
+func getArchiveFormat(plan core.BackupPlan) string {
+	if plan.ArchiveFormat == "" {
+		return core.ZipArchiveFormat
+	}
+	return plan.ArchiveFormat
+}
+
+func formatCmdsBool(value bool) string {
+	if value {
+		return "Yes"
+	}
+	return "No"
+}
+
 func checkCmdsBool(text string) error {
 	_, err := parseCmdsBool(text)
 	return err
 }
+
+func formatRateLimit(bytesPerSec int64) string {
+	if bytesPerSec <= 0 {
+		return "unlimited"
+	}
+	return strconv.FormatInt(bytesPerSec/1024, 10)
+}
@@ -0,0 +1,248 @@
+package cmds
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// value of option which could be repeated in command line
+type ListFlag []string
+
+func (lf *ListFlag) String() string {
+	return strings.Join(*lf, ",")
+}
+
+func (lf *ListFlag) Set(value string) error {
+	*lf = append(*lf, value)
+	return nil
+}
+
+// values of command options provided in command line, values which are not provided
+// are asked interactively, or defaults are used if input is disabled
+type Options struct {
+	values  map[string]string
+	lists   map[string][]string
+	storage map[string]string
+	noInput bool
+}
+
+// options for interactive commands, all values are asked
+func InteractiveOptions() Options {
+	return Options{}
+}
+
+// collects options set in command line, storage config is passed by repeated --storage key=value
+func NewOptions(fs *flag.FlagSet, noInput bool) (Options, error) {
+	opts := Options{
+		values:  make(map[string]string),
+		lists:   make(map[string][]string),
+		storage: make(map[string]string),
+		noInput: noInput,
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if list, ok := f.Value.(*ListFlag); ok {
+			opts.lists[f.Name] = *list
+		} else {
+			opts.values[f.Name] = f.Value.String()
+		}
+	})
+	if output, provided := opts.values["output"]; provided {
+		if output != TextOutput && output != JsonOutput {
+			return opts, fmt.Errorf("Output format should be %v or %v: %v", TextOutput, JsonOutput, output)
+		}
+		// prompts would break json output
+		opts.noInput = opts.noInput || output == JsonOutput
+	}
+	for _, kv := range opts.lists["storage"] {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return opts, fmt.Errorf("Storage option should be in form key=value: %v", kv)
+		}
+		opts.storage[parts[0]] = parts[1]
+	}
+	return opts, opts.readSecretFiles()
+}
+
+// options, which values could be read from files given by --<name>-file
+var secretOptions = []string{"passphrase", "new-passphrase"}
+
+// secrets are read from files, so they are not exposed in process list and shell history,
+// storage values are passed as --storage-file key=path_to_file
+func (opts Options) readSecretFiles() error {
+	for _, name := range secretOptions {
+		path, provided := opts.values[name+"-file"]
+		if !provided {
+			continue
+		}
+		if _, exists := opts.values[name]; exists {
+			return fmt.Errorf("Only one of --%v and --%v-file could be provided", name, name)
+		}
+		value, err := readSecretFile(path)
+		if err != nil {
+			return fmt.Errorf("Value of --%v-file can not be read: %v", name, err)
+		}
+		opts.values[name] = value
+	}
+	for _, kv := range opts.lists["storage-file"] {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("Storage file option should be in form key=path: %v", kv)
+		}
+		if _, exists := opts.storage[parts[0]]; exists {
+			return fmt.Errorf("Storage value %v is provided by both --storage and --storage-file", parts[0])
+		}
+		value, err := readSecretFile(parts[1])
+		if err != nil {
+			return fmt.Errorf("Storage value %v can not be read: %v", parts[0], err)
+		}
+		opts.storage[parts[0]] = value
+	}
+	return nil
+}
+
+// trailing line break is not a part of value, files are usually written with it
+func readSecretFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// returns value of option if provided, otherwise asks it
+func (opts Options) getInput(name string, title string, defaultValue string, checkFunc func(string) error) (string, error) {
+	value, provided := opts.values[name]
+	return opts.getValue(value, provided, "--"+name, title, defaultValue, checkFunc)
+}
+
+func (opts Options) getStorageInput(key string, title string, defaultValue string, checkFunc func(string) error) (string, error) {
+	value, provided := opts.storage[key]
+	return opts.getValue(value, provided, "--storage "+key+"=", title, defaultValue, checkFunc)
+}
+
+func (opts Options) getValue(value string, provided bool, option string, title string, defaultValue string,
+	checkFunc func(string) error) (string, error) {
+
+	if provided {
+		if err := checkFunc(value); err != nil {
+			return "", fmt.Errorf("Invalid value of %v: %v", option, err)
+		}
+		return value, nil
+	}
+	if opts.noInput {
+		if defaultValue != "" {
+			return defaultValue, nil
+		} else if err := checkFunc(""); err != nil {
+			return "", fmt.Errorf("Value of %v is required", option)
+		}
+		return "", nil
+	}
+
+	for {
+		if defaultValue == "" {
+			fmt.Print(title + ": ")
+		} else {
+			fmt.Printf("%v (default: %v): ", title, defaultValue)
+		}
+		input, err := stdinReader.ReadString('\n')
+		if err != nil && !(err == io.EOF && input != "") {
+			return "", fmt.Errorf("Value of %v is not provided: %v", option, err)
+		}
+
+		input = strings.TrimRight(input, "\r\n")
+		if input == "" && defaultValue != "" {
+			return defaultValue, nil
+		} else if err = checkFunc(input); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+		} else {
+			return input, nil
+		}
+	}
+}
+
+// returns list of values if option is provided, otherwise asks list items one by one
+func (opts Options) getInputList(name string, title string, oneItemTitle string, notEmpty bool,
+	checkFunc func(string) error) ([]string, error) {
+
+	if list, provided := opts.lists[name]; provided {
+		for _, item := range list {
+			if err := checkFunc(item); err != nil {
+				return nil, fmt.Errorf("Invalid value of --%v: %v", name, err)
+			}
+		}
+		return list, nil
+	}
+	if opts.noInput {
+		if notEmpty {
+			return nil, fmt.Errorf("Value of --%v is required", name)
+		}
+		return []string{}, nil
+	}
+
+	list := make([]string, 0)
+	fmt.Println(title + ": ")
+	for {
+		itemText, err := opts.getValue("", false, "--"+name, "    "+oneItemTitle, "", checkFunc)
+		if err != nil {
+			return nil, err
+		}
+		if itemText != "" {
+			list = append(list, itemText)
+		} else {
+			if notEmpty && len(list) == 0 {
+				fmt.Printf("[ERROR] Values list should not be empty\n")
+			} else {
+				break
+			}
+		}
+	}
+	return list, nil
+}
+
+// list is edited if it is provided in command line, or if user agrees to do it
+func (opts Options) isListToEdit(name string, currentTitle string, currentList []string, title string) (bool, error) {
+	if _, provided := opts.lists[name]; provided {
+		return true, nil
+	} else if opts.noInput {
+		return false, nil
+	}
+	fmt.Println(currentTitle + ":")
+	for _, item := range currentList {
+		fmt.Printf("    %v\n", item)
+	}
+	return opts.getInputBool("", title+" [Y/N]", "")
+}
+
+func (opts Options) getInputBool(name string, title string, defaultValue string) (bool, error) {
+	value, err := opts.getInput(name, title, defaultValue, checkCmdsBool)
+	if err != nil {
+		return false, err
+	}
+	return parseCmdsBool(value)
+}
+
+func (opts Options) getInputInt(name string, title string, defaultValue int) (int, error) {
+	value, err := opts.getInput(name, title, strconv.Itoa(defaultValue),
+		func(text string) error {
+			return checkInt(text, 0, 100000)
+		})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// prints informational message in text output mode only, so json output is not broken
+func (opts Options) printText(format string, a ...interface{}) {
+	if !opts.IsJsonOutput() {
+		fmt.Printf(format, a...)
+	}
+}
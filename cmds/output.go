@@ -0,0 +1,194 @@
+package cmds
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/n-boy/backuper/core"
+	"github.com/n-boy/backuper/storage"
+)
+
+const (
+	TextOutput string = "text"
+	JsonOutput string = "json"
+)
+
+// result of command printed in json output mode, errors hold the error command failed with
+type cmdOutput struct {
+	Command string      `json:"command"`
+	Plan    string      `json:"plan,omitempty"`
+	Ok      bool        `json:"ok"`
+	Result  interface{} `json:"result,omitempty"`
+	Errors  []string    `json:"errors"`
+}
+
+type planOutput struct {
+	Name              string            `json:"name"`
+	ChunkSizeMB       int64             `json:"chunk_size_mb"`
+	TmpSpaceMB        int64             `json:"tmp_space_mb"`
+	Encrypt           bool              `json:"encrypt"`
+	EncryptPassphrase string            `json:"encrypt_passphrase,omitempty"`
+	EncryptRecipients []string          `json:"encrypt_recipients,omitempty"`
+	ObfuscateNames    bool              `json:"obfuscate_names"`
+	Dedup             bool              `json:"dedup"`
+	Compression       string            `json:"compression,omitempty"`
+	CompressionLevel  int               `json:"compression_level,omitempty"`
+	ArchiveFormat     string            `json:"archive_format,omitempty"`
+	Retention         *retentionOutput  `json:"retention,omitempty"`
+	Retry             retryOutput       `json:"retry"`
+	UploadRateKB      int64             `json:"upload_rate_limit_kb"`
+	DownloadRateKB    int64             `json:"download_rate_limit_kb"`
+	UploadWindows     []string          `json:"upload_windows"`
+	Paths             []string          `json:"paths"`
+	ExcludeMasks      []string          `json:"exclude_masks"`
+	Storage           map[string]string `json:"storage"`
+}
+
+type retentionOutput struct {
+	KeepLast           int `json:"keep_last"`
+	KeepDaily          int `json:"keep_daily"`
+	KeepWeekly         int `json:"keep_weekly"`
+	KeepMonthly        int `json:"keep_monthly"`
+	DeletedFilesDays   int `json:"deleted_files_days"`
+	RepackThresholdPct int `json:"repack_threshold_pct"`
+}
+
+// effective retry policy, default values are shown for not set ones
+type retryOutput struct {
+	Attempts        int     `json:"attempts"`
+	InitialDelaySec float64 `json:"initial_delay_sec"`
+	MaxDelaySec     float64 `json:"max_delay_sec"`
+}
+
+type statusOutput struct {
+	Locks []string `json:"locks"`
+}
+
+type backupOutput struct {
+	Archives      []string          `json:"archives"`
+	FilesArchived int               `json:"files_archived"`
+	BytesUploaded int64             `json:"bytes_uploaded"`
+	Skipped       []nodeErrorOutput `json:"skipped"`
+}
+
+type nodeErrorOutput struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type restoreOutput struct {
+	FilesRestored int `json:"files_restored"`
+}
+
+type syncOutput struct {
+	MetaFiles []string `json:"metafiles"`
+}
+
+type verifyOutput struct {
+	ArchivesChecked int      `json:"archives_checked"`
+	FilesChecked    int      `json:"files_checked"`
+	Problems        []string `json:"problems"`
+}
+
+type pruneOutput struct {
+	Deleted  []string `json:"deleted"`
+	Repacked []string `json:"repacked"`
+}
+
+func (opts Options) IsJsonOutput() bool {
+	return opts.values["output"] == JsonOutput
+}
+
+// prints result of command in json output mode, returns error of command
+func (opts Options) printJson(command string, planName string, result interface{}, err error) error {
+	if !opts.IsJsonOutput() {
+		return err
+	}
+	output := cmdOutput{Command: command, Plan: planName, Ok: err == nil, Result: result, Errors: []string{}}
+	if err != nil {
+		output.Errors = append(output.Errors, err.Error())
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if jsonErr := encoder.Encode(output); jsonErr != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", jsonErr)
+	}
+	return err
+}
+
+// prints error happened before command is started, in the format of selected output mode
+func PrintError(opts Options, command string, planName string, err error) {
+	if opts.IsJsonOutput() {
+		opts.printJson(command, planName, nil, err)
+	} else {
+		fmt.Printf("[ERROR] %v\n", err)
+	}
+}
+
+// plan config with secrets hidden
+func getPlanOutput(plan core.BackupPlan) planOutput {
+	output := planOutput{
+		Name:              plan.Name,
+		ChunkSizeMB:       plan.ChunkSize / 1024 / 1024,
+		TmpSpaceMB:        plan.TmpSpaceLimit / 1024 / 1024,
+		Encrypt:           plan.Encrypt,
+		EncryptRecipients: plan.Encrypt_recipients,
+		ObfuscateNames:    plan.Obfuscate_names,
+		Dedup:             plan.Dedup,
+		Paths:             emptyIfNil(plan.NodesToArchive),
+		ExcludeMasks:      emptyIfNil(plan.ExcludeMasks),
+	}
+	if plan.Encrypt_passphrase != "" {
+		output.EncryptPassphrase = storage.RedactedValue
+	}
+	if !plan.Dedup {
+		output.Compression = plan.Compression.GetMethod()
+		output.CompressionLevel = plan.Compression.Level
+		output.ArchiveFormat = getArchiveFormat(plan)
+	}
+	output.UploadRateKB = plan.UploadRateLimit / 1024
+	output.DownloadRateKB = plan.DownloadRateLimit / 1024
+	output.UploadWindows = make([]string, 0, len(plan.UploadWindows))
+	for _, w := range plan.UploadWindows {
+		output.UploadWindows = append(output.UploadWindows, w.String())
+	}
+	retry := plan.Retry.WithDefaults()
+	output.Retry = retryOutput{
+		Attempts:        retry.Attempts,
+		InitialDelaySec: retry.InitialDelay.Seconds(),
+		MaxDelaySec:     retry.MaxDelay.Seconds(),
+	}
+	if plan.Retention.IsEnabled() {
+		output.Retention = &retentionOutput{
+			KeepLast:           plan.Retention.KeepLast,
+			KeepDaily:          plan.Retention.KeepDaily,
+			KeepWeekly:         plan.Retention.KeepWeekly,
+			KeepMonthly:        plan.Retention.KeepMonthly,
+			DeletedFilesDays:   plan.Retention.DeletedFilesDays,
+			RepackThresholdPct: plan.Retention.RepackThresholdPct,
+		}
+	}
+	if plan.Storage != nil {
+		storageConfig := plan.Storage.GetStorageConfig()
+		storageConfig["type"] = plan.Storage.GetType()
+		output.Storage = storage.GetRedactedStorageConfig(storageConfig)
+	}
+	return output
+}
+
+func getArchNames(metaFiles core.MetafileList) []string {
+	archNames := make([]string, 0)
+	for _, metaFile := range metaFiles {
+		archNames = append(archNames, core.GetArchName(metaFile))
+	}
+	return archNames
+}
+
+func emptyIfNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
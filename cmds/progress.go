@@ -0,0 +1,170 @@
+package cmds
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n-boy/backuper/base"
+	"github.com/n-boy/backuper/core"
+)
+
+const (
+	progressBarWidth      = 30
+	progressRedrawPeriod  = 200 * time.Millisecond
+	progressEtaMinElapsed = 3 * time.Second
+)
+
+// progress of backup or restore drawn in one line of terminal.
+// Backup progress counts source bytes twice: when they are archived and when archive with them is uploaded
+type progressBar struct {
+	out io.Writer
+
+	mu         sync.Mutex
+	started    time.Time
+	totalFiles int
+	totalBytes int64
+	doneFiles  int
+	doneBytes  int64
+	status     string
+	lastDraw   time.Time
+	drawn      bool
+
+	// source bytes of archives planned by backup, upload progress of archive is converted to them
+	chunkBytes    map[string]int64
+	uploadedBytes map[string]int64
+	countedBytes  map[string]int64
+}
+
+// progress bar is shown in text output mode only, when stderr is terminal and it is not disabled by --no-progress.
+// Informational log is not printed to stdout then, to not break the bar, it is kept in history log
+func (opts Options) newProgressBar() *progressBar {
+	if opts.IsJsonOutput() || opts.values["no-progress"] == "true" || !isTerminal(os.Stderr) {
+		return nil
+	}
+	base.SetLogToStdout(false)
+	return &progressBar{
+		out:           os.Stderr,
+		chunkBytes:    make(map[string]int64),
+		uploadedBytes: make(map[string]int64),
+		countedBytes:  make(map[string]int64),
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (pb *progressBar) OnEvent(event core.Event) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	force := false
+	switch event.Type {
+	case core.EventScanStarted:
+		pb.status = "scanning files"
+		force = true
+	case core.EventScanFinished:
+		pb.start(event.Files, event.Bytes*2)
+		pb.status = ""
+	case core.EventRestoreStarted:
+		pb.start(event.Files, event.Bytes)
+		pb.status = "restoring"
+	case core.EventChunkPlanned:
+		pb.chunkBytes[event.Archive] = event.Bytes
+		pb.status = "archiving " + event.Archive
+		force = true
+	case core.EventFileArchived, core.EventFileRestored:
+		pb.doneFiles++
+		pb.doneBytes += event.Bytes
+	case core.EventBytesUploaded:
+		uploaded := pb.uploadedBytes[event.Archive] + event.Bytes
+		pb.uploadedBytes[event.Archive] = uploaded
+		// size of archive streamed to storage is not known, its source bytes are counted when it is uploaded
+		if event.TotalBytes <= 0 {
+			pb.status = "uploading " + event.Archive
+			break
+		}
+		if chunkBytes, planned := pb.chunkBytes[event.Archive]; planned {
+			// uploaded part of archive is counted as the same part of its source bytes
+			counted := int64(float64(uploaded) * float64(chunkBytes) / float64(event.TotalBytes))
+			pb.doneBytes += counted - pb.countedBytes[event.Archive]
+			pb.countedBytes[event.Archive] = counted
+		}
+		pb.status = fmt.Sprintf("uploading %v %v%%", event.Archive, percent(uploaded, event.TotalBytes))
+	case core.EventArchiveUploaded:
+		if chunkBytes, planned := pb.chunkBytes[event.Archive]; planned {
+			pb.doneBytes += chunkBytes - pb.countedBytes[event.Archive]
+			pb.countedBytes[event.Archive] = chunkBytes
+		}
+		pb.status = ""
+	case core.EventStorageWaiting:
+		pb.status = "waiting for request to storage"
+		force = true
+	case core.EventUploadPaused:
+		pb.status = "upload paused till upload window"
+		force = true
+	case core.EventStorageRetry:
+		pb.status = "request to storage failed, retrying"
+		force = true
+	}
+	pb.draw(force)
+}
+
+func (pb *progressBar) start(files int, bytes int64) {
+	pb.started = time.Now()
+	pb.totalFiles = files
+	pb.totalBytes = bytes
+	pb.doneFiles = 0
+	pb.doneBytes = 0
+}
+
+// ends line of bar, so following output is printed below it
+func (pb *progressBar) Finish() {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if pb.drawn {
+		pb.draw(true)
+		fmt.Fprintln(pb.out)
+		pb.drawn = false
+	}
+}
+
+func (pb *progressBar) draw(force bool) {
+	if !force && time.Since(pb.lastDraw) < progressRedrawPeriod {
+		return
+	}
+	pb.lastDraw = time.Now()
+	pb.drawn = true
+
+	pct := percent(pb.doneBytes, pb.totalBytes)
+	filled := progressBarWidth * pct / 100
+	line := fmt.Sprintf("[%v%v] %3d%%  %v/%v files",
+		strings.Repeat("#", filled), strings.Repeat("-", progressBarWidth-filled), pct, pb.doneFiles, pb.totalFiles)
+
+	elapsed := time.Since(pb.started)
+	if !pb.started.IsZero() && pb.doneBytes > 0 && pb.doneBytes < pb.totalBytes && elapsed > progressEtaMinElapsed {
+		eta := time.Duration(float64(elapsed) * float64(pb.totalBytes-pb.doneBytes) / float64(pb.doneBytes))
+		line += "  ETA " + eta.Round(time.Second).String()
+	}
+	if pb.status != "" {
+		line += "  " + pb.status
+	}
+	// line is cleared to its end, as the previous one could be longer
+	fmt.Fprintf(pb.out, "\r%v\033[K", line)
+}
+
+func percent(done, total int64) int {
+	if total <= 0 {
+		return 0
+	}
+	if done >= total {
+		return 100
+	}
+	return int(done * 100 / total)
+}
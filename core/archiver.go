@@ -3,7 +3,10 @@ package core
 import (
 	"archive/zip"
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
@@ -11,67 +14,141 @@ import (
 
 	"github.com/n-boy/backuper/base"
 	"github.com/n-boy/backuper/crypter"
+	storageutils "github.com/n-boy/backuper/storage/utils"
 )
 
-func ArchiveNodes(nodes []NodeMetaInfo, archFilePath string, encrypter *crypter.Encrypter) (nodesArch []NodeMetaInfo) {
+// files, that can not be read (e.g. deleted after listing, or access is denied), are skipped and returned as errors.
+// Files are compressed by method of compression, if they are worth it.
+// If archiving is canceled or fails, partly written archive is removed. Observer could be nil
+func ArchiveNodes(ctx context.Context, nodes []NodeMetaInfo, archFilePath string, encrypter *crypter.Encrypter,
+	compression Compression, observer Observer) (nodesArch []NodeMetaInfo, nodesErr []NodeError, err error) {
 	archFileWriter, err := os.Create(archFilePath)
 	if err != nil {
-		base.LogErr.Fatalln(err)
+		return nil, nil, err
 	}
-	defer archFileWriter.Close()
+	defer func() {
+		archFileWriter.Close()
+		if err != nil {
+			os.Remove(archFilePath)
+		}
+	}()
 
-	archWriter := io.Writer(archFileWriter)
+	if nodesArch, nodesErr, err = ArchiveNodesToWriter(ctx, nodes, archFileWriter, encrypter, compression, observer); err != nil {
+		return nil, nil, err
+	}
+	if err = archFileWriter.Close(); err != nil {
+		return nil, nil, err
+	}
+	return nodesArch, nodesErr, nil
+}
+
+// writes archive to writer, e.g. to stream it to storage, archive is written completely when it returns
+func ArchiveNodesToWriter(ctx context.Context, nodes []NodeMetaInfo, archFileWriter io.Writer, encrypter *crypter.Encrypter,
+	compression Compression, observer Observer) (nodesArch []NodeMetaInfo, nodesErr []NodeError, err error) {
+
+	archWriter := archFileWriter
 	if encrypter != nil {
-		encrypter.InitWriter(archFileWriter)
+		if _, err = encrypter.InitWriter(archFileWriter); err != nil {
+			return nil, nil, err
+		}
 		archWriter = io.Writer(encrypter)
 	}
 
 	bufWriter := bufio.NewWriterSize(archWriter, 16*1024*1024)
 	w := zip.NewWriter(bufWriter)
+	compressor := newZipCompressor(compression)
+	compressor.register(w)
 
 	for _, node := range nodes {
+		if err = ctx.Err(); err != nil {
+			return nil, nil, err
+		}
 		fInfo, err := os.Stat(node.path)
 		if err != nil {
-			base.LogErr.Fatalln(err)
+			nodesErr = append(nodesErr, NodeError{Path: node.path, Err: err})
+			continue
 		}
+		var fileReader *os.File
+		var nodeReader *errorTrackingReader
+		var sample []byte
+		if !node.is_dir {
+			if fileReader, err = os.Open(node.path); err != nil {
+				nodesErr = append(nodesErr, NodeError{Path: node.path, Err: err})
+				continue
+			}
+			defer fileReader.Close()
+			nodeReader = &errorTrackingReader{r: fileReader}
+			if sample, err = compressor.readSample(nodeReader); err != nil {
+				nodesErr = append(nodesErr, NodeError{Path: node.path, Err: err})
+				fileReader.Close()
+				continue
+			}
+		}
+
 		fHeader, err := zip.FileInfoHeader(fInfo)
 		if err != nil {
-			base.LogErr.Fatalln(err)
+			return nil, nil, err
+		}
+		fHeader.Name = node.entryInArchive()
+		if !node.is_dir {
+			if fHeader.Method, err = compressor.getFileMethod(node.path, sample); err != nil {
+				return nil, nil, err
+			}
 		}
-		fHeader.Name = GetPathInArchive(node.path)
 
 		fileWriter, err := w.CreateHeader(fHeader)
 		if err != nil {
-			base.LogErr.Fatalln(err)
+			return nil, nil, err
 		}
 
 		if !node.is_dir {
-			fileReader, err := os.Open(node.path)
-			if err != nil {
-				base.LogErr.Fatalln(err)
+			// partly written entry of file failed to read stays in archive, but it is not referenced by metafile
+			crcHash := crc32.NewIEEE()
+			_, err = io.Copy(io.MultiWriter(fileWriter, crcHash),
+				storageutils.NewContextReader(ctx, io.MultiReader(bytes.NewReader(sample), nodeReader)))
+			if nodeReader.err != nil {
+				nodesErr = append(nodesErr, NodeError{Path: node.path, Err: nodeReader.err})
+				fileReader.Close()
+				continue
+			} else if err != nil {
+				return nil, nil, err
 			}
-			defer fileReader.Close()
+			node.crc = fmt.Sprintf("%08x", crcHash.Sum32())
 
-			_, err = io.Copy(fileWriter, fileReader)
-			if err != nil {
-				base.LogErr.Fatalln(err)
-			}
-
-			err = fileReader.Close()
-			if err != nil {
-				base.LogErr.Fatalln(err)
+			if err = fileReader.Close(); err != nil {
+				return nil, nil, err
 			}
 		}
 		node.applyFileInfo(fInfo)
 		nodesArch = append(nodesArch, node)
+		notify(observer, Event{Type: EventFileArchived, Path: node.path, Bytes: node.size})
 	}
 
 	if err = w.Close(); err != nil {
-		base.LogErr.Fatalln(err)
-	} else if err = archFileWriter.Close(); err != nil {
-		base.LogErr.Fatalln(err)
+		return nil, nil, err
+	} else if err = bufWriter.Flush(); err != nil {
+		return nil, nil, err
+	}
+	if encrypter != nil {
+		if err = encrypter.Close(); err != nil {
+			return nil, nil, err
+		}
 	}
-	return nodesArch
+	return nodesArch, nodesErr, nil
+}
+
+// keeps error of reading source file, to tell it from error of writing archive
+type errorTrackingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (etr *errorTrackingReader) Read(p []byte) (int, error) {
+	n, err := etr.r.Read(p)
+	if err != nil && err != io.EOF {
+		etr.err = err
+	}
+	return n, err
 }
 
 func UnarchiveNodes(archFilePath string, nodes []NodeMetaInfo, targetPath string) (nodesUnarch []NodeMetaInfo, err error) {
@@ -93,26 +170,18 @@ func UnarchiveNodes(archFilePath string, nodes []NodeMetaInfo, targetPath string
 	for _, node := range nodes {
 		var targetFilePath string
 		if node.is_dir {
-			if targetPath == OriginTargetPath {
-				targetFilePath = node.GetNodePath()
-			} else {
-				targetFilePath = filepath.Join(targetPath, GetPathInArchive(node.GetNodePath()))
-			}
+			targetFilePath = getNodeTargetPath(node, targetPath)
 			err = os.MkdirAll(targetFilePath, 0775)
 			if err != nil {
 				return nodesUnarch, err
 			}
 		} else {
-			f, exists := nodesInArchiveMap[GetPathInArchive(node.GetNodePath())]
+			f, exists := nodesInArchiveMap[node.entryInArchive()]
 			if !exists {
 				return nodesUnarch, fmt.Errorf("File %v is not founded in archive %v", node.GetNodePath(), archFilePath)
 			}
 
-			if targetPath == OriginTargetPath {
-				targetFilePath = node.GetNodePath()
-			} else {
-				targetFilePath = filepath.Join(targetPath, f.Name)
-			}
+			targetFilePath = getNodeTargetPath(node, targetPath)
 			tfi, err := os.Stat(targetFilePath)
 			if err == nil {
 				if tfi.ModTime().Equal(node.modtime) && tfi.Size() == node.size {
@@ -167,6 +236,67 @@ func UnarchiveNodes(archFilePath string, nodes []NodeMetaInfo, targetPath string
 	return nodesUnarch, nil
 }
 
+// copies entries of nodes from existing archive into new one without recompression
+func RepackNodes(srcArchFilePath string, nodes []NodeMetaInfo, archFilePath string, encrypter *crypter.Encrypter) error {
+	zipReader, err := zip.OpenReader(srcArchFilePath)
+	if err != nil {
+		return err
+	}
+	defer zipReader.Close()
+
+	nodesInArchiveMap := make(map[string]*zip.File)
+	for _, f := range zipReader.File {
+		nodesInArchiveMap[f.Name] = f
+	}
+
+	archFileWriter, err := os.Create(archFilePath)
+	if err != nil {
+		return err
+	}
+	defer archFileWriter.Close()
+
+	archWriter := io.Writer(archFileWriter)
+	if encrypter != nil {
+		if _, err = encrypter.InitWriter(archFileWriter); err != nil {
+			return err
+		}
+		archWriter = io.Writer(encrypter)
+	}
+
+	bufWriter := bufio.NewWriterSize(archWriter, 16*1024*1024)
+	w := zip.NewWriter(bufWriter)
+
+	for _, node := range nodes {
+		f, exists := nodesInArchiveMap[node.entryInArchive()]
+		if !exists {
+			return fmt.Errorf("File %v is not founded in archive %v", node.GetNodePath(), srcArchFilePath)
+		}
+		if err = w.Copy(f); err != nil {
+			return err
+		}
+	}
+
+	if err = w.Close(); err != nil {
+		return err
+	} else if err = bufWriter.Flush(); err != nil {
+		return err
+	}
+	if encrypter != nil {
+		if err = encrypter.Close(); err != nil {
+			return err
+		}
+	}
+	return archFileWriter.Close()
+}
+
+// path node is restored to, its own path for origin target path
+func getNodeTargetPath(node NodeMetaInfo, targetPath string) string {
+	if targetPath == OriginTargetPath {
+		return node.GetNodePath()
+	}
+	return filepath.Join(targetPath, GetPathInArchive(node.GetNodePath()))
+}
+
 func GetPathInArchive(path string) string {
 	path = regexp.MustCompile(`^([A-Za-z]):`).ReplaceAllString(path, "$1")
 	path = regexp.MustCompile(`^[/\\]+`).ReplaceAllString(path, "")
@@ -0,0 +1,171 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/n-boy/backuper/base"
+	storageutils "github.com/n-boy/backuper/storage/utils"
+)
+
+// period of day when backup is allowed to upload archives, e.g. "22:00-06:00 mon-fri".
+// Window ending at or before its start lasts till the next day, days of week are the days window starts at
+type UploadWindow struct {
+	Start time.Duration // since midnight
+	End   time.Duration
+	Days  [7]bool // indexed by time.Weekday
+
+	text string
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parses window in format "HH:MM-HH:MM [days]", days are listed by comma and could be ranges, e.g. "mon-fri,sun",
+// all days of week if they are not specified
+func ParseUploadWindow(text string) (UploadWindow, error) {
+	w := UploadWindow{text: text}
+	formatErr := fmt.Errorf("Upload window should be in format HH:MM-HH:MM [mon-fri,sun]: %v", text)
+
+	fields := strings.Fields(text)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, formatErr
+	}
+	times := strings.Split(fields[0], "-")
+	if len(times) != 2 {
+		return w, formatErr
+	}
+	var err error
+	if w.Start, err = parseDayTime(times[0]); err != nil || w.Start == 24*time.Hour {
+		return w, formatErr
+	}
+	if w.End, err = parseDayTime(times[1]); err != nil {
+		return w, formatErr
+	}
+
+	if len(fields) == 1 {
+		for day := range w.Days {
+			w.Days[day] = true
+		}
+		return w, nil
+	}
+	for _, daysRange := range strings.Split(strings.ToLower(fields[1]), ",") {
+		bounds := strings.Split(daysRange, "-")
+		first, last := getWeekday(bounds[0]), getWeekday(bounds[len(bounds)-1])
+		if len(bounds) > 2 || first < 0 || last < 0 {
+			return w, formatErr
+		}
+		// range could pass through the end of week, e.g. "sat-mon"
+		for day := first; ; day = (day + 1) % 7 {
+			w.Days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return w, nil
+}
+
+// end of day is written as 24:00
+func parseDayTime(text string) (time.Duration, error) {
+	if text == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", text)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func getWeekday(name string) int {
+	for day, dayName := range weekdayNames {
+		if name == dayName {
+			return day
+		}
+	}
+	return -1
+}
+
+func (w UploadWindow) String() string {
+	return w.text
+}
+
+// time of day is taken by clock, so windows follow daylight saving time changes
+func (w UploadWindow) Contains(t time.Time) bool {
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	overnight := w.End <= w.Start
+	if w.Days[t.Weekday()] && sinceMidnight >= w.Start && (overnight || sinceMidnight < w.End) {
+		return true
+	}
+	// window started the day before
+	return overnight && w.Days[(t.Weekday()+6)%7] && sinceMidnight < w.End
+}
+
+// returns the nearest time since t, when one of windows is open; t itself, if there are no windows or one of them is open
+func GetUploadWindowStart(windows []UploadWindow, t time.Time) time.Time {
+	if len(windows) == 0 {
+		return t
+	}
+	for _, w := range windows {
+		if w.Contains(t) {
+			return t
+		}
+	}
+
+	var next time.Time
+	for _, w := range windows {
+		for day := 0; day <= 7; day++ {
+			date := t.AddDate(0, 0, day)
+			if !w.Days[date.Weekday()] {
+				continue
+			}
+			start := time.Date(date.Year(), date.Month(), date.Day(),
+				int(w.Start/time.Hour), int(w.Start%time.Hour/time.Minute), 0, 0, t.Location())
+			if start.After(t) {
+				if next.IsZero() || start.Before(next) {
+					next = start
+				}
+				break
+			}
+		}
+	}
+	return next
+}
+
+// pause is checked by wall clock regularly, so it is not prolonged by sleep of computer
+const uploadWindowCheckPeriod = time.Minute
+
+// pauses upload till one of upload windows of plan is open, fails with context error when ctx is canceled
+func (plan BackupPlan) waitForUploadWindow(ctx context.Context) error {
+	notified := false
+	for {
+		start := GetUploadWindowStart(plan.UploadWindows, time.Now())
+		wait := time.Until(start)
+		if wait <= 0 {
+			return nil
+		}
+		if !notified {
+			base.Log.Printf("Upload is paused till %v, outside of upload windows", start.Format("2006-01-02 15:04"))
+			plan.notify(Event{Type: EventUploadPaused})
+			notified = true
+		}
+		if wait > uploadWindowCheckPeriod {
+			wait = uploadWindowCheckPeriod
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// returns context limiting rate of data sent to storage by upload rate limit of plan
+func (plan BackupPlan) limitUploadRate(ctx context.Context) context.Context {
+	return storageutils.WithUploadRateLimit(ctx, storageutils.NewRateLimiter(plan.UploadRateLimit))
+}
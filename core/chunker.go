@@ -0,0 +1,80 @@
+package core
+
+import (
+	"io"
+)
+
+// content-defined chunking (gear rolling hash, FastCDC-like):
+// chunk boundaries depend on content only, so insertion of data into the middle of a file
+// changes only few chunks around the insertion point
+const (
+	chunkMinSize = 512 * 1024
+	chunkMaxSize = 8 * 1024 * 1024
+	// boundary is found when 20 high bits of hash are zero, average chunk size is about chunkMinSize+1MB
+	chunkBoundaryMask uint64 = 0xFFFFF << 44
+)
+
+var gearTable = makeGearTable()
+
+type Chunker struct {
+	r   io.Reader
+	buf []byte
+	eof bool
+}
+
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, 0, chunkMaxSize)}
+}
+
+// returns next chunk of data, or io.EOF when there is no more data
+func (c *Chunker) Next() ([]byte, error) {
+	if !c.eof && len(c.buf) < chunkMaxSize {
+		n, err := io.ReadFull(c.r, c.buf[len(c.buf):chunkMaxSize])
+		c.buf = c.buf[:len(c.buf)+n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+
+	cut := findChunkBoundary(c.buf)
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf[:cut])
+	c.buf = c.buf[:copy(c.buf, c.buf[cut:])]
+
+	return chunk, nil
+}
+
+func findChunkBoundary(data []byte) int {
+	if len(data) <= chunkMinSize {
+		return len(data)
+	}
+	var hash uint64
+	for i := chunkMinSize; i < len(data); i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&chunkBoundaryMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// table of pseudo-random values, must be the same in all versions of application,
+// otherwise chunks of unchanged files would not be deduplicated
+func makeGearTable() [256]uint64 {
+	var table [256]uint64
+	// splitmix64
+	state := uint64(0x6261636b75706572)
+	for i := range table {
+		state += 0x9E3779B97F4A7C15
+		z := state
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
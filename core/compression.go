@@ -0,0 +1,208 @@
+package core
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionStore   = "store"
+	CompressionDeflate = "deflate"
+	CompressionZstd    = "zstd"
+)
+
+// method of zip entries compressed by zstd, as it is registered by zip specification
+const ZipZstdMethod uint16 = 93
+
+// compression of files in zip archives, zero value is deflate with its default level.
+// Files known as incompressible by extension, or by sample of their content, are stored without compression
+type Compression struct {
+	Method string
+	Level  int // 0 - default level of method
+}
+
+var compressionLevels = map[string][2]int{
+	CompressionStore:   {0, 0},
+	CompressionDeflate: {flate.BestSpeed, flate.BestCompression},
+	CompressionZstd:    {1, 22},
+}
+
+func GetCompressionMethods() []string {
+	return []string{CompressionStore, CompressionDeflate, CompressionZstd}
+}
+
+func (c Compression) Check() error {
+	levels, ok := compressionLevels[c.GetMethod()]
+	if !ok {
+		return fmt.Errorf("Compression method should be one of: %v", strings.Join(GetCompressionMethods(), ", "))
+	}
+	if c.Level != 0 && (c.Level < levels[0] || c.Level > levels[1]) {
+		if levels[1] == 0 {
+			return fmt.Errorf("Compression level is not supported by method %v", c.GetMethod())
+		}
+		return fmt.Errorf("Compression level of %v should be from %v to %v", c.GetMethod(), levels[0], levels[1])
+	}
+	return nil
+}
+
+// method applied to files, deflate if it is not set
+func (c Compression) GetMethod() string {
+	if c.Method == "" {
+		return CompressionDeflate
+	}
+	return c.Method
+}
+
+func (c Compression) String() string {
+	if c.Level == 0 {
+		return c.GetMethod()
+	}
+	return fmt.Sprintf("%v, level %v", c.GetMethod(), c.Level)
+}
+
+// extensions of files compressed by their format: media, archives, packages and encrypted files
+var incompressibleExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".avif": true,
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true, ".opus": true, ".flac": true,
+	".mp4": true, ".m4v": true, ".mkv": true, ".mov": true, ".avi": true, ".webm": true, ".wmv": true,
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".lz4": true, ".7z": true, ".rar": true,
+	".jar": true, ".apk": true, ".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".ods": true, ".epub": true,
+	".gpg": true, ".age": true,
+}
+
+const (
+	// start of file compressed to check, whether file is worth to be compressed
+	compressionSampleSize = 64 * 1024
+	// smaller files are compressed without check, as sample of them tells little
+	compressionMinSample = 4 * 1024
+	// file is stored, if its sample is compressed to more than this part of its size.
+	// Sample is compressed by Huffman coding only: it is fast, and content already compressed
+	// (media, archives, encrypted data) has nearly uniform distribution of bytes
+	compressionMaxRatio = 0.9
+)
+
+// chooses compression method of each file of zip archive, its compressors are reused for files one by one
+type zipCompressor struct {
+	compression Compression
+	sample      []byte
+
+	sampleWriter  *flate.Writer
+	sampleCounter *countingWriter
+	deflater      *flate.Writer
+	zstdEncoder   *zstd.Encoder
+}
+
+func newZipCompressor(compression Compression) *zipCompressor {
+	return &zipCompressor{compression: compression, sample: make([]byte, compressionSampleSize)}
+}
+
+// registers compressor of method with level of plan in zip writer
+func (zc *zipCompressor) register(w *zip.Writer) {
+	switch zc.compression.GetMethod() {
+	case CompressionDeflate:
+		if zc.compression.Level == 0 {
+			return
+		}
+		w.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			if zc.deflater == nil {
+				var err error
+				if zc.deflater, err = flate.NewWriter(out, zc.compression.Level); err != nil {
+					return nil, err
+				}
+			} else {
+				zc.deflater.Reset(out)
+			}
+			return zc.deflater, nil
+		})
+	case CompressionZstd:
+		w.RegisterCompressor(ZipZstdMethod, func(out io.Writer) (io.WriteCloser, error) {
+			if zc.zstdEncoder == nil {
+				level := zstd.SpeedDefault
+				if zc.compression.Level != 0 {
+					level = zstd.EncoderLevelFromZstd(zc.compression.Level)
+				}
+				var err error
+				if zc.zstdEncoder, err = zstd.NewWriter(out, zstd.WithEncoderLevel(level)); err != nil {
+					return nil, err
+				}
+			} else {
+				zc.zstdEncoder.Reset(out)
+			}
+			return zc.zstdEncoder, nil
+		})
+	}
+}
+
+// reads sample of file content, it should be written to archive before the rest of reader
+func (zc *zipCompressor) readSample(r io.Reader) ([]byte, error) {
+	n, err := io.ReadFull(r, zc.sample)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return zc.sample[:n], err
+}
+
+// returns zip method of file by its name and sample of its content
+func (zc *zipCompressor) getFileMethod(path string, sample []byte) (uint16, error) {
+	var method uint16
+	switch zc.compression.GetMethod() {
+	case CompressionStore:
+		return zip.Store, nil
+	case CompressionDeflate:
+		method = zip.Deflate
+	case CompressionZstd:
+		method = ZipZstdMethod
+	}
+	if incompressibleExts[strings.ToLower(filepath.Ext(path))] {
+		return zip.Store, nil
+	}
+	if len(sample) < compressionMinSample {
+		return method, nil
+	}
+
+	if zc.sampleWriter == nil {
+		zc.sampleCounter = &countingWriter{w: io.Discard}
+		var err error
+		if zc.sampleWriter, err = flate.NewWriter(zc.sampleCounter, flate.HuffmanOnly); err != nil {
+			return 0, err
+		}
+	} else {
+		zc.sampleCounter.n = 0
+		zc.sampleWriter.Reset(zc.sampleCounter)
+	}
+	if _, err := zc.sampleWriter.Write(sample); err != nil {
+		return 0, err
+	}
+	if err := zc.sampleWriter.Close(); err != nil {
+		return 0, err
+	}
+	if float64(zc.sampleCounter.n) > float64(len(sample))*compressionMaxRatio {
+		return zip.Store, nil
+	}
+	return method, nil
+}
+
+// zstd entries are read by any zip reader of the app, e.g. by restore and verify
+func init() {
+	zip.RegisterDecompressor(ZipZstdMethod, func(r io.Reader) io.ReadCloser {
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return io.NopCloser(errorReader{err: err})
+		}
+		return decoder.IOReadCloser()
+	})
+}
+
+type errorReader struct {
+	err error
+}
+
+func (er errorReader) Read(p []byte) (int, error) {
+	return 0, er.err
+}
@@ -5,13 +5,27 @@ package core_test
 import (
 	"github.com/n-boy/backuper/base"
 	"github.com/n-boy/backuper/core"
+	"github.com/n-boy/backuper/crypter"
+	"github.com/n-boy/backuper/storage"
+	"github.com/n-boy/backuper/storage/towebdav"
+	storageutils "github.com/n-boy/backuper/storage/utils"
 
 	"github.com/n-boy/backuper/ut/testutils"
 
 	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 var fileSize = 400 * 1024
@@ -33,12 +47,18 @@ func TestBROnePoint(t *testing.T) {
 		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
 	}
 
-	err = plan.DoBackup()
+	backupResult, err := plan.DoBackup(context.Background())
 	if err != nil {
 		t.Fatalf("Test died. Error while backuping files: %v\n", err)
 	}
+	if len(backupResult.Archives) != 1 || backupResult.BytesUploaded == 0 {
+		t.Errorf("Test failed. Backup result not as expected: %+v\n", backupResult)
+	}
 
-	points := plan.GetRestorePoints([]string{tfs.DataPath()})
+	points, err := plan.GetRestorePoints([]string{tfs.DataPath()})
+	if err != nil {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
 	if len(points) == 0 {
 		t.Fatalf("Test died. No restore points founded\n")
 	}
@@ -52,7 +72,7 @@ func TestBROnePoint(t *testing.T) {
 		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
 	}
 
-	err = plan.DoRestore()
+	_, err = plan.DoRestore(context.Background())
 	if err != nil {
 		t.Fatalf("Test died. Error while restoring files: %v\n", err)
 	}
@@ -85,7 +105,7 @@ func TestBRFewPointsRestoreFirst(t *testing.T) {
 		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
 	}
 
-	err = plan.DoBackup()
+	_, err = plan.DoBackup(context.Background())
 	if err != nil {
 		t.Fatalf("Test died. Error while backuping files: %v\n", err)
 	}
@@ -104,12 +124,15 @@ func TestBRFewPointsRestoreFirst(t *testing.T) {
 		t.Fatalf("Test died. Error while modifying filesystem: %v\n", err)
 	}
 
-	err = plan.DoBackup()
+	_, err = plan.DoBackup(context.Background())
 	if err != nil {
 		t.Fatalf("Test died. Error while backuping files: %v\n", err)
 	}
 
-	points := plan.GetRestorePoints([]string{tfs.DataPath()})
+	points, err := plan.GetRestorePoints([]string{tfs.DataPath()})
+	if err != nil {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
 	if len(points) == 0 {
 		t.Fatalf("Test died. No restore points founded\n")
 	}
@@ -122,7 +145,7 @@ func TestBRFewPointsRestoreFirst(t *testing.T) {
 		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
 	}
 
-	err = plan.DoRestore()
+	_, err = plan.DoRestore(context.Background())
 	if err != nil {
 		t.Fatalf("Test died. Error while restoring files: %v\n", err)
 	}
@@ -160,7 +183,7 @@ func TestBRFewPointsRestoreLast(t *testing.T) {
 		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
 	}
 
-	err = plan.DoBackup()
+	_, err = plan.DoBackup(context.Background())
 	if err != nil {
 		t.Fatalf("Test died. Error while backuping files: %v\n", err)
 	}
@@ -174,12 +197,15 @@ func TestBRFewPointsRestoreLast(t *testing.T) {
 		t.Fatalf("Test died. Error while modifying filesystem: %v\n", err)
 	}
 
-	err = plan.DoBackup()
+	_, err = plan.DoBackup(context.Background())
 	if err != nil {
 		t.Fatalf("Test died. Error while backuping files: %v\n", err)
 	}
 
-	points := plan.GetRestorePoints([]string{tfs.DataPath()})
+	points, err := plan.GetRestorePoints([]string{tfs.DataPath()})
+	if err != nil {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
 	if len(points) == 0 {
 		t.Fatalf("Test died. No restore points founded\n")
 	}
@@ -192,7 +218,7 @@ func TestBRFewPointsRestoreLast(t *testing.T) {
 		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
 	}
 
-	err = plan.DoRestore()
+	_, err = plan.DoRestore(context.Background())
 	if err != nil {
 		t.Fatalf("Test died. Error while restoring files: %v\n", err)
 	}
@@ -228,7 +254,7 @@ func TestBRFewPointsRestoreLastEncrypted(t *testing.T) {
 	plan.Encrypt = true
 	plan.Encrypt_passphrase = "encryptpassphrasefortest1"
 
-	err = plan.DoBackup()
+	_, err = plan.DoBackup(context.Background())
 	if err != nil {
 		t.Fatalf("Test died. Error while backuping files: %v\n", err)
 	}
@@ -270,12 +296,15 @@ func TestBRFewPointsRestoreLastEncrypted(t *testing.T) {
 		t.Fatalf("Test died. Error while modifying filesystem: %v\n", err)
 	}
 
-	err = plan.DoBackup()
+	_, err = plan.DoBackup(context.Background())
 	if err != nil {
 		t.Fatalf("Test died. Error while backuping files: %v\n", err)
 	}
 
-	points := plan.GetRestorePoints([]string{tfs.DataPath()})
+	points, err := plan.GetRestorePoints([]string{tfs.DataPath()})
+	if err != nil {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
 	if len(points) == 0 {
 		t.Fatalf("Test died. No restore points founded\n")
 	}
@@ -288,7 +317,7 @@ func TestBRFewPointsRestoreLastEncrypted(t *testing.T) {
 		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
 	}
 
-	err = plan.DoRestore()
+	_, err = plan.DoRestore(context.Background())
 	if err != nil {
 		t.Fatalf("Test died. Error while restoring files: %v\n", err)
 	}
@@ -326,12 +355,15 @@ func TestBROnePointFewBackupPathes(t *testing.T) {
 		t.Fatalf("Test died. Error while saving plan: %v", err)
 	}
 
-	err = plan.DoBackup()
+	_, err = plan.DoBackup(context.Background())
 	if err != nil {
 		t.Fatalf("Test died. Error while backuping files: %v\n", err)
 	}
 
-	points := plan.GetRestorePoints([]string{tfs.DataPath()})
+	points, err := plan.GetRestorePoints([]string{tfs.DataPath()})
+	if err != nil {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
 	if len(points) == 0 {
 		t.Fatalf("Test died. No restore points founded\n")
 	}
@@ -346,7 +378,7 @@ func TestBROnePointFewBackupPathes(t *testing.T) {
 		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
 	}
 
-	err = plan.DoRestore()
+	_, err = plan.DoRestore(context.Background())
 	if err != nil {
 		t.Fatalf("Test died. Error while restoring files: %v\n", err)
 	}
@@ -394,7 +426,7 @@ func checkSyncMeta(t *testing.T, encrypted bool) {
 		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
 	}
 
-	err = plan.DoBackup()
+	_, err = plan.DoBackup(context.Background())
 	if err != nil {
 		t.Fatalf("Test died. Error while backuping files: %v\n", err)
 	}
@@ -408,7 +440,7 @@ func checkSyncMeta(t *testing.T, encrypted bool) {
 		t.Fatalf("Test died. Error while modifying filesystem: %v\n", err)
 	}
 
-	err = plan.DoBackup()
+	_, err = plan.DoBackup(context.Background())
 	if err != nil {
 		t.Fatalf("Test died. Error while backuping files: %v\n", err)
 	}
@@ -432,10 +464,14 @@ func checkSyncMeta(t *testing.T, encrypted bool) {
 		}
 	}
 
-	err = plan.SyncMeta(false)
+	syncResult, err := plan.SyncMeta(context.Background(), false)
 	if err != nil {
 		t.Fatalf("Test died. Error while synchronizing metafiles from remote to local storage: %v\n", err)
 	}
+	if len(syncResult.MetaFiles) != pointsQty {
+		t.Errorf("Test failed. Qty of metafiles downloaded by sync not as expected: got %v, expected %v\n",
+			len(syncResult.MetaFiles), pointsQty)
+	}
 
 	planPathSnapshot2, err2 := testutils.GetDirNodes(core.GetPlanDir(plan.Name))
 	if err2 != nil {
@@ -468,25 +504,1732 @@ func checkSyncMeta(t *testing.T, encrypted bool) {
 	}
 }
 
-func InitTfsAndPlan(t *testing.T) (tfs testutils.TestFileSystem, plan core.BackupPlan) {
-	tfs = testutils.CreateTestFileSystem()
-	t.Logf("Test file system created with base path: %v\n", tfs.BasePath())
+// passphrase is changed between two iterations, then everything is restored on "another machine"
+func TestChangePassphrase(t *testing.T) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
 
-	base.InitApp(base.AppConfig{
-		AppDir:         tfs.AppPath(),
-		LogToStdout:    false,
-		LogErrToStderr: false,
+	plan.Encrypt = true
+	plan.Encrypt_passphrase = "encryptpassphrasefortest1"
+
+	err := tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/file1.txt",
+			"dir1/file2.txt",
+			"dir3",
+		},
 	})
-	plan = testutils.CreateTestPlan(tfs, chunkSize)
-	tfs.SetFileSize(fileSize)
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
 
-	return
+	_, err = plan.DoBackup(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+	if !plan.IsMasterKeyExists() {
+		t.Fatalf("Test died. Master key is not created by backup\n")
+	}
+
+	oldPlan := plan
+	newPassphrase := "encryptpassphrasefortest2"
+	err = plan.ChangePassphrase(context.Background(), newPassphrase)
+	if err != nil {
+		t.Fatalf("Test died. Error while changing passphrase: %v\n", err)
+	}
+	if _, err = oldPlan.GetMasterKey(); err == nil {
+		t.Errorf("Test failed. Master key unwrapped with old passphrase\n")
+	}
+	savedPlan, err := core.GetBackupPlan(plan.Name)
+	if err != nil {
+		t.Fatalf("Test died. Error while loading plan: %v\n", err)
+	}
+	if savedPlan.Encrypt_passphrase != newPassphrase {
+		t.Errorf("Test failed. New passphrase is not saved in plan\n")
+	}
+
+	err = tfs.ApplyCmds(testutils.CmdsToApply{
+		"modify": {
+			"dir1/file1.txt",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while modifying filesystem: %v\n", err)
+	}
+
+	_, err = plan.DoBackup(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+
+	storagePathSnapshot, err1 := testutils.GetDirNodes(tfs.StoragePath())
+	if err1 != nil {
+		t.Fatalf("Test died. Error while taking snapshot of storage path: %v\n", err1)
+	}
+	keyFilesQty := 0
+	for p, _ := range storagePathSnapshot {
+		if core.GetMasterKeyRemoteFileNameRE().MatchString(p) {
+			keyFilesQty++
+		}
+	}
+	if keyFilesQty != 1 {
+		t.Errorf("Test failed. Qty of master key files in storage not as expected: got %v, expected %v\n", keyFilesQty, 1)
+	}
+
+	// local plan dir is lost, only passphrase is known
+	planPathSnapshot, err2 := testutils.GetDirNodes(core.GetPlanDir(plan.Name))
+	if err2 != nil {
+		t.Fatalf("Test died. Error while taking plan path snapshot: %v\n", err2)
+	}
+	for p, node := range planPathSnapshot {
+		if core.GetMetaFileNameRE().MatchString(p) || strings.HasPrefix(p, "master_key") {
+			if err = os.Remove(node.GetNodePath()); err != nil {
+				t.Fatalf("Test died. Error while deleting local plan files: %v\n", err)
+			}
+		}
+	}
+
+	_, err = plan.SyncMeta(context.Background(), false)
+	if err != nil {
+		t.Fatalf("Test died. Error while synchronizing metafiles from remote to local storage: %v\n", err)
+	}
+	if !plan.IsMasterKeyExists() {
+		t.Fatalf("Test died. Master key is not synchronized from storage\n")
+	}
+
+	points, err := plan.GetRestorePoints([]string{tfs.DataPath()})
+	if err != nil {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
+	if len(points) != 2 {
+		t.Fatalf("Test died. Qty of restore points not as expected: got %v, expected %v\n", len(points), 2)
+	}
+	err = plan.InitRestore([]string{tfs.DataPath()}, &points[len(points)-1], tfs.RestorePath())
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
+	}
+	_, err = plan.DoRestore(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while restoring files: %v\n", err)
+	}
+
+	dataPathAfterRestore := filepath.Join(tfs.RestorePath(), core.GetPathInArchive(tfs.DataPath()))
+	cmpRes, err3 := testutils.CompareDirs(tfs.DataPath(), dataPathAfterRestore)
+	if err3 != nil {
+		t.Fatalf("Test died. Error while comparing directories: %v\n", err3)
+	}
+	if !cmpRes.Equals {
+		t.Errorf("Test failed. Restored dir content differs from source dir content:\n%s", cmpRes.String())
+	}
 }
 
-func leaveOnlyArchiveMetaFiles(nodesMap *map[string]core.NodeMetaInfo) {
-	for p, _ := range *nodesMap {
-		if !core.GetMetaFileNameRE().MatchString(p) {
-			delete(*nodesMap, p)
+// data is encrypted to public key, metafiles are synchronized and data is restored with private key only
+func TestBRPublicKey(t *testing.T) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
+
+	identity, recipient, err := crypter.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Test died. Error while generating key pair: %v\n", err)
+	}
+	plan.Encrypt = true
+	plan.Encrypt_recipients = []string{recipient}
+
+	err = tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/file1.txt",
+			"dir1/file2.txt",
+			"dir3",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+
+	_, err = plan.DoBackup(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+	if plan.IsMasterKeyExists() {
+		t.Errorf("Test failed. Master key is created for public key encryption\n")
+	}
+
+	planPathSnapshot, err1 := testutils.GetDirNodes(core.GetPlanDir(plan.Name))
+	if err1 != nil {
+		t.Fatalf("Test died. Error while taking plan path snapshot: %v\n", err1)
+	}
+	leaveOnlyArchiveMetaFiles(&planPathSnapshot)
+	for _, node := range planPathSnapshot {
+		if err = os.Remove(node.GetNodePath()); err != nil {
+			t.Fatalf("Test died. Error while deleting local meta files: %v\n", err)
+		}
+	}
+
+	_, err = plan.SyncMeta(context.Background(), false)
+	if err != crypter.ErrIdentityRequired {
+		t.Errorf("Test failed. Unexpected result of synchronizing metafiles without private key: %v\n", err)
+	}
+
+	plan.Decrypt_identity = identity
+	_, err = plan.SyncMeta(context.Background(), true)
+	if err != nil {
+		t.Fatalf("Test died. Error while synchronizing metafiles from remote to local storage: %v\n", err)
+	}
+
+	points, err := plan.GetRestorePoints([]string{tfs.DataPath()})
+	if err != nil {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
+	if len(points) != 1 {
+		t.Fatalf("Test died. Qty of restore points not as expected: got %v, expected %v\n", len(points), 1)
+	}
+	err = plan.InitRestore([]string{tfs.DataPath()}, &points[0], tfs.RestorePath())
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
+	}
+	_, err = plan.DoRestore(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while restoring files: %v\n", err)
+	}
+
+	dataPathAfterRestore := filepath.Join(tfs.RestorePath(), core.GetPathInArchive(tfs.DataPath()))
+	cmpRes, err3 := testutils.CompareDirs(tfs.DataPath(), dataPathAfterRestore)
+	if err3 != nil {
+		t.Fatalf("Test died. Error while comparing directories: %v\n", err3)
+	}
+	if !cmpRes.Equals {
+		t.Errorf("Test failed. Restored dir content differs from source dir content:\n%s", cmpRes.String())
+	}
+}
+
+// names in storage and in archives are obfuscated, metafiles are synchronized back under real names
+func TestBRObfuscateNames(t *testing.T) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
+
+	plan.Encrypt = true
+	plan.Encrypt_passphrase = "encryptpassphrasefortest1"
+	plan.Obfuscate_names = true
+
+	err := tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/file1.txt",
+			"dir1/file2.txt",
+			"dir3",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+
+	_, err = plan.DoBackup(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+
+	err = tfs.ApplyCmds(testutils.CmdsToApply{
+		"modify": {
+			"dir1/file1.txt",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while modifying filesystem: %v\n", err)
+	}
+
+	_, err = plan.DoBackup(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+
+	storagePathSnapshot, err1 := testutils.GetDirNodes(tfs.StoragePath())
+	if err1 != nil {
+		t.Fatalf("Test died. Error while taking snapshot of storage path: %v\n", err1)
+	}
+	obfuscatedMetaFilesQty := 0
+	for p, _ := range storagePathSnapshot {
+		if core.GetArchiveFileNameRE().MatchString(p) || core.GetMetaFileNameRE().MatchString(p) {
+			t.Errorf("Test failed. File with not obfuscated name is found in storage: %v\n", p)
+		}
+		if core.GetObfuscatedMetaFileNameRE().MatchString(p) {
+			obfuscatedMetaFilesQty++
+		}
+	}
+	if obfuscatedMetaFilesQty != 2 {
+		t.Errorf("Test failed. Qty of obfuscated metafiles in storage not as expected: got %v, expected %v\n",
+			obfuscatedMetaFilesQty, 2)
+	}
+
+	// zip entries are opaque ids
+	metaFiles, err := plan.GetMetaFiles()
+	if err != nil {
+		t.Fatalf("Test died. Error while reading metafiles: %v\n", err)
+	}
+	metaFile, err := plan.GetMetaFile(metaFiles[0])
+	if err != nil {
+		t.Fatalf("Test died. Error while reading metafile: %v\n", err)
+	}
+	archFilePath := filepath.Join(tfs.BasePath(), "archive.zip")
+	err = plan.DownloadAndDecryptFile(context.Background(), metaFile.GetStorageInfo(), archFilePath, true)
+	if err != nil {
+		t.Fatalf("Test died. Error while downloading archive: %v\n", err)
+	}
+	zipReader, err := zip.OpenReader(archFilePath)
+	if err != nil {
+		t.Fatalf("Test died. Error while opening archive: %v\n", err)
+	}
+	for _, f := range zipReader.File {
+		if strings.Contains(f.Name, "dir1") || strings.Contains(f.Name, "file") {
+			t.Errorf("Test failed. Path of file is found in archive: %v\n", f.Name)
+		}
+	}
+	zipReader.Close()
+
+	for _, metaFile := range metaFiles {
+		if err = os.Remove(filepath.Join(core.GetPlanDir(plan.Name), metaFile)); err != nil {
+			t.Fatalf("Test died. Error while deleting local meta files: %v\n", err)
 		}
 	}
+	_, err = plan.SyncMeta(context.Background(), false)
+	if err != nil {
+		t.Fatalf("Test died. Error while synchronizing metafiles from remote to local storage: %v\n", err)
+	}
+	syncedMetaFiles, err := plan.GetMetaFiles()
+	if err != nil {
+		t.Fatalf("Test died. Error while reading metafiles: %v\n", err)
+	}
+	if strings.Join(syncedMetaFiles, ",") != strings.Join(metaFiles, ",") {
+		t.Errorf("Test failed. Synchronized metafiles differ from source ones: got %v, expected %v\n",
+			syncedMetaFiles, metaFiles)
+	}
+
+	points, err := plan.GetRestorePoints([]string{tfs.DataPath()})
+	if err != nil {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
+	if len(points) != 2 {
+		t.Fatalf("Test died. Qty of restore points not as expected: got %v, expected %v\n", len(points), 2)
+	}
+	err = plan.InitRestore([]string{tfs.DataPath()}, &points[len(points)-1], tfs.RestorePath())
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
+	}
+	_, err = plan.DoRestore(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while restoring files: %v\n", err)
+	}
+
+	dataPathAfterRestore := filepath.Join(tfs.RestorePath(), core.GetPathInArchive(tfs.DataPath()))
+	cmpRes, err3 := testutils.CompareDirs(tfs.DataPath(), dataPathAfterRestore)
+	if err3 != nil {
+		t.Fatalf("Test died. Error while comparing directories: %v\n", err3)
+	}
+	if !cmpRes.Equals {
+		t.Errorf("Test failed. Restored dir content differs from source dir content:\n%s", cmpRes.String())
+	}
+}
+
+// two iterations with deduplication, second archive contains only new data
+func TestBRDedup(t *testing.T) {
+	checkBRDedup(t, false)
+}
+
+func TestBRDedupEncrypted(t *testing.T) {
+	checkBRDedup(t, true)
+}
+
+func checkBRDedup(t *testing.T, encrypted bool) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
+
+	plan.Dedup = true
+	if encrypted {
+		plan.Encrypt = true
+		plan.Encrypt_passphrase = "encryptpassphrasefortest1"
+	}
+
+	err := tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/file1.txt",
+			"dir1/file2.txt",
+			"dir3",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+
+	_, err = plan.DoBackup(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+	firstPoints, err := plan.GetRestorePoints([]string{tfs.DataPath()})
+	if err != nil {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
+	dataSnapshot, err := testutils.GetDirNodes(tfs.DataPath())
+	if err != nil {
+		t.Fatalf("Test died. Error while taking snapshot of data path: %v\n", err)
+	}
+
+	// copy of already backed up file should not be stored again
+	content, err := ioutil.ReadFile(filepath.Join(tfs.DataPath(), "dir1", "file1.txt"))
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(tfs.DataPath(), "dir1", "file1_copy.txt"), content, 0660)
+	}
+	if err != nil {
+		t.Fatalf("Test died. Error while copying file: %v\n", err)
+	}
+	err = tfs.ApplyCmds(testutils.CmdsToApply{
+		"modify": {
+			"dir1/file2.txt",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while modifying filesystem: %v\n", err)
+	}
+
+	_, err = plan.DoBackup(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+
+	points, err := plan.GetRestorePoints([]string{tfs.DataPath()})
+	if err != nil {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
+	if len(points) != len(firstPoints)+1 {
+		t.Fatalf("Test died. Qty of archives (restore points) in storage not as expected: got %v, expected %v\n",
+			len(points), len(firstPoints)+1)
+	}
+	lastPoint := points[len(points)-1]
+	if lastPoint.GetFormat() != core.PackArchiveFormat {
+		t.Errorf("Test failed. Archive format not as expected: got %v, expected %v\n",
+			lastPoint.GetFormat(), core.PackArchiveFormat)
+	}
+	// only modified file2 should be in the last pack
+	packSize := 0
+	for _, chunk := range lastPoint.GetPackChunks() {
+		packSize += int(chunk.Size())
+	}
+	if packSize > fileSize+1024 {
+		t.Errorf("Test failed. Size of deduplicated data in the last archive is too big: got %v, expected not more than %v\n",
+			packSize, fileSize+1024)
+	}
+
+	// restore the last point
+	err = plan.InitRestore([]string{tfs.DataPath()}, &lastPoint, tfs.RestorePath())
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
+	}
+	_, err = plan.DoRestore(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while restoring files: %v\n", err)
+	}
+
+	dataPathAfterRestore := filepath.Join(tfs.RestorePath(), core.GetPathInArchive(tfs.DataPath()))
+	cmpRes, err := testutils.CompareDirs(tfs.DataPath(), dataPathAfterRestore)
+	if err != nil {
+		t.Fatalf("Test died. Error while comparing directories: %v\n", err)
+	}
+	if !cmpRes.Equals {
+		t.Errorf("Test failed. Restored dir content differs from source dir (after second backup iteration) content:\n%s", cmpRes.String())
+	}
+
+	// restore the first point
+	if err = os.RemoveAll(tfs.RestorePath()); err == nil {
+		err = os.MkdirAll(tfs.RestorePath(), 0770)
+	}
+	if err != nil {
+		t.Fatalf("Test died. Error while cleaning restore path: %v\n", err)
+	}
+	err = plan.InitRestore([]string{tfs.DataPath()}, &firstPoints[len(firstPoints)-1], tfs.RestorePath())
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
+	}
+	_, err = plan.DoRestore(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while restoring files: %v\n", err)
+	}
+
+	restoreSnapshot, err := testutils.GetDirNodes(dataPathAfterRestore)
+	if err != nil {
+		t.Fatalf("Test died. Error while taking snapshot of restore path: %v\n", err)
+	}
+	cmpRes, err = testutils.CompareDirNodes(dataSnapshot, restoreSnapshot)
+	if err != nil {
+		t.Fatalf("Test died. Error while comparing directories: %v\n", err)
+	}
+	if !cmpRes.Equals {
+		t.Errorf("Test failed. Restored dir content differs from source dir (after first backup iteration) content:\n%s", cmpRes.String())
+	}
+}
+
+// verify archives in storage, then damage them and verify again
+func TestVerify(t *testing.T) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
+
+	err := tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/file1.txt",
+			"dir1/file2.txt",
+			"dir1/file3.txt",
+			"dir3",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+
+	_, err = plan.DoBackup(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+
+	report, err := plan.Verify(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Test died. Error while verifying archives: %v\n", err)
+	}
+	if !report.IsOk() {
+		t.Errorf("Test failed. Problems found in not damaged archives: %v\n", report.Problems)
+	}
+	metaFiles, err := plan.GetMetaFiles()
+	if err != nil {
+		t.Fatalf("Test died. Error while reading metafiles: %v\n", err)
+	}
+	if report.ArchivesChecked != len(metaFiles) {
+		t.Errorf("Test failed. Qty of checked archives not as expected: got %v, expected %v\n",
+			report.ArchivesChecked, len(metaFiles))
+	}
+
+	storageSnapshot, err := testutils.GetDirNodes(tfs.StoragePath())
+	if err != nil {
+		t.Fatalf("Test died. Error while taking snapshot of storage path: %v\n", err)
+	}
+	var archFileNames []string
+	for p := range storageSnapshot {
+		if core.GetArchiveFileNameRE().MatchString(p) {
+			archFileNames = append(archFileNames, p)
+		}
+	}
+	if len(archFileNames) < 2 {
+		t.Fatalf("Test died. Qty of archives in storage not as expected: got %v, expected at least 2\n", len(archFileNames))
+	}
+	sort.Strings(archFileNames)
+
+	// damage content of the first archive and delete the second one
+	archFilePath := filepath.Join(tfs.StoragePath(), archFileNames[0])
+	content, err := ioutil.ReadFile(archFilePath)
+	if err == nil {
+		for i := len(content) / 2; i < len(content)/2+100; i++ {
+			content[i] ^= 0xFF
+		}
+		err = ioutil.WriteFile(archFilePath, content, 0660)
+	}
+	if err == nil {
+		err = os.Remove(filepath.Join(tfs.StoragePath(), archFileNames[1]))
+	}
+	if err != nil {
+		t.Fatalf("Test died. Error while damaging archives: %v\n", err)
+	}
+
+	report, err = plan.Verify(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Test died. Error while verifying archives: %v\n", err)
+	}
+	if report.IsOk() {
+		t.Fatalf("Test failed. No problems found in damaged archives\n")
+	}
+	damagedFound, missedFound := false, false
+	for _, problem := range report.Problems {
+		if problem.Archive == archFileNames[0] && problem.Path != "" {
+			damagedFound = true
+		}
+		if problem.Archive == archFileNames[1] && problem.Path == "" {
+			missedFound = true
+		}
+	}
+	if !damagedFound {
+		t.Errorf("Test failed. Damaged file is not reported: %v\n", report.Problems)
+	}
+	if !missedFound {
+		t.Errorf("Test failed. Missed archive is not reported: %v\n", report.Problems)
+	}
+}
+
+// files vanished after listing and missing backup pathes are skipped, other files are backed up
+func TestBackupSkipsUnreadableFiles(t *testing.T) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
+
+	err := tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/file1.txt",
+			"dir1/file2.txt",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+
+	guardNodes, guardErrors := plan.GetGuardedNodes()
+	if len(guardErrors) != 0 {
+		t.Fatalf("Test died. Errors while listing files: %v\n", guardErrors)
+	}
+	err = tfs.ApplyCmds(testutils.CmdsToApply{
+		"delete": {
+			"dir1/file2.txt",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while modifying filesystem: %v\n", err)
+	}
+	nodesArch, nodesErr, err := core.ArchiveNodes(context.Background(), guardNodes, filepath.Join(tfs.BasePath(), "test.zip"), nil, core.Compression{}, nil)
+	if err != nil {
+		t.Fatalf("Test died. Error while archiving: %v\n", err)
+	}
+	if len(nodesErr) != 1 || filepath.Base(nodesErr[0].Path) != "file2.txt" {
+		t.Errorf("Test failed. Skipped files not as expected: %v\n", nodesErr)
+	}
+	if len(nodesArch) != len(guardNodes)-1 {
+		t.Errorf("Test failed. Qty of archived files not as expected: got %v, expected %v\n", len(nodesArch), len(guardNodes)-1)
+	}
+
+	missingPath := filepath.Join(tfs.BasePath(), "missing")
+	plan.NodesToArchive = append(plan.NodesToArchive, missingPath)
+	result, err := plan.DoBackup(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+	if len(result.Skipped) != 1 || result.Skipped[0].Path != missingPath {
+		t.Errorf("Test failed. Skipped files not as expected: %v\n", result.Skipped)
+	}
+	archNodesMap, err := plan.GetArchivedNodesMap()
+	if err != nil {
+		t.Fatalf("Test died. Error while reading archived nodes: %v\n", err)
+	}
+	if _, archived := archNodesMap[filepath.Join(tfs.DataPath(), "dir1", "file1.txt")]; !archived {
+		t.Errorf("Test failed. Readable file is not backed up\n")
+	}
+}
+
+// files are compressed by method of plan, incompressible ones are stored, archives of any method are restored
+func TestCompression(t *testing.T) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
+
+	err := tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/text.txt",
+			"dir1/photo.jpg",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+	randomData := make([]byte, fileSize)
+	if _, err = rand.Read(randomData); err != nil {
+		t.Fatalf("Test died. Error while generating random data: %v\n", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(tfs.DataPath(), "dir1", "random.bin"), randomData, 0644); err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+	guardNodes, guardErrors := plan.GetGuardedNodes()
+	if len(guardErrors) != 0 {
+		t.Fatalf("Test died. Errors while listing files: %v\n", guardErrors)
+	}
+
+	for _, invalid := range []core.Compression{{Method: "lzma"}, {Method: core.CompressionZstd, Level: 23}, {Method: core.CompressionStore, Level: 1}} {
+		if err = invalid.Check(); err == nil {
+			t.Errorf("Test failed. Invalid compression is accepted: %+v\n", invalid)
+		}
+	}
+
+	testCases := []struct {
+		compression core.Compression
+		textMethod  uint16
+	}{
+		{core.Compression{Method: core.CompressionStore}, zip.Store},
+		{core.Compression{}, zip.Deflate},
+		{core.Compression{Method: core.CompressionDeflate, Level: 9}, zip.Deflate},
+		{core.Compression{Method: core.CompressionZstd, Level: 19}, core.ZipZstdMethod},
+	}
+	for _, tc := range testCases {
+		archFilePath := filepath.Join(tfs.BasePath(), "test.zip")
+		nodesArch, _, err := core.ArchiveNodes(context.Background(), guardNodes, archFilePath, nil, tc.compression, nil)
+		if err != nil {
+			t.Fatalf("Test died. Compression: %v, error while archiving: %v\n", tc.compression, err)
+		}
+
+		zipReader, err := zip.OpenReader(archFilePath)
+		if err != nil {
+			t.Fatalf("Test died. Compression: %v, error while opening archive: %v\n", tc.compression, err)
+		}
+		expectedMethods := map[string]uint16{"text.txt": tc.textMethod, "photo.jpg": zip.Store, "random.bin": zip.Store}
+		for _, f := range zipReader.File {
+			if method, ok := expectedMethods[filepath.Base(f.Name)]; ok && f.Method != method {
+				t.Errorf("Test failed. Compression: %v, method of %v not as expected: got %v, expected %v\n",
+					tc.compression, filepath.Base(f.Name), f.Method, method)
+			}
+		}
+		zipReader.Close()
+
+		restorePath := filepath.Join(tfs.RestorePath(), tc.compression.String())
+		if _, err = core.UnarchiveNodes(archFilePath, nodesArch, restorePath); err != nil {
+			t.Fatalf("Test died. Compression: %v, error while unarchiving: %v\n", tc.compression, err)
+		}
+		cmpRes, err := testutils.CompareDirs(tfs.DataPath(), filepath.Join(restorePath, core.GetPathInArchive(tfs.DataPath())))
+		if err != nil {
+			t.Fatalf("Test died. Error while comparing directories: %v\n", err)
+		}
+		if !cmpRes.Equals {
+			t.Errorf("Test failed. Compression: %v, restored dir content differs from source dir content:\n%s", tc.compression, cmpRes.String())
+		}
+		if err = os.Remove(archFilePath); err != nil {
+			t.Fatalf("Test died. Error while removing archive: %v\n", err)
+		}
+	}
+}
+
+// tar archive keeps permissions, symlinks and hard links of files, file stored as hard link
+// is restored without its target file too
+func TestTarFormat(t *testing.T) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
+
+	err := tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/file1.txt",
+			"dir1/file2.txt",
+			"dir2/script.sh",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+	dataPath := tfs.DataPath()
+	modes := map[string]os.FileMode{"dir1/file1.txt": 0600, "dir2/script.sh": 0755}
+	for path, mode := range modes {
+		if err = os.Chmod(filepath.Join(dataPath, path), mode); err != nil {
+			t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+		}
+	}
+	if err = os.Symlink("../dir1/file2.txt", filepath.Join(dataPath, "dir2/symlink.txt")); err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+	if err = os.Link(filepath.Join(dataPath, "dir1/file1.txt"), filepath.Join(dataPath, "dir2/hardlink.txt")); err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+	// fraction of second is rounded up by tar writer, restored files get modification time kept in metafile
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 700000000, time.UTC)
+	modTimePaths := []string{"dir1/file1.txt", "dir1/file2.txt", "dir2/script.sh"}
+	for _, path := range modTimePaths {
+		if err = os.Chtimes(filepath.Join(dataPath, path), modTime, modTime); err != nil {
+			t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+		}
+	}
+
+	// hard links are kept within one archive only
+	plan.ChunkSize = 10 * chunkSize
+	plan.ArchiveFormat = core.TarArchiveFormat
+	plan.Compression = core.Compression{Method: core.CompressionZstd}
+	if _, err = plan.DoBackup(context.Background()); err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+	metaFiles, err := plan.GetMetaFiles()
+	if err != nil {
+		t.Fatalf("Test died. Error while reading metafiles: %v\n", err)
+	}
+	for _, metaFile := range metaFiles {
+		mf, err := plan.GetMetaFile(metaFile)
+		if err != nil {
+			t.Fatalf("Test died. Error while reading metafile: %v\n", err)
+		}
+		if mf.GetFormat() != core.TarZstdArchiveFormat {
+			t.Errorf("Test failed. Format of archive not as expected: got %v, expected %v\n", mf.GetFormat(), core.TarZstdArchiveFormat)
+		}
+	}
+
+	report, err := plan.Verify(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Test died. Error while verifying archives: %v\n", err)
+	}
+	if !report.IsOk() {
+		t.Errorf("Test failed. Problems found in not damaged archives: %v\n", report.Problems)
+	}
+
+	points, err := plan.GetRestorePoints([]string{dataPath})
+	if err != nil || len(points) == 0 {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
+	if err = plan.InitRestore([]string{dataPath}, &points[len(points)-1], tfs.RestorePath()); err != nil {
+		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
+	}
+	if _, err = plan.DoRestore(context.Background()); err != nil {
+		t.Fatalf("Test died. Error while restoring files: %v\n", err)
+	}
+	dataPathAfterRestore := filepath.Join(tfs.RestorePath(), core.GetPathInArchive(dataPath))
+	cmpRes, err := testutils.CompareDirs(dataPath, dataPathAfterRestore)
+	if err != nil {
+		t.Fatalf("Test died. Error while comparing directories: %v\n", err)
+	}
+	if !cmpRes.Equals {
+		t.Errorf("Test failed. Restored dir content differs from source dir content:\n%s", cmpRes.String())
+	}
+
+	for path, mode := range modes {
+		fInfo, err := os.Stat(filepath.Join(dataPathAfterRestore, path))
+		if err != nil {
+			t.Fatalf("Test died. Error while reading restored file: %v\n", err)
+		}
+		if fInfo.Mode().Perm() != mode {
+			t.Errorf("Test failed. Permissions of %v not as expected: got %v, expected %v\n", path, fInfo.Mode().Perm(), mode)
+		}
+	}
+	if linkTarget, err := os.Readlink(filepath.Join(dataPathAfterRestore, "dir2/symlink.txt")); err != nil || linkTarget != "../dir1/file2.txt" {
+		t.Errorf("Test failed. Symlink is not restored: target %v, error %v\n", linkTarget, err)
+	}
+	linkInfo, err := os.Stat(filepath.Join(dataPathAfterRestore, "dir2/hardlink.txt"))
+	if err != nil {
+		t.Fatalf("Test died. Error while reading restored file: %v\n", err)
+	}
+	fileInfo, err := os.Stat(filepath.Join(dataPathAfterRestore, "dir1/file1.txt"))
+	if err != nil {
+		t.Fatalf("Test died. Error while reading restored file: %v\n", err)
+	}
+	if !os.SameFile(linkInfo, fileInfo) {
+		t.Errorf("Test failed. Hard link is restored as separate file\n")
+	}
+	for _, path := range modTimePaths {
+		fInfo, err := os.Stat(filepath.Join(dataPathAfterRestore, path))
+		if err != nil {
+			t.Fatalf("Test died. Error while reading restored file: %v\n", err)
+		}
+		if !fInfo.ModTime().Equal(modTime.Truncate(time.Second)) {
+			t.Errorf("Test failed. Modification time of %v not as expected: got %v, expected %v\n",
+				path, fInfo.ModTime(), modTime.Truncate(time.Second))
+		}
+	}
+
+	// the same restore run again into the same target skips files restored already
+	if err = plan.InitRestore([]string{dataPath}, &points[len(points)-1], tfs.RestorePath()); err != nil {
+		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
+	}
+	if _, err = plan.DoRestore(context.Background()); err != nil {
+		t.Errorf("Test failed. Error while restoring files again into the same target: %v\n", err)
+	}
+
+	linkPath := filepath.Join(dataPath, "dir2/hardlink.txt")
+	restorePath := filepath.Join(tfs.RestorePath(), "link_only")
+	if err = os.Mkdir(restorePath, 0755); err != nil {
+		t.Fatalf("Test died. Error while creating dir: %v\n", err)
+	}
+	if err = plan.InitRestore([]string{linkPath}, &points[len(points)-1], restorePath); err != nil {
+		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
+	}
+	if _, err = plan.DoRestore(context.Background()); err != nil {
+		t.Fatalf("Test died. Error while restoring files: %v\n", err)
+	}
+	expected, err := ioutil.ReadFile(linkPath)
+	if err != nil {
+		t.Fatalf("Test died. Error while reading file: %v\n", err)
+	}
+	restored, err := ioutil.ReadFile(filepath.Join(restorePath, core.GetPathInArchive(linkPath)))
+	if err != nil {
+		t.Fatalf("Test died. Error while reading restored file: %v\n", err)
+	}
+	if !bytes.Equal(restored, expected) {
+		t.Errorf("Test failed. Content of hard link restored without its target differs from source file\n")
+	}
+}
+
+// canceled backup leaves no partly created archive, and the next run backs up all files
+func TestBackupCanceled(t *testing.T) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
+
+	err := tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/file1.txt",
+			"dir1/file2.txt",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	guardNodes, _ := plan.GetGuardedNodes()
+	archFilePath := filepath.Join(tfs.BasePath(), "test.zip")
+	if _, _, err = core.ArchiveNodes(ctx, guardNodes, archFilePath, nil, core.Compression{}, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Test failed. Archiving is not canceled, error: %v\n", err)
+	}
+	if _, err = os.Stat(archFilePath); !os.IsNotExist(err) {
+		t.Errorf("Test failed. Partly created archive is not removed, stat error: %v\n", err)
+	}
+
+	if _, err = plan.DoBackup(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Test failed. Backup is not canceled, error: %v\n", err)
+	}
+	metaFiles, err := plan.GetMetaFiles()
+	if err != nil {
+		t.Fatalf("Test died. Error while reading metafiles: %v\n", err)
+	}
+	if len(metaFiles) != 0 {
+		t.Errorf("Test failed. Metafiles are created by canceled backup: %v\n", metaFiles)
+	}
+
+	result, err := plan.DoBackup(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+	if result.FilesArchived != len(guardNodes) {
+		t.Errorf("Test failed. Qty of archived files not as expected: got %v, expected %v\n", result.FilesArchived, len(guardNodes))
+	}
+}
+
+// archive missing in tmp dir is dropped with its metafile and upload state kept by storage
+func TestBackupDropsMissingArchive(t *testing.T) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
+
+	err := tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/file1.txt",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+
+	origStorage := plan.Storage
+	plan.Storage = &metaUploadFailStorage{GenericStorage: origStorage}
+	if _, err = plan.DoBackup(context.Background()); err == nil {
+		t.Fatalf("Test died. Backup is not failed\n")
+	}
+	tmpArchives, err := filepath.Glob(filepath.Join(plan.TmpDir, "archive_*.zip"))
+	if err != nil || len(tmpArchives) != 1 {
+		t.Fatalf("Test died. Archive is not left in tmp dir: %v, error: %v\n", tmpArchives, err)
+	}
+	statePath := tmpArchives[0] + ".glacier_region_vault.upload"
+	if err = os.WriteFile(statePath, []byte("{}"), 0600); err != nil {
+		t.Fatalf("Test died. Error while creating upload state file: %v\n", err)
+	}
+	if err = os.Remove(tmpArchives[0]); err != nil {
+		t.Fatalf("Test died. Error while removing archive: %v\n", err)
+	}
+
+	plan.Storage = origStorage
+	if _, err = plan.DoBackup(context.Background()); err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+	if _, err = os.Stat(statePath); !os.IsNotExist(err) {
+		t.Errorf("Test failed. Upload state of dropped archive is not removed, stat error: %v\n", err)
+	}
+	if tmpFiles, _ := filepath.Glob(filepath.Join(plan.TmpDir, "*")); len(tmpFiles) != 0 {
+		t.Errorf("Test failed. Files are left in tmp dir: %v\n", tmpFiles)
+	}
+}
+
+// canceled restore releases its lock, and the same restore initialized again restores all files
+func TestRestoreCanceled(t *testing.T) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
+
+	err := tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/file1.txt",
+			"dir1/file2.txt",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+	if _, err = plan.DoBackup(context.Background()); err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+	points, err := plan.GetRestorePoints([]string{tfs.DataPath()})
+	if err != nil || len(points) == 0 {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = plan.InitRestore([]string{tfs.DataPath()}, &points[len(points)-1], tfs.RestorePath()); err != nil {
+		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
+	}
+	if _, err = plan.DoRestore(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Test failed. Restore is not canceled, error: %v\n", err)
+	}
+	if plan.CheckOpLocked("restore") {
+		t.Errorf("Test failed. Restore lock is kept by canceled restore\n")
+	}
+
+	if err = plan.InitRestore([]string{tfs.DataPath()}, &points[len(points)-1], tfs.RestorePath()); err != nil {
+		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
+	}
+	if _, err = plan.DoRestore(context.Background()); err != nil {
+		t.Fatalf("Test died. Error while restoring files: %v\n", err)
+	}
+	cmpRes, err := testutils.CompareDirs(tfs.DataPath(), filepath.Join(tfs.RestorePath(), core.GetPathInArchive(tfs.DataPath())))
+	if err != nil {
+		t.Fatalf("Test died. Error while comparing directories: %v\n", err)
+	}
+	if !cmpRes.Equals {
+		t.Errorf("Test failed. Restored dir content differs from source dir content:\n%s", cmpRes.String())
+	}
+}
+
+// three iterations, the second archive holds only revision not needed by retention policy
+func TestPrune(t *testing.T) {
+	checkPrune(t, false, false, false)
+}
+
+func TestPruneDedup(t *testing.T) {
+	checkPrune(t, true, false, false)
+}
+
+// the same, and the first archive with superseded revision of file is repacked
+func TestPruneRepack(t *testing.T) {
+	checkPrune(t, false, true, false)
+}
+
+func TestPruneRepackEncrypted(t *testing.T) {
+	checkPrune(t, false, true, true)
+}
+
+// repacked archive is deleted from storage, if its metafile fails to upload, and storage keeps metafile of source archive
+func TestPruneRepackFailed(t *testing.T) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
+
+	plan.Retention.KeepLast = 1
+	plan.Retention.RepackThresholdPct = 90
+	err := tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/file1.txt",
+			"dir1/file2.txt",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			if err = tfs.ApplyCmds(testutils.CmdsToApply{"modify": {"dir1/file1.txt"}}); err != nil {
+				t.Fatalf("Test died. Error while modifying filesystem: %v\n", err)
+			}
+		}
+		if _, err = plan.DoBackup(context.Background()); err != nil {
+			t.Fatalf("Test died. Error while backuping files: %v\n", err)
+		}
+	}
+	metaFiles, err := plan.GetMetaFiles()
+	if err != nil {
+		t.Fatalf("Test died. Error while reading metafiles: %v\n", err)
+	}
+	storageBefore, err := testutils.GetDirNodes(tfs.StoragePath())
+	if err != nil {
+		t.Fatalf("Test died. Error while taking snapshot of storage path: %v\n", err)
+	}
+
+	origStorage := plan.Storage
+	plan.Storage = &metaUploadFailStorage{GenericStorage: origStorage}
+	if _, err = plan.DoPrune(context.Background()); err == nil {
+		t.Fatalf("Test died. Prune is not failed\n")
+	}
+	storageAfter, err := testutils.GetDirNodes(tfs.StoragePath())
+	if err != nil {
+		t.Fatalf("Test died. Error while taking snapshot of storage path: %v\n", err)
+	}
+	if len(storageAfter) != len(storageBefore) {
+		t.Errorf("Test failed. Files in storage after failed repack not as expected: got %v, expected %v\n",
+			len(storageAfter), len(storageBefore))
+	}
+	for p := range storageBefore {
+		if _, exists := storageAfter[p]; !exists {
+			t.Errorf("Test failed. File is deleted from storage by failed repack: %v\n", p)
+		}
+	}
+
+	plan.Storage = origStorage
+	result, err := plan.DoPrune(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while pruning archives: %v\n", err)
+	}
+	if len(result.Repacked) != 1 || result.Repacked[0] != metaFiles[0] {
+		t.Errorf("Test failed. Repacked archives not as expected: got %v, expected %v\n", result.Repacked, metaFiles[0:1])
+	}
+}
+
+// fails upload of metafiles with permanent error
+type metaUploadFailStorage struct {
+	storage.GenericStorage
+}
+
+func (ms *metaUploadFailStorage) UploadFile(ctx context.Context, filePath string, remoteFileName string) (map[string]string, error) {
+	if core.GetMetaFileNameRE().MatchString(filepath.Base(filePath)) {
+		return nil, fmt.Errorf("metafile upload is denied")
+	}
+	return ms.GenericStorage.UploadFile(ctx, filePath, remoteFileName)
+}
+
+func checkPrune(t *testing.T, dedup bool, repack bool, encrypted bool) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
+
+	if encrypted {
+		plan.Encrypt = true
+		plan.Encrypt_passphrase = "encryptpassphrasefortest1"
+	}
+	plan.Dedup = dedup
+	plan.Retention.KeepLast = 1
+	if repack {
+		plan.Retention.RepackThresholdPct = 90
+	}
+
+	err := tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/file1.txt",
+			"dir1/file2.txt",
+			"dir3",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			err = tfs.ApplyCmds(testutils.CmdsToApply{
+				"modify": {
+					"dir1/file1.txt",
+				},
+			})
+			if err != nil {
+				t.Fatalf("Test died. Error while modifying filesystem: %v\n", err)
+			}
+		}
+		_, err = plan.DoBackup(context.Background())
+		if err != nil {
+			t.Fatalf("Test died. Error while backuping files: %v\n", err)
+		}
+	}
+
+	metaFiles, err := plan.GetMetaFiles()
+	if err != nil {
+		t.Fatalf("Test died. Error while reading metafiles: %v\n", err)
+	}
+	if len(metaFiles) != 3 {
+		t.Fatalf("Test died. Qty of archives in storage not as expected: got %v, expected %v\n", len(metaFiles), 3)
+	}
+
+	result, err := plan.DoPrune(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while pruning archives: %v\n", err)
+	}
+	if len(result.Deleted) != 1 || result.Deleted[0] != metaFiles[1] {
+		t.Errorf("Test failed. Pruned archives not as expected: got %v, expected %v\n", result.Deleted, metaFiles[1:2])
+	}
+	expectedRepacked := core.MetafileList{}
+	if repack {
+		expectedRepacked = metaFiles[0:1]
+	}
+	if len(result.Repacked) != len(expectedRepacked) || (len(expectedRepacked) > 0 && result.Repacked[0] != expectedRepacked[0]) {
+		t.Errorf("Test failed. Repacked archives not as expected: got %v, expected %v\n", result.Repacked, expectedRepacked)
+	}
+	if repack {
+		metaFile, err := plan.GetMetaFile(metaFiles[0])
+		if err != nil {
+			t.Fatalf("Test died. Error while reading metafile: %v\n", err)
+		}
+		for _, node := range metaFile.GetNodes() {
+			if filepath.Base(node.GetNodePath()) == "file1.txt" {
+				t.Errorf("Test failed. Superseded revision remains in repacked archive: %v\n", node.GetNodePath())
+			}
+		}
+	}
+
+	storageSnapshot, err := testutils.GetDirNodes(tfs.StoragePath())
+	if err != nil {
+		t.Fatalf("Test died. Error while taking snapshot of storage path: %v\n", err)
+	}
+	for p := range storageSnapshot {
+		if strings.HasPrefix(filepath.Base(p), core.GetArchName(metaFiles[1])) {
+			t.Errorf("Test failed. File of pruned archive remains in storage: %v\n", p)
+		}
+	}
+
+	points, err := plan.GetRestorePoints([]string{tfs.DataPath()})
+	if err != nil {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
+	if len(points) != 2 {
+		t.Fatalf("Test died. Qty of restore points not as expected: got %v, expected %v\n", len(points), 2)
+	}
+	err = plan.InitRestore([]string{tfs.DataPath()}, &points[len(points)-1], tfs.RestorePath())
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
+	}
+	_, err = plan.DoRestore(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while restoring files: %v\n", err)
+	}
+
+	dataPathAfterRestore := filepath.Join(tfs.RestorePath(), core.GetPathInArchive(tfs.DataPath()))
+	cmpRes, err := testutils.CompareDirs(tfs.DataPath(), dataPathAfterRestore)
+	if err != nil {
+		t.Fatalf("Test died. Error while comparing directories: %v\n", err)
+	}
+	if !cmpRes.Equals {
+		t.Errorf("Test failed. Restored dir content differs from source dir content:\n%s", cmpRes.String())
+	}
+}
+
+func InitTfsAndPlan(t *testing.T) (tfs testutils.TestFileSystem, plan core.BackupPlan) {
+	tfs = testutils.CreateTestFileSystem()
+	t.Logf("Test file system created with base path: %v\n", tfs.BasePath())
+
+	base.InitApp(base.AppConfig{
+		AppDir:         tfs.AppPath(),
+		LogToStdout:    false,
+		LogErrToStderr: false,
+	})
+	plan = testutils.CreateTestPlan(tfs, chunkSize)
+	tfs.SetFileSize(fileSize)
+
+	return
+}
+
+func leaveOnlyArchiveMetaFiles(nodesMap *map[string]core.NodeMetaInfo) {
+	for p, _ := range *nodesMap {
+		if !core.GetMetaFileNameRE().MatchString(p) {
+			delete(*nodesMap, p)
+		}
+	}
+}
+
+type eventsRecorder struct {
+	events []core.Event
+}
+
+func (er *eventsRecorder) OnEvent(event core.Event) {
+	er.events = append(er.events, event)
+}
+
+func (er *eventsRecorder) count(eventType core.EventType) (qty int) {
+	for _, event := range er.events {
+		if event.Type == eventType {
+			qty++
+		}
+	}
+	return
+}
+
+func TestBackupRestoreEvents(t *testing.T) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
+
+	err := tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/file1.txt",
+			"dir1/file2.txt",
+			"dir1/file3.txt",
+			"dir3",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+
+	recorder := &eventsRecorder{}
+	plan.Observer = recorder
+	backupResult, err := plan.DoBackup(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+
+	if len(recorder.events) == 0 || recorder.events[0].Type != core.EventScanStarted {
+		t.Fatalf("Test died. Backup is not started with scan event: %+v\n", recorder.events)
+	}
+	var scanned int
+	uploadedBytes := make(map[string]int64)
+	for _, event := range recorder.events {
+		switch event.Type {
+		case core.EventScanFinished:
+			scanned = event.Files
+		case core.EventBytesUploaded:
+			uploadedBytes[event.Archive] += event.Bytes
+			if event.TotalBytes > 0 && uploadedBytes[event.Archive] > event.TotalBytes {
+				t.Errorf("Test failed. Bytes uploaded exceed size of archive: %+v\n", event)
+			}
+		case core.EventArchiveUploaded:
+			if uploadedBytes[event.Archive] != event.Bytes {
+				t.Errorf("Test failed. Bytes uploaded not as expected for archive %v: got %v, expected %v\n",
+					event.Archive, uploadedBytes[event.Archive], event.Bytes)
+			}
+		}
+	}
+	if archived := recorder.count(core.EventFileArchived); archived != backupResult.FilesArchived || archived != scanned {
+		t.Errorf("Test failed. Qty of archived files events not as expected: got %v, scanned %v, archived %v\n",
+			archived, scanned, backupResult.FilesArchived)
+	}
+	if planned := recorder.count(core.EventChunkPlanned); planned != len(backupResult.Archives) {
+		t.Errorf("Test failed. Qty of planned chunks not as expected: got %v, expected %v\n", planned, len(backupResult.Archives))
+	}
+	if uploaded := recorder.count(core.EventArchiveUploaded); uploaded != len(backupResult.Archives) {
+		t.Errorf("Test failed. Qty of uploaded archives not as expected: got %v, expected %v\n", uploaded, len(backupResult.Archives))
+	}
+
+	points, err := plan.GetRestorePoints([]string{tfs.DataPath()})
+	if err != nil {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
+	err = plan.InitRestore([]string{tfs.DataPath()}, &points[len(points)-1], tfs.RestorePath())
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
+	}
+	recorder.events = nil
+	restoreResult, err := plan.DoRestore(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while restoring files: %v\n", err)
+	}
+	if len(recorder.events) == 0 || recorder.events[0].Type != core.EventRestoreStarted ||
+		recorder.events[0].Files != restoreResult.FilesRestored {
+		t.Fatalf("Test died. Restore is not started with event holding qty of files: %+v\n", recorder.events)
+	}
+	if restored := recorder.count(core.EventFileRestored); restored != restoreResult.FilesRestored {
+		t.Errorf("Test failed. Qty of restored files events not as expected: got %v, expected %v\n", restored, restoreResult.FilesRestored)
+	}
+}
+
+// counts archives in tmp dir on upload of each archive, could fail upload of the first archive
+// when the next ones are created
+type pipelineCheckStorage struct {
+	storage.GenericStorage
+	tmpDir        string
+	maxPending    int
+	failOnPending int
+}
+
+func (ps *pipelineCheckStorage) UploadFile(ctx context.Context, filePath string, remoteFileName string) (map[string]string, error) {
+	if !core.GetArchiveFileNameRE().MatchString(filepath.Base(filePath)) {
+		return ps.GenericStorage.UploadFile(ctx, filePath, remoteFileName)
+	}
+	for timeout := time.Now().Add(10 * time.Second); ; {
+		metaFiles, err := filepath.Glob(filepath.Join(ps.tmpDir, core.GetMetaFileGlobMask()))
+		if err != nil {
+			return nil, err
+		}
+		if len(metaFiles) > ps.maxPending {
+			ps.maxPending = len(metaFiles)
+		}
+		if ps.failOnPending == 0 {
+			break
+		} else if len(metaFiles) >= ps.failOnPending {
+			return nil, errors.New("upload failed")
+		} else if time.Now().After(timeout) {
+			return nil, errors.New("next archives are not created while archive is uploaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return ps.GenericStorage.UploadFile(ctx, filePath, remoteFileName)
+}
+
+func TestBackupPipeline(t *testing.T) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
+
+	err := tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/file1.txt",
+			"dir1/file2.txt",
+			"dir1/file3.txt",
+			"dir1/file4.txt",
+			"dir1/file5.txt",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+
+	// without tmp space limit archive is created only after the previous one is uploaded
+	originStorage := plan.Storage
+	checkStorage := &pipelineCheckStorage{GenericStorage: originStorage, tmpDir: plan.TmpDir}
+	plan.Storage = checkStorage
+	backupResult, err := plan.DoBackup(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+	if len(backupResult.Archives) < 2 || checkStorage.maxPending != 1 {
+		t.Errorf("Test failed. Archives are not created one by one: archives %v, max pending %v\n",
+			backupResult.Archives, checkStorage.maxPending)
+	}
+
+	// with tmp space limit archives are created while the first one is uploaded,
+	// upload fails and they are uploaded by the next run in order of creation
+	err = tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir2/file1.txt",
+			"dir2/file2.txt",
+			"dir2/file3.txt",
+			"dir2/file4.txt",
+			"dir2/file5.txt",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while changing filesystem: %v\n", err)
+	}
+	plan.TmpSpaceLimit = 100 * chunkSize
+	plan.Storage = &pipelineCheckStorage{GenericStorage: originStorage, tmpDir: plan.TmpDir, failOnPending: 2}
+	if _, err = plan.DoBackup(context.Background()); err == nil {
+		t.Fatalf("Test died. Backup is not failed\n")
+	}
+
+	plan.Storage = originStorage
+	backupResult, err = plan.DoBackup(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+	if len(backupResult.Archives) < 2 {
+		t.Errorf("Test failed. Archives left in tmp dir are not uploaded: %v\n", backupResult.Archives)
+	}
+	metaFiles, err := plan.GetMetaFiles()
+	if err != nil {
+		t.Fatalf("Test died. Error while reading metafiles: %v\n", err)
+	}
+	for i, metaFile := range metaFiles {
+		if !strings.HasPrefix(metaFile, fmt.Sprintf("archive_%v_", i+1)) {
+			t.Errorf("Test failed. Archives are not numbered in order of creation: %v\n", metaFiles)
+			break
+		}
+	}
+
+	points, err := plan.GetRestorePoints([]string{tfs.DataPath()})
+	if err != nil {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
+	err = plan.InitRestore([]string{tfs.DataPath()}, &points[len(points)-1], tfs.RestorePath())
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
+	}
+	if _, err = plan.DoRestore(context.Background()); err != nil {
+		t.Fatalf("Test died. Error while restoring files: %v\n", err)
+	}
+	cmpRes, err := testutils.CompareDirs(tfs.DataPath(), filepath.Join(tfs.RestorePath(), core.GetPathInArchive(tfs.DataPath())))
+	if err != nil {
+		t.Fatalf("Test died. Error while comparing directories: %v\n", err)
+	}
+	if !cmpRes.Equals {
+		t.Errorf("Test failed. Restored dir content differs from source dir content:\n%s", cmpRes.String())
+	}
+}
+
+// fails the first attempt of each request with err, file is partly uploaded or downloaded before failure
+type flakyStorage struct {
+	storage.GenericStorage
+	err   error
+	calls int
+}
+
+func (fs *flakyStorage) fail() bool {
+	fs.calls++
+	return fs.calls%2 == 1
+}
+
+func (fs *flakyStorage) UploadFile(ctx context.Context, filePath string, remoteFileName string) (map[string]string, error) {
+	if fs.fail() {
+		storageutils.ReportUploadProgress(ctx, 10)
+		return nil, fs.err
+	}
+	return fs.GenericStorage.UploadFile(ctx, filePath, remoteFileName)
+}
+
+func (fs *flakyStorage) DownloadFileToPipe(ctx context.Context, fileStorageId map[string]string, pipe io.Writer) error {
+	if fs.fail() {
+		pipe.Write([]byte("partly downloaded"))
+		return fs.err
+	}
+	return fs.GenericStorage.DownloadFileToPipe(ctx, fileStorageId, pipe)
+}
+
+func (fs *flakyStorage) GetFilesList(ctx context.Context) ([]base.GenericStorageFileInfo, error) {
+	if fs.fail() {
+		return nil, fs.err
+	}
+	return fs.GenericStorage.GetFilesList(ctx)
+}
+
+// checks that archive is not staged in tmp dir while it is streamed to storage,
+// the first stream fails with err after part of archive is sent
+type streamCheckStorage struct {
+	storage.GenericStorage
+	tmpDir  string
+	err     error
+	streams int
+	staged  []string
+}
+
+func (ss *streamCheckStorage) UploadStream(ctx context.Context, reader io.Reader, remoteFileName string) (map[string]string, error) {
+	ss.streams++
+	head := make([]byte, 1024)
+	n, err := io.ReadFull(reader, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	tmpFiles, err := ioutil.ReadDir(ss.tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range tmpFiles {
+		if core.GetArchiveFileNameRE().MatchString(fi.Name()) {
+			ss.staged = append(ss.staged, fi.Name())
+		}
+	}
+	if ss.streams == 1 {
+		storageutils.ReportUploadProgress(ctx, int64(n))
+		return nil, ss.err
+	}
+	return ss.GenericStorage.(storage.StreamingStorage).UploadStream(ctx, io.MultiReader(bytes.NewReader(head[:n]), reader), remoteFileName)
+}
+
+func TestBackupStreaming(t *testing.T) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
+
+	err := tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/file1.txt",
+			"dir1/file2.txt",
+			"dir1/file3.txt",
+			"dir1/file4.txt",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+
+	plan.Dedup = true
+	plan.Encrypt = true
+	plan.Encrypt_passphrase = "encryptpassphrasefortest1"
+	plan.Retry = core.RetryPolicy{Attempts: 2, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	originStorage := plan.Storage
+	checkStorage := &streamCheckStorage{GenericStorage: originStorage, tmpDir: plan.TmpDir,
+		err: &towebdav.StatusError{StatusCode: 503, Status: "503 Service Unavailable"}}
+	plan.Storage = checkStorage
+	recorder := &eventsRecorder{}
+	plan.Observer = recorder
+
+	backupResult, err := plan.DoBackup(context.Background())
+	if err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+	if checkStorage.streams != len(backupResult.Archives)+1 {
+		t.Errorf("Test failed. Archives are not streamed to storage: streams %v, archives %v\n",
+			checkStorage.streams, backupResult.Archives)
+	}
+	if len(checkStorage.staged) > 0 {
+		t.Errorf("Test failed. Archives are staged in tmp dir while they are streamed: %v\n", checkStorage.staged)
+	}
+	if archived := recorder.count(core.EventFileArchived); archived != backupResult.FilesArchived {
+		t.Errorf("Test failed. Files archived by repeated stream are counted twice: got %v, expected %v\n",
+			archived, backupResult.FilesArchived)
+	}
+	uploadedBytes := make(map[string]int64)
+	for _, event := range recorder.events {
+		if event.Type == core.EventBytesUploaded {
+			uploadedBytes[event.Archive] += event.Bytes
+		} else if event.Type == core.EventArchiveUploaded && uploadedBytes[event.Archive] != event.Bytes {
+			t.Errorf("Test failed. Bytes streamed not as expected for archive %v: got %v, expected %v\n",
+				event.Archive, uploadedBytes[event.Archive], event.Bytes)
+		}
+	}
+
+	plan.Storage = originStorage
+	points, err := plan.GetRestorePoints([]string{tfs.DataPath()})
+	if err != nil {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
+	err = plan.InitRestore([]string{tfs.DataPath()}, &points[len(points)-1], tfs.RestorePath())
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
+	}
+	if _, err = plan.DoRestore(context.Background()); err != nil {
+		t.Fatalf("Test died. Error while restoring files: %v\n", err)
+	}
+	cmpRes, err := testutils.CompareDirs(tfs.DataPath(), filepath.Join(tfs.RestorePath(), core.GetPathInArchive(tfs.DataPath())))
+	if err != nil {
+		t.Fatalf("Test died. Error while comparing directories: %v\n", err)
+	}
+	if !cmpRes.Equals {
+		t.Errorf("Test failed. Restored dir content differs from source dir content:\n%s", cmpRes.String())
+	}
+}
+
+func TestStorageRetry(t *testing.T) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
+
+	err := tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/file1.txt",
+			"dir1/file2.txt",
+			"dir1/file3.txt",
+			"dir3",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+
+	// each request fails with server error first and succeeds when it is repeated
+	plan.Encrypt = true
+	plan.Encrypt_passphrase = "encryptpassphrasefortest1"
+	plan.Retry = core.RetryPolicy{Attempts: 2, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	originStorage := plan.Storage
+	plan.Storage = &flakyStorage{GenericStorage: originStorage, err: &towebdav.StatusError{StatusCode: 503, Status: "503 Service Unavailable"}}
+	recorder := &eventsRecorder{}
+	plan.Observer = recorder
+
+	if _, err = plan.DoBackup(context.Background()); err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+	if recorder.count(core.EventStorageRetry) == 0 {
+		t.Errorf("Test failed. Failed requests are not repeated\n")
+	}
+	uploadedBytes := make(map[string]int64)
+	for _, event := range recorder.events {
+		if event.Type == core.EventBytesUploaded {
+			uploadedBytes[event.Archive] += event.Bytes
+		} else if event.Type == core.EventArchiveUploaded && uploadedBytes[event.Archive] != event.Bytes {
+			t.Errorf("Test failed. Bytes uploaded by repeated requests not as expected for archive %v: got %v, expected %v\n",
+				event.Archive, uploadedBytes[event.Archive], event.Bytes)
+		}
+	}
+
+	if err = plan.CleanLocalMeta(); err != nil {
+		t.Fatalf("Test died. Error while deleting local meta files: %v\n", err)
+	}
+	if _, err = plan.SyncMeta(context.Background(), false); err != nil {
+		t.Fatalf("Test died. Error while synchronizing metafiles: %v\n", err)
+	}
+
+	points, err := plan.GetRestorePoints([]string{tfs.DataPath()})
+	if err != nil {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
+	err = plan.InitRestore([]string{tfs.DataPath()}, &points[len(points)-1], tfs.RestorePath())
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
+	}
+	if _, err = plan.DoRestore(context.Background()); err != nil {
+		t.Fatalf("Test died. Error while restoring files: %v\n", err)
+	}
+	cmpRes, err := testutils.CompareDirs(tfs.DataPath(), filepath.Join(tfs.RestorePath(), core.GetPathInArchive(tfs.DataPath())))
+	if err != nil {
+		t.Fatalf("Test died. Error while comparing directories: %v\n", err)
+	}
+	if !cmpRes.Equals {
+		t.Errorf("Test failed. Restored dir content differs from source dir content:\n%s", cmpRes.String())
+	}
+
+	// permanent error is not repeated
+	err = tfs.ApplyCmds(testutils.CmdsToApply{
+		"modify": {
+			"dir1/file1.txt",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while modifying filesystem: %v\n", err)
+	}
+	flaky := &flakyStorage{GenericStorage: originStorage, err: &towebdav.StatusError{StatusCode: 403, Status: "403 Forbidden"}}
+	plan.Storage = flaky
+	if _, err = plan.DoBackup(context.Background()); err == nil {
+		t.Fatalf("Test died. Backup is not failed\n")
+	}
+	if flaky.calls != 1 {
+		t.Errorf("Test failed. Request failed with permanent error is repeated: %v calls\n", flaky.calls)
+	}
+}
+
+func TestBandwidthLimits(t *testing.T) {
+	tfs, plan := InitTfsAndPlan(t)
+	defer tfs.Destroy()
+
+	err := tfs.ApplyCmds(testutils.CmdsToApply{
+		"create": {
+			"dir1/file1.txt",
+			"dir1/file2.txt",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing filesystem: %v\n", err)
+	}
+
+	// backup is paused outside of upload window, till it is canceled
+	closedHour := (time.Now().Hour() + 2) % 24
+	window, err := core.ParseUploadWindow(fmt.Sprintf("%02d:00-%02d:00", closedHour, (closedHour+1)%24))
+	if err != nil {
+		t.Fatalf("Test died. Error while parsing upload window: %v\n", err)
+	}
+	plan.UploadWindows = []core.UploadWindow{window}
+	recorder := &eventsRecorder{}
+	plan.Observer = recorder
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err = plan.DoBackup(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Test failed. Backup outside of upload window is not paused: %v\n", err)
+	}
+	if recorder.count(core.EventUploadPaused) != 1 || recorder.count(core.EventArchiveUploaded) != 0 {
+		t.Errorf("Test failed. Events of paused backup not as expected: %+v\n", recorder.events)
+	}
+
+	// paused archive is uploaded not faster than upload rate limit
+	plan.UploadWindows = nil
+	plan.UploadRateLimit = 1024 * 1024
+	recorder.events = nil
+	started := time.Now()
+	if _, err = plan.DoBackup(context.Background()); err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+	var uploadedBytes int64
+	for _, event := range recorder.events {
+		if event.Type == core.EventArchiveUploaded {
+			uploadedBytes += event.Bytes
+		}
+	}
+	if uploadedBytes == 0 {
+		t.Fatalf("Test died. Archives are not uploaded\n")
+	}
+	minDuration := time.Duration(float64(uploadedBytes) / float64(plan.UploadRateLimit) * float64(time.Second))
+	if elapsed := time.Since(started); elapsed < minDuration {
+		t.Errorf("Test failed. Upload of %v bytes took %v, faster than rate limit\n", uploadedBytes, elapsed)
+	}
+
+	plan.DownloadRateLimit = 2 * 1024 * 1024
+	points, err := plan.GetRestorePoints([]string{tfs.DataPath()})
+	if err != nil {
+		t.Fatalf("Test died. Error while getting restore points: %v\n", err)
+	}
+	err = plan.InitRestore([]string{tfs.DataPath()}, &points[len(points)-1], tfs.RestorePath())
+	if err != nil {
+		t.Fatalf("Test died. Error while initializing restore: %v\n", err)
+	}
+	started = time.Now()
+	if _, err = plan.DoRestore(context.Background()); err != nil {
+		t.Fatalf("Test died. Error while restoring files: %v\n", err)
+	}
+	minDuration = time.Duration(float64(uploadedBytes) / float64(plan.DownloadRateLimit) * float64(time.Second))
+	if elapsed := time.Since(started); elapsed < minDuration {
+		t.Errorf("Test failed. Download of %v bytes took %v, faster than rate limit\n", uploadedBytes, elapsed)
+	}
+	cmpRes, err := testutils.CompareDirs(tfs.DataPath(), filepath.Join(tfs.RestorePath(), core.GetPathInArchive(tfs.DataPath())))
+	if err != nil {
+		t.Fatalf("Test died. Error while comparing directories: %v\n", err)
+	}
+	if !cmpRes.Equals {
+		t.Errorf("Test failed. Restored dir content differs from source dir content:\n%s", cmpRes.String())
+	}
 }
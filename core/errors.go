@@ -0,0 +1,42 @@
+package core
+
+import (
+	"fmt"
+)
+
+// error returned when config of plan is not found in application directory
+type PlanNotFoundError struct {
+	Name string
+}
+
+func (e *PlanNotFoundError) Error() string {
+	return fmt.Sprintf("Plan %v is not found", e.Name)
+}
+
+// error returned when local metafile can not be read or parsed
+type MetafileError struct {
+	Path string
+	Err  error
+}
+
+func (e *MetafileError) Error() string {
+	return fmt.Sprintf("Metafile %v is corrupted: %v", e.Path, e.Err)
+}
+
+func (e *MetafileError) Unwrap() error {
+	return e.Err
+}
+
+// error returned when request to storage fails, Op is the name of failed step
+type StorageError struct {
+	Op  string
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("Error while %v: %v", e.Op, e.Err)
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"fmt"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -15,15 +17,36 @@ type NodeMetaInfo struct {
 	modtime time.Time
 	is_dir  bool
 	md5     string
+	// hashes of file content chunks, for files stored in pack archives only
+	chunks []string
+	// CRC-32 (IEEE) of file content in hex, for files stored in zip archives only
+	crc string
+	// name of file entry in zip or tar archive, if it is not the path in archive (obfuscated names)
+	entry string
+	// entry of tar archive holding content of file, if file is stored as hard link to it
+	link string
+}
+
+// file or directory, that could not be read while doing backup, it is retried by the next backup
+type NodeError struct {
+	Path string
+	Err  error
+}
+
+func (nodeErr NodeError) String() string {
+	return fmt.Sprintf("%v: %v", nodeErr.Path, nodeErr.Err)
 }
 
 type NodeList struct {
-	list []NodeMetaInfo
+	list   []NodeMetaInfo
+	errors []NodeError
 }
 
+// unreadable or vanished files and directories are skipped, so one of them does not stop walking
 func (nodes *NodeList) AddNodeToList(path string, info os.FileInfo, err error) error {
 	if err != nil {
-		return err
+		nodes.errors = append(nodes.errors, NodeError{Path: path, Err: err})
+		return nil
 	}
 	meta := NodeMetaInfo{path: path}
 	meta.applyFileInfo(info)
@@ -35,6 +58,10 @@ func (nodes NodeList) GetList() []NodeMetaInfo {
 	return nodes.list
 }
 
+func (nodes NodeList) GetErrors() []NodeError {
+	return nodes.errors
+}
+
 func (node *NodeMetaInfo) applyFileInfo(info os.FileInfo) {
 	node.size = info.Size()
 	node.modtime = info.ModTime()
@@ -65,8 +92,23 @@ func (node *NodeMetaInfo) SetMd5(md5 string) {
 	node.md5 = md5
 }
 
+func (node *NodeMetaInfo) Chunks() []string {
+	return node.chunks
+}
+
+func (node *NodeMetaInfo) Crc() string {
+	return node.crc
+}
+
+func (node *NodeMetaInfo) entryInArchive() string {
+	if node.entry != "" {
+		return node.entry
+	}
+	return GetPathInArchive(node.path)
+}
+
 func GetNodeCurrentFormat() []string {
-	return []string{"path", "size", "modtime", "is_dir"}
+	return []string{"path", "size", "modtime", "is_dir", "chunks", "crc", "entry", "link"}
 }
 
 func (node *NodeMetaInfo) ToString() string {
@@ -82,6 +124,15 @@ func (node *NodeMetaInfo) ToString() string {
 			value = node.modtime.UTC().Format(time.RFC3339)
 		case "is_dir":
 			value = strconv.FormatBool(node.is_dir)
+		case "chunks":
+			value = strings.Join(node.chunks, ";")
+		case "crc":
+			value = node.crc
+		case "entry":
+			value = node.entry
+		case "link":
+			// only path could contain commas unescaped
+			value = url.PathEscape(node.link)
 		}
 		line = append(line, value)
 	}
@@ -113,6 +164,17 @@ func GetNodeFromString(nodeString string, format []string) (NodeMetaInfo, error)
 		return node, err
 	}
 	node.is_dir, err = strconv.ParseBool(named_line["is_dir"])
+	if err != nil {
+		return node, err
+	}
+	if named_line["chunks"] != "" {
+		node.chunks = strings.Split(named_line["chunks"], ";")
+	}
+	node.crc = named_line["crc"]
+	node.entry = named_line["entry"]
+	if node.link, err = url.PathUnescape(named_line["link"]); err != nil {
+		return node, err
+	}
 
-	return node, err
+	return node, nil
 }
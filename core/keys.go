@@ -0,0 +1,264 @@
+package core
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/n-boy/backuper/base"
+	"github.com/n-boy/backuper/crypter"
+)
+
+// master key of plan wrapped with passphrase, the same file is kept in plan dir and in storage
+const masterKeyFilename string = "master_key.yaml"
+
+type yamlMasterKeyFile struct {
+	WrappedKey string `yaml:"wrapped_key"`
+	// storage info of the copy in storage, it is kept in local file only
+	StorageInfo map[string]string `yaml:"storage_info,omitempty"`
+}
+
+// unwrapping of master key is slow by design, so unwrapped keys are cached
+var masterKeysCache = make(map[string]*crypter.MasterKey)
+var masterKeysCacheMutex sync.Mutex
+
+func GetMasterKeyRemoteFileNameRE() *regexp.Regexp {
+	return regexp.MustCompile(`^master_key_\d+\.yaml$`)
+}
+
+func (plan BackupPlan) getMasterKeyFilePath() string {
+	return filepath.Join(plan.BaseDir, masterKeyFilename)
+}
+
+// master key file being saved, it replaces current one when saving is finished
+func (plan BackupPlan) getMasterKeyFilePathNew() string {
+	return plan.getMasterKeyFilePath() + "~"
+}
+
+func (plan BackupPlan) IsMasterKeyExists() bool {
+	_, err := os.Stat(plan.getMasterKeyFilePath())
+	return err == nil
+}
+
+func (plan BackupPlan) GetMasterKey() (*crypter.MasterKey, error) {
+	mk, _, err := readMasterKeyFile(plan.getMasterKeyFilePath(), plan.Encrypt_passphrase)
+	if err == crypter.ErrWrongPassphrase {
+		// change of passphrase could be interrupted after plan was saved with new passphrase
+		if mkNew, _, errNew := readMasterKeyFile(plan.getMasterKeyFilePathNew(), plan.Encrypt_passphrase); errNew == nil {
+			base.Log.Println("Master key file saved by interrupted change of passphrase is used")
+			return mkNew, os.Rename(plan.getMasterKeyFilePathNew(), plan.getMasterKeyFilePath())
+		}
+	}
+	return mk, err
+}
+
+// creates master key at the first use, data encrypted before with passphrase stays readable
+func (plan BackupPlan) getOrCreateMasterKey(ctx context.Context) (*crypter.MasterKey, error) {
+	if plan.IsMasterKeyExists() {
+		return plan.GetMasterKey()
+	}
+
+	mk, err := crypter.GenerateMasterKey(plan.Encrypt_passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if err = plan.saveMasterKey(ctx, mk, plan.Encrypt_passphrase); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(plan.getMasterKeyFilePathNew(), plan.getMasterKeyFilePath()); err != nil {
+		return nil, err
+	}
+	base.Log.Printf("Master key is created for plan: %v\n", plan.Name)
+	return mk, nil
+}
+
+// wraps master key with passphrase and uploads it to storage,
+// local file is saved as pending one, caller replaces current master key file with it
+func (plan BackupPlan) saveMasterKey(ctx context.Context, mk *crypter.MasterKey, passphrase string) error {
+	wrapped, err := mk.Wrap(passphrase)
+	if err != nil {
+		return err
+	}
+	keyFile := yamlMasterKeyFile{WrappedKey: base64.StdEncoding.EncodeToString(wrapped)}
+	if err = writeMasterKeyFile(plan.getMasterKeyFilePathNew(), keyFile); err != nil {
+		return err
+	}
+
+	// nanoseconds are added, so the key file rewrapped right after creation does not replace it in storage
+	now := time.Now()
+	remoteFileName := fmt.Sprintf("master_key_%v%09d.yaml", now.Format("20060102150405"), now.Nanosecond())
+	keyFile.StorageInfo, err = plan.uploadFile(ctx, plan.getMasterKeyFilePathNew(), remoteFileName)
+	if err != nil {
+		return err
+	}
+	return writeMasterKeyFile(plan.getMasterKeyFilePathNew(), keyFile)
+}
+
+// rewraps master key with new passphrase and saves plan with it, data is not re-encrypted
+func (plan *BackupPlan) ChangePassphrase(ctx context.Context, newPassphrase string) error {
+	if !plan.Encrypt && !plan.IsMasterKeyExists() {
+		return fmt.Errorf("Encryption is not enabled for plan")
+	} else if plan.IsPublicKeyEncryption() {
+		return fmt.Errorf("Data of plan is encrypted with public keys, passphrase is not used")
+	}
+
+	var mk *crypter.MasterKey
+	var oldStorageInfo map[string]string
+	var err error
+	if plan.IsMasterKeyExists() {
+		mk, oldStorageInfo, err = readMasterKeyFile(plan.getMasterKeyFilePath(), plan.Encrypt_passphrase)
+	} else {
+		mk, err = crypter.GenerateMasterKey(plan.Encrypt_passphrase)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = plan.saveMasterKey(ctx, mk, newPassphrase); err != nil {
+		return err
+	}
+	plan.Encrypt_passphrase = newPassphrase
+	if err = plan.SavePlan(true); err != nil {
+		return err
+	}
+	if err = os.Rename(plan.getMasterKeyFilePathNew(), plan.getMasterKeyFilePath()); err != nil {
+		return err
+	}
+
+	if len(oldStorageInfo) > 0 {
+		if err = plan.deleteFile(ctx, oldStorageInfo); err != nil {
+			base.LogErr.Printf("Error while deleting previous master key file from storage: %v\n", err)
+		}
+	}
+	base.Log.Printf("Passphrase is changed for plan: %v\n", plan.Name)
+	return nil
+}
+
+// downloads the latest master key file from storage, if there is no local one
+func (plan BackupPlan) syncMasterKey(ctx context.Context, remoteFiles []base.GenericStorageFileInfo) error {
+	if plan.IsMasterKeyExists() {
+		return nil
+	}
+	var latest base.GenericStorageFileInfo
+	for _, rf := range remoteFiles {
+		if GetMasterKeyRemoteFileNameRE().MatchString(rf.GetFilename()) &&
+			(latest == nil || rf.GetFilename() > latest.GetFilename()) {
+			latest = rf
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+
+	base.Log.Printf("Start downloading master key file %v\n", latest.GetFilename())
+	if err := plan.downloadFile(ctx, latest.GetFileStorageId(), plan.getMasterKeyFilePathNew()); err != nil {
+		return err
+	}
+	keyFile, err := parseMasterKeyFile(plan.getMasterKeyFilePathNew())
+	if err != nil {
+		return err
+	}
+	keyFile.StorageInfo = latest.GetFileStorageId()
+	if err = writeMasterKeyFile(plan.getMasterKeyFilePathNew(), keyFile); err != nil {
+		return err
+	}
+	base.Log.Printf("Finish downloading master key file %v\n", latest.GetFilename())
+	return os.Rename(plan.getMasterKeyFilePathNew(), plan.getMasterKeyFilePath())
+}
+
+func (plan BackupPlan) IsPublicKeyEncryption() bool {
+	return plan.Encrypt && len(plan.Encrypt_recipients) > 0
+}
+
+func (plan BackupPlan) getEncrypter(ctx context.Context) (*crypter.Encrypter, error) {
+	if plan.IsPublicKeyEncryption() {
+		return crypter.GetRecipientsEncrypter(plan.Encrypt_recipients)
+	}
+	mk, err := plan.getOrCreateMasterKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return crypter.GetMasterKeyEncrypter(mk), nil
+}
+
+// data of plans without master key is encrypted with passphrase,
+// private key is added to decrypt data encrypted to recipients (also the data encrypted before switching to them)
+func (plan BackupPlan) getDecrypter() (*crypter.Decrypter, error) {
+	decrypter := crypter.GetDecrypter(plan.Encrypt_passphrase)
+	if plan.IsMasterKeyExists() {
+		mk, err := plan.GetMasterKey()
+		if err != nil {
+			return nil, err
+		}
+		decrypter = crypter.GetMasterKeyDecrypter(mk)
+	}
+	if plan.Decrypt_identity != "" {
+		if err := decrypter.AddIdentities(plan.Decrypt_identity); err != nil {
+			return nil, fmt.Errorf("Error while parsing private key: %v", err)
+		}
+	}
+	return decrypter, nil
+}
+
+func (plan BackupPlan) encryptFile(ctx context.Context, srcFilePath string, targetFilePath string) error {
+	encrypter, err := plan.getEncrypter(ctx)
+	if err != nil {
+		return err
+	}
+	return crypter.EncryptFileWith(encrypter, srcFilePath, targetFilePath)
+}
+
+func readMasterKeyFile(keyFilePath string, passphrase string) (*crypter.MasterKey, map[string]string, error) {
+	keyFile, err := parseMasterKeyFile(keyFilePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cacheKey := keyFile.WrappedKey + "\x00" + passphrase
+	masterKeysCacheMutex.Lock()
+	defer masterKeysCacheMutex.Unlock()
+	if mk, ok := masterKeysCache[cacheKey]; ok {
+		return mk, keyFile.StorageInfo, nil
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(keyFile.WrappedKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	mk, err := crypter.UnwrapMasterKey(wrapped, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	masterKeysCache[cacheKey] = mk
+	return mk, keyFile.StorageInfo, nil
+}
+
+func parseMasterKeyFile(keyFilePath string) (yamlMasterKeyFile, error) {
+	var keyFile yamlMasterKeyFile
+	yamlContent, err := ioutil.ReadFile(keyFilePath)
+	if err != nil {
+		return keyFile, err
+	}
+	err = yaml.Unmarshal(yamlContent, &keyFile)
+	return keyFile, err
+}
+
+func writeMasterKeyFile(keyFilePath string, keyFile yamlMasterKeyFile) error {
+	yamlData, err := yaml.Marshal(&keyFile)
+	if err != nil {
+		return err
+	}
+	keyFilePathTmp := keyFilePath + ".tmp"
+	if err = ioutil.WriteFile(keyFilePathTmp, yamlData, 0600); err != nil {
+		return err
+	}
+	return os.Rename(keyFilePathTmp, keyFilePath)
+}
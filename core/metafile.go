@@ -21,15 +21,34 @@ type ArchiveMetafile struct {
 	encrypted    bool
 	storage_info map[string]string
 	nodes        []NodeMetaInfo
+	format       string
+	pack_chunks  []PackChunk
+	// for metafiles uploaded under obfuscated names
+	name        string
+	remote_name string
 }
 
 type yamlArchiveMetafile struct {
-	Encrypted      bool
-	StorageInfo    map[string]string `yaml:"storage_info"`
-	NodesFormatCSV string            `yaml:"files_format"`
-	NodesCSV       []string          `yaml:"files"`
+	Encrypted           bool
+	Name                string            `yaml:"name,omitempty"`
+	RemoteName          string            `yaml:"remote_name,omitempty"`
+	Format              string            `yaml:"format,omitempty"`
+	StorageInfo         map[string]string `yaml:"storage_info"`
+	NodesFormatCSV      string            `yaml:"files_format"`
+	NodesCSV            []string          `yaml:"files"`
+	PackChunksFormatCSV string            `yaml:"pack_chunks_format,omitempty"`
+	PackChunksCSV       []string          `yaml:"pack_chunks,omitempty"`
 }
 
+const (
+	ZipArchiveFormat  string = "zip"
+	PackArchiveFormat string = "pack"
+	// tar archives are compressed as a whole, format is the extension of archive file
+	TarArchiveFormat     string = "tar"
+	TarGzArchiveFormat   string = "tar.gz"
+	TarZstdArchiveFormat string = "tar.zst"
+)
+
 func GetArchName(metaFileName string) string {
 	return regexp.MustCompile(`_meta\.yaml$`).ReplaceAllString(metaFileName, "")
 }
@@ -61,33 +80,63 @@ func GetMetaFileNameRE() *regexp.Regexp {
 }
 
 func GetArchiveFileNameRE() *regexp.Regexp {
-	return regexp.MustCompile(`^archive_\d+_\d+.zip$`)
+	return regexp.MustCompile(`^archive_\d+_\d+(_r\d+)?\.(zip|pack|tar|tar\.gz|tar\.zst)$`)
+}
+
+func GetArchiveFileName(archName string, format string) string {
+	if format == "" {
+		format = ZipArchiveFormat
+	}
+	return archName + "." + format
+}
+
+// name of archive file replacing archive after repack, metafile name is kept the same
+func GetRepackedArchiveFileName(archName string, format string) string {
+	return GetArchiveFileName(archName+"_r"+time.Now().Format("20060102150405"), format)
 }
 
-func GetMetaFile(metaFilePath string) ArchiveMetafile {
+func GetArchNameId(archName string) string {
+	return strings.TrimPrefix(archName, "archive_")
+}
+
+func GetMetaFile(metaFilePath string) (ArchiveMetafile, error) {
+	var archMeta ArchiveMetafile
 	yamlMF, err := ParseMetaFile(metaFilePath)
 	if err != nil {
-		base.LogErr.Fatalln(err)
+		return archMeta, &MetafileError{Path: metaFilePath, Err: err}
 	}
 
-	archMeta := ArchiveMetafile{storage_info: yamlMF.StorageInfo, encrypted: yamlMF.Encrypted}
+	archMeta = ArchiveMetafile{storage_info: yamlMF.StorageInfo, encrypted: yamlMF.Encrypted, format: yamlMF.Format,
+		name: yamlMF.Name, remote_name: yamlMF.RemoteName}
 	parts := strings.Split(filepath.Base(metaFilePath), "_")
+	if len(parts) < 3 {
+		return archMeta, &MetafileError{Path: metaFilePath, Err: fmt.Errorf("invalid name")}
+	}
 	if archMeta.id, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
-		base.LogErr.Fatalln(err)
+		return archMeta, &MetafileError{Path: metaFilePath, Err: err}
 	}
 	if archMeta.cdate, err = time.Parse("20060102150405", parts[2]); err != nil {
-		base.LogErr.Fatalln(err)
+		return archMeta, &MetafileError{Path: metaFilePath, Err: err}
 	}
 
 	nodes_format := strings.Split(yamlMF.NodesFormatCSV, ",")
 	for _, fileinfo_str := range yamlMF.NodesCSV {
 		node, err := GetNodeFromString(fileinfo_str, nodes_format)
 		if err != nil {
-			base.LogErr.Fatalln(err)
+			return archMeta, &MetafileError{Path: metaFilePath, Err: err}
 		}
 		archMeta.nodes = append(archMeta.nodes, node)
 	}
-	return archMeta
+
+	chunks_format := strings.Split(yamlMF.PackChunksFormatCSV, ",")
+	for _, chunk_str := range yamlMF.PackChunksCSV {
+		chunk, err := GetPackChunkFromString(chunk_str, chunks_format)
+		if err != nil {
+			return archMeta, &MetafileError{Path: metaFilePath, Err: err}
+		}
+		archMeta.pack_chunks = append(archMeta.pack_chunks, chunk)
+	}
+	return archMeta, nil
 }
 
 func ParseMetaFile(metaFilePath string) (yamlArchiveMetafile, error) {
@@ -112,10 +161,19 @@ func (archMeta ArchiveMetafile) SaveMetaFile(metaFilePath string) error {
 	yamlMF := yamlArchiveMetafile{}
 	yamlMF.StorageInfo = archMeta.storage_info
 	yamlMF.Encrypted = archMeta.encrypted
+	yamlMF.Format = archMeta.format
+	yamlMF.Name = archMeta.name
+	yamlMF.RemoteName = archMeta.remote_name
 	yamlMF.NodesFormatCSV = strings.Join(GetNodeCurrentFormat(), ",")
 	for _, node := range archMeta.nodes {
 		yamlMF.NodesCSV = append(yamlMF.NodesCSV, node.ToString())
 	}
+	if len(archMeta.pack_chunks) > 0 {
+		yamlMF.PackChunksFormatCSV = strings.Join(GetPackChunkCurrentFormat(), ",")
+		for _, chunk := range archMeta.pack_chunks {
+			yamlMF.PackChunksCSV = append(yamlMF.PackChunksCSV, chunk.ToString())
+		}
+	}
 
 	yamlData, err := yaml.Marshal(&yamlMF)
 	if err != nil {
@@ -138,10 +196,36 @@ func (archMeta *ArchiveMetafile) SetStorageInfo(storageInfo map[string]string) {
 	archMeta.storage_info = storageInfo
 }
 
+// name is kept in metafile to restore it after sync from storage
+func (archMeta *ArchiveMetafile) SetRemoteName(metaFileName string, remoteName string) {
+	archMeta.name = metaFileName
+	archMeta.remote_name = remoteName
+}
+
 func (archMeta ArchiveMetafile) GetNodes() []NodeMetaInfo {
 	return archMeta.nodes
 }
 
+func (archMeta ArchiveMetafile) GetFormat() string {
+	if archMeta.format == "" {
+		return ZipArchiveFormat
+	}
+	return archMeta.format
+}
+
+func (archMeta ArchiveMetafile) GetPackChunks() []PackChunk {
+	return archMeta.pack_chunks
+}
+
+func (archMeta *ArchiveMetafile) SetFormat(format string) {
+	archMeta.format = format
+}
+
+func (archMeta *ArchiveMetafile) SetPackChunks(chunks []PackChunk) {
+	archMeta.format = PackArchiveFormat
+	archMeta.pack_chunks = chunks
+}
+
 func (archMeta ArchiveMetafile) GetMetaFileId() int64 {
 	return archMeta.id
 }
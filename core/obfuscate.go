@@ -0,0 +1,112 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/n-boy/backuper/base"
+)
+
+// With obfuscation of names, archives and metafiles are uploaded to storage under random names
+// and files are stored in zip archives under sequential ids, real paths and names are kept
+// in encrypted metafile only. Obfuscation is applied to encrypted plans only.
+
+const (
+	obfuscatedArchiveExt  string = "data"
+	obfuscatedMetaFileExt string = "meta"
+)
+
+func (plan BackupPlan) IsObfuscateNames() bool {
+	return plan.Encrypt && plan.Obfuscate_names
+}
+
+func GetObfuscatedFileName(ext string) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("Error while generating obfuscated file name: %w", err)
+	}
+	return hex.EncodeToString(id) + "." + ext, nil
+}
+
+func GetObfuscatedMetaFileNameRE() *regexp.Regexp {
+	return regexp.MustCompile(`^[0-9a-f]{32}\.` + obfuscatedMetaFileExt + `$`)
+}
+
+// replaces paths of files in zip archive with opaque ids
+func setObfuscatedEntries(nodes []NodeMetaInfo) {
+	for i := range nodes {
+		nodes[i].entry = strconv.Itoa(i + 1)
+	}
+}
+
+// name of archive file in storage, empty name means the name of local file
+func (plan BackupPlan) getRemoteArchiveFileName() (string, error) {
+	if plan.IsObfuscateNames() {
+		return GetObfuscatedFileName(obfuscatedArchiveExt)
+	}
+	return "", nil
+}
+
+// maps obfuscated remote names of metafiles to local ones
+func (plan BackupPlan) getMetaFilesByRemoteName() (map[string]string, error) {
+	metaFilesMap := make(map[string]string)
+	metaFiles, err := plan.GetMetaFiles()
+	if err != nil {
+		return metaFilesMap, err
+	}
+	for _, metaFile := range metaFiles {
+		mf, err := plan.GetMetaFile(metaFile)
+		if err != nil {
+			return metaFilesMap, err
+		}
+		if mf.remote_name != "" {
+			metaFilesMap[mf.remote_name] = metaFile
+		}
+	}
+	return metaFilesMap, nil
+}
+
+// maps names of local metafiles to remote ones, metafiles uploaded under obfuscated names
+// are matched by remote name saved in local metafile
+func (plan BackupPlan) getRemoteMetaFilesMap(remoteMetaFiles []base.GenericStorageFileInfo) (map[string]base.GenericStorageFileInfo, error) {
+	remoteMetaFilesMap := make(map[string]base.GenericStorageFileInfo)
+	localNamesMap, err := plan.getMetaFilesByRemoteName()
+	if err != nil {
+		return remoteMetaFilesMap, err
+	}
+
+	for _, rmf := range remoteMetaFiles {
+		if GetObfuscatedMetaFileNameRE().MatchString(rmf.GetFilename()) {
+			if metaFile, exists := localNamesMap[rmf.GetFilename()]; exists {
+				remoteMetaFilesMap[metaFile] = rmf
+			}
+		} else {
+			cf, _ := CleanMetaFileNameEnc(rmf.GetFilename())
+			remoteMetaFilesMap[cf] = rmf
+		}
+	}
+	return remoteMetaFilesMap, nil
+}
+
+// downloads metafile uploaded under obfuscated name and saves it under real name
+func (plan BackupPlan) downloadObfuscatedMetaFile(ctx context.Context, remoteMetaFile base.GenericStorageFileInfo) (string, error) {
+	downloadedFilePath := filepath.Join(plan.BaseDir, remoteMetaFile.GetFilename())
+	err := plan.DownloadAndDecryptFile(ctx, remoteMetaFile.GetFileStorageId(), downloadedFilePath, true)
+	if err != nil {
+		return "", err
+	}
+	yamlMF, err := ParseMetaFile(downloadedFilePath)
+	if err != nil {
+		return "", err
+	}
+	if !GetMetaFileNameRE().MatchString(yamlMF.Name) {
+		return "", fmt.Errorf("Metafile %v has invalid name: %v", remoteMetaFile.GetFilename(), yamlMF.Name)
+	}
+	return yamlMF.Name, os.Rename(downloadedFilePath, filepath.Join(plan.BaseDir, yamlMF.Name))
+}
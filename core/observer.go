@@ -0,0 +1,56 @@
+package core
+
+type EventType string
+
+const (
+	// scanning of files under backup is started
+	EventScanStarted EventType = "scan_started"
+	// files to backup are found, Files and Bytes hold their qty and total size
+	EventScanFinished EventType = "scan_finished"
+	// files are planned to be packed into Archive, Files and Bytes hold their qty and total size
+	EventChunkPlanned EventType = "chunk_planned"
+	// file at Path is written to archive of the last planned chunk, Bytes holds its size
+	EventFileArchived EventType = "file_archived"
+	// Bytes of Archive are sent to storage, TotalBytes holds size of archive,
+	// it is 0 when archive is streamed to storage while it is created
+	EventBytesUploaded EventType = "bytes_uploaded"
+	// Archive is uploaded to storage with its metafile, Bytes holds size of archive
+	EventArchiveUploaded EventType = "archive_uploaded"
+	// files to restore are found, Files and Bytes hold their qty and total size
+	EventRestoreStarted EventType = "restore_started"
+	// file is restored to Path, Bytes holds its size
+	EventFileRestored EventType = "file_restored"
+	// request to storage (e.g. Glacier retrieval job) is not completed yet, operation will be continued later
+	EventStorageWaiting EventType = "storage_waiting"
+	// request to storage failed with transient error, it is repeated after pause
+	EventStorageRetry EventType = "storage_retry"
+	// upload of archives is paused till one of upload windows of plan is open
+	EventUploadPaused EventType = "upload_paused"
+)
+
+// event of backup or restore, fields not related to event type are empty
+type Event struct {
+	Type       EventType
+	Archive    string
+	Path       string
+	Files      int
+	Bytes      int64
+	TotalBytes int64
+}
+
+// receives events of operations of plan, e.g. to show their progress.
+// Events are sent synchronously from the running operation, so the observer should not block.
+// Backup creates and uploads archives at the same time, its events could be sent concurrently
+type Observer interface {
+	OnEvent(event Event)
+}
+
+func notify(observer Observer, event Event) {
+	if observer != nil {
+		observer.OnEvent(event)
+	}
+}
+
+func (plan BackupPlan) notify(event Event) {
+	notify(plan.Observer, event)
+}
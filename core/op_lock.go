@@ -8,7 +8,7 @@ import (
 	"path/filepath"
 )
 
-var lockOperations = [...]string{"backup", "sync", "restore"}
+var lockOperations = [...]string{"backup", "sync", "restore", "prune"}
 
 func (plan BackupPlan) CheckOpLocked(op string) bool {
 	CheckLockOperation(op)
@@ -19,6 +19,17 @@ func (plan BackupPlan) CheckOpLocked(op string) bool {
 	return opLocked
 }
 
+// returns operations in progress (or interrupted) for plan
+func (plan BackupPlan) GetOpLocks() []string {
+	locked := make([]string, 0)
+	for _, op := range lockOperations {
+		if plan.CheckOpLocked(op) {
+			locked = append(locked, op)
+		}
+	}
+	return locked
+}
+
 func (plan BackupPlan) CreateOpLock(op string) error {
 	err := plan.CheckOpLockAllowed(op)
 	if err != nil {
@@ -0,0 +1,292 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/n-boy/backuper/base"
+	"github.com/n-boy/backuper/crypter"
+)
+
+// chunk of file content stored in pack archive,
+// offset is a position of chunk in unencrypted pack
+type PackChunk struct {
+	hash   string
+	offset int64
+	size   int64
+}
+
+type ChunkLocation struct {
+	archNameId string
+	chunk      PackChunk
+}
+
+// writes content of nodes into pack archive by chunks,
+// chunks already stored in other packs (or earlier in this pack) are only referenced by hash,
+// files that can not be read are skipped and returned as errors,
+// if packing is canceled or fails, partly written pack is removed. Observer could be nil
+func PackNodes(ctx context.Context, nodes []NodeMetaInfo, packFilePath string, encrypter *crypter.Encrypter,
+	knownChunks map[string]ChunkLocation, observer Observer) (nodesPacked []NodeMetaInfo, packChunks []PackChunk, nodesErr []NodeError, err error) {
+
+	packFileWriter, err := os.Create(packFilePath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer func() {
+		packFileWriter.Close()
+		if err != nil {
+			os.Remove(packFilePath)
+		}
+	}()
+
+	nodesPacked, packChunks, nodesErr, err = PackNodesToWriter(ctx, nodes, packFileWriter, encrypter, knownChunks, observer)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err = packFileWriter.Close(); err != nil {
+		return nil, nil, nil, err
+	}
+	return nodesPacked, packChunks, nodesErr, nil
+}
+
+// writes pack archive to writer, e.g. to stream it to storage, pack is written completely when it returns
+func PackNodesToWriter(ctx context.Context, nodes []NodeMetaInfo, packFileWriter io.Writer, encrypter *crypter.Encrypter,
+	knownChunks map[string]ChunkLocation, observer Observer) (nodesPacked []NodeMetaInfo, packChunks []PackChunk, nodesErr []NodeError, err error) {
+
+	packWriter := packFileWriter
+	if encrypter != nil {
+		if _, err = encrypter.InitWriter(packFileWriter); err != nil {
+			return nil, nil, nil, err
+		}
+		packWriter = io.Writer(encrypter)
+	}
+	bufWriter := bufio.NewWriterSize(packWriter, 16*1024*1024)
+
+	chunksInPack := make(map[string]bool)
+	var offset int64
+NODES_LOOP:
+	for _, node := range nodes {
+		fInfo, err := os.Stat(node.path)
+		if err != nil {
+			nodesErr = append(nodesErr, NodeError{Path: node.path, Err: err})
+			continue
+		}
+
+		node.chunks = nil
+		if !node.is_dir {
+			fileReader, err := os.Open(node.path)
+			if err != nil {
+				nodesErr = append(nodesErr, NodeError{Path: node.path, Err: err})
+				continue
+			}
+			defer fileReader.Close()
+
+			// chunks of file failed to read stay in pack, they are valid data for later files
+			chunker := NewChunker(fileReader)
+			for {
+				if err := ctx.Err(); err != nil {
+					return nil, nil, nil, err
+				}
+				data, err := chunker.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					nodesErr = append(nodesErr, NodeError{Path: node.path, Err: err})
+					fileReader.Close()
+					continue NODES_LOOP
+				}
+
+				hashBytes := sha256.Sum256(data)
+				hash := hex.EncodeToString(hashBytes[:])
+				node.chunks = append(node.chunks, hash)
+
+				if _, known := knownChunks[hash]; known || chunksInPack[hash] {
+					continue
+				}
+				if _, err = bufWriter.Write(data); err != nil {
+					return nil, nil, nil, err
+				}
+				packChunks = append(packChunks, PackChunk{hash: hash, offset: offset, size: int64(len(data))})
+				chunksInPack[hash] = true
+				offset += int64(len(data))
+			}
+
+			if err = fileReader.Close(); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		node.applyFileInfo(fInfo)
+		nodesPacked = append(nodesPacked, node)
+		notify(observer, Event{Type: EventFileArchived, Path: node.path, Bytes: node.size})
+	}
+
+	if err = bufWriter.Flush(); err != nil {
+		return nil, nil, nil, err
+	}
+	if encrypter != nil {
+		if err = encrypter.Close(); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return nodesPacked, packChunks, nodesErr, nil
+}
+
+// restores nodes from chunks, packFilePaths should contain local (decrypted) copies
+// of all packs with chunks of nodes, keyed by pack archNameId
+func UnpackNodes(nodes []NodeMetaInfo, targetPath string, chunksIndex map[string]ChunkLocation,
+	packFilePaths map[string]string) (nodesUnpacked []NodeMetaInfo, err error) {
+
+	packReaders := make(map[string]*os.File)
+	defer func() {
+		for _, r := range packReaders {
+			r.Close()
+		}
+	}()
+
+	for _, node := range nodes {
+		targetFilePath := getNodeTargetPath(node, targetPath)
+
+		if node.is_dir {
+			if err = os.MkdirAll(targetFilePath, 0775); err != nil {
+				return nodesUnpacked, err
+			}
+			nodesUnpacked = append(nodesUnpacked, node)
+			continue
+		}
+
+		tfi, err := os.Stat(targetFilePath)
+		if err == nil {
+			if tfi.ModTime().Equal(node.modtime) && tfi.Size() == node.size {
+				nodesUnpacked = append(nodesUnpacked, node)
+				continue
+			} else {
+				return nodesUnpacked, fmt.Errorf("File %v already exists and differs from that in archive", node.GetNodePath())
+			}
+		} else if !os.IsNotExist(err) {
+			return nodesUnpacked, err
+		}
+
+		if err = os.MkdirAll(filepath.Dir(targetFilePath), 0775); err != nil {
+			return nodesUnpacked, err
+		}
+		tfWriter, err := os.OpenFile(targetFilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0664)
+		if err != nil {
+			return nodesUnpacked, err
+		}
+		defer tfWriter.Close()
+
+		for _, hash := range node.chunks {
+			location, exists := chunksIndex[hash]
+			if !exists {
+				return nodesUnpacked, fmt.Errorf("Chunk %v of file %v is not found in any pack", hash, node.GetNodePath())
+			}
+			packReader, opened := packReaders[location.archNameId]
+			if !opened {
+				packFilePath, exists := packFilePaths[location.archNameId]
+				if !exists {
+					return nodesUnpacked, fmt.Errorf("Pack archive_%v is not downloaded", location.archNameId)
+				}
+				if packReader, err = os.Open(packFilePath); err != nil {
+					return nodesUnpacked, err
+				}
+				packReaders[location.archNameId] = packReader
+			}
+
+			data := make([]byte, location.chunk.size)
+			if _, err = packReader.ReadAt(data, location.chunk.offset); err != nil {
+				return nodesUnpacked, err
+			}
+			hashBytes := sha256.Sum256(data)
+			if hex.EncodeToString(hashBytes[:]) != hash {
+				return nodesUnpacked, fmt.Errorf("Chunk %v in pack archive_%v is corrupted", hash, location.archNameId)
+			}
+			if _, err = tfWriter.Write(data); err != nil {
+				return nodesUnpacked, err
+			}
+		}
+
+		if err = tfWriter.Close(); err != nil {
+			return nodesUnpacked, err
+		}
+		if err = os.Chtimes(targetFilePath, node.modtime, node.modtime); err != nil {
+			base.LogErr.Println(err)
+		}
+		nodesUnpacked = append(nodesUnpacked, node)
+	}
+
+	return nodesUnpacked, nil
+}
+
+// returns archNameIds of packs containing chunks of nodes
+func GetNodesPacks(nodes []NodeMetaInfo, chunksIndex map[string]ChunkLocation) ([]string, error) {
+	packs := make([]string, 0)
+	packsMap := make(map[string]bool)
+	for _, node := range nodes {
+		for _, hash := range node.chunks {
+			location, exists := chunksIndex[hash]
+			if !exists {
+				return packs, fmt.Errorf("Chunk %v of file %v is not found in any pack", hash, node.GetNodePath())
+			}
+			if !packsMap[location.archNameId] {
+				packsMap[location.archNameId] = true
+				packs = append(packs, location.archNameId)
+			}
+		}
+	}
+	return packs, nil
+}
+
+func GetPackChunkCurrentFormat() []string {
+	return []string{"hash", "offset", "size"}
+}
+
+func (chunk PackChunk) ToString() string {
+	line := make([]string, 0)
+	for _, field := range GetPackChunkCurrentFormat() {
+		value := ""
+		switch field {
+		case "hash":
+			value = chunk.hash
+		case "offset":
+			value = strconv.FormatInt(chunk.offset, 10)
+		case "size":
+			value = strconv.FormatInt(chunk.size, 10)
+		}
+		line = append(line, value)
+	}
+	return strings.Join(line, ",")
+}
+
+func GetPackChunkFromString(chunkString string, format []string) (PackChunk, error) {
+	var chunk PackChunk
+	var err error
+
+	line := strings.Split(chunkString, ",")
+	if len(line) != len(format) {
+		return chunk, fmt.Errorf("Pack chunk line does not match format: %v", chunkString)
+	}
+	named_line := make(map[string]string)
+	for i := 0; i < len(format); i++ {
+		named_line[format[i]] = line[i]
+	}
+
+	chunk.hash = named_line["hash"]
+	if chunk.offset, err = strconv.ParseInt(named_line["offset"], 10, 64); err != nil {
+		return chunk, err
+	}
+	chunk.size, err = strconv.ParseInt(named_line["size"], 10, 64)
+
+	return chunk, err
+}
+
+func (chunk PackChunk) Size() int64 {
+	return chunk.size
+}
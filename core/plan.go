@@ -1,7 +1,10 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -15,6 +18,7 @@ import (
 	"github.com/n-boy/backuper/base"
 	"github.com/n-boy/backuper/crypter"
 	"github.com/n-boy/backuper/storage"
+	storageutils "github.com/n-boy/backuper/storage/utils"
 )
 
 type BackupPlan struct {
@@ -22,11 +26,24 @@ type BackupPlan struct {
 	BaseDir            string
 	TmpDir             string
 	ChunkSize          int64
+	TmpSpaceLimit      int64 // for archives waiting for upload, next archive is created while previous one is uploaded, if it fits
 	Encrypt            bool
 	Encrypt_passphrase string
+	Encrypt_recipients []string // public keys data is encrypted to, passphrase is not used then
+	Decrypt_identity   string   // private key for data encrypted to recipients, provided at restore time, never saved
+	Obfuscate_names    bool
+	Dedup              bool
+	Compression        Compression // of files in zip archives, dedup packs are not compressed
+	ArchiveFormat      string      // zip or tar, dedup plans store packs
+	Retention          RetentionPolicy
+	Retry              RetryPolicy
+	UploadRateLimit    int64          // bytes per second, 0 - unlimited
+	DownloadRateLimit  int64          // bytes per second, 0 - unlimited
+	UploadWindows      []UploadWindow // backup uploads archives within them only, no windows - any time
 	NodesToArchive     []string
-	ExcludeMasks	   []string
+	ExcludeMasks       []string
 	Storage            storage.GenericStorage
+	Observer           Observer // receives events of backup and restore, never saved
 
 	cacheMetaFiles map[string]ArchiveMetafile
 }
@@ -35,9 +52,21 @@ type yamlBackupPlanStruct struct {
 	FilesList         []string `yaml:"files_list"`
 	ExcludeMasks      []string `yaml:"exclude_masks"`
 	Storage           map[string]string
-	ChunkSizeMB       int64  `yaml:"chunk_size_mb"`
-	Encrypt           bool   `yaml:"encrypt"`
-	EncryptPassphrase string `yaml:"encrypt_passphrase"`
+	ChunkSizeMB       int64               `yaml:"chunk_size_mb"`
+	TmpSpaceMB        int64               `yaml:"tmp_space_mb,omitempty"`
+	Encrypt           bool                `yaml:"encrypt"`
+	EncryptPassphrase string              `yaml:"encrypt_passphrase"`
+	EncryptRecipients []string            `yaml:"encrypt_recipients,omitempty"`
+	ObfuscateNames    bool                `yaml:"obfuscate_names,omitempty"`
+	Dedup             bool                `yaml:"dedup"`
+	Compression       string              `yaml:"compression,omitempty"`
+	CompressionLevel  int                 `yaml:"compression_level,omitempty"`
+	ArchiveFormat     string              `yaml:"archive_format,omitempty"`
+	Retention         yamlRetentionPolicy `yaml:"retention,omitempty"`
+	Retry             yamlRetryPolicy     `yaml:"retry,omitempty"`
+	UploadRateKB      int64               `yaml:"upload_rate_limit_kb,omitempty"`
+	DownloadRateKB    int64               `yaml:"download_rate_limit_kb,omitempty"`
+	UploadWindows     []string            `yaml:"upload_windows,omitempty"`
 }
 
 var planFilename string = "plan.yaml"
@@ -60,29 +89,54 @@ func GetBackupPlan(planName string) (BackupPlan, error) {
 		yamlContent []byte
 	)
 	yamlContent, err = ioutil.ReadFile(filepath.Join(planDir, planFilename))
-	if err != nil {
-		base.LogErr.Fatalln(err)
+	if os.IsNotExist(err) {
+		return plan, &PlanNotFoundError{Name: planName}
+	} else if err != nil {
+		return plan, err
 	}
 
 	yamlBP := yamlBackupPlanStruct{}
 	err = yaml.Unmarshal(yamlContent, &yamlBP)
 	if err != nil {
-		base.LogErr.Fatalln(err)
+		return plan, fmt.Errorf("Config of plan %v is corrupted: %v", planName, err)
 	}
 
 	plan.NodesToArchive = yamlBP.FilesList
 	plan.ExcludeMasks = yamlBP.ExcludeMasks
 	plan.Storage, err = storage.NewStorage(yamlBP.Storage)
 	if err != nil {
-		base.LogErr.Fatalln(err)
+		return plan, fmt.Errorf("Storage config of plan %v is invalid: %v", planName, err)
 	}
 	if yamlBP.ChunkSizeMB == 0 {
 		plan.ChunkSize = DefaultChunkSizeMB * 1024 * 1024
 	} else {
 		plan.ChunkSize = yamlBP.ChunkSizeMB * 1024 * 1024
 	}
+	plan.TmpSpaceLimit = yamlBP.TmpSpaceMB * 1024 * 1024
 	plan.Encrypt = yamlBP.Encrypt
 	plan.Encrypt_passphrase = yamlBP.EncryptPassphrase
+	plan.Encrypt_recipients = yamlBP.EncryptRecipients
+	plan.Obfuscate_names = yamlBP.ObfuscateNames
+	plan.Dedup = yamlBP.Dedup
+	plan.Compression = Compression{Method: yamlBP.Compression, Level: yamlBP.CompressionLevel}
+	if err = plan.Compression.Check(); err != nil {
+		return plan, fmt.Errorf("Config of plan %v is corrupted: %v", planName, err)
+	}
+	plan.ArchiveFormat = yamlBP.ArchiveFormat
+	if err = CheckArchiveFormat(plan.ArchiveFormat); err != nil {
+		return plan, fmt.Errorf("Config of plan %v is corrupted: %v", planName, err)
+	}
+	plan.Retention = RetentionPolicy(yamlBP.Retention)
+	plan.Retry = newRetryPolicy(yamlBP.Retry)
+	plan.UploadRateLimit = yamlBP.UploadRateKB * 1024
+	plan.DownloadRateLimit = yamlBP.DownloadRateKB * 1024
+	for _, text := range yamlBP.UploadWindows {
+		w, err := ParseUploadWindow(text)
+		if err != nil {
+			return plan, fmt.Errorf("Config of plan %v is corrupted: %v", planName, err)
+		}
+		plan.UploadWindows = append(plan.UploadWindows, w)
+	}
 
 	plan.Name = planName
 	plan.BaseDir = planDir
@@ -103,6 +157,16 @@ func IsBackupPlanExists(planName string) bool {
 	return true
 }
 
+// deletes plan with its local metafiles, data in storage is kept
+func (plan BackupPlan) DeletePlan() error {
+	for _, op := range lockOperations {
+		if plan.CheckOpLocked(op) {
+			return fmt.Errorf("Plan can not be deleted while operation '%v' is in progress", op)
+		}
+	}
+	return os.RemoveAll(plan.BaseDir)
+}
+
 func (plan *BackupPlan) CheckTmpDir() error {
 	if plan.TmpDir == "" {
 		return fmt.Errorf("Temporary dir is not defined")
@@ -129,11 +193,25 @@ func (plan *BackupPlan) SavePlan(overwrite bool) error {
 		FilesList:         plan.NodesToArchive,
 		ExcludeMasks:      plan.ExcludeMasks,
 		ChunkSizeMB:       plan.ChunkSize / 1024 / 1024,
+		TmpSpaceMB:        plan.TmpSpaceLimit / 1024 / 1024,
 		Encrypt:           plan.Encrypt,
 		EncryptPassphrase: plan.Encrypt_passphrase,
+		EncryptRecipients: plan.Encrypt_recipients,
+		ObfuscateNames:    plan.Obfuscate_names,
+		Dedup:             plan.Dedup,
+		Compression:       plan.Compression.Method,
+		CompressionLevel:  plan.Compression.Level,
+		ArchiveFormat:     plan.ArchiveFormat,
+		Retention:         yamlRetentionPolicy(plan.Retention),
+		Retry:             plan.Retry.toYaml(),
+		UploadRateKB:      plan.UploadRateLimit / 1024,
+		DownloadRateKB:    plan.DownloadRateLimit / 1024,
 		Storage:           plan.Storage.GetStorageConfig(),
 	}
 	yamlBP.Storage["type"] = plan.Storage.GetType()
+	for _, w := range plan.UploadWindows {
+		yamlBP.UploadWindows = append(yamlBP.UploadWindows, w.String())
+	}
 
 	planDir := GetPlanDir(plan.Name)
 	if err := os.MkdirAll(planDir, 0700); err != nil {
@@ -164,36 +242,46 @@ func (plan *BackupPlan) SavePlan(overwrite bool) error {
 	return err
 }
 
-func (plan BackupPlan) GetGuardedNodes() []NodeMetaInfo {
+// returns files and directories under backup, and ones that could not be read
+func (plan BackupPlan) GetGuardedNodes() ([]NodeMetaInfo, []NodeError) {
 	var nodes NodeList
 	for _, path := range plan.NodesToArchive {
-		err := filepath.Walk(path, nodes.AddNodeToList)
-		if err != nil {
-			base.LogErr.Fatalln(err)
-		}
+		filepath.Walk(path, nodes.AddNodeToList)
 	}
-	return nodes.GetList()
+	return nodes.GetList(), nodes.GetErrors()
 }
 
-func (plan BackupPlan) GetArchivedNodesMap() map[string]NodeMetaInfo {
+func (plan BackupPlan) GetArchivedNodesMap() (map[string]NodeMetaInfo, error) {
 	nodesMap := make(map[string]NodeMetaInfo)
 
-	metafiles := plan.GetMetaFiles()
+	metafiles, err := plan.GetMetaFiles()
+	if err != nil {
+		return nodesMap, err
+	}
 	for _, filename := range metafiles {
-		archMeta := plan.GetMetaFile(filename)
+		archMeta, err := plan.GetMetaFile(filename)
+		if err != nil {
+			return nodesMap, err
+		}
 		for _, node := range archMeta.GetNodes() {
 			nodesMap[node.path] = node
 		}
 	}
-	return nodesMap
+	return nodesMap, nil
 }
 
-func (plan BackupPlan) GetArchivedNodesAllRevMap() map[string][]NodeMetaInfo {
+func (plan BackupPlan) GetArchivedNodesAllRevMap() (map[string][]NodeMetaInfo, error) {
 	nodesMap := make(map[string][]NodeMetaInfo)
 
-	metafiles := plan.GetMetaFiles()
+	metafiles, err := plan.GetMetaFiles()
+	if err != nil {
+		return nodesMap, err
+	}
 	for _, filename := range metafiles {
-		archMeta := plan.GetMetaFile(filename)
+		archMeta, err := plan.GetMetaFile(filename)
+		if err != nil {
+			return nodesMap, err
+		}
 		for _, node := range archMeta.GetNodes() {
 			if _, exists := nodesMap[node.path]; !exists {
 				nodesMap[node.path] = make([]NodeMetaInfo, 0)
@@ -201,73 +289,111 @@ func (plan BackupPlan) GetArchivedNodesAllRevMap() map[string][]NodeMetaInfo {
 			nodesMap[node.path] = append(nodesMap[node.path], node)
 		}
 	}
-	return nodesMap
+	return nodesMap, nil
 }
 
-func (plan BackupPlan) GetMetaFiles() MetafileList {
-	var metafiles []string
-	var err error
-	err = os.Chdir(plan.BaseDir)
+// returns locations of all chunks stored in pack archives
+func (plan BackupPlan) GetChunksIndex() (map[string]ChunkLocation, error) {
+	chunksIndex := make(map[string]ChunkLocation)
+
+	metafiles, err := plan.GetMetaFiles()
 	if err != nil {
-		base.LogErr.Fatalln(err)
+		return chunksIndex, err
 	}
+	for _, filename := range metafiles {
+		archMeta, err := plan.GetMetaFile(filename)
+		if err != nil {
+			return chunksIndex, err
+		}
+		for _, chunk := range archMeta.GetPackChunks() {
+			chunksIndex[chunk.hash] = ChunkLocation{archNameId: archMeta.GetMetaFileNameId(), chunk: chunk}
+		}
+	}
+	return chunksIndex, nil
+}
 
-	metafiles, err = filepath.Glob(GetMetaFileGlobMask())
+func (plan BackupPlan) GetMetaFiles() (MetafileList, error) {
+	return getMetaFilesInDir(plan.BaseDir)
+}
+
+// returns names of metafiles in directory sorted by archive number,
+// working directory is not changed, so it is safe to call while archives are uploaded
+func getMetaFilesInDir(dir string) (MetafileList, error) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		base.LogErr.Fatalln(err)
+		return nil, err
 	}
 
-	var metafilesClean MetafileList
-	for _, mf := range metafiles {
-		if GetMetaFileNameRE().MatchString(mf) {
-			metafilesClean = append(metafilesClean, mf)
+	var metafiles MetafileList
+	for _, entry := range entries {
+		if matched, _ := filepath.Match(GetMetaFileGlobMask(), entry.Name()); matched && GetMetaFileNameRE().MatchString(entry.Name()) {
+			metafiles = append(metafiles, entry.Name())
 		}
 	}
-	sort.Sort(metafilesClean)
-	return metafilesClean
+	sort.Sort(metafiles)
+	return metafiles, nil
 }
 
-func (plan BackupPlan) GetMetaFile(filename string) ArchiveMetafile {
+func (plan BackupPlan) GetMetaFile(filename string) (ArchiveMetafile, error) {
 	if plan.cacheMetaFiles == nil {
 		plan.cacheMetaFiles = make(map[string]ArchiveMetafile)
 	}
 	_, ok := plan.cacheMetaFiles[filename]
 	if !ok {
-		plan.cacheMetaFiles[filename] = GetMetaFile(filepath.Join(plan.BaseDir, filename))
+		archMeta, err := GetMetaFile(filepath.Join(plan.BaseDir, filename))
+		if err != nil {
+			return archMeta, err
+		}
+		plan.cacheMetaFiles[filename] = archMeta
 	}
-	return plan.cacheMetaFiles[filename]
+	return plan.cacheMetaFiles[filename], nil
 }
 
-func (plan BackupPlan) GetRemoteMetaFiles() ([]base.GenericStorageFileInfo, error) {
-	metaFiles := []base.GenericStorageFileInfo{}
-
-	remoteFiles, err := plan.Storage.GetFilesList()
+func (plan BackupPlan) GetRemoteMetaFiles(ctx context.Context) ([]base.GenericStorageFileInfo, error) {
+	remoteFiles, err := plan.getFilesList(ctx)
 	if err != nil {
-		return metaFiles, err
+		return []base.GenericStorageFileInfo{}, err
 	}
+	return filterRemoteMetaFiles(remoteFiles), nil
+}
 
+func filterRemoteMetaFiles(remoteFiles []base.GenericStorageFileInfo) []base.GenericStorageFileInfo {
+	metaFiles := []base.GenericStorageFileInfo{}
 	for _, rf := range remoteFiles {
-		if GetMetaFileNameRE().MatchString(rf.GetFilename()) {
+		if GetMetaFileNameRE().MatchString(rf.GetFilename()) || GetObfuscatedMetaFileNameRE().MatchString(rf.GetFilename()) {
 			metaFiles = append(metaFiles, rf)
 		}
 	}
-	return metaFiles, nil
+	return metaFiles
 }
 
-func (plan BackupPlan) GetNextArchiveName() string {
-	var err error
-	metafiles := plan.GetMetaFiles()
-
+// archives created, but not uploaded yet (their metafiles are in tmp dir) are taken into account,
+// so names of archives waiting for upload are not reused
+func (plan BackupPlan) GetNextArchiveName() (string, error) {
 	lastInd := 0
-	if len(metafiles) > 0 {
+	// tmp dir is read first: metafile of uploaded archive is moved from it to base dir,
+	// so it is not missed if it is moved meanwhile
+	for _, dir := range []string{plan.TmpDir, plan.BaseDir} {
+		metafiles, err := getMetaFilesInDir(dir)
+		if os.IsNotExist(err) && dir == plan.TmpDir {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if len(metafiles) == 0 {
+			continue
+		}
 		lastName := metafiles[len(metafiles)-1]
-		lastInd, err = strconv.Atoi(strings.Split(lastName, "_")[1])
+		ind, err := strconv.Atoi(strings.Split(lastName, "_")[1])
 		if err != nil {
-			base.LogErr.Fatalln(err)
+			return "", &MetafileError{Path: filepath.Join(dir, lastName), Err: err}
+		}
+		if ind > lastInd {
+			lastInd = ind
 		}
 	}
 
-	return fmt.Sprint("archive_", lastInd+1, "_", time.Now().Format("20060102150405"))
+	return fmt.Sprint("archive_", lastInd+1, "_", time.Now().Format("20060102150405")), nil
 }
 
 func (plan BackupPlan) GetProcessNodes(guardNodes []NodeMetaInfo, archNodesMap map[string]NodeMetaInfo) []NodeMetaInfo {
@@ -296,6 +422,14 @@ func (plan BackupPlan) IsNodeExcluded(node NodeMetaInfo) bool {
 	return false
 }
 
+func getNodesSize(nodes []NodeMetaInfo) int64 {
+	var size int64
+	for _, node := range nodes {
+		size += node.size
+	}
+	return size
+}
+
 func (plan BackupPlan) GetNodeChunks(nodes []NodeMetaInfo) [][]NodeMetaInfo {
 	var chunks [][]NodeMetaInfo
 	var chunkSize int64 = 0
@@ -317,95 +451,471 @@ func (plan BackupPlan) GetNodeChunks(nodes []NodeMetaInfo) [][]NodeMetaInfo {
 	return chunks
 }
 
-func (plan BackupPlan) DoBackup() error {
+// archives uploaded to storage by backup run, including ones left by interrupted run
+type BackupResult struct {
+	Archives      []string
+	FilesArchived int
+	BytesUploaded int64
+	// files and directories skipped, because they could not be read
+	Skipped []NodeError
+}
+
+func (result *BackupResult) addSkipped(nodesErr []NodeError) {
+	for _, nodeErr := range nodesErr {
+		base.LogErr.Printf("Skipped: %v\n", nodeErr)
+	}
+	result.Skipped = append(result.Skipped, nodesErr...)
+}
+
+func (result *BackupResult) addUploaded(archName string, filesQty int, bytesUploaded int64) {
+	result.Archives = append(result.Archives, archName)
+	result.FilesArchived += filesQty
+	result.BytesUploaded += bytesUploaded
+}
+
+// backup could be canceled by context between files, partly created archive is removed,
+// archive created before is kept in tmp dir and is uploaded by the next run
+func (plan BackupPlan) DoBackup(ctx context.Context) (BackupResult, error) {
 	base.Log.Printf("Start doing backup for plan: %v\n", plan.Name)
+	var result BackupResult
 
 	if err := plan.CheckOpLockAllowed("backup"); err != nil {
-		return err
+		return result, err
 	}
 
 	if err := plan.CheckTmpDir(); err != nil {
-		return err
+		return result, err
 	}
 
-	// доливаем недокачанный архив
-	if err := os.Chdir(plan.TmpDir); err != nil {
-		return err
-	}
-	metafiles, err := filepath.Glob(GetMetaFileGlobMask())
+	// доливаем недокачанные архивы, в порядке их создания
+	metafiles, err := getMetaFilesInDir(plan.TmpDir)
 	if err != nil {
-		return err
+		return result, err
 	}
 	for _, mf := range metafiles {
 		archName := GetArchName(mf)
-		_, err := os.Stat(fmt.Sprint(archName, ".zip"))
+		archMeta, err := GetMetaFile(filepath.Join(plan.TmpDir, mf))
+		if err != nil {
+			return result, err
+		}
+		archFilepath := filepath.Join(plan.TmpDir, GetArchiveFileName(archName, archMeta.GetFormat()))
+		_, err = os.Stat(archFilepath)
 		if err != nil {
 			base.LogErr.Println(err)
 			base.Log.Printf("Remove metafile %v from tmp dir\n", mf)
 			if err := os.Remove(filepath.Join(plan.TmpDir, mf)); err != nil {
 				base.LogErr.Println(err)
 			}
+			removeUploadStateFiles(archFilepath)
 		} else {
-			plan.uploadArchiveToStorage(archName)
+			bytesUploaded, err := plan.uploadArchiveToStorage(ctx, archName)
+			if err != nil {
+				return result, err
+			}
+			result.addUploaded(archName, len(archMeta.GetNodes()), bytesUploaded)
 		}
 	}
 
 	// получаем список файлов под наблюдением
-	guardNodes := plan.GetGuardedNodes()
+	plan.notify(Event{Type: EventScanStarted})
+	guardNodes, guardErrors := plan.GetGuardedNodes()
+	result.addSkipped(guardErrors)
 
 	// строим список архивированных файлов
-	archNodesMap := plan.GetArchivedNodesMap()
+	archNodesMap, err := plan.GetArchivedNodesMap()
+	if err != nil {
+		return result, err
+	}
 
 	//  вычисляем список файлов к архивации
 	procNodes := plan.GetProcessNodes(guardNodes, archNodesMap)
+	plan.notify(Event{Type: EventScanFinished, Files: len(procNodes), Bytes: getNodesSize(procNodes)})
+
+	var knownChunks map[string]ChunkLocation
+	if plan.Dedup {
+		if knownChunks, err = plan.GetChunksIndex(); err != nil {
+			return result, err
+		}
+	}
 
 	// обрабатываем файлы по частям
-	for _, chunk := range plan.GetNodeChunks(procNodes) {
-		archName := plan.GetNextArchiveName()
-		archFilepath := filepath.Join(plan.TmpDir, fmt.Sprint(archName, ".zip"))
-		var encrypter *crypter.Encrypter
-		if plan.Encrypt {
-			encrypter = crypter.GetEncrypter(plan.Encrypt_passphrase)
+	if err = plan.archiveAndUploadChunks(ctx, plan.GetNodeChunks(procNodes), knownChunks, &result); err != nil {
+		return result, err
+	}
+
+	base.Log.Printf("Finish doing backup for plan: %v", plan.Name)
+
+	return result, nil
+}
+
+// archive created in tmp dir and waiting for upload
+type createdArchive struct {
+	name  string
+	files int
+	size  int64
+}
+
+// archives chunks one by one and uploads them in the same order, archive of the next chunk is created
+// while the previous one is uploaded, if tmp space limit of plan allows to keep both of them.
+// Size of archive being created is estimated by size of its files. Archives failed to upload are kept in tmp dir.
+// Archives are not staged in tmp dir, if storage is able to upload them while they are created
+func (plan BackupPlan) archiveAndUploadChunks(ctx context.Context, chunks [][]NodeMetaInfo,
+	knownChunks map[string]ChunkLocation, result *BackupResult) error {
+
+	if streamer, ok := plan.Storage.(storage.StreamingStorage); ok {
+		for _, chunk := range chunks {
+			if err := plan.streamArchive(ctx, streamer, chunk, knownChunks, result); err != nil {
+				return err
+			}
 		}
-		doneNodes := ArchiveNodes(chunk, archFilepath, encrypter)
-		base.Log.Printf("Archive %v created", archName)
-		archMetaFilepath := filepath.Join(plan.TmpDir, GetMetaFileName(archName))
-		archMeta := NewMetaFile(doneNodes, plan.Encrypt)
-		err := archMeta.SaveMetaFile(archMetaFilepath)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	archives := make(chan createdArchive, len(chunks))
+	uploadedSizes := make(chan int64, len(chunks))
+	var uploadErr error
+	uploadDone := make(chan struct{})
+	go func() {
+		defer close(uploadDone)
+		for arch := range archives {
+			bytesUploaded, err := plan.uploadArchiveToStorage(ctx, arch.name)
+			if err != nil {
+				// archiving is stopped, archives created but not uploaded are uploaded by the next run
+				uploadErr = err
+				cancel()
+				return
+			}
+			result.addUploaded(arch.name, arch.files, bytesUploaded)
+			uploadedSizes <- arch.size
+		}
+	}()
+
+	var archiveErr error
+	var pendingSize int64
+CHUNKS_LOOP:
+	for _, chunk := range chunks {
+		// at least one archive is created, even if it does not fit into limit
+		for pendingSize > 0 && pendingSize+getNodesSize(chunk) > plan.TmpSpaceLimit {
+			select {
+			case size := <-uploadedSizes:
+				pendingSize -= size
+			case <-ctx.Done():
+				archiveErr = ctx.Err()
+				break CHUNKS_LOOP
+			}
+		}
+		arch, err := plan.createArchive(ctx, chunk, knownChunks, result)
 		if err != nil {
-			os.Remove(archFilepath)
-			os.Remove(archMetaFilepath)
-			base.LogErr.Fatalln(err)
+			archiveErr = err
+			break
 		}
-		base.Log.Printf("Metafile for archive %v created", archName)
+		if arch.files == 0 {
+			continue
+		}
+		pendingSize += arch.size
+		archives <- arch
+	}
+	// archives already created are uploaded, even if creating of the next one failed
+	close(archives)
+	<-uploadDone
 
-		// заливаем архив в хранилище
-		plan.uploadArchiveToStorage(archName)
+	if uploadErr != nil {
+		return uploadErr
 	}
+	return archiveErr
+}
 
-	base.Log.Printf("Finish doing backup for plan: %v", plan.Name)
+// creates archive of chunk with its metafile in tmp dir,
+// archive is not created (files qty is 0), if no files of chunk could be read
+func (plan BackupPlan) createArchive(ctx context.Context, chunk []NodeMetaInfo,
+	knownChunks map[string]ChunkLocation, result *BackupResult) (createdArchive, error) {
+
+	var arch createdArchive
+	if err := ctx.Err(); err != nil {
+		return arch, err
+	}
+	archName, err := plan.GetNextArchiveName()
+	if err != nil {
+		return arch, err
+	}
+	plan.notify(Event{Type: EventChunkPlanned, Archive: archName, Files: len(chunk), Bytes: getNodesSize(chunk)})
+	var encrypter *crypter.Encrypter
+	if plan.Encrypt {
+		if encrypter, err = plan.getEncrypter(ctx); err != nil {
+			return arch, err
+		}
+	}
+
+	var archFilepath string
+	var doneNodes []NodeMetaInfo
+	var packChunks []PackChunk
+	var nodesErr []NodeError
+	archFormat := plan.getArchiveFormat()
+	archFilepath = filepath.Join(plan.TmpDir, GetArchiveFileName(archName, archFormat))
+	if !plan.Dedup && plan.IsObfuscateNames() {
+		setObfuscatedEntries(chunk)
+	}
+	switch {
+	case plan.Dedup:
+		doneNodes, packChunks, nodesErr, err = PackNodes(ctx, chunk, archFilepath, encrypter, knownChunks, plan.Observer)
+	case isTarFormat(archFormat):
+		doneNodes, nodesErr, err = TarNodes(ctx, chunk, archFilepath, encrypter, archFormat, plan.Compression.Level, plan.Observer)
+	default:
+		doneNodes, nodesErr, err = ArchiveNodes(ctx, chunk, archFilepath, encrypter, plan.Compression, plan.Observer)
+	}
+	if err != nil {
+		return arch, err
+	}
+	result.addSkipped(nodesErr)
+	if len(doneNodes) == 0 {
+		base.Log.Printf("Archive %v is not created, no files of chunk could be read", archName)
+		if err := os.Remove(archFilepath); err != nil {
+			base.LogErr.Println(err)
+		}
+		return arch, nil
+	}
+	archFileInfo, err := os.Stat(archFilepath)
+	if err != nil {
+		return arch, err
+	}
 
+	archMeta := NewMetaFile(doneNodes, plan.Encrypt)
+	if plan.Dedup {
+		archMeta.SetPackChunks(packChunks)
+		for _, packChunk := range packChunks {
+			knownChunks[packChunk.hash] = ChunkLocation{archNameId: GetArchNameId(archName), chunk: packChunk}
+		}
+	} else if isTarFormat(archFormat) {
+		archMeta.SetFormat(archFormat)
+	}
+	base.Log.Printf("Archive %v created", archName)
+	archMetaFilepath := filepath.Join(plan.TmpDir, GetMetaFileName(archName))
+	err = archMeta.SaveMetaFile(archMetaFilepath)
+	if err != nil {
+		os.Remove(archFilepath)
+		os.Remove(archMetaFilepath)
+		return arch, err
+	}
+	base.Log.Printf("Metafile for archive %v created", archName)
+
+	return createdArchive{name: archName, files: len(doneNodes), size: archFileInfo.Size()}, nil
+}
+
+// counts bytes of archive streamed to storage
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// creates archive of chunk and uploads it to storage at the same time, only its metafile is saved in tmp dir.
+// Archive failed to upload is created again by repeated attempt, its partly uploaded file is removed by storage.
+// Archive is deleted from storage, if no files of chunk could be read
+func (plan BackupPlan) streamArchive(ctx context.Context, streamer storage.StreamingStorage, chunk []NodeMetaInfo,
+	knownChunks map[string]ChunkLocation, result *BackupResult) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := plan.waitForUploadWindow(ctx); err != nil {
+		return err
+	}
+	archName, err := plan.GetNextArchiveName()
+	if err != nil {
+		return err
+	}
+	plan.notify(Event{Type: EventChunkPlanned, Archive: archName, Files: len(chunk), Bytes: getNodesSize(chunk)})
+	archFormat := plan.getArchiveFormat()
+	if !plan.Dedup && plan.IsObfuscateNames() {
+		setObfuscatedEntries(chunk)
+	}
+	// archive is named in storage like the staged one
+	remoteFileName, err := plan.getRemoteArchiveFileName()
+	if err != nil {
+		return err
+	}
+	if remoteFileName == "" {
+		remoteFileName = GetArchiveFileName(archName, archFormat)
+	}
+
+	var doneNodes []NodeMetaInfo
+	var packChunks []PackChunk
+	var nodesErr []NodeError
+	var archSize int64
+	var archiveStorageInfo map[string]string
+	// error of archiving is not repeated, unlike failed upload
+	var archiveErr error
+	// repeated attempt reports files and bytes sent by previous attempts again, they are not counted twice
+	var reported int64
+	attempt := 0
+	err = plan.retryStorageRequest(ctx, "uploading archive "+archName, func() error {
+		attempt++
+		observer := plan.Observer
+		if attempt > 1 {
+			observer = nil
+		}
+		var encrypter *crypter.Encrypter
+		if plan.Encrypt {
+			if encrypter, archiveErr = plan.getEncrypter(ctx); archiveErr != nil {
+				return archiveErr
+			}
+		}
+
+		pipeReader, pipeWriter := io.Pipe()
+		archived := make(chan error, 1)
+		go func() {
+			archWriter := &countingWriter{w: pipeWriter}
+			var err error
+			switch {
+			case plan.Dedup:
+				doneNodes, packChunks, nodesErr, err = PackNodesToWriter(ctx, chunk, archWriter, encrypter, knownChunks, observer)
+			case isTarFormat(archFormat):
+				doneNodes, nodesErr, err = TarNodesToWriter(ctx, chunk, archWriter, encrypter, archFormat, plan.Compression.Level, observer)
+			default:
+				doneNodes, nodesErr, err = ArchiveNodesToWriter(ctx, chunk, archWriter, encrypter, plan.Compression, observer)
+			}
+			archSize = archWriter.n
+			pipeWriter.CloseWithError(err)
+			archived <- err
+		}()
+
+		var attemptBytes int64
+		progressCtx := storageutils.WithUploadProgress(plan.limitUploadRate(ctx), func(bytes int64) {
+			attemptBytes += bytes
+			if attemptBytes > reported {
+				// size of archive is not known till it is created
+				plan.notify(Event{Type: EventBytesUploaded, Archive: archName, Bytes: attemptBytes - reported})
+				reported = attemptBytes
+			}
+		})
+		var uploadErr error
+		archiveStorageInfo, uploadErr = streamer.UploadStream(progressCtx, pipeReader, remoteFileName)
+		// archiving is stopped, if upload failed before the whole archive is read
+		pipeReader.CloseWithError(uploadErr)
+		archiveErr = <-archived
+		// archiving fails by itself, or because upload is failed and stopped reading
+		if archiveErr != nil && !errors.Is(archiveErr, uploadErr) {
+			if uploadErr == nil {
+				plan.Storage.DeleteFile(context.Background(), archiveStorageInfo)
+			}
+			return archiveErr
+		}
+		archiveErr = nil
+		return uploadErr
+	})
+	if archiveErr != nil {
+		return archiveErr
+	}
+	if err != nil {
+		return &StorageError{Op: "uploading archive " + archName, Err: err}
+	}
+
+	result.addSkipped(nodesErr)
+	if len(doneNodes) == 0 {
+		base.Log.Printf("Archive %v is deleted from storage, no files of chunk could be read", archName)
+		if err := plan.deleteFile(ctx, archiveStorageInfo); err != nil {
+			base.LogErr.Println(err)
+		}
+		return nil
+	}
+	base.Log.Printf("Archive %v created and uploaded to storage", archName)
+
+	archMeta := NewMetaFile(doneNodes, plan.Encrypt)
+	if plan.Dedup {
+		archMeta.SetPackChunks(packChunks)
+		for _, packChunk := range packChunks {
+			knownChunks[packChunk.hash] = ChunkLocation{archNameId: GetArchNameId(archName), chunk: packChunk}
+		}
+	} else if isTarFormat(archFormat) {
+		archMeta.SetFormat(archFormat)
+	}
+	bytesUploaded, err := plan.uploadArchiveMetaFile(ctx, archName, archMeta, archiveStorageInfo, "", archSize)
+	if err != nil {
+		return err
+	}
+	result.addUploaded(archName, len(doneNodes), bytesUploaded)
 	return nil
 }
 
-func (plan BackupPlan) uploadArchiveToStorage(archName string) {
+// returns number of bytes uploaded to storage,
+// archive failed to upload (or upload is canceled) stays in tmp dir with its metafile,
+// failures of storage are returned as StorageError
+func (plan BackupPlan) uploadArchiveToStorage(ctx context.Context, archName string) (int64, error) {
+	if err := plan.waitForUploadWindow(ctx); err != nil {
+		return 0, err
+	}
 	// заливаем архив в хранилище
 	archMetaFilepath := filepath.Join(plan.TmpDir, GetMetaFileName(archName))
-	archMeta := GetMetaFile(archMetaFilepath)
+	archMeta, err := GetMetaFile(archMetaFilepath)
+	if err != nil {
+		return 0, err
+	}
 
-	archFilepath := filepath.Join(plan.TmpDir, fmt.Sprint(archName, ".zip"))
-	archiveStorageInfo, err := plan.Storage.UploadFile(archFilepath, "")
+	archFilepath := filepath.Join(plan.TmpDir, GetArchiveFileName(archName, archMeta.GetFormat()))
+	archFileInfo, err := os.Stat(archFilepath)
+	if err != nil {
+		return 0, err
+	}
+	remoteFileName, err := plan.getRemoteArchiveFileName()
 	if err != nil {
-		base.LogErr.Fatalln(err)
+		return 0, err
+	}
+	// repeated or resumed upload reports bytes sent by previous attempts again, they are not counted twice
+	var reported int64
+	var archiveStorageInfo map[string]string
+	err = plan.retryStorageRequest(ctx, "uploading archive "+archName, func() error {
+		var attemptBytes int64
+		progressCtx := storageutils.WithUploadProgress(plan.limitUploadRate(ctx), func(bytes int64) {
+			attemptBytes += bytes
+			if attemptBytes > reported {
+				plan.notify(Event{Type: EventBytesUploaded, Archive: archName, Bytes: attemptBytes - reported, TotalBytes: archFileInfo.Size()})
+				reported = attemptBytes
+			}
+		})
+		archiveStorageInfo, err = plan.Storage.UploadFile(progressCtx, archFilepath, remoteFileName)
+		return err
+	})
+	if err != nil {
+		return 0, &StorageError{Op: "uploading archive " + archName, Err: err}
 	}
 	base.Log.Printf("Archive %v uploaded to storage", archName)
+	return plan.uploadArchiveMetaFile(ctx, archName, archMeta, archiveStorageInfo, archFilepath, archFileInfo.Size())
+}
+
+// saves metafile of archive uploaded to storage and uploads it, archive is deleted from storage, if it fails.
+// Staged archive file (if any) is removed after upload, metafile is moved to the base directory.
+// Returns number of bytes uploaded with archive
+func (plan BackupPlan) uploadArchiveMetaFile(ctx context.Context, archName string, archMeta ArchiveMetafile,
+	archiveStorageInfo map[string]string, archFilepath string, archSize int64) (int64, error) {
+
+	archMetaFilepath := filepath.Join(plan.TmpDir, GetMetaFileName(archName))
+	bytesUploaded := archSize
 	archMeta.SetStorageInfo(archiveStorageInfo)
-	err = archMeta.SaveMetaFile(archMetaFilepath)
+	if plan.IsObfuscateNames() {
+		remoteName, err := GetObfuscatedFileName(obfuscatedMetaFileExt)
+		if err != nil {
+			// archive is uploaded again by the next run
+			plan.Storage.DeleteFile(context.Background(), archiveStorageInfo)
+			return 0, err
+		}
+		archMeta.SetRemoteName(GetMetaFileName(archName), remoteName)
+	}
+	err := archMeta.SaveMetaFile(archMetaFilepath)
 	if err != nil {
 		os.Remove(archMetaFilepath)
-		os.Remove(archFilepath)
-		plan.Storage.DeleteFile(archiveStorageInfo)
-		base.LogErr.Fatalln(err)
+		if archFilepath != "" {
+			os.Remove(archFilepath)
+		}
+		plan.Storage.DeleteFile(context.Background(), archiveStorageInfo)
+		return 0, err
 	}
 
 	// заливаем метафайл в хранилище
@@ -414,23 +924,37 @@ func (plan BackupPlan) uploadArchiveToStorage(archName string) {
 	var encArchMetaFilepath string
 	if plan.Encrypt {
 		encArchMetaFilepath = filepath.Join(filepath.Dir(archMetaFilepath), GetMetaFileNameEnc(archName))
-		err = crypter.EncryptFile(plan.Encrypt_passphrase, archMetaFilepath, encArchMetaFilepath)
+		err = plan.encryptFile(ctx, archMetaFilepath, encArchMetaFilepath)
 		if err != nil {
-			base.LogErr.Fatalf("Error while encrypting metafile: %v\n", err)
+			plan.Storage.DeleteFile(context.Background(), archiveStorageInfo)
+			return 0, fmt.Errorf("Error while encrypting metafile: %w", err)
 		}
 		metaFilePathToUpload = encArchMetaFilepath
 	}
 
-	_, err = plan.Storage.UploadFile(metaFilePathToUpload, "")
+	_, err = plan.uploadFile(ctx, metaFilePathToUpload, archMeta.remote_name)
 	if err != nil {
-		plan.Storage.DeleteFile(archiveStorageInfo)
-		base.LogErr.Fatalf("Error while uploading metafile to storage: %v\n", err)
+		// archive is deleted even if upload is canceled, it is uploaded again by the next run
+		plan.Storage.DeleteFile(context.Background(), archiveStorageInfo)
+		if archFilepath == "" {
+			// streamed archive is created again by the next run
+			os.Remove(archMetaFilepath)
+			if plan.Encrypt {
+				os.Remove(encArchMetaFilepath)
+			}
+		}
+		return 0, &StorageError{Op: "uploading metafile of archive " + archName, Err: err}
+	}
+	if metaFileInfo, err := os.Stat(metaFilePathToUpload); err == nil {
+		bytesUploaded += metaFileInfo.Size()
 	}
 	base.Log.Printf("Metafile for archive %v uploaded to storage", archName)
 
-	err = os.Remove(archFilepath)
-	if err != nil {
-		base.LogErr.Println(err)
+	if archFilepath != "" {
+		err = os.Remove(archFilepath)
+		if err != nil {
+			base.LogErr.Println(err)
+		}
 	}
 	if plan.Encrypt {
 		err = os.Remove(encArchMetaFilepath)
@@ -443,40 +967,78 @@ func (plan BackupPlan) uploadArchiveToStorage(archName string) {
 		base.LogErr.Println(err)
 	}
 	base.Log.Printf("Metafile for archive %v moved to the base directory", archName)
+	plan.notify(Event{Type: EventArchiveUploaded, Archive: archName, Bytes: archSize})
+	return bytesUploaded, nil
 }
 
-func (plan BackupPlan) SyncMeta(cleanLocalMeta bool) error {
+// metafiles downloaded from storage by sync run
+type SyncResult struct {
+	MetaFiles []string
+}
+
+// sync lock is removed when sync is canceled, metafiles downloaded already are kept
+func (plan BackupPlan) SyncMeta(ctx context.Context, cleanLocalMeta bool) (SyncResult, error) {
 	base.Log.Printf("Trying to sync metafiles from storage for plan: %v\n", plan.Name)
+	var result SyncResult
 	syncLocked := plan.CheckOpLocked("sync")
 
-	if !syncLocked && len(plan.GetMetaFiles()) != 0 {
+	localMetaFiles, err := plan.GetMetaFiles()
+	if err != nil {
+		return result, err
+	}
+	if !syncLocked && len(localMetaFiles) != 0 {
 		if cleanLocalMeta {
-			err := plan.CleanLocalMeta()
-			if err != nil {
-				return err
+			if err = plan.CleanLocalMeta(); err != nil {
+				return result, err
 			}
 		} else {
-			return base.ErrLocalMetaExists
+			return result, base.ErrLocalMetaExists
 		}
 	}
 
 	if err := plan.CreateOpLock("sync"); err != nil {
-		return err
+		return result, err
 	}
+	defer func() {
+		if ctx.Err() != nil {
+			if err := plan.RemoveOpLock("sync"); err != nil {
+				base.LogErr.Println(err)
+			}
+		}
+	}()
 
 	base.Log.Printf("Start doing sync metafiles from storage for plan: %v\n", plan.Name)
 
-	remoteMetaFiles, err := plan.GetRemoteMetaFiles()
+	remoteFiles, err := plan.getFilesList(ctx)
+	if err == base.ErrStorageRequestInProgress {
+		plan.notify(Event{Type: EventStorageWaiting})
+	}
 	if err != nil {
-		return err
+		return result, err
+	}
+	if err = plan.syncMasterKey(ctx, remoteFiles); err != nil {
+		return result, err
+	}
+	remoteMetaFiles := filterRemoteMetaFiles(remoteFiles)
+	localMetaFiles, err = plan.GetMetaFiles()
+	if err != nil {
+		return result, err
 	}
 	localMetaFilesMap := make(map[string]bool)
-	for _, lmf := range plan.GetMetaFiles() {
+	for _, lmf := range localMetaFiles {
 		localMetaFilesMap[lmf] = true
 	}
+	obfuscatedMetaFilesMap, err := plan.getMetaFilesByRemoteName()
+	if err != nil {
+		return result, err
+	}
 	var procMetaFiles []base.GenericStorageFileInfo
 	for _, rmf := range remoteMetaFiles {
-		if cf, _ := CleanMetaFileNameEnc(rmf.GetFilename()); !localMetaFilesMap[cf] {
+		if GetObfuscatedMetaFileNameRE().MatchString(rmf.GetFilename()) {
+			if _, exists := obfuscatedMetaFilesMap[rmf.GetFilename()]; !exists {
+				procMetaFiles = append(procMetaFiles, rmf)
+			}
+		} else if cf, _ := CleanMetaFileNameEnc(rmf.GetFilename()); !localMetaFilesMap[cf] {
 			procMetaFiles = append(procMetaFiles, rmf)
 		}
 	}
@@ -486,16 +1048,23 @@ func (plan BackupPlan) SyncMeta(cleanLocalMeta bool) error {
 		base.Log.Printf("Start downloading metafile %v\n", pmf.GetFilename())
 		cf, encrypted := CleanMetaFileNameEnc(pmf.GetFilename())
 
-		downloadedFilePath := filepath.Join(plan.BaseDir, cf)
-		err := plan.DownloadAndDecryptFile(pmf.GetFileStorageId(), downloadedFilePath, encrypted)
+		var err error
+		if GetObfuscatedMetaFileNameRE().MatchString(pmf.GetFilename()) {
+			cf, err = plan.downloadObfuscatedMetaFile(ctx, pmf)
+			encrypted = true
+		} else {
+			downloadedFilePath := filepath.Join(plan.BaseDir, cf)
+			err = plan.DownloadAndDecryptFile(ctx, pmf.GetFileStorageId(), downloadedFilePath, encrypted)
+		}
 		if err != nil {
 			if err == base.ErrStorageRequestInProgress {
 				base.Log.Println(err)
 				errInProgress = true
 			} else {
-				return err
+				return result, err
 			}
 		} else {
+			result.MetaFiles = append(result.MetaFiles, cf)
 			if encrypted {
 				base.Log.Printf("Finish downloading metafile %v and decrypting to %v\n",
 					pmf.GetFilename(), cf)
@@ -510,10 +1079,28 @@ func (plan BackupPlan) SyncMeta(cleanLocalMeta bool) error {
 		if err == nil {
 			base.Log.Printf("Finish doing sync metafiles from storage for plan: %v\n", plan.Name)
 		}
-		return err
+		return result, err
 	} else {
 		base.Log.Printf("Start doing sync metafiles from storage for plan: %v\n", plan.Name)
-		return base.ErrStorageRequestInProgress
+		plan.notify(Event{Type: EventStorageWaiting})
+		return result, base.ErrStorageRequestInProgress
+	}
+}
+
+// removes state of resumable uploads of file, which storage keeps next to it as <file>.<storage>.upload (e.g. Glacier)
+func removeUploadStateFiles(filePath string) {
+	entries, err := os.ReadDir(filepath.Dir(filePath))
+	if err != nil {
+		base.LogErr.Println(err)
+		return
+	}
+	prefix := filepath.Base(filePath) + "."
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), prefix) && strings.HasSuffix(entry.Name(), ".upload") {
+			if err := os.Remove(filepath.Join(filepath.Dir(filePath), entry.Name())); err != nil {
+				base.LogErr.Println(err)
+			}
+		}
 	}
 }
 
@@ -523,7 +1110,11 @@ func (plan BackupPlan) CleanLocalMeta() error {
 		return err
 	}
 
-	for _, filename := range plan.GetMetaFiles() {
+	metafiles, err := plan.GetMetaFiles()
+	if err != nil {
+		return err
+	}
+	for _, filename := range metafiles {
 		err := os.Remove(filename)
 		if err != nil {
 			return err
@@ -6,11 +6,15 @@ import (
 
 	"github.com/n-boy/backuper/ut/testutils"
 
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"testing"
+	"time"
 )
 
 type FilesysTestCase struct {
@@ -129,8 +133,11 @@ func TestGetProcessNodes(t *testing.T) {
 			t.Fatalf("Test died. Step: %v, Name: %v, error: %v\n", step, tc.name, err)
 		}
 
-		guardNodes := plan.GetGuardedNodes()
-		archNodesMap := plan.GetArchivedNodesMap()
+		guardNodes, _ := plan.GetGuardedNodes()
+		archNodesMap, err := plan.GetArchivedNodesMap()
+		if err != nil {
+			t.Fatalf("Test died. Error while reading archived nodes: %v\n", err)
+		}
 
 		procNodes := plan.GetProcessNodes(guardNodes, archNodesMap)
 		var procNodesPathes sort.StringSlice
@@ -164,8 +171,91 @@ func TestGetProcessNodes(t *testing.T) {
 			}
 		}
 
-		if err := plan.DoBackup(); err != nil {
+		if _, err := plan.DoBackup(context.Background()); err != nil {
 			t.Fatalf("Test died. Step: %v, Name: %v, error: %v\n", step, tc.name, err)
 		}
 	}
 }
+
+func TestTypedErrors(t *testing.T) {
+	tfs := testutils.CreateTestFileSystem()
+	defer tfs.Destroy()
+
+	base.InitApp(base.AppConfig{
+		AppDir:         tfs.AppPath(),
+		LogToStdout:    false,
+		LogErrToStderr: false,
+	})
+	plan := testutils.CreateTestPlan(tfs, core.DefaultChunkSizeMB*1024*1024)
+
+	_, err := core.GetBackupPlan("not_existing_plan")
+	var planErr *core.PlanNotFoundError
+	if !errors.As(err, &planErr) {
+		t.Errorf("Test failed. Error for not existing plan not as expected: %v\n", err)
+	}
+
+	if err := tfs.ApplyCmds(testutils.CmdsToApply{"create": {"dir1/file1.txt"}}); err != nil {
+		t.Fatalf("Test died. Error while creating files: %v\n", err)
+	}
+	if _, err := plan.DoBackup(context.Background()); err != nil {
+		t.Fatalf("Test died. Error while backuping files: %v\n", err)
+	}
+	metaFiles, err := plan.GetMetaFiles()
+	if err != nil || len(metaFiles) != 1 {
+		t.Fatalf("Test died. Metafiles not as expected: %v, error: %v\n", metaFiles, err)
+	}
+	err = ioutil.WriteFile(filepath.Join(plan.BaseDir, metaFiles[0]), []byte("garbage"), 0600)
+	if err != nil {
+		t.Fatalf("Test died. Error while corrupting metafile: %v\n", err)
+	}
+
+	var metaErr *core.MetafileError
+	if _, err := plan.GetArchivedNodesMap(); !errors.As(err, &metaErr) {
+		t.Errorf("Test failed. Error for corrupted metafile not as expected: %v\n", err)
+	}
+	if _, err := plan.DoBackup(context.Background()); !errors.As(err, &metaErr) {
+		t.Errorf("Test failed. Backup error for corrupted metafile not as expected: %v\n", err)
+	}
+}
+
+func TestUploadWindows(t *testing.T) {
+	// 2024-01-05 is Friday
+	at := func(day int, hour int, min int) time.Time {
+		return time.Date(2024, 1, day, hour, min, 0, 0, time.Local)
+	}
+	testCases := []struct {
+		window    string
+		t         time.Time
+		contains  bool
+		nextStart time.Time
+	}{
+		{"22:00-06:00 mon-fri", at(5, 23, 0), true, at(5, 23, 0)},
+		{"22:00-06:00 mon-fri", at(6, 5, 59), true, at(6, 5, 59)},
+		{"22:00-06:00 mon-fri", at(6, 6, 0), false, at(8, 22, 0)},
+		{"22:00-06:00 mon-fri", at(5, 12, 0), false, at(5, 22, 0)},
+		{"22:00-06:00 mon-fri", at(7, 23, 0), false, at(8, 22, 0)},
+		{"00:00-24:00 sat,sun", at(7, 23, 59), true, at(7, 23, 59)},
+		{"00:00-24:00 sat,sun", at(5, 10, 0), false, at(6, 0, 0)},
+		{"09:30-10:00 fri-mon", at(8, 9, 45), true, at(8, 9, 45)},
+		{"09:30-10:00", at(3, 10, 0), false, at(4, 9, 30)},
+	}
+	for _, tc := range testCases {
+		w, err := core.ParseUploadWindow(tc.window)
+		if err != nil {
+			t.Errorf("Test failed. Error while parsing upload window %q: %v\n", tc.window, err)
+			continue
+		}
+		if w.Contains(tc.t) != tc.contains {
+			t.Errorf("Test failed. Upload window %q contains %v: got %v, expected %v\n", tc.window, tc.t, !tc.contains, tc.contains)
+		}
+		if start := core.GetUploadWindowStart([]core.UploadWindow{w}, tc.t); !start.Equal(tc.nextStart) {
+			t.Errorf("Test failed. Start of upload window %q after %v: got %v, expected %v\n", tc.window, tc.t, start, tc.nextStart)
+		}
+	}
+
+	for _, text := range []string{"", "22:00", "22:00-25:00", "24:00-06:00", "22:00-06:00 mon-", "22:00-06:00 monday", "10:00-12:00 mon fri"} {
+		if _, err := core.ParseUploadWindow(text); err == nil {
+			t.Errorf("Test failed. Invalid upload window %q is parsed\n", text)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/n-boy/backuper/base"
+	"github.com/n-boy/backuper/crypter"
+)
+
+const pruneOp string = "prune"
+
+// retention policy of plan, all zero values mean that all archives are kept forever
+type RetentionPolicy struct {
+	// revisions of each file to keep, at least the last revision is always kept
+	KeepLast int
+	// latest restore points of the last N days (weeks, months) having restore points to keep
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	// revisions of files deleted locally are dropped, when the last revision is older than N days
+	DeletedFilesDays int
+	// zip archives holding less than N% of needed data are repacked, 0 - repack is disabled
+	RepackThresholdPct int
+}
+
+type yamlRetentionPolicy struct {
+	KeepLast           int `yaml:"keep_last,omitempty"`
+	KeepDaily          int `yaml:"keep_daily,omitempty"`
+	KeepWeekly         int `yaml:"keep_weekly,omitempty"`
+	KeepMonthly        int `yaml:"keep_monthly,omitempty"`
+	DeletedFilesDays   int `yaml:"deleted_files_days,omitempty"`
+	RepackThresholdPct int `yaml:"repack_threshold_pct,omitempty"`
+}
+
+// archives to delete from storage, and archives to repack with nodes to keep in them
+type PrunePlan struct {
+	Delete MetafileList
+	Repack map[string][]NodeMetaInfo
+}
+
+type PruneResult struct {
+	Deleted  MetafileList
+	Repacked MetafileList
+}
+
+func (policy RetentionPolicy) IsEnabled() bool {
+	return policy != RetentionPolicy{}
+}
+
+// returns archives, that do not hold any revision needed by retention policy,
+// and zip archives, that hold too small part of needed data
+func (plan BackupPlan) GetPrunePlan() (PrunePlan, error) {
+	prunePlan := PrunePlan{Repack: make(map[string][]NodeMetaInfo)}
+	if !plan.Retention.IsEnabled() {
+		return prunePlan, fmt.Errorf("Retention policy is not set up for plan")
+	}
+
+	metaFiles, err := plan.GetMetaFiles()
+	if err != nil || len(metaFiles) == 0 {
+		return prunePlan, err
+	}
+	mfs := make([]ArchiveMetafile, len(metaFiles))
+	for i, metaFile := range metaFiles {
+		if mfs[i], err = plan.GetMetaFile(metaFile); err != nil {
+			return prunePlan, err
+		}
+	}
+
+	// revisions of each path, as indexes of metafiles in ascending order
+	revisions := make(map[string][]int)
+	for i, mf := range mfs {
+		for _, node := range mf.GetNodes() {
+			revisions[node.path] = append(revisions[node.path], i)
+		}
+	}
+
+	localNodes := make(map[string]bool)
+	guardNodes, guardErrors := plan.GetGuardedNodes()
+	for _, node := range guardNodes {
+		localNodes[node.path] = true
+	}
+	// files under paths that could not be read are not considered as deleted
+	isLocalNode := func(path string) bool {
+		if localNodes[path] {
+			return true
+		}
+		for _, nodeErr := range guardErrors {
+			if base.IsPathInBasePath(nodeErr.Path, path) {
+				return true
+			}
+		}
+		return false
+	}
+
+	keepPoints := plan.getRestorePointsToKeep(mfs)
+
+	// archives needed by revisions: archive index -> paths of needed revisions in it
+	neededRevs := make(map[int]map[string]bool)
+	keepRev := func(path string, i int) {
+		if neededRevs[i] == nil {
+			neededRevs[i] = make(map[string]bool)
+		}
+		neededRevs[i][path] = true
+	}
+	deletedBorder := time.Now().AddDate(0, 0, -plan.Retention.DeletedFilesDays)
+	for path, revs := range revisions {
+		if plan.Retention.DeletedFilesDays > 0 && !isLocalNode(path) &&
+			mfs[revs[len(revs)-1]].GetMetaFileCreateDate().Before(deletedBorder) {
+			continue
+		}
+
+		keepLast := plan.Retention.KeepLast
+		if keepLast < 1 {
+			keepLast = 1
+		}
+		for j := len(revs) - 1; j >= 0 && j >= len(revs)-keepLast; j-- {
+			keepRev(path, revs[j])
+		}
+
+		// revision actual at restore point is the latest one not after it
+		for _, point := range keepPoints {
+			j := sort.SearchInts(revs, point+1) - 1
+			if j >= 0 {
+				keepRev(path, revs[j])
+			}
+		}
+	}
+
+	// packs are needed while they hold chunks of needed revisions
+	neededChunks := make(map[string]bool)
+	for i, paths := range neededRevs {
+		for _, node := range mfs[i].GetNodes() {
+			if paths[node.path] {
+				for _, hash := range node.chunks {
+					neededChunks[hash] = true
+				}
+			}
+		}
+	}
+
+	for i, metaFile := range metaFiles {
+		mf := mfs[i]
+		if mf.GetFormat() == PackArchiveFormat {
+			// chunks of pack are shared with other archives, so packs are not repacked
+			needed := neededRevs[i] != nil
+			for _, chunk := range mf.GetPackChunks() {
+				if needed {
+					break
+				}
+				needed = neededChunks[chunk.hash]
+			}
+			if !needed {
+				prunePlan.Delete = append(prunePlan.Delete, metaFile)
+			}
+			continue
+		}
+
+		if neededRevs[i] == nil {
+			prunePlan.Delete = append(prunePlan.Delete, metaFile)
+			continue
+		}
+		if plan.Retention.RepackThresholdPct == 0 || len(neededRevs[i]) == len(mf.GetNodes()) {
+			continue
+		}
+		// archive encrypted to public keys can not be repacked without private key
+		if mf.encrypted && plan.IsPublicKeyEncryption() && plan.Decrypt_identity == "" {
+			continue
+		}
+		var totalSize, neededSize int64
+		var neededNodes []NodeMetaInfo
+		for _, node := range mf.GetNodes() {
+			totalSize += node.size
+			if neededRevs[i][node.path] {
+				neededSize += node.size
+				neededNodes = append(neededNodes, node)
+			}
+		}
+		if neededSize*100 < totalSize*int64(plan.Retention.RepackThresholdPct) {
+			prunePlan.Repack[metaFile] = neededNodes
+		}
+	}
+
+	return prunePlan, nil
+}
+
+// returns indexes of metafiles, which are restore points kept by daily, weekly and monthly rules
+func (plan BackupPlan) getRestorePointsToKeep(metaFiles []ArchiveMetafile) []int {
+	periodKeys := []struct {
+		qty int
+		key func(t time.Time) string
+	}{
+		{plan.Retention.KeepDaily, func(t time.Time) string {
+			return t.Format("2006-01-02")
+		}},
+		{plan.Retention.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%v-%v", year, week)
+		}},
+		{plan.Retention.KeepMonthly, func(t time.Time) string {
+			return t.Format("2006-01")
+		}},
+	}
+
+	var keepPoints []int
+	for _, period := range periodKeys {
+		periodsSeen := make(map[string]bool)
+		for i := len(metaFiles) - 1; i >= 0 && len(periodsSeen) < period.qty; i-- {
+			key := period.key(metaFiles[i].GetMetaFileCreateDate())
+			if !periodsSeen[key] {
+				periodsSeen[key] = true
+				keepPoints = append(keepPoints, i)
+			}
+		}
+	}
+	return keepPoints
+}
+
+// deletes archives not needed by retention policy from storage, with their remote and local metafiles,
+// and repacks archives holding small part of needed data.
+// Prune lock is removed when prune is canceled, because prune plan is built again by the next run
+func (plan BackupPlan) DoPrune(ctx context.Context) (PruneResult, error) {
+	var result PruneResult
+
+	base.Log.Printf("Trying to start prune for plan: %v\n", plan.Name)
+	prunePlan, err := plan.GetPrunePlan()
+	if err != nil || len(prunePlan.Delete)+len(prunePlan.Repack) == 0 {
+		return result, err
+	}
+
+	if err := plan.CreateOpLock(pruneOp); err != nil {
+		return result, err
+	}
+	defer func() {
+		if ctx.Err() != nil {
+			if err := plan.RemoveOpLock(pruneOp); err != nil {
+				base.LogErr.Println(err)
+			}
+		}
+	}()
+
+	base.Log.Printf("Start doing prune for plan: %v\n", plan.Name)
+	// remote metafiles are needed to be listed before deleting of anything,
+	// so prune could be just repeated if storage request is in progress
+	remoteMetaFiles, err := plan.GetRemoteMetaFiles(ctx)
+	if err != nil {
+		return result, err
+	}
+	remoteMetaFilesMap, err := plan.getRemoteMetaFilesMap(remoteMetaFiles)
+	if err != nil {
+		return result, err
+	}
+
+	for _, metaFile := range prunePlan.Delete {
+		if err = ctx.Err(); err != nil {
+			return result, err
+		}
+		// remote metafile is deleted first, otherwise sync could bring back metafile of deleted archive
+		if rmf, exists := remoteMetaFilesMap[metaFile]; exists {
+			if err = plan.deleteFile(ctx, rmf.GetFileStorageId()); err != nil {
+				return result, err
+			}
+		}
+		mf, err := plan.GetMetaFile(metaFile)
+		if err != nil {
+			return result, err
+		}
+		if err = plan.deleteFile(ctx, mf.GetStorageInfo()); err != nil {
+			return result, err
+		}
+		if err = os.Remove(filepath.Join(plan.BaseDir, metaFile)); err != nil {
+			return result, err
+		}
+		delete(plan.cacheMetaFiles, metaFile)
+		result.Deleted = append(result.Deleted, metaFile)
+		base.Log.Printf("Archive %v deleted from storage\n", GetArchName(metaFile))
+	}
+
+	if len(prunePlan.Repack) > 0 {
+		if err = plan.CheckTmpDir(); err != nil {
+			return result, err
+		}
+	}
+	errInProgress := false
+	for _, metaFile := range sortedMetaFiles(prunePlan.Repack) {
+		if err = ctx.Err(); err != nil {
+			return result, err
+		}
+		err = plan.repackArchive(ctx, metaFile, prunePlan.Repack[metaFile], remoteMetaFilesMap[metaFile])
+		if err == base.ErrStorageRequestInProgress {
+			base.Log.Println(err)
+			errInProgress = true
+			continue
+		} else if err != nil {
+			return result, err
+		}
+		result.Repacked = append(result.Repacked, metaFile)
+		base.Log.Printf("Archive %v repacked\n", GetArchName(metaFile))
+	}
+	if errInProgress {
+		plan.notify(Event{Type: EventStorageWaiting})
+		return result, base.ErrStorageRequestInProgress
+	}
+
+	err = plan.RemoveOpLock(pruneOp)
+	if err == nil {
+		base.Log.Printf("Finish doing prune for plan: %v\n", plan.Name)
+	}
+	return result, err
+}
+
+// replaces archive in storage by new one containing only nodes to keep,
+// name of metafile is kept, so restore points and order of revisions are not changed
+func (plan BackupPlan) repackArchive(ctx context.Context, metaFile string, nodes []NodeMetaInfo, remoteMetaFile base.GenericStorageFileInfo) error {
+	archName := GetArchName(metaFile)
+	mf, err := plan.GetMetaFile(metaFile)
+	if err != nil {
+		return err
+	}
+	archFileName := GetArchiveFileName(archName, mf.GetFormat())
+
+	srcArchFilePath := filepath.Join(plan.TmpDir, "repack_"+archFileName)
+	if _, err := os.Stat(srcArchFilePath); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		base.Log.Printf("Start downloading archive %v\n", archFileName)
+		if err = plan.DownloadAndDecryptFile(ctx, mf.GetStorageInfo(), srcArchFilePath, mf.encrypted); err != nil {
+			return err
+		}
+		base.Log.Printf("Finish downloading archive %v\n", archFileName)
+	}
+
+	var encrypter *crypter.Encrypter
+	if plan.Encrypt {
+		var err error
+		if encrypter, err = plan.getEncrypter(ctx); err != nil {
+			return err
+		}
+	}
+	archFilePath := filepath.Join(plan.TmpDir, GetRepackedArchiveFileName(archName, mf.GetFormat()))
+	if isTarFormat(mf.GetFormat()) {
+		err = RepackTarNodes(srcArchFilePath, mf.GetFormat(), plan.Compression.Level, nodes, archFilePath, encrypter)
+	} else {
+		err = RepackNodes(srcArchFilePath, nodes, archFilePath, encrypter)
+	}
+	if err != nil {
+		os.Remove(archFilePath)
+		return err
+	}
+
+	remoteFileName, err := plan.getRemoteArchiveFileName()
+	if err != nil {
+		os.Remove(archFilePath)
+		return err
+	}
+	archiveStorageInfo, err := plan.uploadFile(ctx, archFilePath, remoteFileName)
+	if err != nil {
+		os.Remove(archFilePath)
+		return err
+	}
+	archMetaFilepath := filepath.Join(plan.TmpDir, metaFile)
+	// new archive is deleted from storage, if its metafile is not uploaded, even if prune is canceled
+	metaUploaded := false
+	defer func() {
+		if !metaUploaded {
+			plan.Storage.DeleteFile(context.Background(), archiveStorageInfo)
+			os.Remove(archFilePath)
+			os.Remove(archMetaFilepath)
+		}
+	}()
+
+	archMeta := NewMetaFile(nodes, plan.Encrypt)
+	if isTarFormat(mf.GetFormat()) {
+		archMeta.SetFormat(mf.GetFormat())
+	}
+	archMeta.SetStorageInfo(archiveStorageInfo)
+	if mf.remote_name != "" && plan.Encrypt {
+		archMeta.SetRemoteName(metaFile, mf.remote_name)
+	} else if plan.IsObfuscateNames() {
+		remoteName, err := GetObfuscatedFileName(obfuscatedMetaFileExt)
+		if err != nil {
+			return err
+		}
+		archMeta.SetRemoteName(metaFile, remoteName)
+	}
+	if err = archMeta.SaveMetaFile(archMetaFilepath); err != nil {
+		return err
+	}
+
+	metaFilePathToUpload := archMetaFilepath
+	if plan.Encrypt {
+		metaFilePathToUpload = filepath.Join(plan.TmpDir, GetMetaFileNameEnc(archName))
+		if err = plan.encryptFile(ctx, archMetaFilepath, metaFilePathToUpload); err != nil {
+			return err
+		}
+		defer os.Remove(metaFilePathToUpload)
+	}
+	// remote metafile is replaced by new one with the same name, so storage always has metafile of archive
+	metaStorageInfo, err := plan.uploadFile(ctx, metaFilePathToUpload, archMeta.remote_name)
+	if err != nil {
+		return err
+	}
+	metaUploaded = true
+	if err = os.Rename(archMetaFilepath, filepath.Join(plan.BaseDir, metaFile)); err != nil {
+		return err
+	}
+	delete(plan.cacheMetaFiles, metaFile)
+
+	// storage keeping files by id (e.g. Glacier) doesn't replace files of the same name, old metafile is deleted then.
+	// Repacked archive is kept, if it fails, so any of metafiles in storage refers to existing archive
+	if remoteMetaFile != nil && !maps.Equal(remoteMetaFile.GetFileStorageId(), metaStorageInfo) {
+		if err = plan.deleteFile(ctx, remoteMetaFile.GetFileStorageId()); err != nil {
+			return err
+		}
+	}
+	if err = plan.deleteFile(ctx, mf.GetStorageInfo()); err != nil {
+		base.LogErr.Printf("Error while deleting repacked archive %v from storage: %v\n", archName, err)
+	}
+
+	if err = os.Remove(srcArchFilePath); err != nil {
+		base.LogErr.Println(err)
+	}
+	if err = os.Remove(archFilePath); err != nil {
+		base.LogErr.Println(err)
+	}
+	return nil
+}
+
+func sortedMetaFiles(metaFilesMap map[string][]NodeMetaInfo) MetafileList {
+	var metaFiles MetafileList
+	for metaFile := range metaFilesMap {
+		metaFiles = append(metaFiles, metaFile)
+	}
+	sort.Sort(metaFiles)
+	return metaFiles
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/n-boy/backuper/base"
 	"github.com/n-boy/backuper/crypter"
+	storageutils "github.com/n-boy/backuper/storage/utils"
 )
 
 const (
@@ -34,10 +36,17 @@ func (plan BackupPlan) CheckRestoreAllowed() error {
 	return plan.CheckOpLockAllowed("restore")
 }
 
-func (plan BackupPlan) GetRestorePoints(pathList []string) []ArchiveMetafile {
+func (plan BackupPlan) GetRestorePoints(pathList []string) ([]ArchiveMetafile, error) {
 	metaFiles := make([]ArchiveMetafile, 0)
-	for _, filename := range plan.GetMetaFiles() {
-		mf := plan.GetMetaFile(filename)
+	filenames, err := plan.GetMetaFiles()
+	if err != nil {
+		return metaFiles, err
+	}
+	for _, filename := range filenames {
+		mf, err := plan.GetMetaFile(filename)
+		if err != nil {
+			return metaFiles, err
+		}
 		for _, node := range mf.GetNodes() {
 			nodeInPath := false
 			for _, path := range pathList {
@@ -52,7 +61,7 @@ func (plan BackupPlan) GetRestorePoints(pathList []string) []ArchiveMetafile {
 			}
 		}
 	}
-	return metaFiles
+	return metaFiles, nil
 }
 
 func (plan BackupPlan) InitRestore(pathList []string, restorePoint *ArchiveMetafile, targetPath string) error {
@@ -94,10 +103,16 @@ func (plan BackupPlan) InitRestore(pathList []string, restorePoint *ArchiveMetaf
 		}
 	}
 
-	metaFiles := plan.GetMetaFiles()
+	metaFiles, err := plan.GetMetaFiles()
+	if err != nil {
+		return err
+	}
 	restorePointOk := false
 	for i := len(metaFiles) - 1; i >= 0; i-- {
-		mf := plan.GetMetaFile(metaFiles[i])
+		mf, err := plan.GetMetaFile(metaFiles[i])
+		if err != nil {
+			return err
+		}
 		if !restorePointOk && restorePoint != nil && mf.GetMetaFileId() != restorePoint.GetMetaFileId() {
 			continue
 		}
@@ -145,7 +160,7 @@ func (plan BackupPlan) InitRestore(pathList []string, restorePoint *ArchiveMetaf
 		return err
 	}
 
-	err := plan.SaveRestorePlan(RestorePlan{
+	err = plan.SaveRestorePlan(RestorePlan{
 		TargetPath:         targetPath,
 		ArchNodesToRestore: archNodesToRestore,
 	})
@@ -255,30 +270,60 @@ func (plan BackupPlan) getRestoredNodes() (map[string]bool, error) {
 	return restoredNodes, nil
 }
 
-func (plan BackupPlan) DoRestore() error {
+// files restored by restore run, restore could be continued by several runs
+type RestoreResult struct {
+	FilesRestored int
+}
+
+// restore could be canceled by context between archives, restore lock is removed then,
+// and the same restore initialized again skips files restored already
+func (plan BackupPlan) DoRestore(ctx context.Context) (RestoreResult, error) {
 	base.Log.Printf("Trying to start restore for plan: %v\n", plan.Name)
+	var result RestoreResult
 	rplan, err := plan.GetRestorePlan()
 	if err != nil {
-		return err
+		return result, err
 	}
 
 	if err := plan.CreateOpLock("restore"); err != nil {
-		return err
+		return result, err
 	}
+	defer func() {
+		if ctx.Err() != nil {
+			if err := plan.RemoveOpLock("restore"); err != nil {
+				base.LogErr.Println(err)
+			}
+		}
+	}()
 
 	base.Log.Printf("Start doing restore for plan: %v\n", plan.Name)
 	restoredNodes, err := plan.getRestoredNodes()
 	if err != nil {
-		return err
+		return result, err
 	}
 
+	restoreEvent := Event{Type: EventRestoreStarted}
+	for _, nodes := range rplan.ArchNodesToRestore {
+		for _, node := range nodes {
+			if !restoredNodes[node.GetNodePath()] {
+				restoreEvent.Files++
+				restoreEvent.Bytes += node.size
+			}
+		}
+	}
+	plan.notify(restoreEvent)
+
 	errInProgress := false
 	if err := plan.CheckTmpDir(); err != nil {
-		return err
+		return result, err
 	}
+	var chunksIndex map[string]ChunkLocation
 
 ARCH_LOOP:
 	for archNameId, nodes := range rplan.ArchNodesToRestore {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
 		nodesToRestore := make([]NodeMetaInfo, 0)
 		for _, node := range nodes {
 			if !restoredNodes[node.GetNodePath()] {
@@ -289,53 +334,97 @@ ARCH_LOOP:
 			// TODO если восстанавливаются только директории - не качать архив
 
 			archName := "archive_" + archNameId
-			mf := GetMetaFile(filepath.Join(plan.BaseDir, GetMetaFileName(archName)))
-			archLocalFilePath := filepath.Join(plan.TmpDir, "restore_archive_"+archName+".zip")
-			_, err := os.Stat(archLocalFilePath)
+			mf, err := GetMetaFile(filepath.Join(plan.BaseDir, GetMetaFileName(archName)))
 			if err != nil {
-				if os.IsNotExist(err) {
-					base.Log.Printf("Start downloading archive %v\n", archName+".zip")
-					err = plan.DownloadAndDecryptFile(mf.GetStorageInfo(), archLocalFilePath, mf.encrypted)
-					if err == nil {
-						base.Log.Printf("Finish downloading archive %v\n", archName+".zip")
+				return result, err
+			}
+
+			var nodesUnarch []NodeMetaInfo
+			if mf.GetFormat() == PackArchiveFormat {
+				if chunksIndex == nil {
+					if chunksIndex, err = plan.GetChunksIndex(); err != nil {
+						return result, err
+					}
+				}
+				packs, err := GetNodesPacks(nodesToRestore, chunksIndex)
+				if err != nil {
+					return result, err
+				}
+				packFilePaths := make(map[string]string)
+				for _, packNameId := range packs {
+					packFilePath, err := plan.downloadArchiveForRestore(ctx, "archive_"+packNameId)
+					if err != nil {
+						if err == base.ErrStorageRequestInProgress {
+							base.Log.Println(err)
+							errInProgress = true
+							continue ARCH_LOOP
+						} else {
+							return result, err
+						}
 					}
+					packFilePaths[packNameId] = packFilePath
 				}
+
+				nodesUnarch, err = UnpackNodes(nodesToRestore, rplan.TargetPath, chunksIndex, packFilePaths)
+				if err != nil {
+					return result, err
+				}
+			} else {
+				archLocalFilePath, err := plan.downloadArchiveForRestore(ctx, archName)
 				if err != nil {
 					if err == base.ErrStorageRequestInProgress {
 						base.Log.Println(err)
 						errInProgress = true
 						continue ARCH_LOOP
 					} else {
-						return err
+						return result, err
 					}
 				}
-			}
 
-			nodesUnarch, err := UnarchiveNodes(archLocalFilePath, nodesToRestore, rplan.TargetPath)
-			if err != nil {
-				return err
+				if isTarFormat(mf.GetFormat()) {
+					nodesUnarch, err = UntarNodes(archLocalFilePath, mf.GetFormat(), nodesToRestore, rplan.TargetPath)
+				} else {
+					nodesUnarch, err = UnarchiveNodes(archLocalFilePath, nodesToRestore, rplan.TargetPath)
+				}
+				if err != nil {
+					return result, err
+				}
+				if err = os.Remove(archLocalFilePath); err != nil {
+					base.LogErr.Println(err)
+				}
 			}
 
 			fh, err := os.OpenFile(plan.getRestorePlanDoneFilePath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 			if err != nil {
-				return err
+				return result, err
 			}
 			defer fh.Close()
 			for _, node := range nodesUnarch {
 				if _, err := fh.WriteString(node.GetNodePath() + "\r\n"); err != nil {
-					return err
+					return result, err
 				}
+				plan.notify(Event{Type: EventFileRestored, Path: node.GetNodePath(), Bytes: node.size})
 			}
 			if err = fh.Close(); err != nil {
-				return err
-			}
-			if err = os.Remove(archLocalFilePath); err != nil {
-				base.LogErr.Println(err)
+				return result, err
 			}
+			result.FilesRestored += len(nodesUnarch)
 		}
 	}
 	if errInProgress {
-		return base.ErrStorageRequestInProgress
+		plan.notify(Event{Type: EventStorageWaiting})
+		return result, base.ErrStorageRequestInProgress
+	}
+
+	// packs are kept until the end of restore, because chunks of files from different archives could be in them
+	packFiles, err := filepath.Glob(filepath.Join(plan.TmpDir, "restore_archive_*."+PackArchiveFormat))
+	if err != nil {
+		return result, err
+	}
+	for _, packFile := range packFiles {
+		if err = os.Remove(packFile); err != nil {
+			base.LogErr.Println(err)
+		}
 	}
 
 	if err = os.Remove(plan.getRestorePlanDoneFilePath()); err != nil {
@@ -348,7 +437,7 @@ ARCH_LOOP:
 	if err == nil {
 		base.Log.Printf("Finish doing restore for plan: %v\n", plan.Name)
 	}
-	return err
+	return result, err
 	// достаем список уже восстановленных файлов
 	// для каждого архива из файла
 	// 	- определяем файлы которые еще не восстановили
@@ -360,7 +449,35 @@ ARCH_LOOP:
 	// 	- удаляем архив
 }
 
-func (plan BackupPlan) DownloadAndDecryptFile(fileStorageInfo map[string]string, localFilePath string, isEncrypted bool) error {
+// downloads archive to tmp dir, if it is not downloaded yet, and returns local path to it
+func (plan BackupPlan) downloadArchiveForRestore(ctx context.Context, archName string) (string, error) {
+	mf, err := GetMetaFile(filepath.Join(plan.BaseDir, GetMetaFileName(archName)))
+	if err != nil {
+		return "", err
+	}
+	archFileName := GetArchiveFileName(archName, mf.GetFormat())
+	archLocalFilePath := filepath.Join(plan.TmpDir, "restore_"+archFileName)
+
+	_, err = os.Stat(archLocalFilePath)
+	if err != nil && os.IsNotExist(err) {
+		base.Log.Printf("Start downloading archive %v\n", archFileName)
+		err = plan.DownloadAndDecryptFile(ctx, mf.GetStorageInfo(), archLocalFilePath, mf.encrypted)
+		if err == nil {
+			base.Log.Printf("Finish downloading archive %v\n", archFileName)
+		}
+	}
+	return archLocalFilePath, err
+}
+
+// partly downloaded file is removed, if download fails or is canceled,
+// download failed with transient error is started from scratch according to retry policy of plan
+func (plan BackupPlan) DownloadAndDecryptFile(ctx context.Context, fileStorageInfo map[string]string, localFilePath string, isEncrypted bool) error {
+	return plan.retryStorageRequest(ctx, "downloading file "+filepath.Base(localFilePath), func() error {
+		return plan.downloadAndDecryptFile(ctx, fileStorageInfo, localFilePath, isEncrypted)
+	})
+}
+
+func (plan BackupPlan) downloadAndDecryptFile(ctx context.Context, fileStorageInfo map[string]string, localFilePath string, isEncrypted bool) error {
 	localFilePathShadow := localFilePath + "~"
 	fileWriter, err := os.OpenFile(localFilePathShadow, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
 	if err != nil {
@@ -371,12 +488,20 @@ func (plan BackupPlan) DownloadAndDecryptFile(fileStorageInfo map[string]string,
 	w := io.Writer(fileWriter)
 	var decrypter *crypter.Decrypter
 	if isEncrypted {
-		decrypter = crypter.GetDecrypter(plan.Encrypt_passphrase)
+		if decrypter, err = plan.getDecrypter(); err != nil {
+			fileWriter.Close()
+			os.Remove(localFilePathShadow)
+			return err
+		}
 		decrypter.InitWriter(fileWriter)
 		w = io.Writer(decrypter)
 	}
 
-	err = plan.Storage.DownloadFileToPipe(fileStorageInfo, w)
+	err = plan.Storage.DownloadFileToPipe(ctx, fileStorageInfo,
+		storageutils.NewRateLimitWriter(ctx, storageutils.NewRateLimiter(plan.DownloadRateLimit), w))
+	if err == nil && decrypter != nil {
+		err = decrypter.Close()
+	}
 	if err != nil {
 		fileWriter.Close()
 		os.Remove(localFilePathShadow)
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"context"
+	"math/rand"
+	"path/filepath"
+	"time"
+
+	"github.com/n-boy/backuper/base"
+	"github.com/n-boy/backuper/storage"
+)
+
+// retry policy of requests to storage failed with transient errors (timeouts, server errors, throttling),
+// zero values mean default ones
+type RetryPolicy struct {
+	// attempts of each request including the first one, 1 - failed requests are not repeated
+	Attempts int
+	// pause before the first repeat, it is doubled for each next repeat up to MaxDelay
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+type yamlRetryPolicy struct {
+	Attempts        int `yaml:"attempts,omitempty"`
+	InitialDelaySec int `yaml:"initial_delay_sec,omitempty"`
+	MaxDelaySec     int `yaml:"max_delay_sec,omitempty"`
+}
+
+var DefaultRetryPolicy = RetryPolicy{Attempts: 5, InitialDelay: 2 * time.Second, MaxDelay: time.Minute}
+
+func newRetryPolicy(yrp yamlRetryPolicy) RetryPolicy {
+	return RetryPolicy{
+		Attempts:     yrp.Attempts,
+		InitialDelay: time.Duration(yrp.InitialDelaySec) * time.Second,
+		MaxDelay:     time.Duration(yrp.MaxDelaySec) * time.Second,
+	}
+}
+
+func (rp RetryPolicy) toYaml() yamlRetryPolicy {
+	return yamlRetryPolicy{
+		Attempts:        rp.Attempts,
+		InitialDelaySec: int(rp.InitialDelay / time.Second),
+		MaxDelaySec:     int(rp.MaxDelay / time.Second),
+	}
+}
+
+func (rp RetryPolicy) WithDefaults() RetryPolicy {
+	if rp.Attempts <= 0 {
+		rp.Attempts = DefaultRetryPolicy.Attempts
+	}
+	if rp.InitialDelay <= 0 {
+		rp.InitialDelay = DefaultRetryPolicy.InitialDelay
+	}
+	if rp.MaxDelay <= 0 {
+		rp.MaxDelay = DefaultRetryPolicy.MaxDelay
+	}
+	return rp
+}
+
+// pause after failed attempt (counted from 1): exponential backoff with jitter,
+// random value between half and full backoff, so concurrent runs don't repeat requests in lockstep
+func (rp RetryPolicy) getDelay(attempt int) time.Duration {
+	delay := rp.InitialDelay
+	for i := 1; i < attempt && delay < rp.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > rp.MaxDelay {
+		delay = rp.MaxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// calls request to storage until it succeeds, fails with permanent error, or attempts are over.
+// Pause between attempts is interrupted, when ctx is canceled
+func (plan BackupPlan) retryStorageRequest(ctx context.Context, op string, request func() error) error {
+	rp := plan.Retry.WithDefaults()
+	for attempt := 1; ; attempt++ {
+		err := request()
+		if err == nil || attempt >= rp.Attempts || ctx.Err() != nil || !storage.IsTransientError(err) {
+			return err
+		}
+
+		delay := rp.getDelay(attempt)
+		base.LogErr.Printf("Error while %v (attempt %v of %v), retrying in %v: %v",
+			op, attempt, rp.Attempts, delay.Round(time.Millisecond), err)
+		plan.notify(Event{Type: EventStorageRetry})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// requests to storage repeated according to retry policy of plan
+
+func (plan BackupPlan) uploadFile(ctx context.Context, filePath string, remoteFileName string) (storageInfo map[string]string, err error) {
+	err = plan.retryStorageRequest(ctx, "uploading file "+remoteFileName, func() error {
+		storageInfo, err = plan.Storage.UploadFile(plan.limitUploadRate(ctx), filePath, remoteFileName)
+		return err
+	})
+	return
+}
+
+func (plan BackupPlan) downloadFile(ctx context.Context, fileStorageId map[string]string, localFilePath string) error {
+	return plan.retryStorageRequest(ctx, "downloading file "+filepath.Base(localFilePath), func() error {
+		return plan.Storage.DownloadFile(ctx, fileStorageId, localFilePath)
+	})
+}
+
+func (plan BackupPlan) deleteFile(ctx context.Context, fileStorageInfo map[string]string) error {
+	return plan.retryStorageRequest(ctx, "deleting file from storage", func() error {
+		return plan.Storage.DeleteFile(ctx, fileStorageInfo)
+	})
+}
+
+func (plan BackupPlan) getFilesList(ctx context.Context) (remoteFiles []base.GenericStorageFileInfo, err error) {
+	err = plan.retryStorageRequest(ctx, "getting files list from storage", func() error {
+		remoteFiles, err = plan.Storage.GetFilesList(ctx)
+		return err
+	})
+	return
+}
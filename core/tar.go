@@ -0,0 +1,519 @@
+package core
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/n-boy/backuper/base"
+	"github.com/n-boy/backuper/crypter"
+	storageutils "github.com/n-boy/backuper/storage/utils"
+)
+
+// archive formats of plan, zip is the default one
+func GetArchiveFormats() []string {
+	return []string{ZipArchiveFormat, TarArchiveFormat}
+}
+
+func CheckArchiveFormat(format string) error {
+	if format != "" && format != ZipArchiveFormat && format != TarArchiveFormat {
+		return fmt.Errorf("Archive format should be one of: %v", strings.Join(GetArchiveFormats(), ", "))
+	}
+	return nil
+}
+
+// format of archives created by plan: tar archive is compressed as a whole by compression method of plan
+func (plan BackupPlan) getArchiveFormat() string {
+	if plan.Dedup {
+		return PackArchiveFormat
+	} else if plan.ArchiveFormat != TarArchiveFormat {
+		return ZipArchiveFormat
+	}
+	switch plan.Compression.GetMethod() {
+	case CompressionDeflate:
+		return TarGzArchiveFormat
+	case CompressionZstd:
+		return TarZstdArchiveFormat
+	}
+	return TarArchiveFormat
+}
+
+func isTarFormat(format string) bool {
+	return format == TarArchiveFormat || format == TarGzArchiveFormat || format == TarZstdArchiveFormat
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// level 0 - default level of compression method
+func newTarCompressor(w io.Writer, format string, level int) (io.WriteCloser, error) {
+	switch format {
+	case TarGzArchiveFormat:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case TarZstdArchiveFormat:
+		zstdLevel := zstd.SpeedDefault
+		if level != 0 {
+			zstdLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstdLevel))
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// tar archive read sequentially from file
+type tarArchiveReader struct {
+	*tar.Reader
+	file         *os.File
+	decompressor io.ReadCloser
+}
+
+func openTarArchive(archFilePath string, format string) (*tarArchiveReader, error) {
+	file, err := os.Open(archFilePath)
+	if err != nil {
+		return nil, err
+	}
+	var decompressor io.ReadCloser
+	bufReader := bufio.NewReaderSize(file, 1024*1024)
+	switch format {
+	case TarGzArchiveFormat:
+		decompressor, err = gzip.NewReader(bufReader)
+	case TarZstdArchiveFormat:
+		var decoder *zstd.Decoder
+		if decoder, err = zstd.NewReader(bufReader); err == nil {
+			decompressor = decoder.IOReadCloser()
+		}
+	default:
+		decompressor = io.NopCloser(bufReader)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &tarArchiveReader{Reader: tar.NewReader(decompressor), file: file, decompressor: decompressor}, nil
+}
+
+func (tr *tarArchiveReader) Close() error {
+	tr.decompressor.Close()
+	return tr.file.Close()
+}
+
+// writes nodes to tar archive, keeping ownership, permissions, symlinks and hard links of files.
+// Files, that can not be read, are skipped and returned as errors, as well as special files (devices, sockets, pipes).
+// If archiving is canceled or fails, partly written archive is removed. Observer could be nil
+func TarNodes(ctx context.Context, nodes []NodeMetaInfo, archFilePath string, encrypter *crypter.Encrypter,
+	format string, level int, observer Observer) (nodesArch []NodeMetaInfo, nodesErr []NodeError, err error) {
+	archFileWriter, err := os.Create(archFilePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		archFileWriter.Close()
+		if err != nil {
+			os.Remove(archFilePath)
+		}
+	}()
+
+	if nodesArch, nodesErr, err = TarNodesToWriter(ctx, nodes, archFileWriter, encrypter, format, level, observer); err != nil {
+		return nil, nil, err
+	}
+	if err = archFileWriter.Close(); err != nil {
+		return nil, nil, err
+	}
+	return nodesArch, nodesErr, nil
+}
+
+// writes tar archive to writer, e.g. to stream it to storage, archive is written completely when it returns
+func TarNodesToWriter(ctx context.Context, nodes []NodeMetaInfo, archFileWriter io.Writer, encrypter *crypter.Encrypter,
+	format string, level int, observer Observer) (nodesArch []NodeMetaInfo, nodesErr []NodeError, err error) {
+
+	archWriter := archFileWriter
+	if encrypter != nil {
+		if _, err = encrypter.InitWriter(archFileWriter); err != nil {
+			return nil, nil, err
+		}
+		archWriter = io.Writer(encrypter)
+	}
+
+	bufWriter := bufio.NewWriterSize(archWriter, 16*1024*1024)
+	compressor, err := newTarCompressor(bufWriter, format, level)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := tar.NewWriter(compressor)
+
+	// the first archived node of each file having several hard links, the next ones are stored as links to it
+	linkTargets := make(map[fileId]NodeMetaInfo)
+	for _, node := range nodes {
+		if err = ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		fInfo, err := os.Lstat(node.path)
+		if err != nil {
+			nodesErr = append(nodesErr, NodeError{Path: node.path, Err: err})
+			continue
+		}
+		hdr, err := getTarHeader(node, fInfo)
+		if err != nil {
+			nodesErr = append(nodesErr, NodeError{Path: node.path, Err: err})
+			continue
+		}
+		node.link = ""
+		id, hasLinks := getFileId(fInfo)
+		if target, exists := linkTargets[id]; hasLinks && exists {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = target.entryInArchive()
+			hdr.Size = 0
+			node.link = hdr.Linkname
+			node.crc = target.crc
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			if err = w.WriteHeader(hdr); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			fileReader, err := os.Open(node.path)
+			if err != nil {
+				nodesErr = append(nodesErr, NodeError{Path: node.path, Err: err})
+				continue
+			}
+			defer fileReader.Close()
+			if err = w.WriteHeader(hdr); err != nil {
+				return nil, nil, err
+			}
+
+			// entry should get size written to its header, file changed after it is listed is cut or padded by zeros.
+			// Entry of file failed to read stays in archive, but it is not referenced by metafile
+			nodeReader := &errorTrackingReader{r: fileReader}
+			crcHash := crc32.NewIEEE()
+			written, err := io.CopyN(io.MultiWriter(w, crcHash), storageutils.NewContextReader(ctx, nodeReader), hdr.Size)
+			if nodeReader.err != nil || err == io.EOF {
+				readErr := nodeReader.err
+				if readErr == nil {
+					readErr = fmt.Errorf("File is truncated while archiving")
+				}
+				nodesErr = append(nodesErr, NodeError{Path: node.path, Err: readErr})
+				fileReader.Close()
+				if _, err = io.CopyN(w, zeroReader{}, hdr.Size-written); err != nil {
+					return nil, nil, err
+				}
+				continue
+			} else if err != nil {
+				return nil, nil, err
+			}
+			node.crc = fmt.Sprintf("%08x", crcHash.Sum32())
+
+			if err = fileReader.Close(); err != nil {
+				return nil, nil, err
+			}
+			if hasLinks {
+				linkTargets[id] = node
+			}
+		}
+		node.applyFileInfo(fInfo)
+		nodesArch = append(nodesArch, node)
+		notify(observer, Event{Type: EventFileArchived, Path: node.path, Bytes: node.size})
+	}
+
+	if err = w.Close(); err != nil {
+		return nil, nil, err
+	} else if err = compressor.Close(); err != nil {
+		return nil, nil, err
+	} else if err = bufWriter.Flush(); err != nil {
+		return nil, nil, err
+	}
+	if encrypter != nil {
+		if err = encrypter.Close(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return nodesArch, nodesErr, nil
+}
+
+// header of node with its type, permissions and ownership, only directories, regular files and symlinks are archived
+func getTarHeader(node NodeMetaInfo, fInfo os.FileInfo) (*tar.Header, error) {
+	var linkTarget string
+	mode := fInfo.Mode()
+	if mode&os.ModeSymlink != 0 {
+		var err error
+		if linkTarget, err = os.Readlink(node.path); err != nil {
+			return nil, err
+		}
+	} else if !mode.IsDir() && !mode.IsRegular() {
+		return nil, fmt.Errorf("File type is not supported by tar archive: %v", mode.Type())
+	}
+
+	hdr, err := tar.FileInfoHeader(fInfo, linkTarget)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = node.entryInArchive()
+	if mode.IsDir() {
+		hdr.Name += "/"
+	}
+	// tar writer rounds modification time to seconds, metafile keeps it truncated
+	hdr.ModTime = fInfo.ModTime().Truncate(time.Second)
+	return hdr, nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// restores nodes from tar archive with their permissions, symlinks and hard links, ownership is restored
+// when running as root only. File stored as hard link to file, that is not restored, gets content of that file
+func UntarNodes(archFilePath string, format string, nodes []NodeMetaInfo, targetPath string) (nodesUnarch []NodeMetaInfo, err error) {
+	tarReader, err := openTarArchive(archFilePath, format)
+	if err != nil {
+		return nodesUnarch, err
+	}
+	defer tarReader.Close()
+
+	nodesByEntry := make(map[string]NodeMetaInfo)
+	for _, node := range nodes {
+		nodesByEntry[node.entryInArchive()] = node
+	}
+	// the first of nodes stored as hard links to entry, that is not restored, gets content of the entry
+	linkedNodes := make(map[string]NodeMetaInfo)
+	for _, node := range nodes {
+		if _, restored := nodesByEntry[node.link]; node.link != "" && !restored {
+			if _, exists := linkedNodes[node.link]; !exists {
+				linkedNodes[node.link] = node
+			}
+		}
+	}
+
+	// paths entries are restored to, hard links are restored as links to them
+	restoredPaths := make(map[string]string)
+	// directories get their permissions and modification time, when files are restored into them
+	var dirPaths []string
+	var dirHeaders []*tar.Header
+	var dirNodes []NodeMetaInfo
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nodesUnarch, err
+		}
+		entry := strings.TrimSuffix(hdr.Name, "/")
+		node, requested := nodesByEntry[entry]
+		if !requested {
+			if node, requested = linkedNodes[entry]; !requested || hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+		}
+		if _, restored := restoredPaths[node.entryInArchive()]; restored {
+			// hard link got content of its target entry already
+			continue
+		}
+
+		targetFilePath := getNodeTargetPath(node, targetPath)
+		exists, err := checkTarEntryRestored(hdr, node, targetFilePath)
+		if err != nil {
+			return nodesUnarch, err
+		}
+		if !exists {
+			if err = restoreTarEntry(tarReader, hdr, targetFilePath, restoredPaths); err != nil {
+				return nodesUnarch, err
+			}
+			if hdr.Typeflag == tar.TypeDir {
+				dirPaths = append(dirPaths, targetFilePath)
+				dirHeaders = append(dirHeaders, hdr)
+				dirNodes = append(dirNodes, node)
+			} else if hdr.Typeflag != tar.TypeLink {
+				setTarEntryAttrs(targetFilePath, hdr, node)
+			}
+		}
+		restoredPaths[entry] = targetFilePath
+		restoredPaths[node.entryInArchive()] = targetFilePath
+		nodesUnarch = append(nodesUnarch, node)
+	}
+	for i := len(dirPaths) - 1; i >= 0; i-- {
+		setTarEntryAttrs(dirPaths[i], dirHeaders[i], dirNodes[i])
+	}
+
+	for _, node := range nodes {
+		if _, restored := restoredPaths[node.entryInArchive()]; !restored {
+			return nodesUnarch, fmt.Errorf("File %v is not founded in archive %v", node.GetNodePath(), archFilePath)
+		}
+	}
+	return nodesUnarch, nil
+}
+
+// reports whether the same file exists at target path already, file differing from that in archive is an error
+func checkTarEntryRestored(hdr *tar.Header, node NodeMetaInfo, targetFilePath string) (bool, error) {
+	tfi, err := os.Lstat(targetFilePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	var same bool
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		same = tfi.IsDir()
+	case tar.TypeSymlink:
+		linkTarget, err := os.Readlink(targetFilePath)
+		same = err == nil && linkTarget == hdr.Linkname
+	default:
+		same = tfi.Mode().IsRegular() && tfi.ModTime().Equal(node.modtime) && tfi.Size() == node.size
+	}
+	if !same {
+		return false, fmt.Errorf("File %v already exists and differs from that in archive", node.GetNodePath())
+	}
+	return true, nil
+}
+
+func restoreTarEntry(tarReader *tarArchiveReader, hdr *tar.Header, targetFilePath string, restoredPaths map[string]string) error {
+	if hdr.Typeflag == tar.TypeDir {
+		return os.MkdirAll(targetFilePath, 0775)
+	}
+	if err := os.MkdirAll(filepath.Dir(targetFilePath), 0775); err != nil {
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		return os.Symlink(hdr.Linkname, targetFilePath)
+	case tar.TypeLink:
+		linkedPath, exists := restoredPaths[hdr.Linkname]
+		if !exists {
+			return fmt.Errorf("Target of hard link %v is not founded in archive: %v", hdr.Name, hdr.Linkname)
+		}
+		return os.Link(linkedPath, targetFilePath)
+	case tar.TypeReg:
+		tfWriter, err := os.OpenFile(targetFilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer tfWriter.Close()
+		if _, err = io.Copy(tfWriter, tarReader); err != nil {
+			return err
+		}
+		return tfWriter.Close()
+	}
+	return fmt.Errorf("Type of entry %v is not supported: %c", hdr.Name, hdr.Typeflag)
+}
+
+// ownership is restored by user and group ids, when running as root only.
+// Permissions are set after it, as changing of owner clears setuid bits.
+// Modification time is set from node, restored file is compared with it when restore is run again
+func setTarEntryAttrs(path string, hdr *tar.Header, node NodeMetaInfo) {
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			base.LogErr.Println(err)
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return
+	}
+	mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(path, mode); err != nil {
+		base.LogErr.Println(err)
+	}
+	if err := os.Chtimes(path, node.modtime, node.modtime); err != nil {
+		base.LogErr.Println(err)
+	}
+}
+
+// copies entries of nodes from existing tar archive into new one of the same format,
+// entries of files their hard links refer to are copied too. Entries are compressed again with level of compression
+func RepackTarNodes(srcArchFilePath string, format string, level int, nodes []NodeMetaInfo, archFilePath string,
+	encrypter *crypter.Encrypter) error {
+	tarReader, err := openTarArchive(srcArchFilePath, format)
+	if err != nil {
+		return err
+	}
+	defer tarReader.Close()
+
+	entries := make(map[string]bool)
+	for _, node := range nodes {
+		entries[node.entryInArchive()] = false
+		if node.link != "" {
+			entries[node.link] = false
+		}
+	}
+
+	archFileWriter, err := os.Create(archFilePath)
+	if err != nil {
+		return err
+	}
+	defer archFileWriter.Close()
+
+	archWriter := io.Writer(archFileWriter)
+	if encrypter != nil {
+		if _, err = encrypter.InitWriter(archFileWriter); err != nil {
+			return err
+		}
+		archWriter = io.Writer(encrypter)
+	}
+
+	bufWriter := bufio.NewWriterSize(archWriter, 16*1024*1024)
+	compressor, err := newTarCompressor(bufWriter, format, level)
+	if err != nil {
+		return err
+	}
+	w := tar.NewWriter(compressor)
+
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		entry := strings.TrimSuffix(hdr.Name, "/")
+		if _, needed := entries[entry]; !needed {
+			continue
+		}
+		if err = w.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err = io.Copy(w, tarReader); err != nil {
+			return err
+		}
+		entries[entry] = true
+	}
+	for _, node := range nodes {
+		if !entries[node.entryInArchive()] {
+			return fmt.Errorf("File %v is not founded in archive %v", node.GetNodePath(), srcArchFilePath)
+		}
+	}
+
+	if err = w.Close(); err != nil {
+		return err
+	} else if err = compressor.Close(); err != nil {
+		return err
+	} else if err = bufWriter.Flush(); err != nil {
+		return err
+	}
+	if encrypter != nil {
+		if err = encrypter.Close(); err != nil {
+			return err
+		}
+	}
+	return archFileWriter.Close()
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package core
+
+import (
+	"os"
+)
+
+type fileId struct{}
+
+// hard links are not detected, each of them is archived as separate file
+func getFileId(fInfo os.FileInfo) (fileId, bool) {
+	return fileId{}, false
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package core
+
+import (
+	"os"
+	"syscall"
+)
+
+// identity of file on disk, shared by all hard links to it
+type fileId struct {
+	dev uint64
+	ino uint64
+}
+
+// returns identity of file and whether file has other hard links to it
+func getFileId(fInfo os.FileInfo) (fileId, bool) {
+	stat, ok := fInfo.Sys().(*syscall.Stat_t)
+	if !ok || fInfo.IsDir() {
+		return fileId{}, false
+	}
+	return fileId{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, stat.Nlink > 1
+}
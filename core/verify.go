@@ -0,0 +1,300 @@
+package core
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/n-boy/backuper/base"
+)
+
+// problem found while verifying archive, path is empty if the whole archive is affected
+type VerifyProblem struct {
+	Archive string
+	Path    string
+	Problem string
+}
+
+type VerifyReport struct {
+	ArchivesChecked int
+	FilesChecked    int
+	Problems        []VerifyProblem
+	// metafiles of archives, that could not be checked yet because of storage request in progress
+	InProgress MetafileList
+}
+
+func (report VerifyReport) IsOk() bool {
+	return len(report.Problems) == 0 && len(report.InProgress) == 0
+}
+
+func (report *VerifyReport) Merge(other VerifyReport) {
+	report.ArchivesChecked += other.ArchivesChecked
+	report.FilesChecked += other.FilesChecked
+	report.Problems = append(report.Problems, other.Problems...)
+	report.InProgress = other.InProgress
+}
+
+func (problem VerifyProblem) String() string {
+	if problem.Path == "" {
+		return fmt.Sprintf("%v: %v", problem.Archive, problem.Problem)
+	}
+	return fmt.Sprintf("%v: %v: %v", problem.Archive, problem.Path, problem.Problem)
+}
+
+// checks that archives listed in metafiles are restorable and contain all files with recorded size and CRC,
+// all local metafiles of plan are checked if metaFiles is empty
+func (plan BackupPlan) Verify(ctx context.Context, metaFiles MetafileList) (VerifyReport, error) {
+	var report VerifyReport
+
+	if err := plan.CheckTmpDir(); err != nil {
+		return report, err
+	}
+	if len(metaFiles) == 0 {
+		var err error
+		if metaFiles, err = plan.GetMetaFiles(); err != nil {
+			return report, err
+		}
+	}
+
+	base.Log.Printf("Start verifying archives for plan: %v\n", plan.Name)
+	var chunksIndex map[string]ChunkLocation
+	for _, metaFile := range metaFiles {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		mf, err := plan.GetMetaFile(metaFile)
+		if err != nil {
+			return report, err
+		}
+		archFileName := GetArchiveFileName(GetArchName(metaFile), mf.GetFormat())
+
+		archFilePath, isTmpCopy, err := plan.getArchiveToVerify(ctx, mf, archFileName)
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		} else if err == base.ErrStorageRequestInProgress {
+			base.Log.Println(err)
+			report.InProgress = append(report.InProgress, metaFile)
+			continue
+		}
+		report.ArchivesChecked++
+		if err != nil {
+			if os.IsNotExist(err) {
+				err = fmt.Errorf("archive is missing in storage")
+			}
+			report.Problems = append(report.Problems, VerifyProblem{Archive: archFileName, Problem: err.Error()})
+			continue
+		}
+
+		var problems []VerifyProblem
+		if mf.GetFormat() == PackArchiveFormat {
+			if chunksIndex == nil {
+				if chunksIndex, err = plan.GetChunksIndex(); err != nil {
+					return report, err
+				}
+			}
+			problems = verifyPack(archFilePath, mf, chunksIndex)
+		} else if isTarFormat(mf.GetFormat()) {
+			problems = verifyTar(archFilePath, mf)
+		} else {
+			problems = verifyZip(archFilePath, mf)
+		}
+		for i := range problems {
+			problems[i].Archive = archFileName
+		}
+		report.Problems = append(report.Problems, problems...)
+		report.FilesChecked += len(mf.GetNodes())
+
+		if isTmpCopy {
+			if err = os.Remove(archFilePath); err != nil {
+				base.LogErr.Println(err)
+			}
+		}
+	}
+	base.Log.Printf("Finish verifying archives for plan: %v\n", plan.Name)
+
+	return report, nil
+}
+
+// returns local path to archive content, archives in local filesystem storage are read in place when possible
+func (plan BackupPlan) getArchiveToVerify(ctx context.Context, mf ArchiveMetafile, archFileName string) (archFilePath string, isTmpCopy bool, err error) {
+	if plan.Storage.GetType() == "localfs" && !mf.encrypted {
+		archFilePath = filepath.Join(plan.Storage.GetStorageConfig()["path"], mf.GetStorageInfo()["filename"])
+		_, err = os.Stat(archFilePath)
+		return archFilePath, false, err
+	}
+
+	archFilePath = filepath.Join(plan.TmpDir, "verify_"+archFileName)
+	if err = os.Remove(archFilePath); err != nil && !os.IsNotExist(err) {
+		return archFilePath, true, err
+	}
+	err = plan.DownloadAndDecryptFile(ctx, mf.GetStorageInfo(), archFilePath, mf.encrypted)
+	return archFilePath, true, err
+}
+
+func verifyZip(archFilePath string, mf ArchiveMetafile) (problems []VerifyProblem) {
+	zipReader, err := zip.OpenReader(archFilePath)
+	if err != nil {
+		return append(problems, VerifyProblem{Problem: fmt.Sprintf("archive can not be opened: %v", err)})
+	}
+	defer zipReader.Close()
+
+	filesInArchiveMap := make(map[string]*zip.File)
+	for _, f := range zipReader.File {
+		filesInArchiveMap[f.Name] = f
+	}
+
+	for _, node := range mf.GetNodes() {
+		f, exists := filesInArchiveMap[node.entryInArchive()]
+		if !exists {
+			problems = append(problems, VerifyProblem{Path: node.GetNodePath(), Problem: "file is missing in archive"})
+			continue
+		}
+		if node.is_dir {
+			continue
+		}
+		if int64(f.UncompressedSize64) != node.size {
+			problems = append(problems, VerifyProblem{Path: node.GetNodePath(),
+				Problem: fmt.Sprintf("size differs: %v in archive, %v in metafile", f.UncompressedSize64, node.size)})
+			continue
+		}
+		if node.crc != "" && fmt.Sprintf("%08x", f.CRC32) != node.crc {
+			problems = append(problems, VerifyProblem{Path: node.GetNodePath(),
+				Problem: fmt.Sprintf("CRC differs: %08x in archive, %v in metafile", f.CRC32, node.crc)})
+			continue
+		}
+		// zip reader checks CRC of content at the end of reading
+		if err := readZipFile(f); err != nil {
+			problems = append(problems, VerifyProblem{Path: node.GetNodePath(), Problem: fmt.Sprintf("file is corrupted: %v", err)})
+		}
+	}
+
+	return problems
+}
+
+// tar archive is read sequentially, CRC of hard links is checked by content of entries they refer to
+func verifyTar(archFilePath string, mf ArchiveMetafile) (problems []VerifyProblem) {
+	tarReader, err := openTarArchive(archFilePath, mf.GetFormat())
+	if err != nil {
+		return append(problems, VerifyProblem{Problem: fmt.Sprintf("archive can not be opened: %v", err)})
+	}
+	defer tarReader.Close()
+
+	nodesByEntry := make(map[string]NodeMetaInfo)
+	for _, node := range mf.GetNodes() {
+		nodesByEntry[node.entryInArchive()] = node
+	}
+	entriesCrc := make(map[string]string)
+	found := make(map[string]bool)
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return append(problems, VerifyProblem{Problem: fmt.Sprintf("archive is corrupted: %v", err)})
+		}
+		entry := strings.TrimSuffix(hdr.Name, "/")
+		var crc string
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			crcHash := crc32.NewIEEE()
+			if _, err = io.Copy(crcHash, tarReader); err != nil {
+				return append(problems, VerifyProblem{Problem: fmt.Sprintf("archive is corrupted: %v", err)})
+			}
+			crc = fmt.Sprintf("%08x", crcHash.Sum32())
+			entriesCrc[entry] = crc
+		case tar.TypeLink:
+			crc = entriesCrc[hdr.Linkname]
+		}
+
+		node, exists := nodesByEntry[entry]
+		if !exists {
+			continue
+		}
+		found[entry] = true
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeLink {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeReg && hdr.Size != node.size {
+			problems = append(problems, VerifyProblem{Path: node.GetNodePath(),
+				Problem: fmt.Sprintf("size differs: %v in archive, %v in metafile", hdr.Size, node.size)})
+			continue
+		}
+		if node.crc != "" && crc != node.crc {
+			problems = append(problems, VerifyProblem{Path: node.GetNodePath(),
+				Problem: fmt.Sprintf("CRC differs: %v in archive, %v in metafile", crc, node.crc)})
+		}
+	}
+
+	for _, node := range mf.GetNodes() {
+		if !found[node.entryInArchive()] {
+			problems = append(problems, VerifyProblem{Path: node.GetNodePath(), Problem: "file is missing in archive"})
+		}
+	}
+	return problems
+}
+
+func readZipFile(f *zip.File) error {
+	fReader, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer fReader.Close()
+
+	if _, err = io.Copy(ioutil.Discard, fReader); err != nil {
+		return err
+	}
+	return fReader.Close()
+}
+
+func verifyPack(packFilePath string, mf ArchiveMetafile, chunksIndex map[string]ChunkLocation) (problems []VerifyProblem) {
+	packReader, err := os.Open(packFilePath)
+	if err != nil {
+		return append(problems, VerifyProblem{Problem: fmt.Sprintf("archive can not be opened: %v", err)})
+	}
+	defer packReader.Close()
+
+	for _, chunk := range mf.GetPackChunks() {
+		data := make([]byte, chunk.size)
+		if _, err = packReader.ReadAt(data, chunk.offset); err != nil {
+			problems = append(problems, VerifyProblem{Problem: fmt.Sprintf("chunk %v can not be read: %v", chunk.hash, err)})
+			continue
+		}
+		hashBytes := sha256.Sum256(data)
+		if hex.EncodeToString(hashBytes[:]) != chunk.hash {
+			problems = append(problems, VerifyProblem{Problem: fmt.Sprintf("chunk %v is corrupted", chunk.hash)})
+		}
+	}
+
+	// chunks of files could be stored in other packs, they are checked while verifying those packs
+	for _, node := range mf.GetNodes() {
+		if node.is_dir {
+			continue
+		}
+		var size int64
+		for _, hash := range node.chunks {
+			location, exists := chunksIndex[hash]
+			if !exists {
+				problems = append(problems, VerifyProblem{Path: node.GetNodePath(),
+					Problem: fmt.Sprintf("chunk %v is not found in any pack", hash)})
+				size = node.size
+				break
+			}
+			size += location.chunk.size
+		}
+		if size != node.size {
+			problems = append(problems, VerifyProblem{Path: node.GetNodePath(),
+				Problem: fmt.Sprintf("size differs: %v in chunks, %v in metafile", size, node.size)})
+		}
+	}
+
+	return problems
+}
@@ -1,154 +1,455 @@
 package crypter
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted data format (version 1) starts with header: magic "BKPRENC", version, KDF id,
+// scrypt params (log2 N, r, p), salt and chunk size. Key of data is derived from passphrase by scrypt,
+// or from master key by HKDF (scrypt params are not used then). Header is followed by AES-256-GCM sealed chunks of plain data,
+// each chunk is authenticated with header as additional data, nonce contains chunk counter and flag
+// of the last chunk, so reordering and truncation of chunks are detected.
+// Data encrypted to recipient public keys is in age format (see recipients.go).
+// Legacy format (no header): random IV followed by AES-256-OFB stream, key is passphrase padded with zeroes.
+const (
+	formatMagic   = "BKPRENC"
+	formatVersion = 1
+
+	kdfScrypt     = 1
+	kdfMasterKey  = 2
+	scryptLogN    = 15
+	scryptR       = 8
+	scryptP       = 1
+	saltSize      = 16
+	keySize       = 32
+	chunkSize     = 64 * 1024
+	maxChunkSize  = 16 * 1024 * 1024
+	headerSize    = len(formatMagic) + 1 + 1 + 3 + saltSize + 4
+	lastChunkFlag = 1
 )
 
+var ErrDecrypt = fmt.Errorf("Encrypted data is corrupted or passphrase is wrong")
+
 type Encrypter struct {
-	passphrase   string
-	streamWriter *cipher.StreamWriter
+	passphrase string
+	masterKey  *MasterKey
+	recipients []age.Recipient
+	ageWriter  io.WriteCloser
+	fileWriter io.Writer
+	aead       cipher.AEAD
+	header     []byte
+	counter    uint64
+	buf        []byte
+	closed     bool
 }
 
 func GetEncrypter(passphrase string) *Encrypter {
 	return &Encrypter{passphrase: passphrase}
 }
 
+func GetMasterKeyEncrypter(masterKey *MasterKey) *Encrypter {
+	return &Encrypter{masterKey: masterKey}
+}
+
 func (e *Encrypter) InitWriter(fileWriter io.Writer) (io.Writer, error) {
-	if e.streamWriter != nil {
+	if e.fileWriter != nil {
 		return io.Writer(e), fmt.Errorf("Encrypt writer already inited")
 	}
-	encStream, iv, err := getEncryptStream(e.passphrase)
+	if len(e.recipients) > 0 {
+		ageWriter, err := age.Encrypt(fileWriter, e.recipients...)
+		if err != nil {
+			return io.Writer(e), err
+		}
+		e.fileWriter = fileWriter
+		e.ageWriter = ageWriter
+		return io.Writer(e), nil
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, formatMagic)
+	pos := len(formatMagic)
+	header[pos] = formatVersion
+	if e.masterKey != nil {
+		header[pos+1] = kdfMasterKey
+	} else {
+		header[pos+1] = kdfScrypt
+		header[pos+2], header[pos+3], header[pos+4] = scryptLogN, scryptR, scryptP
+	}
+	salt := header[pos+5 : pos+5+saltSize]
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return io.Writer(e), err
+	}
+	binary.BigEndian.PutUint32(header[headerSize-4:], chunkSize)
+
+	aead, err := getAEAD(header, e.passphrase, e.masterKey)
 	if err != nil {
 		return io.Writer(e), err
 	}
-	if _, err := fileWriter.Write(iv); err != nil {
+	if _, err := fileWriter.Write(header); err != nil {
 		return io.Writer(e), err
 	}
-	e.streamWriter = &cipher.StreamWriter{S: encStream, W: fileWriter}
+
+	e.fileWriter = fileWriter
+	e.aead = aead
+	e.header = header
+	e.buf = make([]byte, 0, chunkSize+1)
 	return io.Writer(e), nil
 }
 
 func (e *Encrypter) Write(p []byte) (n int, err error) {
-	if e.streamWriter == nil {
+	if e.fileWriter == nil {
 		return 0, fmt.Errorf("Encrypt writer should be inited before use")
+	} else if e.closed {
+		return 0, fmt.Errorf("Encrypt writer is already closed")
+	}
+	if e.ageWriter != nil {
+		return e.ageWriter.Write(p)
+	}
+
+	for len(p) > 0 {
+		// chunk is sealed only when next data arrives, so the last chunk is always sealed by Close
+		if len(e.buf) == chunkSize {
+			if err = e.writeChunk(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(e.buf[len(e.buf):chunkSize], p)
+		e.buf = e.buf[:len(e.buf)+k]
+		p = p[k:]
+		n += k
 	}
-	return e.streamWriter.Write(p)
+	return n, nil
+}
+
+// writes the last chunk, underlying writer is not closed
+func (e *Encrypter) Close() error {
+	if e.fileWriter == nil {
+		return fmt.Errorf("Encrypt writer should be inited before use")
+	} else if e.closed {
+		return nil
+	}
+	e.closed = true
+	if e.ageWriter != nil {
+		return e.ageWriter.Close()
+	}
+	return e.writeChunk(true)
+}
+
+func (e *Encrypter) writeChunk(last bool) error {
+	sealed := e.aead.Seal(nil, getChunkNonce(e.counter, last), e.buf, e.header)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.fileWriter.Write(sealed)
+	return err
 }
 
 type Decrypter struct {
-	passphrase   string
-	iv           []byte
+	passphrase string
+	masterKey  *MasterKey
+	identities []age.Identity
+	// age format
+	ageReader io.Reader
+	ageWriter *io.PipeWriter
+	ageDone   chan error
+	// legacy format
 	streamReader *cipher.StreamReader
 	streamWriter *cipher.StreamWriter
-	fileWriter   *io.Writer
+	// current format
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int
+	counter   uint64
+	finished  bool
+	// encrypted data not processed yet, and decrypted data not read yet
+	buf      []byte
+	plainBuf []byte
+
+	fileReader io.Reader
+	fileWriter io.Writer
 }
 
 func GetDecrypter(passphrase string) *Decrypter {
 	return &Decrypter{passphrase: passphrase}
 }
 
+// decrypter of data encrypted with master key, data encrypted with passphrase before master key
+// was created is decrypted with legacy passphrase kept with master key
+func GetMasterKeyDecrypter(masterKey *MasterKey) *Decrypter {
+	return &Decrypter{passphrase: masterKey.legacyPassphrase, masterKey: masterKey}
+}
+
 func (d *Decrypter) InitReader(fileReader io.Reader) (io.Reader, error) {
-	iv := make([]byte, aes.BlockSize)
-	n, err := fileReader.Read(iv)
-	if err != nil {
-		return io.Reader(d), err
-	} else if n != aes.BlockSize {
+	d.fileReader = fileReader
+
+	d.buf = make([]byte, len(formatMagic)+1)
+	if _, err := io.ReadFull(fileReader, d.buf); err != nil {
 		return io.Reader(d), fmt.Errorf("Encrypted file is too small")
 	}
+	if d.isAgeFormat() {
+		return io.Reader(d), d.initAgeReader(io.MultiReader(bytes.NewReader(d.buf), fileReader))
+	}
+	if d.isLegacyFormat() {
+		iv := make([]byte, aes.BlockSize)
+		copy(iv, d.buf)
+		if _, err := io.ReadFull(fileReader, iv[len(d.buf):]); err != nil {
+			return io.Reader(d), fmt.Errorf("Encrypted file is too small")
+		}
+		d.streamReader = &cipher.StreamReader{S: getLegacyDecryptStream(d.passphrase, iv), R: fileReader}
+		return io.Reader(d), nil
+	}
 
-	decStream, err := getDecryptStream(d.passphrase, iv)
-	if err != nil {
-		return io.Reader(d), err
+	header := make([]byte, headerSize)
+	copy(header, d.buf)
+	if _, err := io.ReadFull(fileReader, header[len(d.buf):]); err != nil {
+		return io.Reader(d), fmt.Errorf("Encrypted file is too small")
 	}
-	d.streamReader = &cipher.StreamReader{S: decStream, R: fileReader}
-	return io.Reader(d), nil
+	d.buf = d.buf[:0]
+	return io.Reader(d), d.initHeader(header)
 }
 
 func (d *Decrypter) Read(p []byte) (n int, err error) {
-	if d.streamReader == nil {
+	if d.fileReader == nil {
 		return 0, fmt.Errorf("Encrypt reader should be inited before use")
 	}
-	return d.streamReader.Read(p)
+	if d.ageReader != nil {
+		return d.ageReader.Read(p)
+	}
+	if d.streamReader != nil {
+		return d.streamReader.Read(p)
+	}
+
+	for len(d.plainBuf) == 0 {
+		if d.finished {
+			return 0, io.EOF
+		}
+		// one byte more than encrypted chunk is read to know, whether the chunk is the last one
+		recordSize := d.chunkSize + d.aead.Overhead()
+		eof := false
+		for len(d.buf) <= recordSize && !eof {
+			readBuf := make([]byte, recordSize+1-len(d.buf))
+			k, err := io.ReadFull(d.fileReader, readBuf)
+			d.buf = append(d.buf, readBuf[:k]...)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		if err = d.openChunks(eof); err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(p, d.plainBuf)
+	d.plainBuf = d.plainBuf[n:]
+	return n, nil
 }
 
 func (d *Decrypter) InitWriter(fileWriter io.Writer) (io.Writer, error) {
-	d.iv = make([]byte, 0)
-	d.fileWriter = &fileWriter
+	d.buf = make([]byte, 0)
+	d.fileWriter = fileWriter
 
 	return io.Writer(d), nil
 }
 
-func (d *Decrypter) finishInitWriter() error {
-	decStream, err := getDecryptStream(d.passphrase, d.iv)
-	if err != nil {
-		return err
-	}
-	d.streamWriter = &cipher.StreamWriter{S: decStream, W: *d.fileWriter}
-	return nil
-}
-
 func (d *Decrypter) Write(p []byte) (n int, err error) {
 	if d.fileWriter == nil {
 		return 0, fmt.Errorf("Decrypt writer should be inited before use")
 	}
+	if d.ageWriter != nil {
+		return d.ageWriter.Write(p)
+	}
+	if d.streamWriter != nil {
+		return d.streamWriter.Write(p)
+	}
 
-	readPos := 0
-	if d.streamWriter == nil {
-		leftBytesForIV := aes.BlockSize - len(d.iv)
-		if leftBytesForIV > 0 {
-			bytesToRead := leftBytesForIV
-			if bytesToRead > len(p) {
-				bytesToRead = len(p)
+	d.buf = append(d.buf, p...)
+	if d.aead == nil {
+		if len(d.buf) < len(formatMagic)+1 {
+			return len(p), nil
+		}
+		if d.isAgeFormat() {
+			if err = d.initAgeWriter(); err != nil {
+				return 0, err
 			}
-			d.iv = append(d.iv, p[0:bytesToRead]...)
-			readPos += bytesToRead
+			return len(p), nil
 		}
-
-		if len(d.iv) == aes.BlockSize {
-			err := d.finishInitWriter()
-			if err != nil {
+		if d.isLegacyFormat() {
+			if len(d.buf) < aes.BlockSize {
+				return len(p), nil
+			}
+			d.streamWriter = &cipher.StreamWriter{S: getLegacyDecryptStream(d.passphrase, d.buf[:aes.BlockSize]),
+				W: d.fileWriter}
+			data := d.buf[aes.BlockSize:]
+			d.buf = nil
+			if _, err = d.streamWriter.Write(data); err != nil {
 				return 0, err
 			}
+			return len(p), nil
 		}
+		if len(d.buf) < headerSize {
+			return len(p), nil
+		}
+		if err = d.initHeader(d.buf[:headerSize]); err != nil {
+			return 0, err
+		}
+		d.buf = d.buf[headerSize:]
+	}
+
+	if err = d.openChunks(false); err != nil {
+		return 0, err
+	}
+	if err = d.flushPlain(); err != nil {
+		return 0, err
 	}
+	return len(p), nil
+}
 
+// checks that all encrypted data is written and authenticated, underlying writer is not closed
+func (d *Decrypter) Close() error {
+	if d.fileWriter == nil {
+		return fmt.Errorf("Decrypt writer should be inited before use")
+	}
+	if d.ageWriter != nil {
+		return d.closeAgeWriter()
+	}
 	if d.streamWriter != nil {
-		n, err = d.streamWriter.Write(p[readPos:])
-		return n + readPos, err
-	} else {
-		return readPos, nil
+		return nil
+	}
+	if d.aead == nil {
+		return fmt.Errorf("Encrypted file is too small")
+	}
+	if err := d.openChunks(true); err != nil {
+		return err
+	}
+	return d.flushPlain()
+}
+
+func (d *Decrypter) isLegacyFormat() bool {
+	return !bytes.Equal(d.buf[:len(formatMagic)], []byte(formatMagic))
+}
+
+func (d *Decrypter) initHeader(header []byte) error {
+	if header[len(formatMagic)] != formatVersion {
+		return fmt.Errorf("Unsupported version of encrypted data format: %v", header[len(formatMagic)])
+	}
+	d.chunkSize = int(binary.BigEndian.Uint32(header[headerSize-4:]))
+	if d.chunkSize <= 0 || d.chunkSize > maxChunkSize {
+		return ErrDecrypt
+	}
+	d.header = make([]byte, headerSize)
+	copy(d.header, header)
+
+	aead, err := getAEAD(d.header, d.passphrase, d.masterKey)
+	if err != nil {
+		return err
+	}
+	d.aead = aead
+	return nil
+}
+
+// decrypts chunks from buffer, the chunk followed by any data is not the last one,
+// the rest of buffer is the last chunk when all encrypted data is received
+func (d *Decrypter) openChunks(eof bool) error {
+	recordSize := d.chunkSize + d.aead.Overhead()
+	for len(d.buf) > recordSize || (eof && !d.finished) {
+		if d.finished {
+			return ErrDecrypt
+		}
+		size := recordSize
+		last := false
+		if len(d.buf) <= recordSize {
+			size = len(d.buf)
+			last = true
+		}
+		plain, err := d.aead.Open(nil, getChunkNonce(d.counter, last), d.buf[:size], d.header)
+		if err != nil {
+			return ErrDecrypt
+		}
+		d.counter++
+		d.finished = last
+		d.buf = d.buf[size:]
+		d.plainBuf = append(d.plainBuf, plain...)
+	}
+	return nil
+}
+
+func (d *Decrypter) flushPlain() error {
+	if len(d.plainBuf) == 0 {
+		return nil
 	}
+	_, err := d.fileWriter.Write(d.plainBuf)
+	d.plainBuf = d.plainBuf[:0]
+	return err
 }
 
-func getEncryptStream(passphrase string) (stream cipher.Stream, iv []byte, err error) {
-	enc_block, err := aes.NewCipher(getEncryptKey(passphrase))
+// scrypt params are read from header before data is authenticated, tampered ones could make scrypt
+// allocate huge memory or run for hours, so only params written by this code are accepted
+func isScryptParamsSupported(logN, r, p byte) bool {
+	return logN == scryptLogN && r == scryptR && p == scryptP
+}
+
+func getAEAD(header []byte, passphrase string, masterKey *MasterKey) (cipher.AEAD, error) {
+	pos := len(formatMagic) + 1
+	salt := header[pos+4 : pos+4+saltSize]
+
+	var key []byte
+	var err error
+	switch header[pos] {
+	case kdfScrypt:
+		logN, r, p := header[pos+1], header[pos+2], header[pos+3]
+		if !isScryptParamsSupported(logN, r, p) {
+			return nil, ErrDecrypt
+		}
+		key, err = scrypt.Key([]byte(passphrase), salt, 1<<logN, int(r), int(p), keySize)
+	case kdfMasterKey:
+		if masterKey == nil {
+			return nil, fmt.Errorf("Data is encrypted with master key, but master key is not provided")
+		}
+		key, err = masterKey.deriveKey(salt)
+	default:
+		return nil, fmt.Errorf("Unsupported key derivation function of encrypted data: %v", header[pos])
+	}
 	if err != nil {
-		return
+		return nil, err
 	}
-	iv = make([]byte, aes.BlockSize)
-	_, err = io.ReadFull(rand.Reader, iv)
+
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return
+		return nil, err
 	}
-	stream = cipher.NewOFB(enc_block, iv)
-	return
+	return cipher.NewGCM(block)
 }
 
-func getDecryptStream(passphrase string, iv []byte) (stream cipher.Stream, err error) {
-	enc_block, err := aes.NewCipher(getEncryptKey(passphrase))
+func getChunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = lastChunkFlag
+	}
+	return nonce
+}
+
+func getLegacyDecryptStream(passphrase string, iv []byte) cipher.Stream {
+	enc_block, err := aes.NewCipher(getLegacyEncryptKey(passphrase))
 	if err != nil {
-		return
+		// key size is always valid
+		panic(err)
 	}
-	stream = cipher.NewOFB(enc_block, iv)
-	return
+	return cipher.NewOFB(enc_block, iv)
 }
 
-func getEncryptKey(passphrase string) []byte {
+func getLegacyEncryptKey(passphrase string) []byte {
 	key_size := 32
 	key := []byte(passphrase)
 	for len(key) < key_size {
@@ -158,20 +459,32 @@ func getEncryptKey(passphrase string) []byte {
 }
 
 func EncryptFile(passphrase string, srcFilePath string, targetFilePath string) error {
+	return EncryptFileWith(GetEncrypter(passphrase), srcFilePath, targetFilePath)
+}
+
+func EncryptFileWith(encrypter *Encrypter, srcFilePath string, targetFilePath string) error {
 	convertAction := func(r *os.File, w *os.File) error {
-		encrypter := GetEncrypter(passphrase)
-		encrypter.InitWriter(w)
-		_, err := io.Copy(encrypter, r)
-		return err
+		if _, err := encrypter.InitWriter(w); err != nil {
+			return err
+		}
+		if _, err := io.Copy(encrypter, r); err != nil {
+			return err
+		}
+		return encrypter.Close()
 	}
 
 	return convertFileData(convertAction, srcFilePath, targetFilePath)
 }
 
 func DecryptFile(passphrase string, srcFilePath string, targetFilePath string) error {
+	return DecryptFileWith(GetDecrypter(passphrase), srcFilePath, targetFilePath)
+}
+
+func DecryptFileWith(decrypter *Decrypter, srcFilePath string, targetFilePath string) error {
 	convertAction := func(r *os.File, w *os.File) error {
-		decrypter := GetDecrypter(passphrase)
-		decrypter.InitReader(r)
+		if _, err := decrypter.InitReader(r); err != nil {
+			return err
+		}
 		_, err := io.Copy(w, decrypter)
 		return err
 	}
@@ -7,6 +7,9 @@ import (
 
 	"bufio"
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/hex"
 	"io"
 	"io/ioutil"
@@ -89,9 +92,8 @@ func TestEncryptDecryptPassphraseIncorrect(t *testing.T) {
 	}
 
 	decryptedText, err := decryptText(encText, passphrase2)
-	if err != nil {
-		t.Fatalf("Test died. Name: %v, error while decrypt: %v\n",
-			testName, err)
+	if err == nil {
+		t.Errorf("Test failed. Name: %v, no error while decrypt with incorrect passphrase\n", testName)
 	}
 
 	if plainText == decryptedText {
@@ -141,6 +143,102 @@ func TestEncryptDecryptUseWriterSmallChunks(t *testing.T) {
 
 }
 
+func TestEncryptDecryptLongText(t *testing.T) {
+	testName := "EncryptDecryptLongText"
+	// several encrypted chunks, the last one is full
+	longText := strings.Repeat(testutils.RandString(1024), 128)
+	encText, err := encryptText(longText, passphrase)
+	if err != nil {
+		t.Fatalf("Test died. Name: %v, error while encrypt: %v\n",
+			testName, err)
+	}
+
+	for _, useWriter := range []bool{false, true} {
+		var decryptedText string
+		if useWriter {
+			decryptedText, err = decryptTextUseWriter(encText, passphrase, false)
+		} else {
+			decryptedText, err = decryptText(encText, passphrase)
+		}
+		if err != nil {
+			t.Fatalf("Test died. Name: %v, error while decrypt (use writer: %v): %v\n",
+				testName, useWriter, err)
+		}
+		if longText != decryptedText {
+			t.Errorf("Test failed. Name: %v, decrypted text not equals to source plain text (use writer: %v)\n",
+				testName, useWriter)
+		}
+	}
+}
+
+// changed, truncated or extended encrypted data should not be decrypted
+func TestDecryptTampered(t *testing.T) {
+	testName := "DecryptTampered"
+	longText := strings.Repeat(plainText, 1000)
+	encText, err := encryptText(longText, passphrase)
+	if err != nil {
+		t.Fatalf("Test died. Name: %v, error while encrypt: %v\n",
+			testName, err)
+	}
+
+	changed := append([]byte{}, encText...)
+	changed[len(changed)/2] ^= 1
+	// scrypt params of header set to take hundreds of GB of memory
+	changedParams := append([]byte{}, encText...)
+	paramsPos := len("BKPRENC") + 2
+	changedParams[paramsPos], changedParams[paramsPos+1] = 24, 255
+	cases := map[string][]byte{
+		"changed":            changed,
+		"changed params":     changedParams,
+		"truncated":          encText[:len(encText)-100],
+		"truncated by chunk": encText[:len(encText)-(len(longText)%(64*1024))-16],
+		"extended":           append(append([]byte{}, encText...), 0),
+	}
+	for name, data := range cases {
+		if _, err := decryptText(data, passphrase); err == nil {
+			t.Errorf("Test failed. Name: %v, no error while decrypt %v data\n", testName, name)
+		}
+		if _, err := decryptTextUseWriter(data, passphrase, false); err == nil {
+			t.Errorf("Test failed. Name: %v, no error while decrypt %v data using writer\n", testName, name)
+		}
+	}
+}
+
+// data encrypted by previous versions: IV and AES-OFB stream, key is passphrase padded with zeroes
+func TestDecryptLegacyFormat(t *testing.T) {
+	testName := "DecryptLegacyFormat"
+
+	key := make([]byte, 32)
+	copy(key, passphrase)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("Test died. Name: %v, error while creating cipher: %v\n", testName, err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err = rand.Read(iv); err != nil {
+		t.Fatalf("Test died. Name: %v, error while creating IV: %v\n", testName, err)
+	}
+	encText := make([]byte, len(plainText))
+	cipher.NewOFB(block, iv).XORKeyStream(encText, []byte(plainText))
+	encText = append(iv, encText...)
+
+	decryptedText, err := decryptText(encText, passphrase)
+	if err != nil {
+		t.Fatalf("Test died. Name: %v, error while decrypt: %v\n", testName, err)
+	}
+	if plainText != decryptedText {
+		t.Errorf("Test failed. Name: %v, decrypted text not equals to source plain text\n", testName)
+	}
+
+	decryptedText, err = decryptTextUseWriter(encText, passphrase, true)
+	if err != nil {
+		t.Fatalf("Test died. Name: %v, error while decrypt using writer: %v\n", testName, err)
+	}
+	if plainText != decryptedText {
+		t.Errorf("Test failed. Name: %v, decrypted using writer text not equals to source plain text\n", testName)
+	}
+}
+
 func encryptText(plainText string, passphrase string) (encText []byte, err error) {
 	plainTextReader := strings.NewReader(plainText)
 
@@ -148,12 +246,17 @@ func encryptText(plainText string, passphrase string) (encText []byte, err error
 	encTextWriter := bufio.NewWriter(&encTextBuf)
 
 	encrypter := crypter.GetEncrypter(passphrase)
-	encrypter.InitWriter(encTextWriter)
+	if _, err = encrypter.InitWriter(encTextWriter); err != nil {
+		return
+	}
 
 	_, err = io.Copy(encrypter, plainTextReader)
 	if err != nil {
 		return
 	}
+	if err = encrypter.Close(); err != nil {
+		return
+	}
 	encTextWriter.Flush()
 	encText = encTextBuf.Bytes()
 
@@ -167,7 +270,9 @@ func decryptText(encText []byte, passphrase string) (plainText string, err error
 	plainTextWriter := bufio.NewWriter(&plainTextBuf)
 
 	decrypter := crypter.GetDecrypter(passphrase)
-	decrypter.InitReader(encTextReader)
+	if _, err = decrypter.InitReader(encTextReader); err != nil {
+		return
+	}
 
 	_, err = io.Copy(plainTextWriter, decrypter)
 	if err != nil {
@@ -212,6 +317,9 @@ func decryptTextUseWriter(encText []byte, passphrase string, smallChunks bool) (
 			return
 		}
 	}
+	if err = decrypter.Close(); err != nil {
+		return
+	}
 
 	plainTextWriter.Flush()
 	plainText = string(plainTextBuf.Bytes()[:])
@@ -321,3 +429,161 @@ func TestEncryptDecryptFile(t *testing.T) {
 	}
 
 }
+
+func TestMasterKeyWrapUnwrap(t *testing.T) {
+	testName := "MasterKeyWrapUnwrap"
+
+	mk, err := crypter.GenerateMasterKey(passphrase)
+	if err != nil {
+		t.Fatalf("Test died. Name: %v, error while generating master key: %v\n", testName, err)
+	}
+	wrapped, err := mk.Wrap(passphrase2)
+	if err != nil {
+		t.Fatalf("Test died. Name: %v, error while wrapping master key: %v\n", testName, err)
+	}
+	if _, err = crypter.UnwrapMasterKey(wrapped, passphrase); err != crypter.ErrWrongPassphrase {
+		t.Errorf("Test failed. Name: %v, master key unwrapped with wrong passphrase, error: %v\n", testName, err)
+	}
+	// scrypt params of key file fetched from storage are not trusted
+	changedParams := append([]byte{}, wrapped...)
+	paramsPos := len("BKPRKEY") + 1
+	changedParams[paramsPos], changedParams[paramsPos+1] = 24, 255
+	if _, err = crypter.UnwrapMasterKey(changedParams, passphrase2); err != crypter.ErrWrongPassphrase {
+		t.Errorf("Test failed. Name: %v, master key unwrapped with changed scrypt params, error: %v\n", testName, err)
+	}
+	mk2, err := crypter.UnwrapMasterKey(wrapped, passphrase2)
+	if err != nil {
+		t.Fatalf("Test died. Name: %v, error while unwrapping master key: %v\n", testName, err)
+	}
+
+	// data encrypted with master key before wrapping is decrypted with unwrapped one
+	var encTextBuf bytes.Buffer
+	encrypter := crypter.GetMasterKeyEncrypter(mk)
+	if _, err = encrypter.InitWriter(&encTextBuf); err != nil {
+		t.Fatalf("Test died. Name: %v, error while initializing encrypter: %v\n", testName, err)
+	}
+	if _, err = io.WriteString(encrypter, plainText); err != nil {
+		t.Fatalf("Test died. Name: %v, error while encrypt: %v\n", testName, err)
+	}
+	if err = encrypter.Close(); err != nil {
+		t.Fatalf("Test died. Name: %v, error while encrypt: %v\n", testName, err)
+	}
+	if chunkIsContained([]byte(plainText[:20]), encTextBuf.Bytes()) {
+		t.Errorf("Test failed. Name: %v, encrypted text contains plain text\n", testName)
+	}
+
+	var plainTextBuf bytes.Buffer
+	decrypter := crypter.GetMasterKeyDecrypter(mk2)
+	if _, err = decrypter.InitReader(bytes.NewReader(encTextBuf.Bytes())); err != nil {
+		t.Fatalf("Test died. Name: %v, error while initializing decrypter: %v\n", testName, err)
+	}
+	if _, err = io.Copy(&plainTextBuf, decrypter); err != nil {
+		t.Fatalf("Test died. Name: %v, error while decrypt: %v\n", testName, err)
+	}
+	if plainTextBuf.String() != plainText {
+		t.Errorf("Test failed. Name: %v, decrypted text not equals to source plain text\n", testName)
+	}
+
+	// data encrypted with passphrase before master key was created is decrypted too
+	encText, err := encryptText(plainText, passphrase)
+	if err != nil {
+		t.Fatalf("Test died. Name: %v, error while encrypt with passphrase: %v\n", testName, err)
+	}
+	plainTextBuf.Reset()
+	decrypter = crypter.GetMasterKeyDecrypter(mk2)
+	decrypter.InitWriter(&plainTextBuf)
+	if _, err = decrypter.Write(encText); err == nil {
+		err = decrypter.Close()
+	}
+	if err != nil {
+		t.Fatalf("Test died. Name: %v, error while decrypt data encrypted with passphrase: %v\n", testName, err)
+	}
+	if plainTextBuf.String() != plainText {
+		t.Errorf("Test failed. Name: %v, decrypted legacy text not equals to source plain text\n", testName)
+	}
+}
+
+func TestEncryptDecryptRecipients(t *testing.T) {
+	testName := "EncryptDecryptRecipients"
+
+	identity, recipient, err := crypter.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Test died. Name: %v, error while generating key pair: %v\n", testName, err)
+	}
+	identity2, recipient2, err := crypter.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Test died. Name: %v, error while generating key pair: %v\n", testName, err)
+	}
+	otherIdentity, _, err := crypter.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Test died. Name: %v, error while generating key pair: %v\n", testName, err)
+	}
+
+	encrypter, err := crypter.GetRecipientsEncrypter([]string{recipient, recipient2})
+	if err != nil {
+		t.Fatalf("Test died. Name: %v, error while creating encrypter: %v\n", testName, err)
+	}
+	var encTextBuf bytes.Buffer
+	if _, err = encrypter.InitWriter(&encTextBuf); err != nil {
+		t.Fatalf("Test died. Name: %v, error while initializing encrypter: %v\n", testName, err)
+	}
+	if _, err = io.WriteString(encrypter, plainText); err != nil {
+		t.Fatalf("Test died. Name: %v, error while encrypt: %v\n", testName, err)
+	}
+	if err = encrypter.Close(); err != nil {
+		t.Fatalf("Test died. Name: %v, error while encrypt: %v\n", testName, err)
+	}
+	encText := encTextBuf.Bytes()
+	if chunkIsContained([]byte(plainText[:20]), encText) {
+		t.Errorf("Test failed. Name: %v, encrypted text contains plain text\n", testName)
+	}
+
+	// data is decrypted by private key of any recipient, using reader and writer
+	for _, id := range []string{identity, identity2} {
+		var plainTextBuf bytes.Buffer
+		decrypter := crypter.GetDecrypter("")
+		if err = decrypter.AddIdentities("# private key\n" + id + "\n"); err != nil {
+			t.Fatalf("Test died. Name: %v, error while parsing private key: %v\n", testName, err)
+		}
+		if _, err = decrypter.InitReader(bytes.NewReader(encText)); err != nil {
+			t.Fatalf("Test died. Name: %v, error while initializing decrypter: %v\n", testName, err)
+		}
+		if _, err = io.Copy(&plainTextBuf, decrypter); err != nil {
+			t.Fatalf("Test died. Name: %v, error while decrypt: %v\n", testName, err)
+		}
+		if plainTextBuf.String() != plainText {
+			t.Errorf("Test failed. Name: %v, decrypted text not equals to source plain text\n", testName)
+		}
+
+		plainTextBuf.Reset()
+		decrypter = crypter.GetDecrypter("")
+		decrypter.AddIdentities(id)
+		decrypter.InitWriter(&plainTextBuf)
+		for i := 0; i < len(encText) && err == nil; i += 5 {
+			end := i + 5
+			if end > len(encText) {
+				end = len(encText)
+			}
+			_, err = decrypter.Write(encText[i:end])
+		}
+		if err == nil {
+			err = decrypter.Close()
+		}
+		if err != nil {
+			t.Fatalf("Test died. Name: %v, error while decrypt using writer: %v\n", testName, err)
+		}
+		if plainTextBuf.String() != plainText {
+			t.Errorf("Test failed. Name: %v, decrypted using writer text not equals to source plain text\n", testName)
+		}
+	}
+
+	// data can not be decrypted without private key of recipient, even with passphrase
+	if _, err = decryptText(encText, passphrase); err != crypter.ErrIdentityRequired {
+		t.Errorf("Test failed. Name: %v, unexpected error while decrypt without private key: %v\n", testName, err)
+	}
+	decrypter := crypter.GetDecrypter("")
+	decrypter.AddIdentities(otherIdentity)
+	if _, err = decrypter.InitReader(bytes.NewReader(encText)); err != crypter.ErrIdentityRequired {
+		t.Errorf("Test failed. Name: %v, unexpected error while decrypt with other private key: %v\n", testName, err)
+	}
+}
@@ -0,0 +1,106 @@
+package crypter
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Wrapped master key format: magic "BKPRKEY", version, scrypt params (log2 N, r, p), salt, nonce,
+// followed by AES-256-GCM sealed master key and legacy passphrase, header is authenticated as additional data.
+const (
+	keyFileMagic   = "BKPRKEY"
+	keyFileVersion = 1
+	nonceSize      = 12
+	keyHeaderSize  = len(keyFileMagic) + 1 + 3 + saltSize + nonceSize
+	hkdfInfo       = "backuper data key"
+)
+
+var ErrWrongPassphrase = fmt.Errorf("Master key can not be unwrapped: passphrase is wrong or key file is corrupted")
+
+// random key, data keys are derived from it, so passphrase wrapping it could be changed without re-encrypting data
+type MasterKey struct {
+	key []byte
+	// passphrase, which data was encrypted with before master key was created
+	legacyPassphrase string
+}
+
+func GenerateMasterKey(legacyPassphrase string) (*MasterKey, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return &MasterKey{key: key, legacyPassphrase: legacyPassphrase}, nil
+}
+
+// returns master key encrypted with key derived from passphrase
+func (mk *MasterKey) Wrap(passphrase string) ([]byte, error) {
+	header := make([]byte, keyHeaderSize)
+	copy(header, keyFileMagic)
+	pos := len(keyFileMagic)
+	header[pos] = keyFileVersion
+	header[pos+1], header[pos+2], header[pos+3] = scryptLogN, scryptR, scryptP
+	if _, err := io.ReadFull(rand.Reader, header[pos+4:]); err != nil {
+		return nil, err
+	}
+
+	aead, err := getKeyFileAEAD(header, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	payload := append(append([]byte{}, mk.key...), []byte(mk.legacyPassphrase)...)
+	return aead.Seal(header, header[keyHeaderSize-nonceSize:], payload, header), nil
+}
+
+func UnwrapMasterKey(data []byte, passphrase string) (*MasterKey, error) {
+	if len(data) < keyHeaderSize || !bytes.Equal(data[:len(keyFileMagic)], []byte(keyFileMagic)) {
+		return nil, fmt.Errorf("Master key file has unknown format")
+	}
+	if data[len(keyFileMagic)] != keyFileVersion {
+		return nil, fmt.Errorf("Unsupported version of master key file: %v", data[len(keyFileMagic)])
+	}
+	header := data[:keyHeaderSize]
+
+	aead, err := getKeyFileAEAD(header, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := aead.Open(nil, header[keyHeaderSize-nonceSize:], data[keyHeaderSize:], header)
+	if err != nil || len(payload) < keySize {
+		return nil, ErrWrongPassphrase
+	}
+	return &MasterKey{key: payload[:keySize], legacyPassphrase: string(payload[keySize:])}, nil
+}
+
+func getKeyFileAEAD(header []byte, passphrase string) (cipher.AEAD, error) {
+	pos := len(keyFileMagic) + 1
+	// key file is fetched from storage, its params are checked like params of encrypted data
+	logN, r, p := header[pos], header[pos+1], header[pos+2]
+	if !isScryptParamsSupported(logN, r, p) {
+		return nil, ErrWrongPassphrase
+	}
+	salt := header[pos+3 : pos+3+saltSize]
+
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<logN, int(r), int(p), keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (mk *MasterKey) deriveKey(salt []byte) ([]byte, error) {
+	key := make([]byte, keySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, mk.key, salt, []byte(hkdfInfo)), key)
+	return key, err
+}
@@ -0,0 +1,109 @@
+package crypter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// Data encrypted to recipient public keys is in age format (X25519 recipients),
+// it can be decrypted only with private key (identity) of one of recipients.
+const ageMagic = "age-encryption.org/v1\n"
+
+var ErrIdentityRequired = fmt.Errorf("Data is encrypted with public key, but matching private key is not provided")
+
+func GetRecipientsEncrypter(recipients []string) (*Encrypter, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("At least one recipient public key should be provided")
+	}
+	e := &Encrypter{}
+	for _, r := range recipients {
+		recipient, err := age.ParseX25519Recipient(strings.TrimSpace(r))
+		if err != nil {
+			return nil, err
+		}
+		e.recipients = append(e.recipients, recipient)
+	}
+	return e, nil
+}
+
+func CheckRecipient(recipient string) error {
+	_, err := age.ParseX25519Recipient(strings.TrimSpace(recipient))
+	return err
+}
+
+// returns private key (identity) and public key (recipient) of new key pair
+func GenerateIdentity() (identity string, recipient string, err error) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		return "", "", err
+	}
+	return id.String(), id.Recipient().String(), nil
+}
+
+// adds private keys (identities) decrypting data encrypted to recipients,
+// identities are in age identity file format: one key per line, comments start with #
+func (d *Decrypter) AddIdentities(identities string) error {
+	ids, err := age.ParseIdentities(strings.NewReader(identities))
+	if err != nil {
+		return err
+	}
+	d.identities = append(d.identities, ids...)
+	return nil
+}
+
+func (d *Decrypter) isAgeFormat() bool {
+	return bytes.HasPrefix([]byte(ageMagic), d.buf[:len(formatMagic)+1])
+}
+
+func (d *Decrypter) initAgeReader(fileReader io.Reader) error {
+	if len(d.identities) == 0 {
+		return ErrIdentityRequired
+	}
+	r, err := age.Decrypt(fileReader, d.identities...)
+	if err != nil {
+		return getAgeError(err)
+	}
+	d.ageReader = r
+	return nil
+}
+
+// decryption of age data is reader based, so data written to decrypter is passed through pipe
+func (d *Decrypter) initAgeWriter() error {
+	if len(d.identities) == 0 {
+		return ErrIdentityRequired
+	}
+	pr, pw := io.Pipe()
+	d.ageWriter = pw
+	d.ageDone = make(chan error, 1)
+	go func() {
+		err := d.initAgeReader(pr)
+		if err == nil {
+			_, err = io.Copy(d.fileWriter, d.ageReader)
+		}
+		pr.CloseWithError(err)
+		d.ageDone <- err
+	}()
+
+	data := d.buf
+	d.buf = nil
+	_, err := d.ageWriter.Write(data)
+	return err
+}
+
+func (d *Decrypter) closeAgeWriter() error {
+	d.ageWriter.Close()
+	return <-d.ageDone
+}
+
+func getAgeError(err error) error {
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return ErrIdentityRequired
+	}
+	return err
+}
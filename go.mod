@@ -1,11 +1,24 @@
 module github.com/n-boy/backuper
 
-go 1.20
+go 1.22
 
 require (
+	filippo.io/age v1.1.1
 	github.com/aws/aws-sdk-go v1.53.14
+	github.com/johannesboyne/gofakes3 v0.0.0-20230506070712-04da935ef877
+	github.com/klauspost/compress v1.18.0
 	github.com/nightlyone/lockfile v1.0.0
+	github.com/pkg/sftp v1.13.6
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
-require github.com/jmespath/go-jmespath v0.4.0 // indirect
+require (
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/ryszard/goskiplist v0.0.0-20150312221310-2dfbae5fcf46 // indirect
+	github.com/shabbyrobe/gocovmerge v0.0.0-20190829150210-3e036491d500 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/tools v0.8.0 // indirect
+)
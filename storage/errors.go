@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/pkg/sftp"
+
+	"github.com/n-boy/backuper/base"
+	"github.com/n-boy/backuper/storage/towebdav"
+)
+
+// reports whether request to storage failed by the reason which could go away by itself:
+// timeout, lost connection, throttling or server error (5xx), so the request is worth to be repeated.
+// Errors of canceled requests and pending storage requests are not transient
+func IsTransientError(err error) bool {
+	if err == nil || err == base.ErrStorageRequestInProgress ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	// errors of AWS SDK don't support errors.Unwrap, their causes are walked via OrigErr
+	for e := err; e != nil; e = unwrapError(e) {
+		if isTransientStatus(e) || isTransientNetError(e) {
+			return true
+		}
+		if aerr, ok := e.(awserr.Error); ok {
+			if aerr.Code() == request.CanceledErrorCode {
+				return false
+			}
+			if request.IsErrorThrottle(aerr) || request.IsErrorRetryable(aerr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func unwrapError(err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.OrigErr()
+	}
+	return errors.Unwrap(err)
+}
+
+func isTransientStatus(err error) bool {
+	var status int
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		status = reqErr.StatusCode()
+	} else if statusErr, ok := err.(*towebdav.StatusError); ok {
+		status = statusErr.StatusCode
+	}
+	return status >= 500 || status == http.StatusTooManyRequests || status == http.StatusRequestTimeout
+}
+
+func isTransientNetError(err error) bool {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		// connection to server is refused or broken, but unknown host is not going to appear
+		var dnsErr *net.DNSError
+		return !errors.As(opErr, &dnsErr) || !dnsErr.IsNotFound
+	}
+	return err == io.ErrUnexpectedEOF || err == syscall.ECONNRESET || err == syscall.EPIPE ||
+		err == sftp.ErrSSHFxConnectionLost
+}
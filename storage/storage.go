@@ -4,7 +4,12 @@ import (
 	"github.com/n-boy/backuper/base"
 	"github.com/n-boy/backuper/storage/toglacier"
 	"github.com/n-boy/backuper/storage/tolocalfs"
+	"github.com/n-boy/backuper/storage/tomirror"
+	"github.com/n-boy/backuper/storage/tos3"
+	"github.com/n-boy/backuper/storage/tosftp"
+	"github.com/n-boy/backuper/storage/towebdav"
 
+	"context"
 	"fmt"
 	"io"
 	"reflect"
@@ -12,15 +17,22 @@ import (
 
 type GenericStorage interface {
 	GetStorageConfig() map[string]string
-	UploadFile(filePath string, remoteFileName string) (map[string]string, error)
-	DownloadFile(fileStorageId map[string]string, localFilePath string) error
-	DownloadFileToPipe(fileStorageId map[string]string, pipe io.Writer) error
-	DeleteFile(fileStorageInfo map[string]string) error
-	GetFilesList() ([]base.GenericStorageFileInfo, error)
+	UploadFile(ctx context.Context, filePath string, remoteFileName string) (map[string]string, error)
+	DownloadFile(ctx context.Context, fileStorageId map[string]string, localFilePath string) error
+	DownloadFileToPipe(ctx context.Context, fileStorageId map[string]string, pipe io.Writer) error
+	DeleteFile(ctx context.Context, fileStorageInfo map[string]string) error
+	GetFilesList(ctx context.Context) ([]base.GenericStorageFileInfo, error)
 	GetType() string
 }
 
-var storageTypes = []string{"glacier", "localfs"}
+// storage able to upload file of unknown size read from reader, so file is not staged on local disk before upload.
+// Partly uploaded file is removed, if upload fails or is canceled. It is optional, files staged on disk are
+// uploaded by GenericStorage.UploadFile, e.g. when storage can resume their failed uploads
+type StreamingStorage interface {
+	UploadStream(ctx context.Context, reader io.Reader, remoteFileName string) (map[string]string, error)
+}
+
+var storageTypes = []string{"glacier", "localfs", "s3", "sftp", "webdav", "mirror"}
 
 func GetStorageTypes() []string {
 	return storageTypes
@@ -47,13 +59,24 @@ func NewStorage(config map[string]string) (GenericStorage, error) {
 		return toglacier.NewStorage(config)
 	case "localfs":
 		return tolocalfs.NewStorage(config)
+	case "s3":
+		return tos3.NewStorage(config)
+	case "sftp":
+		return tosftp.NewStorage(config)
+	case "webdav":
+		return towebdav.NewStorage(config)
+	case "mirror":
+		return tomirror.NewStorage(config, newMirrorChildStorage)
 	}
 	return nil, fmt.Errorf("Storage type is not supported: %v", stype)
 }
 
+const RedactedValue string = "<redacted>"
+
 type ConfigField struct {
-	Name  string
-	Title string
+	Name   string
+	Title  string
+	Secret bool
 }
 
 func GetStorageConfigFields(stype string) (fields []ConfigField, err error) {
@@ -74,6 +97,7 @@ func GetStorageConfigFields(stype string) (fields []ConfigField, err error) {
 			} else {
 				cf.Title = cf.Name
 			}
+			cf.Secret = tag.Get("secret") == "true"
 
 			fields = append(fields, cf)
 		}
@@ -82,13 +106,52 @@ func GetStorageConfigFields(stype string) (fields []ConfigField, err error) {
 	return
 }
 
+// returns storage config with values of secret fields (passwords, keys) hidden
+func GetRedactedStorageConfig(config map[string]string) map[string]string {
+	redacted := make(map[string]string)
+	if config["type"] == "mirror" {
+		redacted["type"] = config["type"]
+		for i, childConfig := range tomirror.GetChildConfigs(config) {
+			tomirror.SetChildConfig(redacted, i+1, GetRedactedStorageConfig(childConfig))
+		}
+		return redacted
+	}
+
+	for key, value := range config {
+		redacted[key] = value
+	}
+	fields, _ := GetStorageConfigFields(config["type"])
+	for _, cf := range fields {
+		if cf.Secret && redacted[cf.Name] != "" {
+			redacted[cf.Name] = RedactedValue
+		}
+	}
+	return redacted
+}
+
 func GetEmptyStorage(stype string) (es GenericStorage, err error) {
 	switch stype {
 	case "glacier":
 		return toglacier.GetEmptyStorage(), nil
 	case "localfs":
 		return tolocalfs.GetEmptyStorage(), nil
+	case "s3":
+		return tos3.GetEmptyStorage(), nil
+	case "sftp":
+		return tosftp.GetEmptyStorage(), nil
+	case "webdav":
+		return towebdav.GetEmptyStorage(), nil
+	case "mirror":
+		return tomirror.GetEmptyStorage(), nil
 	}
 
 	return nil, fmt.Errorf("Storage type is not supported")
 }
+
+func newMirrorChildStorage(config map[string]string) (tomirror.ChildStorage, error) {
+	s, err := NewStorage(config)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -2,6 +2,7 @@ package toglacier
 
 import (
 	"bufio"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -12,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -26,11 +28,30 @@ import (
 // must be power of two
 const MultipartUploadPartSize = 32 * 1024 * 1024
 
+// parts of one archive uploaded at the same time
+const MultipartUploadConcurrency = 4
+
+// attempts to upload one part, failed upload is resumed by the next upload of the same file
+const MultipartUploadPartAttempts = 3
+
+// pause before the next attempt to upload part, it grows with each attempt
+const MultipartUploadRetryPause = 5 * time.Second
+
 type GlacierStorage struct {
 	region                string `name:"region" title:"AWS Region"`
 	vault_name            string `name:"vault_name" title:"Vault Name"`
 	aws_access_key_id     string `name:"aws_access_key_id" title:"Access Key ID"`
-	aws_secret_access_key string `name:"aws_secret_access_key" title:"Secret Access Key"`
+	aws_secret_access_key string `name:"aws_secret_access_key" title:"Secret Access Key" secret:"true"`
+}
+
+// state of multipart upload kept in file next to uploaded one, so upload failed or interrupted is resumed
+type multipartUploadState struct {
+	UploadId    string
+	Description string
+	FileSize    int64
+	PartSize    int64
+	// tree hashes of uploaded parts by their numbers (from 0)
+	Parts map[int64]string
 }
 
 type GlacierFileInfo struct {
@@ -71,7 +92,9 @@ func (gs GlacierStorage) GetStorageConfig() map[string]string {
 	return config
 }
 
-func (gs GlacierStorage) UploadFile(filePath string, remoteFileName string) (map[string]string, error) {
+// multipart upload is resumed, if the same file was uploaded to the same vault before and its upload failed,
+// parts are uploaded concurrently, each part is retried several times
+func (gs GlacierStorage) UploadFile(ctx context.Context, filePath string, remoteFileName string) (map[string]string, error) {
 	result := make(map[string]string)
 
 	fileReader, err := os.Open(filePath)
@@ -92,100 +115,311 @@ func (gs GlacierStorage) UploadFile(filePath string, remoteFileName string) (map
 
 	checksum := hex.EncodeToString(glacier.ComputeHashes(fileReader).TreeHash)
 
-	// initiate multipart upload
+	client := gs.getStorageClient()
+	statePath := gs.getUploadStatePath(filePath)
+	state, err := gs.initUpload(ctx, client, statePath, filename, fileInfo.Size())
+	if err != nil {
+		return result, err
+	}
+
+	// failed upload is not aborted, so it could be resumed
+	if err = gs.uploadParts(ctx, client, fileReader, state, statePath); err != nil {
+		return result, err
+	}
+
+	// complete multipart upload
+	completeUploadParams := &glacier.CompleteMultipartUploadInput{
+		AccountId:   aws.String("-"),
+		UploadId:    aws.String(state.UploadId),
+		VaultName:   aws.String(gs.vault_name),
+		ArchiveSize: aws.String(strconv.FormatInt(fileInfo.Size(), 10)),
+		Checksum:    aws.String(checksum),
+	}
+
+	uploadResult, err := client.CompleteMultipartUploadWithContext(ctx, completeUploadParams)
+	if err != nil {
+		if ctx.Err() == nil {
+			gs.abortUpload(&glacier.AbortMultipartUploadInput{
+				AccountId: completeUploadParams.AccountId,
+				UploadId:  completeUploadParams.UploadId,
+				VaultName: completeUploadParams.VaultName,
+			})
+			os.Remove(statePath)
+		}
+		return result, err
+	}
+	if err = os.Remove(statePath); err != nil {
+		base.LogErr.Println(err)
+	}
+	err = fileReader.Close()
+	if err != nil {
+		return result, err
+	}
+
+	result["ArchiveId"] = aws.StringValue(uploadResult.ArchiveId)
+	result["Checksum"] = aws.StringValue(uploadResult.Checksum)
+	result["Location"] = aws.StringValue(uploadResult.Location)
+	return result, nil
+}
+
+// state of multipart upload is kept next to uploaded file, it is named by region and vault,
+// so uploads of the same file to mirrored vaults are not mixed up
+func (gs GlacierStorage) getUploadStatePath(filePath string) string {
+	return fmt.Sprintf("%v.glacier_%v_%v.upload", filePath, gs.region, gs.vault_name)
+}
+
+// resumes multipart upload by its saved state, parts not found in vault are uploaded again,
+// new upload is initiated if there is no state or upload is expired (Glacier keeps it for 24 hours)
+func (gs GlacierStorage) initUpload(ctx context.Context, client *glacier.Glacier, statePath string,
+	description string, fileSize int64) (*multipartUploadState, error) {
+
+	state, err := loadUploadState(statePath)
+	if err == nil && state.isUploadOf(description, fileSize) {
+		uploadedParts, err := gs.getUploadedParts(ctx, client, state.UploadId)
+		if err == nil {
+			state.dropMissingParts(uploadedParts)
+			base.Log.Printf("Resume multipart upload of %v, parts uploaded before: %d", description, len(state.Parts))
+			return state, nil
+		} else if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		base.Log.Printf("Multipart upload of %v could not be resumed, starting new one: %v", description, err)
+	} else if err != nil && !os.IsNotExist(err) {
+		base.LogErr.Printf("Error while reading state of multipart upload, starting new one: %v", err)
+	}
+
 	initUploadParams := &glacier.InitiateMultipartUploadInput{
 		AccountId:          aws.String("-"),
 		VaultName:          aws.String(gs.vault_name),
-		ArchiveDescription: aws.String(filename),
+		ArchiveDescription: aws.String(description),
 		PartSize:           aws.String(strconv.FormatInt(MultipartUploadPartSize, 10))}
-	// panic(fmt.Errorf("%v", initUploadParams).Error())
-	initUploadResult, err := gs.getStorageClient().InitiateMultipartUpload(initUploadParams)
+	initUploadResult, err := client.InitiateMultipartUploadWithContext(ctx, initUploadParams)
 	if err != nil {
-		return result, err
+		return nil, err
+	}
+	state = &multipartUploadState{
+		UploadId:    aws.StringValue(initUploadResult.UploadId),
+		Description: description,
+		FileSize:    fileSize,
+		PartSize:    MultipartUploadPartSize,
+		Parts:       make(map[int64]string),
+	}
+	if err = state.save(statePath); err != nil {
+		base.LogErr.Printf("Error while saving state of multipart upload: %v", err)
 	}
+	return state, nil
+}
 
-	abortUploadParams := &glacier.AbortMultipartUploadInput{
-		AccountId: initUploadParams.AccountId,
-		UploadId:  initUploadResult.UploadId,
-		VaultName: initUploadParams.VaultName,
+// returns tree hashes of parts uploaded to vault by their ranges
+func (gs GlacierStorage) getUploadedParts(ctx context.Context, client *glacier.Glacier, uploadId string) (map[string]string, error) {
+	parts := make(map[string]string)
+	params := &glacier.ListPartsInput{
+		AccountId: aws.String("-"),
+		VaultName: aws.String(gs.vault_name),
+		UploadId:  aws.String(uploadId),
+	}
+	for {
+		result, err := client.ListPartsWithContext(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range result.Parts {
+			parts[aws.StringValue(part.RangeInBytes)] = aws.StringValue(part.SHA256TreeHash)
+		}
+		if aws.StringValue(result.Marker) == "" {
+			return parts, nil
+		}
+		params.Marker = result.Marker
 	}
+}
 
-	// upload archive parts, one-by-one
-	numOfParts := int64(math.Ceil(float64(fileInfo.Size()) / float64(MultipartUploadPartSize)))
+// uploads parts not uploaded yet by several workers, state is saved after each uploaded part.
+// The first failed part stops uploading of others
+func (gs GlacierStorage) uploadParts(ctx context.Context, client *glacier.Glacier, fileReader io.ReaderAt,
+	state *multipartUploadState, statePath string) error {
+
+	workersCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var firstErr error
+	partNums := make(chan int64)
+	var wg sync.WaitGroup
+	for i := 0; i < MultipartUploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for num := range partNums {
+				hash, err := gs.uploadPart(workersCtx, client, fileReader, state, num)
+
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+				} else {
+					state.Parts[num] = hash
+					// upload is not failed, if state is not saved, it could be only not resumed
+					if err := state.save(statePath); err != nil {
+						base.LogErr.Printf("Error while saving state of multipart upload: %v", err)
+					}
+					storageutils.ReportUploadProgress(ctx, state.getPartSize(num))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
 
-	for i := int64(0); i < numOfParts; i++ {
-		rangeStart := i * MultipartUploadPartSize
-		rangeFinish := (i+1)*MultipartUploadPartSize - 1
-		if rangeFinish >= fileInfo.Size() {
-			rangeFinish = fileInfo.Size() - 1
+PARTS_LOOP:
+	for num := int64(0); num < state.getPartsQty(); num++ {
+		mu.Lock()
+		_, uploaded := state.Parts[num]
+		if uploaded {
+			storageutils.ReportUploadProgress(ctx, state.getPartSize(num))
 		}
+		mu.Unlock()
+		if uploaded {
+			continue
+		}
+		select {
+		case partNums <- num:
+		case <-workersCtx.Done():
+			break PARTS_LOOP
+		}
+	}
+	close(partNums)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// returns tree hash of uploaded part
+func (gs GlacierStorage) uploadPart(ctx context.Context, client *glacier.Glacier, fileReader io.ReaderAt,
+	state *multipartUploadState, num int64) (string, error) {
 
-		fileSectionReader := io.NewSectionReader(fileReader, rangeStart, rangeFinish-rangeStart+1)
+	rangeStart := num * state.PartSize
+	partSize := state.getPartSize(num)
+	partReader := io.NewSectionReader(fileReader, rangeStart, partSize)
+	hash := hex.EncodeToString(glacier.ComputeHashes(partReader).TreeHash)
 
+	for attempt := 1; ; attempt++ {
+		if _, err := partReader.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		if err := storageutils.WaitUploadRateLimit(ctx, partSize); err != nil {
+			return "", err
+		}
 		uploadPartParams := &glacier.UploadMultipartPartInput{
-			AccountId: initUploadParams.AccountId,
-			UploadId:  initUploadResult.UploadId,
-			VaultName: initUploadParams.VaultName,
-			Body:      fileSectionReader,
-			Range:     aws.String(fmt.Sprintf("bytes %d-%d/*", rangeStart, rangeFinish)),
+			AccountId: aws.String("-"),
+			UploadId:  aws.String(state.UploadId),
+			VaultName: aws.String(gs.vault_name),
+			Body:      partReader,
+			Checksum:  aws.String(hash),
+			Range:     aws.String(fmt.Sprintf("bytes %v/*", state.getPartRange(num))),
 		}
 
-		base.Log.Println(fmt.Sprintf("Start uploading of part %d, range: %d - %d", i+1, rangeStart, rangeFinish))
+		base.Log.Println(fmt.Sprintf("Start uploading of part %d, range: %v", num+1, state.getPartRange(num)))
 		t0 := time.Now().Unix()
-		_, err := gs.getStorageClient().UploadMultipartPart(uploadPartParams)
-		if err != nil {
-			// errors ignoring upload aborting
-			_, err2 := gs.getStorageClient().AbortMultipartUpload(abortUploadParams)
-			if err2 != nil {
-				base.LogErr.Printf("Error while aborting multipart upload: %v", err2)
-			}
-			return result, err
-		} else {
-			speed := (rangeFinish - rangeStart) / (time.Now().Unix() - t0 + 1) / 1024 * 8
-			base.Log.Println(fmt.Sprintf("Uploaded part %d of %d (%d KBit/s)", i+1, numOfParts, speed))
+		_, err := client.UploadMultipartPartWithContext(ctx, uploadPartParams)
+		if err == nil {
+			speed := partSize / (time.Now().Unix() - t0 + 1) / 1024 * 8
+			base.Log.Println(fmt.Sprintf("Uploaded part %d of %d (%d KBit/s)", num+1, state.getPartsQty(), speed))
+			return hash, nil
+		} else if ctx.Err() != nil || attempt >= MultipartUploadPartAttempts {
+			return "", err
 		}
-	}
 
-	// complete multipart upload
-	completeUploadParams := &glacier.CompleteMultipartUploadInput{
-		AccountId:   initUploadParams.AccountId,
-		UploadId:    initUploadResult.UploadId,
-		VaultName:   initUploadParams.VaultName,
-		ArchiveSize: aws.String(strconv.FormatInt(fileInfo.Size(), 10)),
-		Checksum:    aws.String(checksum),
+		base.LogErr.Printf("Error while uploading part %d (attempt %d of %d): %v", num+1, attempt, MultipartUploadPartAttempts, err)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Duration(attempt) * MultipartUploadRetryPause):
+		}
 	}
+}
 
-	uploadResult, err := gs.getStorageClient().CompleteMultipartUpload(completeUploadParams)
+// aborts multipart upload, not using context of upload: uploaded parts should be dropped even if upload is canceled
+func (gs GlacierStorage) abortUpload(abortUploadParams *glacier.AbortMultipartUploadInput) {
+	// errors ignoring upload aborting
+	_, err := gs.getStorageClient().AbortMultipartUploadWithContext(context.Background(), abortUploadParams)
 	if err != nil {
-		// errors ignoring upload aborting
-		_, err2 := gs.getStorageClient().AbortMultipartUpload(abortUploadParams)
-		if err2 != nil {
-			base.LogErr.Printf("Error while aborting multipart upload: %v", err2)
-		}
+		base.LogErr.Printf("Error while aborting multipart upload: %v", err)
+	}
+}
 
-		return result, err
+func loadUploadState(statePath string) (*multipartUploadState, error) {
+	data, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return nil, err
 	}
-	err = fileReader.Close()
+	var state multipartUploadState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if state.Parts == nil {
+		state.Parts = make(map[int64]string)
+	}
+	return &state, nil
+}
+
+func (state *multipartUploadState) save(statePath string) error {
+	data, err := json.Marshal(state)
 	if err != nil {
-		return result, err
+		return err
+	}
+	err = ioutil.WriteFile(statePath+"~", data, 0600)
+	if err == nil {
+		err = os.Rename(statePath+"~", statePath)
 	}
+	return err
+}
 
-	result["ArchiveId"] = aws.StringValue(uploadResult.ArchiveId)
-	result["Checksum"] = aws.StringValue(uploadResult.Checksum)
-	result["Location"] = aws.StringValue(uploadResult.Location)
-	return result, nil
+// reports whether saved upload is of the same file with the same parts, so it could be resumed
+func (state *multipartUploadState) isUploadOf(description string, fileSize int64) bool {
+	return state.Description == description && state.FileSize == fileSize && state.PartSize == MultipartUploadPartSize
 }
 
-func (gs GlacierStorage) DownloadFile(fileStorageId map[string]string, localFilePath string) error {
+// drops parts not found in vault, or found with other hash, by tree hashes of uploaded parts by their ranges.
+// Dropped parts are uploaded again
+func (state *multipartUploadState) dropMissingParts(uploadedParts map[string]string) {
+	for num, hash := range state.Parts {
+		if num < 0 || num >= state.getPartsQty() || uploadedParts[state.getPartRange(num)] != hash {
+			delete(state.Parts, num)
+		}
+	}
+}
+
+func (state *multipartUploadState) getPartsQty() int64 {
+	return int64(math.Ceil(float64(state.FileSize) / float64(state.PartSize)))
+}
+
+func (state *multipartUploadState) getPartSize(num int64) int64 {
+	if (num+1)*state.PartSize > state.FileSize {
+		return state.FileSize - num*state.PartSize
+	}
+	return state.PartSize
+}
+
+// range of bytes of part in the form Glacier lists it: "start-finish"
+func (state *multipartUploadState) getPartRange(num int64) string {
+	rangeStart := num * state.PartSize
+	return fmt.Sprintf("%d-%d", rangeStart, rangeStart+state.getPartSize(num)-1)
+}
+
+func (gs GlacierStorage) DownloadFile(ctx context.Context, fileStorageId map[string]string, localFilePath string) error {
 	downloadAction := func(pipe io.Writer) error {
-		return gs.DownloadFileToPipe(fileStorageId, pipe)
+		return gs.DownloadFileToPipe(ctx, fileStorageId, pipe)
 	}
 	return storageutils.DownloadFile(downloadAction, localFilePath)
 }
 
-func (gs GlacierStorage) DownloadFileToPipe(fileStorageId map[string]string, pipe io.Writer) error {
+func (gs GlacierStorage) DownloadFileToPipe(ctx context.Context, fileStorageId map[string]string, pipe io.Writer) error {
 
-	activeJob, err := gs.findJob(glacier.ActionCodeArchiveRetrieval, fileStorageId["ArchiveId"])
+	activeJob, err := gs.findJob(ctx, glacier.ActionCodeArchiveRetrieval, fileStorageId["ArchiveId"])
 	if err != nil {
 		return err
 	}
@@ -199,17 +433,17 @@ func (gs GlacierStorage) DownloadFileToPipe(fileStorageId map[string]string, pip
 				Type:      aws.String("archive-retrieval"),
 			},
 		}
-		result, err := gs.getStorageClient().InitiateJob(params)
+		result, err := gs.getStorageClient().InitiateJobWithContext(ctx, params)
 		if err != nil {
 			return err
 		}
-		activeJob, err = gs.getJob(result.JobId)
+		activeJob, err = gs.getJob(ctx, result.JobId)
 		if err != nil {
 			return err
 		}
 	}
 
-	activeJob, err = gs.waitJobComplete(activeJob, 0, 1)
+	activeJob, err = gs.waitJobComplete(ctx, activeJob, 0, 1)
 	if err != nil {
 		return err
 	}
@@ -218,15 +452,19 @@ func (gs GlacierStorage) DownloadFileToPipe(fileStorageId map[string]string, pip
 		AccountId: aws.String("-"),
 		VaultName: aws.String(gs.vault_name),
 		JobId:     activeJob.JobId}
-	result, err := gs.getStorageClient().GetJobOutput(params)
+	result, err := gs.getStorageClient().GetJobOutputWithContext(ctx, params)
 	if err != nil {
 		return err
 	}
+	defer result.Body.Close()
 
 	bufWriter := bufio.NewWriterSize(pipe, 16*1024*1024)
 
 	buf := make([]byte, 4*1024*1024)
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		n, err := result.Body.Read(buf)
 		if err != nil && err != io.EOF {
 			return err
@@ -245,19 +483,19 @@ func (gs GlacierStorage) DownloadFileToPipe(fileStorageId map[string]string, pip
 	return nil
 }
 
-func (gs GlacierStorage) DeleteFile(fileStorageInfo map[string]string) error {
+func (gs GlacierStorage) DeleteFile(ctx context.Context, fileStorageInfo map[string]string) error {
 	params := &glacier.DeleteArchiveInput{
 		AccountId: aws.String("-"),
 		ArchiveId: aws.String(fileStorageInfo["ArchiveId"]),
 		VaultName: aws.String(gs.vault_name)}
 
-	_, err := gs.getStorageClient().DeleteArchive(params)
+	_, err := gs.getStorageClient().DeleteArchiveWithContext(ctx, params)
 	return err
 }
 
-func (gs GlacierStorage) GetFilesList() ([]base.GenericStorageFileInfo, error) {
+func (gs GlacierStorage) GetFilesList(ctx context.Context) ([]base.GenericStorageFileInfo, error) {
 	var filesList []base.GenericStorageFileInfo
-	activeJob, err := gs.findJob(glacier.ActionCodeInventoryRetrieval, "")
+	activeJob, err := gs.findJob(ctx, glacier.ActionCodeInventoryRetrieval, "")
 	if err != nil {
 		return filesList, err
 	}
@@ -270,17 +508,17 @@ func (gs GlacierStorage) GetFilesList() ([]base.GenericStorageFileInfo, error) {
 				Type: aws.String("inventory-retrieval"),
 			},
 		}
-		result, err := gs.getStorageClient().InitiateJob(params)
+		result, err := gs.getStorageClient().InitiateJobWithContext(ctx, params)
 		if err != nil {
 			return filesList, err
 		}
-		activeJob, err = gs.getJob(result.JobId)
+		activeJob, err = gs.getJob(ctx, result.JobId)
 		if err != nil {
 			return filesList, err
 		}
 	}
 
-	activeJob, err = gs.waitJobComplete(activeJob, 0, 1)
+	activeJob, err = gs.waitJobComplete(ctx, activeJob, 0, 1)
 	if err != nil {
 		return filesList, err
 	}
@@ -289,16 +527,17 @@ func (gs GlacierStorage) GetFilesList() ([]base.GenericStorageFileInfo, error) {
 		AccountId: aws.String("-"),
 		VaultName: aws.String(gs.vault_name),
 		JobId:     activeJob.JobId}
-	result, err := gs.getStorageClient().GetJobOutput(params)
+	result, err := gs.getStorageClient().GetJobOutputWithContext(ctx, params)
 	if err != nil {
 		return filesList, err
 	}
+	defer result.Body.Close()
 
 	type jsonJobResp struct {
 		ArchiveList []GlacierFileInfo
 	}
 	var jobResp jsonJobResp
-	jsonResp, err := ioutil.ReadAll(result.Body)
+	jsonResp, err := ioutil.ReadAll(storageutils.NewContextReader(ctx, result.Body))
 	if err == nil {
 		err = json.Unmarshal(jsonResp, &jobResp)
 	}
@@ -311,12 +550,12 @@ func (gs GlacierStorage) GetFilesList() ([]base.GenericStorageFileInfo, error) {
 	return filesList, nil
 }
 
-func (gs GlacierStorage) findJob(jobAction string, archiveId string) (*glacier.JobDescription, error) {
+func (gs GlacierStorage) findJob(ctx context.Context, jobAction string, archiveId string) (*glacier.JobDescription, error) {
 	params := &glacier.ListJobsInput{
 		AccountId: aws.String("-"),
 		VaultName: aws.String(gs.vault_name),
 		Limit:     aws.String("1000000")}
-	jobsList, err := gs.getStorageClient().ListJobs(params)
+	jobsList, err := gs.getStorageClient().ListJobsWithContext(ctx, params)
 	if err != nil {
 		return nil, err
 	}
@@ -340,28 +579,32 @@ func (gs GlacierStorage) findJob(jobAction string, archiveId string) (*glacier.J
 	return activeJob, nil
 }
 
-func (gs GlacierStorage) getJob(jobId *string) (*glacier.JobDescription, error) {
+func (gs GlacierStorage) getJob(ctx context.Context, jobId *string) (*glacier.JobDescription, error) {
 	params := &glacier.DescribeJobInput{
 		AccountId: aws.String("-"),
 		VaultName: aws.String(gs.vault_name),
 		JobId:     jobId,
 	}
-	result, err := gs.getStorageClient().DescribeJob(params)
+	result, err := gs.getStorageClient().DescribeJobWithContext(ctx, params)
 	if err != nil {
 		return nil, err
 	}
 	return result, nil
 }
 
-func (gs GlacierStorage) waitJobComplete(job *glacier.JobDescription, timeout int, repeatPause int) (*glacier.JobDescription, error) {
+func (gs GlacierStorage) waitJobComplete(ctx context.Context, job *glacier.JobDescription, timeout int, repeatPause int) (*glacier.JobDescription, error) {
 	var err error
 	timeStart := time.Now()
 	for *job.Completed == false && *job.StatusCode != glacier.StatusCodeFailed {
-		time.Sleep(time.Duration(repeatPause) * time.Second)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(repeatPause) * time.Second):
+		}
 		if time.Since(timeStart).Seconds() > float64(timeout) {
 			break
 		}
-		job, err = gs.getJob(job.JobId)
+		job, err = gs.getJob(ctx, job.JobId)
 		if err != nil {
 			return nil, err
 		}
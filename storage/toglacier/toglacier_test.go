@@ -31,6 +31,14 @@ func TestGetFilesList(t *testing.T) {
 	teststorage.CheckGetFilesList(t, s, smallFileSize, waitForActualFilesListSeconds)
 }
 
+func TestUploadRateLimit(t *testing.T) {
+	s, err := getStorage()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckUploadRateLimit(t, s, smallFileSize)
+}
+
 func TestDeleteFile(t *testing.T) {
 	s, err := getStorage()
 	if err != nil {
@@ -0,0 +1,98 @@
+package toglacier
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadStateParts(t *testing.T) {
+	const partSize = MultipartUploadPartSize
+	testCases := []struct {
+		fileSize  int64
+		partsQty  int64
+		lastSize  int64
+		lastRange string
+	}{
+		{1, 1, 1, "0-0"},
+		{partSize, 1, partSize, "0-33554431"},
+		{partSize + 1, 2, 1, "33554432-33554432"},
+		{3*partSize - 10, 3, partSize - 10, "67108864-100663285"},
+	}
+	for _, tc := range testCases {
+		state := multipartUploadState{FileSize: tc.fileSize, PartSize: partSize}
+		if qty := state.getPartsQty(); qty != tc.partsQty {
+			t.Errorf("Test failed. File size: %v, qty of parts not as expected: got %v, expected %v\n", tc.fileSize, qty, tc.partsQty)
+			continue
+		}
+		last := tc.partsQty - 1
+		if size := state.getPartSize(last); size != tc.lastSize {
+			t.Errorf("Test failed. File size: %v, size of last part not as expected: got %v, expected %v\n", tc.fileSize, size, tc.lastSize)
+		}
+		if last > 0 && state.getPartSize(0) != partSize {
+			t.Errorf("Test failed. File size: %v, size of first part not as expected: got %v, expected %v\n",
+				tc.fileSize, state.getPartSize(0), partSize)
+		}
+		if partRange := state.getPartRange(last); partRange != tc.lastRange {
+			t.Errorf("Test failed. File size: %v, range of last part not as expected: got %v, expected %v\n", tc.fileSize, partRange, tc.lastRange)
+		}
+	}
+}
+
+// parts missing in vault, uploaded with other content, or out of file are uploaded again
+func TestUploadStateDropMissingParts(t *testing.T) {
+	state := multipartUploadState{FileSize: 3*MultipartUploadPartSize + 5, PartSize: MultipartUploadPartSize,
+		Parts: map[int64]string{0: "hash0", 1: "hash1", 2: "hash2", 3: "hash3", 7: "hash7"}}
+	uploadedParts := map[string]string{
+		state.getPartRange(0): "hash0",
+		state.getPartRange(1): "other",
+		state.getPartRange(3): "hash3",
+	}
+	state.dropMissingParts(uploadedParts)
+
+	expected := map[int64]string{0: "hash0", 3: "hash3"}
+	if len(state.Parts) != len(expected) {
+		t.Errorf("Test failed. Parts kept not as expected: got %v, expected %v\n", state.Parts, expected)
+	}
+	for num, hash := range expected {
+		if state.Parts[num] != hash {
+			t.Errorf("Test failed. Parts kept not as expected: got %v, expected %v\n", state.Parts, expected)
+			break
+		}
+	}
+}
+
+// upload is started again, if file or size of parts is changed since upload state was saved
+func TestUploadStateResume(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "archive.zip.glacier_region_vault.upload")
+	saved := multipartUploadState{UploadId: "upload1", Description: "archive.zip", FileSize: 100,
+		PartSize: MultipartUploadPartSize, Parts: map[int64]string{0: "hash0"}}
+	if err := saved.save(statePath); err != nil {
+		t.Fatalf("Test died. Error while saving upload state: %v\n", err)
+	}
+	state, err := loadUploadState(statePath)
+	if err != nil {
+		t.Fatalf("Test died. Error while loading upload state: %v\n", err)
+	}
+	if state.UploadId != saved.UploadId || state.Parts[0] != "hash0" {
+		t.Errorf("Test failed. Loaded upload state not as expected: got %+v, expected %+v\n", *state, saved)
+	}
+
+	testCases := []struct {
+		description string
+		fileSize    int64
+		partSize    int64
+		resumable   bool
+	}{
+		{"archive.zip", 100, MultipartUploadPartSize, true},
+		{"archive2.zip", 100, MultipartUploadPartSize, false},
+		{"archive.zip", 101, MultipartUploadPartSize, false},
+		{"archive.zip", 100, MultipartUploadPartSize / 2, false},
+	}
+	for _, tc := range testCases {
+		state.PartSize = tc.partSize
+		if resumable := state.isUploadOf(tc.description, tc.fileSize); resumable != tc.resumable {
+			t.Errorf("Test failed. Upload of %v (%v bytes, parts of %v) resumable: got %v, expected %v\n",
+				tc.description, tc.fileSize, tc.partSize, resumable, tc.resumable)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package tolocalfs
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"os"
@@ -42,12 +43,10 @@ func (ls LocalFSStorage) GetStorageConfig() map[string]string {
 	return config
 }
 
-func (ls LocalFSStorage) UploadFile(filePath string, remoteFileName string) (map[string]string, error) {
-	result := make(map[string]string)
-
+func (ls LocalFSStorage) UploadFile(ctx context.Context, filePath string, remoteFileName string) (map[string]string, error) {
 	fileReader, err := os.Open(filePath)
 	if err != nil {
-		return result, err
+		return make(map[string]string), err
 	}
 	defer fileReader.Close()
 
@@ -55,6 +54,14 @@ func (ls LocalFSStorage) UploadFile(filePath string, remoteFileName string) (map
 	if remoteFileName != "" {
 		filename = filepath.Base(remoteFileName)
 	}
+	return ls.UploadStream(ctx, fileReader, filename)
+}
+
+// writes file read from reader till its end, partly written file is removed, if upload fails or is canceled
+func (ls LocalFSStorage) UploadStream(ctx context.Context, reader io.Reader, remoteFileName string) (map[string]string, error) {
+	result := make(map[string]string)
+
+	filename := filepath.Base(remoteFileName)
 	remoteFilepath := filepath.Join(ls.path, filename)
 	remoteFilepathShadow := remoteFilepath + "~"
 	fileWriter, err := os.OpenFile(remoteFilepathShadow, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
@@ -63,11 +70,13 @@ func (ls LocalFSStorage) UploadFile(filePath string, remoteFileName string) (map
 	}
 	defer fileWriter.Close()
 
-	_, err = io.Copy(fileWriter, fileReader)
-	if err != nil {
-		return result, err
+	_, err = io.Copy(fileWriter, storageutils.NewContextReader(ctx, storageutils.NewUploadProgressReader(ctx, storageutils.NewUploadRateLimitReader(ctx, reader))))
+	if err == nil {
+		err = fileWriter.Close()
 	}
-	if fileWriter.Close(); err != nil {
+	if err != nil {
+		fileWriter.Close()
+		os.Remove(remoteFilepathShadow)
 		return result, err
 	}
 
@@ -79,30 +88,30 @@ func (ls LocalFSStorage) UploadFile(filePath string, remoteFileName string) (map
 	return result, nil
 }
 
-func (ls LocalFSStorage) DownloadFile(fileStorageId map[string]string, localFilePath string) error {
+func (ls LocalFSStorage) DownloadFile(ctx context.Context, fileStorageId map[string]string, localFilePath string) error {
 	downloadAction := func(pipe io.Writer) error {
-		return ls.DownloadFileToPipe(fileStorageId, pipe)
+		return ls.DownloadFileToPipe(ctx, fileStorageId, pipe)
 	}
 	return storageutils.DownloadFile(downloadAction, localFilePath)
 }
 
-func (ls LocalFSStorage) DownloadFileToPipe(fileStorageId map[string]string, pipe io.Writer) error {
+func (ls LocalFSStorage) DownloadFileToPipe(ctx context.Context, fileStorageId map[string]string, pipe io.Writer) error {
 	fileReader, err := os.Open(filepath.Join(ls.path, fileStorageId["filename"]))
 	if err != nil {
 		return err
 	}
 	defer fileReader.Close()
 
-	_, err = io.Copy(pipe, fileReader)
+	_, err = io.Copy(pipe, storageutils.NewContextReader(ctx, fileReader))
 
 	return err
 }
 
-func (ls LocalFSStorage) DeleteFile(fileStorageInfo map[string]string) error {
+func (ls LocalFSStorage) DeleteFile(ctx context.Context, fileStorageInfo map[string]string) error {
 	return os.Remove(filepath.Join(ls.path, fileStorageInfo["filename"]))
 }
 
-func (ls LocalFSStorage) GetFilesList() ([]base.GenericStorageFileInfo, error) {
+func (ls LocalFSStorage) GetFilesList(ctx context.Context) ([]base.GenericStorageFileInfo, error) {
 	var filesList []base.GenericStorageFileInfo
 
 	dirNodes, err := ioutil.ReadDir(ls.path)
@@ -30,6 +30,22 @@ func TestGetFilesList(t *testing.T) {
 	teststorage.CheckGetFilesList(t, s, smallFileSize, 0)
 }
 
+func TestUploadRateLimit(t *testing.T) {
+	s, err := getStorage()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckUploadRateLimit(t, s, smallFileSize)
+}
+
+func TestUploadStream(t *testing.T) {
+	s, err := getStorage()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckUploadStream(t, s, smallFileSize)
+}
+
 func TestDeleteFile(t *testing.T) {
 	s, err := getStorage()
 	if err != nil {
@@ -0,0 +1,266 @@
+package tomirror
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/n-boy/backuper/base"
+	storageutils "github.com/n-boy/backuper/storage/utils"
+)
+
+const MinStoragesQty = 2
+
+// the same methods as storage.GenericStorage has,
+// declared here to avoid import cycle with storage package
+type ChildStorage interface {
+	GetStorageConfig() map[string]string
+	UploadFile(ctx context.Context, filePath string, remoteFileName string) (map[string]string, error)
+	DownloadFileToPipe(ctx context.Context, fileStorageId map[string]string, pipe io.Writer) error
+	DeleteFile(ctx context.Context, fileStorageInfo map[string]string) error
+	GetFilesList(ctx context.Context) ([]base.GenericStorageFileInfo, error)
+	GetType() string
+}
+
+type ChildStorageFactory func(config map[string]string) (ChildStorage, error)
+
+// child storages configs and files storage ids are kept in one flat map
+// with keys prefixed by child storage number: "1.type", "1.path", "2.ArchiveId", ...
+type MirrorStorage struct {
+	storages []ChildStorage
+}
+
+type MirrorFileInfo struct {
+	filename      string
+	fileStorageId map[string]string
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func NewStorage(config map[string]string, newChildStorage ChildStorageFactory) (MirrorStorage, error) {
+	var ms MirrorStorage
+
+	childConfigs := GetChildConfigs(config)
+	for i, childConfig := range childConfigs {
+		if childConfig["type"] == "mirror" {
+			return ms, fmt.Errorf("Mirror storage %v can not be nested into another mirror storage", i+1)
+		}
+		cs, err := newChildStorage(childConfig)
+		if err != nil {
+			return ms, fmt.Errorf("Mirror storage %v: %v", i+1, err)
+		}
+		ms.storages = append(ms.storages, cs)
+	}
+	if len(ms.storages) < MinStoragesQty {
+		return ms, fmt.Errorf("Mirror storage should contain at least %v storages", MinStoragesQty)
+	}
+
+	return ms, nil
+}
+
+func GetEmptyStorage() MirrorStorage {
+	return MirrorStorage{}
+}
+
+func (ms MirrorStorage) GetType() string {
+	return "mirror"
+}
+
+func (ms MirrorStorage) GetStorageConfig() map[string]string {
+	config := make(map[string]string)
+
+	for i, cs := range ms.storages {
+		childConfig := cs.GetStorageConfig()
+		childConfig["type"] = cs.GetType()
+		SetChildConfig(config, i+1, childConfig)
+	}
+
+	return config
+}
+
+func (ms MirrorStorage) UploadFile(ctx context.Context, filePath string, remoteFileName string) (map[string]string, error) {
+	result := make(map[string]string)
+
+	// progress is reported as average of mirrors, so it does not exceed size of file
+	var uploaded, reported int64
+	childCtx := storageutils.WithUploadProgress(ctx, func(bytes int64) {
+		uploaded += bytes
+		avg := uploaded / int64(len(ms.storages))
+		storageutils.ReportUploadProgress(ctx, avg-reported)
+		reported = avg
+	})
+
+	for i, cs := range ms.storages {
+		childResult, err := cs.UploadFile(childCtx, filePath, remoteFileName)
+		if err != nil {
+			// file should be in all mirrors or in none of them, also when upload is canceled
+			if err2 := ms.DeleteFile(context.Background(), result); err2 != nil {
+				base.LogErr.Printf("Error while deleting partially mirrored file: %v", err2)
+			}
+			return make(map[string]string), fmt.Errorf("Mirror storage %v (%v): %w", i+1, cs.GetType(), err)
+		}
+		SetChildConfig(result, i+1, childResult)
+	}
+
+	return result, nil
+}
+
+func (ms MirrorStorage) DownloadFile(ctx context.Context, fileStorageId map[string]string, localFilePath string) error {
+	downloadAction := func(pipe io.Writer) error {
+		return ms.DownloadFileToPipe(ctx, fileStorageId, pipe)
+	}
+	return storageutils.DownloadFile(downloadAction, localFilePath)
+}
+
+// downloads file from the first storage able to serve it
+func (ms MirrorStorage) DownloadFileToPipe(ctx context.Context, fileStorageId map[string]string, pipe io.Writer) error {
+	childIds := GetChildConfigs(fileStorageId)
+
+	var lastErr error
+	inProgress := false
+	for i, cs := range ms.storages {
+		if i >= len(childIds) || len(childIds[i]) == 0 {
+			continue
+		}
+
+		cw := &countingWriter{w: pipe}
+		err := cs.DownloadFileToPipe(ctx, childIds[i], cw)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if cw.n > 0 {
+			// part of file is already written to pipe, can't switch to another mirror
+			return fmt.Errorf("Mirror storage %v (%v): %w", i+1, cs.GetType(), err)
+		}
+
+		if err == base.ErrStorageRequestInProgress {
+			inProgress = true
+		} else {
+			base.LogErr.Printf("Mirror storage %v (%v) failed to download file, trying next one: %v", i+1, cs.GetType(), err)
+			lastErr = err
+		}
+	}
+
+	if inProgress {
+		return base.ErrStorageRequestInProgress
+	} else if lastErr != nil {
+		return lastErr
+	}
+	return fmt.Errorf("File storage id does not contain ids for any of mirror storages")
+}
+
+func (ms MirrorStorage) DeleteFile(ctx context.Context, fileStorageInfo map[string]string) error {
+	childIds := GetChildConfigs(fileStorageInfo)
+
+	var firstErr error
+	for i, cs := range ms.storages {
+		if i >= len(childIds) || len(childIds[i]) == 0 {
+			continue
+		}
+		if err := cs.DeleteFile(ctx, childIds[i]); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("Mirror storage %v (%v): %w", i+1, cs.GetType(), err)
+		}
+	}
+
+	return firstErr
+}
+
+// merges files lists of all mirrors, so each file could be downloaded from any mirror containing it
+func (ms MirrorStorage) GetFilesList(ctx context.Context) ([]base.GenericStorageFileInfo, error) {
+	var filesList []base.GenericStorageFileInfo
+
+	filesMap := make(map[string]map[string]string)
+	var lastErr error
+	succeeded := 0
+	for i, cs := range ms.storages {
+		childList, err := cs.GetFilesList(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return filesList, ctx.Err()
+			}
+			if err != base.ErrStorageRequestInProgress {
+				base.LogErr.Printf("Mirror storage %v (%v) failed to get files list: %v", i+1, cs.GetType(), err)
+			}
+			lastErr = err
+			continue
+		}
+		succeeded++
+
+		for _, fi := range childList {
+			if _, exists := filesMap[fi.GetFilename()]; !exists {
+				filesMap[fi.GetFilename()] = make(map[string]string)
+			}
+			SetChildConfig(filesMap[fi.GetFilename()], i+1, fi.GetFileStorageId())
+		}
+	}
+	if succeeded == 0 && lastErr != nil {
+		return filesList, lastErr
+	}
+
+	filenames := make([]string, 0, len(filesMap))
+	for filename := range filesMap {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	for _, filename := range filenames {
+		filesList = append(filesList, base.GenericStorageFileInfo(MirrorFileInfo{
+			filename:      filename,
+			fileStorageId: filesMap[filename],
+		}))
+	}
+
+	return filesList, nil
+}
+
+func (ms MirrorStorage) GetStorages() []ChildStorage {
+	return ms.storages
+}
+
+// splits flat map into maps of child storages, child number N is placed at index N-1
+func GetChildConfigs(config map[string]string) []map[string]string {
+	childConfigs := make([]map[string]string, 0)
+	for key, value := range config {
+		parts := strings.SplitN(key, ".", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		num, err := strconv.Atoi(parts[0])
+		if err != nil || num < 1 {
+			continue
+		}
+		for len(childConfigs) < num {
+			childConfigs = append(childConfigs, make(map[string]string))
+		}
+		childConfigs[num-1][parts[1]] = value
+	}
+	return childConfigs
+}
+
+func SetChildConfig(config map[string]string, num int, childConfig map[string]string) {
+	for key, value := range childConfig {
+		config[fmt.Sprintf("%v.%v", num, key)] = value
+	}
+}
+
+func (cw *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	cw.n += int64(n)
+	return
+}
+
+func (mfi MirrorFileInfo) GetFilename() string {
+	return mfi.filename
+}
+
+func (mfi MirrorFileInfo) GetFileStorageId() map[string]string {
+	return mfi.fileStorageId
+}
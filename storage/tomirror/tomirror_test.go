@@ -0,0 +1,116 @@
+// +build integration storage mirror
+
+package tomirror_test
+
+import (
+	"github.com/n-boy/backuper/storage"
+	"github.com/n-boy/backuper/storage/tomirror"
+
+	"github.com/n-boy/backuper/ut/teststorage"
+	"github.com/n-boy/backuper/ut/testutils"
+
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const normalFileSize = 3 * 1024 * 1024
+const smallFileSize = 1 * 1024 * 1024
+
+func TestUploadDownloadFile(t *testing.T) {
+	s, _, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckUploadDownloadFile(t, s, normalFileSize)
+}
+
+func TestGetFilesList(t *testing.T) {
+	s, _, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckGetFilesList(t, s, smallFileSize, 0)
+}
+
+func TestUploadRateLimit(t *testing.T) {
+	s, _, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckUploadRateLimit(t, s, smallFileSize)
+}
+
+func TestDeleteFile(t *testing.T) {
+	s, _, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckDeleteFile(t, s, smallFileSize, true)
+}
+
+// file lost in the first mirror should be downloaded from the second one
+func TestDownloadFromNextMirror(t *testing.T) {
+	testutils.InitAppForTests()
+	s, childPaths, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	sourceFilePath := filepath.Join(childPaths[0], "..", "source.txt")
+	if err = ioutil.WriteFile(sourceFilePath, []byte(testutils.RandString(1024)), 0600); err != nil {
+		t.Fatalf("Test died. Step: CreateSourceFile, error: %v\n", err)
+	}
+
+	fileStorageId, err := s.UploadFile(context.Background(), sourceFilePath, "")
+	if err != nil {
+		t.Fatalf("Test died. Step: UploadFile, error: %v\n", err)
+	}
+	for i := range childPaths {
+		if len(tomirror.GetChildConfigs(fileStorageId)) <= i {
+			t.Fatalf("Test died. Step: CheckStorageId, storage id for mirror %v not found in %v\n", i+1, fileStorageId)
+		}
+	}
+
+	if err = os.Remove(filepath.Join(childPaths[0], "source.txt")); err != nil {
+		t.Fatalf("Test died. Step: RemoveFromFirstMirror, error: %v\n", err)
+	}
+
+	restoredFilePath := filepath.Join(childPaths[0], "..", "restored.txt")
+	if err = s.DownloadFile(context.Background(), fileStorageId, restoredFilePath); err != nil {
+		t.Fatalf("Test failed. Step: DownloadFile, error: %v\n", err)
+	}
+
+	sourceMD5, _ := testutils.CalcFileMD5(sourceFilePath)
+	restoredMD5, _ := testutils.CalcFileMD5(restoredFilePath)
+	if sourceMD5 != restoredMD5 {
+		t.Errorf("Test failed. Step: CompareMD5, expected: %v, got: %v\n", sourceMD5, restoredMD5)
+	}
+}
+
+func getStorage(t *testing.T) (tomirror.MirrorStorage, []string, error) {
+	baseDir, err := ioutil.TempDir(testutils.TmpDir(), "mirror")
+	if err != nil {
+		return tomirror.MirrorStorage{}, nil, err
+	}
+	t.Cleanup(func() { os.RemoveAll(baseDir) })
+
+	config := map[string]string{"type": "mirror"}
+	var childPaths []string
+	for i := 1; i <= 2; i++ {
+		childPath := filepath.Join(baseDir, "mirror"+string(rune('0'+i)))
+		if err = os.Mkdir(childPath, 0770); err != nil {
+			return tomirror.MirrorStorage{}, nil, err
+		}
+		tomirror.SetChildConfig(config, i, map[string]string{"type": "localfs", "path": childPath})
+		childPaths = append(childPaths, childPath)
+	}
+
+	s, err := storage.NewStorage(config)
+	if err != nil {
+		return tomirror.MirrorStorage{}, nil, err
+	}
+	return s.(tomirror.MirrorStorage), childPaths, nil
+}
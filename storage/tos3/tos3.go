@@ -0,0 +1,305 @@
+package tos3
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"github.com/n-boy/backuper/base"
+	storageutils "github.com/n-boy/backuper/storage/utils"
+)
+
+// must be not less than 5MB (S3 minimal part size)
+const MultipartUploadPartSize = 32 * 1024 * 1024
+
+// days to keep restored copy of archived (GLACIER, DEEP_ARCHIVE) object
+const RestoreObjectDays = 7
+
+const defaultRegion = "us-east-1"
+
+type S3Storage struct {
+	endpoint              string `name:"endpoint" title:"Endpoint URL (empty for AWS S3)"`
+	region                string `name:"region" title:"Region"`
+	bucket                string `name:"bucket" title:"Bucket"`
+	prefix                string `name:"prefix" title:"Key prefix"`
+	path_style            string `name:"path_style" title:"Use path-style addressing [true/false]"`
+	storage_class         string `name:"storage_class" title:"Storage class (empty for STANDARD)"`
+	aws_access_key_id     string `name:"aws_access_key_id" title:"Access Key ID"`
+	aws_secret_access_key string `name:"aws_secret_access_key" title:"Secret Access Key" secret:"true"`
+}
+
+type S3FileInfo struct {
+	key      string
+	filename string
+}
+
+func NewStorage(config map[string]string) (S3Storage, error) {
+	var ss S3Storage
+
+	ss.endpoint = config["endpoint"]
+	ss.region = config["region"]
+	ss.bucket = config["bucket"]
+	ss.prefix = config["prefix"]
+	ss.path_style = config["path_style"]
+	ss.storage_class = config["storage_class"]
+	ss.aws_access_key_id = config["aws_access_key_id"]
+	ss.aws_secret_access_key = config["aws_secret_access_key"]
+
+	if ss.path_style != "" {
+		if _, err := strconv.ParseBool(ss.path_style); err != nil {
+			return ss, err
+		}
+	}
+
+	return ss, nil
+}
+
+func GetEmptyStorage() S3Storage {
+	return S3Storage{}
+}
+
+func (ss S3Storage) GetType() string {
+	return "s3"
+}
+
+func (ss S3Storage) GetStorageConfig() map[string]string {
+	config := make(map[string]string)
+
+	config["endpoint"] = ss.endpoint
+	config["region"] = ss.region
+	config["bucket"] = ss.bucket
+	config["prefix"] = ss.prefix
+	config["path_style"] = ss.path_style
+	config["storage_class"] = ss.storage_class
+	config["aws_access_key_id"] = ss.aws_access_key_id
+	config["aws_secret_access_key"] = ss.aws_secret_access_key
+
+	return config
+}
+
+func (ss S3Storage) UploadFile(ctx context.Context, filePath string, remoteFileName string) (map[string]string, error) {
+	result := make(map[string]string)
+
+	fileReader, err := os.Open(filePath)
+	if err != nil {
+		return result, err
+	}
+	defer fileReader.Close()
+
+	filename := filepath.Base(filePath)
+	if remoteFileName != "" {
+		filename = filepath.Base(remoteFileName)
+	}
+	result, err = ss.UploadStream(ctx, fileReader, filename)
+	if err != nil {
+		return result, err
+	}
+	if err = fileReader.Close(); err != nil {
+		return make(map[string]string), err
+	}
+	return result, nil
+}
+
+// uploads file read from reader till its end by parts, so its size is not needed to be known,
+// parts of multipart upload are aborted by uploader on error or cancellation
+func (ss S3Storage) UploadStream(ctx context.Context, reader io.Reader, remoteFileName string) (map[string]string, error) {
+	result := make(map[string]string)
+
+	key := ss.getKey(filepath.Base(remoteFileName))
+	uploadParams := &s3manager.UploadInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(key),
+		Body:   reader,
+	}
+	if ss.storage_class != "" {
+		uploadParams.StorageClass = aws.String(ss.storage_class)
+	}
+
+	uploader := s3manager.NewUploaderWithClient(ss.getStorageClient(), func(u *s3manager.Uploader) {
+		u.PartSize = MultipartUploadPartSize
+		u.RequestOptions = append(u.RequestOptions, limitUploadRate(ctx), reportUploadedPart(ctx))
+	})
+	if _, err := uploader.UploadWithContext(ctx, uploadParams); err != nil {
+		return result, err
+	}
+
+	result["key"] = key
+	return result, nil
+}
+
+// reports progress of upload by parts (or by whole file, when it is not uploaded by parts),
+// as request of part is completed, so part sent again on retry is not counted twice.
+// Parts are uploaded concurrently, reports are serialized
+func reportUploadedPart(ctx context.Context) request.Option {
+	var mu sync.Mutex
+	return func(r *request.Request) {
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			body := getUploadBody(r)
+			if r.Error != nil || body == nil {
+				return
+			}
+			if size, err := body.Seek(0, io.SeekEnd); err == nil {
+				mu.Lock()
+				defer mu.Unlock()
+				storageutils.ReportUploadProgress(ctx, size)
+			}
+		})
+	}
+}
+
+// delays request of part (or of whole file), while it exceeds upload rate limit of context
+func limitUploadRate(ctx context.Context) request.Option {
+	return func(r *request.Request) {
+		r.Handlers.Build.PushBack(func(r *request.Request) {
+			body := getUploadBody(r)
+			if r.Error != nil || body == nil {
+				return
+			}
+			// body is not sent yet, its position is kept
+			if size, err := aws.SeekerLen(body); err == nil {
+				if err = storageutils.WaitUploadRateLimit(ctx, size); err != nil {
+					r.Error = err
+				}
+			}
+		})
+	}
+}
+
+func getUploadBody(r *request.Request) io.ReadSeeker {
+	switch params := r.Params.(type) {
+	case *s3.UploadPartInput:
+		return params.Body
+	case *s3.PutObjectInput:
+		return params.Body
+	}
+	return nil
+}
+
+func (ss S3Storage) DownloadFile(ctx context.Context, fileStorageId map[string]string, localFilePath string) error {
+	downloadAction := func(pipe io.Writer) error {
+		return ss.DownloadFileToPipe(ctx, fileStorageId, pipe)
+	}
+	return storageutils.DownloadFile(downloadAction, localFilePath)
+}
+
+func (ss S3Storage) DownloadFileToPipe(ctx context.Context, fileStorageId map[string]string, pipe io.Writer) error {
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(fileStorageId["key"]),
+	}
+	result, err := ss.getStorageClient().GetObjectWithContext(ctx, params)
+	if err != nil {
+		// object was moved to archive storage class by lifecycle rule, it should be restored before downloading
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidObjectState" {
+			return ss.restoreObject(ctx, fileStorageId["key"])
+		}
+		return err
+	}
+	defer result.Body.Close()
+
+	_, err = io.Copy(pipe, storageutils.NewContextReader(ctx, result.Body))
+	return err
+}
+
+func (ss S3Storage) DeleteFile(ctx context.Context, fileStorageInfo map[string]string) error {
+	params := &s3.DeleteObjectInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(fileStorageInfo["key"]),
+	}
+	_, err := ss.getStorageClient().DeleteObjectWithContext(ctx, params)
+	return err
+}
+
+func (ss S3Storage) GetFilesList(ctx context.Context) ([]base.GenericStorageFileInfo, error) {
+	var filesList []base.GenericStorageFileInfo
+
+	keyPrefix := ss.getKey("")
+	params := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(ss.bucket),
+		Prefix:    aws.String(keyPrefix),
+		Delimiter: aws.String("/"),
+	}
+	err := ss.getStorageClient().ListObjectsV2PagesWithContext(ctx, params,
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				key := aws.StringValue(obj.Key)
+				filename := strings.TrimPrefix(key, keyPrefix)
+				if filename != "" {
+					filesList = append(filesList, base.GenericStorageFileInfo(S3FileInfo{key: key, filename: filename}))
+				}
+			}
+			return true
+		})
+
+	return filesList, err
+}
+
+func (ss S3Storage) restoreObject(ctx context.Context, key string) error {
+	params := &s3.RestoreObjectInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &s3.RestoreRequest{
+			Days: aws.Int64(RestoreObjectDays),
+		},
+	}
+	_, err := ss.getStorageClient().RestoreObjectWithContext(ctx, params)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "RestoreAlreadyInProgress" {
+			return err
+		}
+	}
+	return base.ErrStorageRequestInProgress
+}
+
+func (ss S3Storage) getKey(filename string) string {
+	prefix := strings.Trim(ss.prefix, "/")
+	if prefix == "" {
+		return filename
+	} else if filename == "" {
+		return prefix + "/"
+	}
+	return path.Join(prefix, filename)
+}
+
+func (ss S3Storage) getStorageClient() *s3.S3 {
+	region := ss.region
+	if region == "" {
+		region = defaultRegion
+	}
+	pathStyle, _ := strconv.ParseBool(ss.path_style)
+
+	config := &aws.Config{
+		Region:           aws.String(region),
+		S3ForcePathStyle: aws.Bool(pathStyle),
+		LogLevel:         aws.LogLevel(1),
+	}
+	if ss.endpoint != "" {
+		config.Endpoint = aws.String(ss.endpoint)
+	}
+	if ss.aws_access_key_id != "" {
+		config.Credentials = credentials.NewStaticCredentials(ss.aws_access_key_id, ss.aws_secret_access_key, "")
+	}
+
+	return s3.New(session.Must(session.NewSession()), config)
+}
+
+func (sfi S3FileInfo) GetFilename() string {
+	return sfi.filename
+}
+
+func (sfi S3FileInfo) GetFileStorageId() map[string]string {
+	return map[string]string{"key": sfi.key}
+}
@@ -0,0 +1,86 @@
+// +build integration storage s3
+
+package tos3_test
+
+import (
+	"github.com/n-boy/backuper/storage/tos3"
+
+	"github.com/n-boy/backuper/ut/teststorage"
+	"github.com/n-boy/backuper/ut/testutils"
+
+	"net/http/httptest"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+const normalFileSize = 40 * 1024 * 1024
+const smallFileSize = 1 * 1024 * 1024
+
+const testBucket = "backuper-test"
+
+func TestUploadDownloadFile(t *testing.T) {
+	s, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckUploadDownloadFile(t, s, normalFileSize)
+}
+
+func TestGetFilesList(t *testing.T) {
+	s, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckGetFilesList(t, s, smallFileSize, 0)
+}
+
+func TestUploadRateLimit(t *testing.T) {
+	s, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckUploadRateLimit(t, s, smallFileSize)
+}
+
+func TestUploadStream(t *testing.T) {
+	s, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckUploadStream(t, s, smallFileSize)
+}
+
+func TestDeleteFile(t *testing.T) {
+	s, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckDeleteFile(t, s, smallFileSize, true)
+}
+
+// uses storage from tests config if defined, otherwise in-process S3-compatible server
+func getStorage(t *testing.T) (tos3.S3Storage, error) {
+	testsConfig, err := testutils.GetTestsConfig()
+	if err == nil && len(testsConfig.StorageS3) > 0 {
+		return tos3.NewStorage(testsConfig.StorageS3)
+	}
+
+	backend := s3mem.New()
+	if err := backend.CreateBucket(testBucket); err != nil {
+		return tos3.S3Storage{}, err
+	}
+	ts := httptest.NewServer(gofakes3.New(backend).Server())
+	t.Cleanup(ts.Close)
+
+	return tos3.NewStorage(map[string]string{
+		"endpoint":              ts.URL,
+		"region":                "eu-central-1",
+		"bucket":                testBucket,
+		"prefix":                "backuper/test",
+		"path_style":            "true",
+		"aws_access_key_id":     "test",
+		"aws_secret_access_key": "test",
+	})
+}
@@ -0,0 +1,284 @@
+package tosftp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/n-boy/backuper/base"
+	storageutils "github.com/n-boy/backuper/storage/utils"
+)
+
+const defaultPort = "22"
+const connectTimeout = 30 * time.Second
+
+type SFTPStorage struct {
+	host             string `name:"host" title:"SSH host"`
+	port             string `name:"port" title:"SSH port (empty for 22)"`
+	user             string `name:"user" title:"SSH user"`
+	key_file         string `name:"key_file" title:"Private key file (empty for password auth)"`
+	password         string `name:"password" title:"Password or private key passphrase" secret:"true"`
+	known_hosts_file string `name:"known_hosts_file" title:"Known hosts file (empty for ~/.ssh/known_hosts)"`
+	path             string `name:"path" title:"Remote path"`
+}
+
+type SFTPFileInfo struct {
+	filename string
+}
+
+type sftpConnection struct {
+	sshClient  *ssh.Client
+	sftpClient *sftp.Client
+}
+
+func NewStorage(config map[string]string) (SFTPStorage, error) {
+	var ss SFTPStorage
+
+	ss.host = config["host"]
+	ss.port = config["port"]
+	ss.user = config["user"]
+	ss.key_file = config["key_file"]
+	ss.password = config["password"]
+	ss.known_hosts_file = config["known_hosts_file"]
+	ss.path = config["path"]
+
+	return ss, nil
+}
+
+func GetEmptyStorage() SFTPStorage {
+	return SFTPStorage{}
+}
+
+func (ss SFTPStorage) GetType() string {
+	return "sftp"
+}
+
+func (ss SFTPStorage) GetStorageConfig() map[string]string {
+	config := make(map[string]string)
+
+	config["host"] = ss.host
+	config["port"] = ss.port
+	config["user"] = ss.user
+	config["key_file"] = ss.key_file
+	config["password"] = ss.password
+	config["known_hosts_file"] = ss.known_hosts_file
+	config["path"] = ss.path
+
+	return config
+}
+
+func (ss SFTPStorage) UploadFile(ctx context.Context, filePath string, remoteFileName string) (map[string]string, error) {
+	fileReader, err := os.Open(filePath)
+	if err != nil {
+		return make(map[string]string), err
+	}
+	defer fileReader.Close()
+
+	filename := filepath.Base(filePath)
+	if remoteFileName != "" {
+		filename = filepath.Base(remoteFileName)
+	}
+	return ss.UploadStream(ctx, fileReader, filename)
+}
+
+// writes file read from reader till its end, partly written file is removed, if upload fails or is canceled
+func (ss SFTPStorage) UploadStream(ctx context.Context, reader io.Reader, remoteFileName string) (map[string]string, error) {
+	result := make(map[string]string)
+
+	conn, err := ss.connect()
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+
+	filename := filepath.Base(remoteFileName)
+	remoteFilepath := path.Join(ss.path, filename)
+	remoteFilepathShadow := remoteFilepath + "~"
+	fileWriter, err := conn.sftpClient.OpenFile(remoteFilepathShadow, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return result, err
+	}
+	defer fileWriter.Close()
+
+	_, err = fileWriter.ReadFrom(storageutils.NewContextReader(ctx, storageutils.NewUploadProgressReader(ctx, storageutils.NewUploadRateLimitReader(ctx, reader))))
+	if err != nil {
+		fileWriter.Close()
+		conn.sftpClient.Remove(remoteFilepathShadow)
+		return result, err
+	}
+	if err = fileWriter.Close(); err != nil {
+		return result, err
+	}
+
+	if err = ss.rename(conn, remoteFilepathShadow, remoteFilepath); err != nil {
+		return result, err
+	}
+	result["filename"] = filename
+
+	return result, nil
+}
+
+func (ss SFTPStorage) DownloadFile(ctx context.Context, fileStorageId map[string]string, localFilePath string) error {
+	downloadAction := func(pipe io.Writer) error {
+		return ss.DownloadFileToPipe(ctx, fileStorageId, pipe)
+	}
+	return storageutils.DownloadFile(downloadAction, localFilePath)
+}
+
+func (ss SFTPStorage) DownloadFileToPipe(ctx context.Context, fileStorageId map[string]string, pipe io.Writer) error {
+	conn, err := ss.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	fileReader, err := conn.sftpClient.Open(path.Join(ss.path, fileStorageId["filename"]))
+	if err != nil {
+		return err
+	}
+	defer fileReader.Close()
+
+	_, err = fileReader.WriteTo(storageutils.NewContextWriter(ctx, pipe))
+
+	return err
+}
+
+func (ss SFTPStorage) DeleteFile(ctx context.Context, fileStorageInfo map[string]string) error {
+	conn, err := ss.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.sftpClient.Remove(path.Join(ss.path, fileStorageInfo["filename"]))
+}
+
+func (ss SFTPStorage) GetFilesList(ctx context.Context) ([]base.GenericStorageFileInfo, error) {
+	var filesList []base.GenericStorageFileInfo
+
+	conn, err := ss.connect()
+	if err != nil {
+		return filesList, err
+	}
+	defer conn.Close()
+
+	dirNodes, err := conn.sftpClient.ReadDir(ss.path)
+	if err != nil {
+		return filesList, err
+	}
+
+	for _, fi := range dirNodes {
+		if !fi.IsDir() {
+			filesList = append(filesList, base.GenericStorageFileInfo(SFTPFileInfo{filename: fi.Name()}))
+		}
+	}
+
+	return filesList, nil
+}
+
+// rename remote file replacing target if it exists,
+// falls back to plain rename for servers without posix-rename extension
+func (ss SFTPStorage) rename(conn *sftpConnection, oldPath, newPath string) error {
+	err := conn.sftpClient.PosixRename(oldPath, newPath)
+	if err != nil {
+		if _, statErr := conn.sftpClient.Stat(newPath); statErr == nil {
+			if err = conn.sftpClient.Remove(newPath); err != nil {
+				return err
+			}
+		}
+		err = conn.sftpClient.Rename(oldPath, newPath)
+	}
+	return err
+}
+
+func (ss SFTPStorage) connect() (*sftpConnection, error) {
+	clientConfig, err := ss.getClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	port := ss.port
+	if port == "" {
+		port = defaultPort
+	}
+	sshClient, err := ssh.Dial("tcp", net.JoinHostPort(ss.host, port), clientConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+
+	return &sftpConnection{sshClient: sshClient, sftpClient: sftpClient}, nil
+}
+
+func (ss SFTPStorage) getClientConfig() (*ssh.ClientConfig, error) {
+	var authMethods []ssh.AuthMethod
+	if ss.key_file != "" {
+		keyData, err := ioutil.ReadFile(ss.key_file)
+		if err != nil {
+			return nil, err
+		}
+		var signer ssh.Signer
+		if ss.password != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(keyData, []byte(ss.password))
+		} else {
+			signer, err = ssh.ParsePrivateKey(keyData)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Can't parse private key %v: %v", ss.key_file, err)
+		}
+		authMethods = append(authMethods, ssh.PublicKeys(signer))
+	} else if ss.password != "" {
+		authMethods = append(authMethods, ssh.Password(ss.password))
+	}
+
+	knownHostsFile := ss.known_hosts_file
+	if knownHostsFile == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(homeDir, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Can't load known hosts file: %v", err)
+	}
+
+	return &ssh.ClientConfig{
+		User:            ss.user,
+		Auth:            authMethods,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         connectTimeout,
+	}, nil
+}
+
+func (conn *sftpConnection) Close() error {
+	err := conn.sftpClient.Close()
+	if err2 := conn.sshClient.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (sfi SFTPFileInfo) GetFilename() string {
+	return sfi.filename
+}
+
+func (sfi SFTPFileInfo) GetFileStorageId() map[string]string {
+	return map[string]string{"filename": sfi.filename}
+}
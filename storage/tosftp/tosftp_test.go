@@ -0,0 +1,180 @@
+// +build integration storage sftp
+
+package tosftp_test
+
+import (
+	"github.com/n-boy/backuper/storage/tosftp"
+
+	"github.com/n-boy/backuper/ut/teststorage"
+	"github.com/n-boy/backuper/ut/testutils"
+
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const normalFileSize = 3 * 1024 * 1024
+const smallFileSize = 1 * 1024 * 1024
+
+const testUser = "backuper"
+const testPassword = "backuper-test-password"
+
+func TestUploadDownloadFile(t *testing.T) {
+	s, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckUploadDownloadFile(t, s, normalFileSize)
+}
+
+func TestGetFilesList(t *testing.T) {
+	s, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckGetFilesList(t, s, smallFileSize, 0)
+}
+
+func TestUploadRateLimit(t *testing.T) {
+	s, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckUploadRateLimit(t, s, smallFileSize)
+}
+
+func TestUploadStream(t *testing.T) {
+	s, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckUploadStream(t, s, smallFileSize)
+}
+
+func TestDeleteFile(t *testing.T) {
+	s, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckDeleteFile(t, s, smallFileSize, true)
+}
+
+// uses storage from tests config if defined, otherwise in-process SSH server
+func getStorage(t *testing.T) (tosftp.SFTPStorage, error) {
+	testsConfig, err := testutils.GetTestsConfig()
+	if err == nil && len(testsConfig.StorageSFTP) > 0 {
+		return tosftp.NewStorage(testsConfig.StorageSFTP)
+	}
+
+	workDir, err := ioutil.TempDir(testutils.TmpDir(), "sftp")
+	if err != nil {
+		return tosftp.SFTPStorage{}, err
+	}
+	t.Cleanup(func() { os.RemoveAll(workDir) })
+	remotePath := filepath.Join(workDir, "storage")
+	if err = os.Mkdir(remotePath, 0770); err != nil {
+		return tosftp.SFTPStorage{}, err
+	}
+
+	addr, hostKey, err := startSSHServer(t)
+	if err != nil {
+		return tosftp.SFTPStorage{}, err
+	}
+	knownHostsFile := filepath.Join(workDir, "known_hosts")
+	knownHostsLine := knownhosts.Line([]string{addr.String()}, hostKey) + "\n"
+	if err = ioutil.WriteFile(knownHostsFile, []byte(knownHostsLine), 0600); err != nil {
+		return tosftp.SFTPStorage{}, err
+	}
+
+	host, port, _ := net.SplitHostPort(addr.String())
+	return tosftp.NewStorage(map[string]string{
+		"host":             host,
+		"port":             port,
+		"user":             testUser,
+		"password":         testPassword,
+		"known_hosts_file": knownHostsFile,
+		"path":             remotePath,
+	})
+}
+
+func startSSHServer(t *testing.T) (net.Addr, ssh.PublicKey, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	hostSigner, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == testUser && string(pass) == testPassword {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSHConn(conn, config)
+		}
+	}()
+
+	return listener.Addr(), hostSigner.PublicKey(), nil
+}
+
+func serveSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				isSftp := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(isSftp, nil)
+			}
+		}(requests)
+
+		go func() {
+			defer channel.Close()
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				return
+			}
+			server.Serve()
+		}()
+	}
+}
@@ -0,0 +1,280 @@
+package towebdav
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/n-boy/backuper/base"
+	storageutils "github.com/n-boy/backuper/storage/utils"
+)
+
+// no overall timeout: upload of large archive could take hours
+var httpClient = &http.Client{}
+
+type WebDAVStorage struct {
+	url        string `name:"url" title:"WebDAV server URL"`
+	username   string `name:"username" title:"Username"`
+	password   string `name:"password" title:"Password" secret:"true"`
+	collection string `name:"collection" title:"Base collection (directory) on server"`
+}
+
+type WebDAVFileInfo struct {
+	filename string
+}
+
+// error returned on unexpected HTTP status of WebDAV request
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("WebDAV request %v %v failed: %v", e.Method, e.URL, e.Status)
+}
+
+func NewStorage(config map[string]string) (WebDAVStorage, error) {
+	var ws WebDAVStorage
+
+	ws.url = config["url"]
+	ws.username = config["username"]
+	ws.password = config["password"]
+	ws.collection = config["collection"]
+
+	if ws.url != "" {
+		if _, err := url.Parse(ws.url); err != nil {
+			return ws, err
+		}
+	}
+
+	return ws, nil
+}
+
+func GetEmptyStorage() WebDAVStorage {
+	return WebDAVStorage{}
+}
+
+func (ws WebDAVStorage) GetType() string {
+	return "webdav"
+}
+
+func (ws WebDAVStorage) GetStorageConfig() map[string]string {
+	config := make(map[string]string)
+
+	config["url"] = ws.url
+	config["username"] = ws.username
+	config["password"] = ws.password
+	config["collection"] = ws.collection
+
+	return config
+}
+
+func (ws WebDAVStorage) UploadFile(ctx context.Context, filePath string, remoteFileName string) (map[string]string, error) {
+	result := make(map[string]string)
+
+	fileReader, err := os.Open(filePath)
+	if err != nil {
+		return result, err
+	}
+	defer fileReader.Close()
+
+	fileInfo, err := fileReader.Stat()
+	if err != nil {
+		return result, err
+	}
+
+	filename := filepath.Base(filePath)
+	if remoteFileName != "" {
+		filename = filepath.Base(remoteFileName)
+	}
+	remoteUrl := ws.getFileUrl(filename)
+	remoteUrlShadow := ws.getFileUrl(filename + "~")
+
+	req, err := ws.newRequest(ctx, "PUT", remoteUrlShadow, storageutils.NewUploadProgressReader(ctx, storageutils.NewUploadRateLimitReader(ctx, fileReader)))
+	if err != nil {
+		return result, err
+	}
+	req.ContentLength = fileInfo.Size()
+	if _, err = ws.doRequest(req, http.StatusCreated, http.StatusNoContent, http.StatusOK); err != nil {
+		// partly uploaded file is removed, even if upload is canceled
+		ws.deleteUrl(context.Background(), remoteUrlShadow)
+		return result, err
+	}
+
+	// the same semantics as rename of shadow file in local filesystem storage
+	req, err = ws.newRequest(ctx, "MOVE", remoteUrlShadow, nil)
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Destination", remoteUrl)
+	req.Header.Set("Overwrite", "T")
+	if _, err = ws.doRequest(req, http.StatusCreated, http.StatusNoContent); err != nil {
+		ws.deleteUrl(context.Background(), remoteUrlShadow)
+		return result, err
+	}
+	result["filename"] = filename
+
+	return result, nil
+}
+
+func (ws WebDAVStorage) DownloadFile(ctx context.Context, fileStorageId map[string]string, localFilePath string) error {
+	downloadAction := func(pipe io.Writer) error {
+		return ws.DownloadFileToPipe(ctx, fileStorageId, pipe)
+	}
+	return storageutils.DownloadFile(downloadAction, localFilePath)
+}
+
+func (ws WebDAVStorage) DownloadFileToPipe(ctx context.Context, fileStorageId map[string]string, pipe io.Writer) error {
+	req, err := ws.newRequest(ctx, "GET", ws.getFileUrl(fileStorageId["filename"]), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ws.doRequestBody(req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(pipe, resp.Body)
+	return err
+}
+
+func (ws WebDAVStorage) DeleteFile(ctx context.Context, fileStorageInfo map[string]string) error {
+	return ws.deleteUrl(ctx, ws.getFileUrl(fileStorageInfo["filename"]))
+}
+
+func (ws WebDAVStorage) GetFilesList(ctx context.Context) ([]base.GenericStorageFileInfo, error) {
+	var filesList []base.GenericStorageFileInfo
+
+	propfindBody := `<?xml version="1.0" encoding="utf-8"?>` +
+		`<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/></d:prop></d:propfind>`
+	req, err := ws.newRequest(ctx, "PROPFIND", ws.getCollectionUrl(), strings.NewReader(propfindBody))
+	if err != nil {
+		return filesList, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := ws.doRequestBody(req, http.StatusMultiStatus)
+	if err != nil {
+		return filesList, err
+	}
+	defer resp.Body.Close()
+
+	type multistatusResponse struct {
+		Href         string     `xml:"href"`
+		ResourceType []xml.Name `xml:"propstat>prop>resourcetype>collection"`
+	}
+	var multistatus struct {
+		Responses []multistatusResponse `xml:"response"`
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return filesList, err
+	}
+
+	for _, r := range multistatus.Responses {
+		if len(r.ResourceType) > 0 {
+			// collection itself or nested collection
+			continue
+		}
+		hrefUrl, err := url.Parse(r.Href)
+		if err != nil {
+			return filesList, err
+		}
+		filename := path.Base(hrefUrl.Path)
+		if filename != "" && filename != "/" && filename != "." {
+			filesList = append(filesList, base.GenericStorageFileInfo(WebDAVFileInfo{filename: filename}))
+		}
+	}
+
+	return filesList, nil
+}
+
+func (ws WebDAVStorage) deleteUrl(ctx context.Context, fileUrl string) error {
+	req, err := ws.newRequest(ctx, "DELETE", fileUrl, nil)
+	if err != nil {
+		return err
+	}
+	_, err = ws.doRequest(req, http.StatusNoContent, http.StatusOK)
+	return err
+}
+
+func (ws WebDAVStorage) getCollectionUrl() string {
+	collection := strings.Trim(ws.collection, "/")
+	if collection == "" {
+		return strings.TrimRight(ws.url, "/") + "/"
+	}
+	return strings.TrimRight(ws.url, "/") + "/" + escapePath(collection) + "/"
+}
+
+func (ws WebDAVStorage) getFileUrl(filename string) string {
+	return ws.getCollectionUrl() + url.PathEscape(filename)
+}
+
+func (ws WebDAVStorage) newRequest(ctx context.Context, method, reqUrl string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, reqUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	if ws.username != "" || ws.password != "" {
+		req.SetBasicAuth(ws.username, ws.password)
+	}
+	return req, nil
+}
+
+// executes request and discards response body
+func (ws WebDAVStorage) doRequest(req *http.Request, okStatuses ...int) (*http.Response, error) {
+	resp, err := ws.doRequestBody(req, okStatuses...)
+	if err != nil {
+		return resp, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp, resp.Body.Close()
+}
+
+// executes request, response body should be closed by caller
+func (ws WebDAVStorage) doRequestBody(req *http.Request, okStatuses ...int) (*http.Response, error) {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return resp, err
+	}
+	for _, status := range okStatuses {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	return resp, &StatusError{
+		Method:     req.Method,
+		URL:        req.URL.Redacted(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+	}
+}
+
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+func (wfi WebDAVFileInfo) GetFilename() string {
+	return wfi.filename
+}
+
+func (wfi WebDAVFileInfo) GetFileStorageId() map[string]string {
+	return map[string]string{"filename": wfi.filename}
+}
@@ -0,0 +1,97 @@
+// +build integration storage webdav
+
+package towebdav_test
+
+import (
+	"github.com/n-boy/backuper/storage/towebdav"
+
+	"github.com/n-boy/backuper/ut/teststorage"
+	"github.com/n-boy/backuper/ut/testutils"
+
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+const normalFileSize = 3 * 1024 * 1024
+const smallFileSize = 1 * 1024 * 1024
+
+const testUser = "backuper"
+const testPassword = "backuper-test-password"
+const testCollection = "backups/test plan"
+
+func TestUploadDownloadFile(t *testing.T) {
+	s, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckUploadDownloadFile(t, s, normalFileSize)
+}
+
+func TestGetFilesList(t *testing.T) {
+	s, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckGetFilesList(t, s, smallFileSize, 0)
+}
+
+func TestUploadRateLimit(t *testing.T) {
+	s, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckUploadRateLimit(t, s, smallFileSize)
+}
+
+func TestDeleteFile(t *testing.T) {
+	s, err := getStorage(t)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	teststorage.CheckDeleteFile(t, s, smallFileSize, true)
+}
+
+// uses storage from tests config if defined, otherwise in-process WebDAV server
+func getStorage(t *testing.T) (towebdav.WebDAVStorage, error) {
+	testsConfig, err := testutils.GetTestsConfig()
+	if err == nil && len(testsConfig.StorageWebDAV) > 0 {
+		return towebdav.NewStorage(testsConfig.StorageWebDAV)
+	}
+
+	rootDir, err := ioutil.TempDir(testutils.TmpDir(), "webdav")
+	if err != nil {
+		return towebdav.WebDAVStorage{}, err
+	}
+	t.Cleanup(func() { os.RemoveAll(rootDir) })
+	if err = os.MkdirAll(filepath.Join(rootDir, filepath.FromSlash(testCollection)), 0770); err != nil {
+		return towebdav.WebDAVStorage{}, err
+	}
+
+	davHandler := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.Dir(rootDir),
+		LockSystem: webdav.NewMemLS(),
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != testUser || pass != testPassword {
+			w.Header().Set("WWW-Authenticate", `Basic realm="backuper"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		davHandler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+
+	return towebdav.NewStorage(map[string]string{
+		"url":        ts.URL + "/dav",
+		"username":   testUser,
+		"password":   testPassword,
+		"collection": testCollection,
+	})
+}
@@ -1,8 +1,11 @@
 package utils
 
 import (
+	"context"
 	"io"
 	"os"
+	"sync"
+	"time"
 )
 
 func DownloadFile(downloadAction func(pipe io.Writer) error, localFilePath string) error {
@@ -25,3 +28,163 @@ func DownloadFile(downloadAction func(pipe io.Writer) error, localFilePath strin
 
 	return os.Rename(localFilePathShadow, localFilePath)
 }
+
+// reader which fails with context error, when context is canceled, so copying of file is interrupted
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+// writer which fails with context error, when context is canceled
+func NewContextWriter(ctx context.Context, w io.Writer) io.Writer {
+	return &contextWriter{ctx: ctx, w: w}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (cw *contextWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
+
+type uploadProgressKey struct{}
+
+// returns context carrying callback, storages call it with qty of bytes of file sent to storage,
+// as soon as they are sent (e.g. by parts of multipart upload). Callback is not called concurrently
+func WithUploadProgress(ctx context.Context, progressFunc func(bytes int64)) context.Context {
+	return context.WithValue(ctx, uploadProgressKey{}, progressFunc)
+}
+
+// calls upload progress callback of context, if there is one
+func ReportUploadProgress(ctx context.Context, bytes int64) {
+	if progressFunc, ok := ctx.Value(uploadProgressKey{}).(func(bytes int64)); ok && bytes > 0 {
+		progressFunc(bytes)
+	}
+}
+
+// reader which reports bytes read from file being uploaded to upload progress callback of context
+func NewUploadProgressReader(ctx context.Context, r io.Reader) io.Reader {
+	return &uploadProgressReader{ctx: ctx, r: r}
+}
+
+type uploadProgressReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (upr *uploadProgressReader) Read(p []byte) (int, error) {
+	n, err := upr.r.Read(p)
+	ReportUploadProgress(upr.ctx, int64(n))
+	return n, err
+}
+
+// limits rate of data transfer, could be shared by concurrent transfers, nil limiter does not limit anything
+type RateLimiter struct {
+	bytesPerSec int64
+
+	mu sync.Mutex
+	// time when data passed through limiter is transferred at the limited rate
+	next time.Time
+}
+
+// returns nil limiter for not positive rate
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &RateLimiter{bytesPerSec: bytesPerSec}
+}
+
+// waits while n bytes transferred just now exceed the rate, fails with context error when ctx is canceled.
+// Time of not used rate is not accumulated, so transfer resumed after pause does not burst
+func (rl *RateLimiter) WaitN(ctx context.Context, n int64) error {
+	if rl == nil || n <= 0 {
+		return nil
+	}
+	rl.mu.Lock()
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	rl.next = rl.next.Add(time.Duration(float64(n) / float64(rl.bytesPerSec) * float64(time.Second)))
+	wait := rl.next.Sub(now)
+	rl.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type uploadRateLimitKey struct{}
+
+// returns context carrying limiter of upload rate, storages limit data sent to them with it
+func WithUploadRateLimit(ctx context.Context, limiter *RateLimiter) context.Context {
+	return context.WithValue(ctx, uploadRateLimitKey{}, limiter)
+}
+
+// waits while n bytes sent to storage exceed upload rate limit of context, if there is one.
+// Storages uploading file by parts call it before sending of each part
+func WaitUploadRateLimit(ctx context.Context, n int64) error {
+	limiter, _ := ctx.Value(uploadRateLimitKey{}).(*RateLimiter)
+	return limiter.WaitN(ctx, n)
+}
+
+// reader of file being uploaded, limited by upload rate limit of context
+func NewUploadRateLimitReader(ctx context.Context, r io.Reader) io.Reader {
+	return &rateLimitReader{ctx: ctx, r: r}
+}
+
+type rateLimitReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (rlr *rateLimitReader) Read(p []byte) (int, error) {
+	n, err := rlr.r.Read(p)
+	if waitErr := WaitUploadRateLimit(rlr.ctx, int64(n)); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
+
+// writer limited by limiter, e.g. pipe of downloaded file
+func NewRateLimitWriter(ctx context.Context, limiter *RateLimiter, w io.Writer) io.Writer {
+	if limiter == nil {
+		return w
+	}
+	return &rateLimitWriter{ctx: ctx, limiter: limiter, w: w}
+}
+
+type rateLimitWriter struct {
+	ctx     context.Context
+	limiter *RateLimiter
+	w       io.Writer
+}
+
+func (rlw *rateLimitWriter) Write(p []byte) (int, error) {
+	if err := rlw.limiter.WaitN(rlw.ctx, int64(len(p))); err != nil {
+		return 0, err
+	}
+	return rlw.w.Write(p)
+}
@@ -6,14 +6,19 @@ package teststorage
 import (
 	"github.com/n-boy/backuper/base"
 	"github.com/n-boy/backuper/storage"
+	storageutils "github.com/n-boy/backuper/storage/utils"
 
 	"github.com/n-boy/backuper/ut/testutils"
 
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -32,13 +37,13 @@ func CheckUploadDownloadFile(t *testing.T, s storage.GenericStorage, fileSize in
 	defer deleteTempFile(t, sourceFilePath)
 
 	var fileStorageInfo map[string]string
-	fileStorageInfo, err = s.UploadFile(sourceFilePath, filepath.Base(sourceFilePath))
+	fileStorageInfo, err = s.UploadFile(context.Background(), sourceFilePath, filepath.Base(sourceFilePath))
 	if err != nil {
 		t.Fatalf("Test died. Step: UploadFile, Name: %v, error: %v\n", testName, err)
 	} else {
 		t.Logf("Successful upload file to storage: %v", sourceFilePath)
 	}
-	defer s.DeleteFile(fileStorageInfo)
+	defer s.DeleteFile(context.Background(), fileStorageInfo)
 
 	var sourceMD5 string
 	sourceMD5, err = testutils.CalcFileMD5(sourceFilePath)
@@ -83,6 +88,100 @@ func CheckUploadDownloadFile(t *testing.T, s storage.GenericStorage, fileSize in
 	}
 }
 
+// file is uploaded with rate limit, which should take at least half of second
+func CheckUploadRateLimit(t *testing.T, s storage.GenericStorage, fileSize int) {
+	testutils.InitAppForTests()
+	testName := "UploadRateLimit"
+
+	sourceFilePath, err := createSourceFile(t, fileSize)
+	if err != nil {
+		t.Fatalf("Test died. Step: CreateSourceFile, Name: %v, error: %v\n", testName, err)
+	}
+	defer deleteTempFile(t, sourceFilePath)
+
+	bytesPerSec := int64(fileSize) * 2
+	ctx := storageutils.WithUploadRateLimit(context.Background(), storageutils.NewRateLimiter(bytesPerSec))
+	started := time.Now()
+	fileStorageInfo, err := s.UploadFile(ctx, sourceFilePath, filepath.Base(sourceFilePath))
+	if err != nil {
+		t.Fatalf("Test died. Step: UploadFile, Name: %v, error: %v\n", testName, err)
+	}
+	defer s.DeleteFile(context.Background(), fileStorageInfo)
+
+	minDuration := time.Duration(float64(fileSize) / float64(bytesPerSec) * float64(time.Second))
+	if elapsed := time.Since(started); elapsed < minDuration {
+		t.Errorf("Test failed. Step: CheckDuration, Name: %v, upload took %v, expected at least %v\n", testName, elapsed, minDuration)
+	} else {
+		t.Logf("Test passed. Step: CheckDuration, Name: %v, upload took %v", testName, elapsed)
+	}
+}
+
+// file of unknown size is streamed to storage, file of broken stream should not be left in storage
+func CheckUploadStream(t *testing.T, s storage.GenericStorage, fileSize int) {
+	testutils.InitAppForTests()
+	testName := "UploadStream"
+
+	streamer, ok := s.(storage.StreamingStorage)
+	if !ok {
+		t.Fatalf("Test died. Step: CheckStreamingStorage, Name: %v, storage %v does not support streaming\n", testName, s.GetType())
+	}
+	sourceFilePath, err := createSourceFile(t, fileSize)
+	if err != nil {
+		t.Fatalf("Test died. Step: CreateSourceFile, Name: %v, error: %v\n", testName, err)
+	}
+	defer deleteTempFile(t, sourceFilePath)
+	sourceMD5, err := testutils.CalcFileMD5(sourceFilePath)
+	if err != nil {
+		t.Fatalf("Test died. Step: CalcSourceFileMD5, Name: %v, error: %v\n", testName, err)
+	}
+
+	fileReader, err := os.Open(sourceFilePath)
+	if err != nil {
+		t.Fatalf("Test died. Step: OpenSourceFile, Name: %v, error: %v\n", testName, err)
+	}
+	defer fileReader.Close()
+	// reader is wrapped to hide size of file from storage
+	fileStorageInfo, err := streamer.UploadStream(context.Background(), io.MultiReader(fileReader), filepath.Base(sourceFilePath))
+	if err != nil {
+		t.Fatalf("Test died. Step: UploadStream, Name: %v, error: %v\n", testName, err)
+	}
+	defer s.DeleteFile(context.Background(), fileStorageInfo)
+
+	restoredFilePath := filepath.Join(testutils.TmpDir(), testutils.RandString(20)+".bin")
+	if err = downloadFile(t, s, fileStorageInfo, restoredFilePath); err != nil {
+		t.Fatalf("Test died. Step: DownloadFile, Name: %v, error: %v\n", testName, err)
+	}
+	defer deleteTempFile(t, restoredFilePath)
+	restoredMD5, err := testutils.CalcFileMD5(restoredFilePath)
+	if err != nil {
+		t.Fatalf("Test died. Step: CalcRestoredFileMD5, Name: %v, error: %v\n", testName, err)
+	}
+	if sourceMD5 != restoredMD5 {
+		t.Errorf("Test failed. Step: CompareMD5, Name: %v, expected: %v, got: %v\n", testName, sourceMD5, restoredMD5)
+	} else {
+		t.Logf("Test passed. Step: CompareMD5, Name: %v", testName)
+	}
+
+	if _, err = fileReader.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Test died. Step: SeekSourceFile, Name: %v, error: %v\n", testName, err)
+	}
+	brokenFileName := testutils.RandString(20) + ".bin"
+	brokenReader := io.MultiReader(io.LimitReader(fileReader, int64(fileSize/2)), iotest.ErrReader(errors.New("stream is broken")))
+	if _, err = streamer.UploadStream(context.Background(), brokenReader, brokenFileName); err == nil {
+		t.Fatalf("Test died. Step: UploadBrokenStream, Name: %v, expected: error, got: file uploaded\n", testName)
+	}
+	filesList, err := getFilesList(t, s)
+	if err != nil {
+		t.Fatalf("Test died. Step: GetFilesList, Name: %v, error: %v\n", testName, err)
+	}
+	for _, f := range filesList {
+		if strings.HasPrefix(f.GetFilename(), brokenFileName) {
+			t.Errorf("Test failed. Step: FindBrokenFileInList, Name: %v, expected: file of broken stream NOT founded in list, got: %v\n",
+				testName, f.GetFilename())
+		}
+	}
+}
+
 func CheckGetFilesList(t *testing.T, s storage.GenericStorage, fileSize int, waitForActualListSeconds int64) {
 	testutils.InitAppForTests()
 	testName := "GetFilesList"
@@ -96,13 +195,13 @@ func CheckGetFilesList(t *testing.T, s storage.GenericStorage, fileSize int, wai
 	defer deleteTempFile(t, sourceFilePath)
 
 	var fileStorageInfo map[string]string
-	fileStorageInfo, err = s.UploadFile(sourceFilePath, filepath.Base(sourceFilePath))
+	fileStorageInfo, err = s.UploadFile(context.Background(), sourceFilePath, filepath.Base(sourceFilePath))
 	if err != nil {
 		t.Fatalf("Test died. Step: UploadFile, Name: %v, error: %v\n", testName, err)
 	} else {
 		t.Logf("Successful upload file to storage: %v", sourceFilePath)
 	}
-	defer s.DeleteFile(fileStorageInfo)
+	defer s.DeleteFile(context.Background(), fileStorageInfo)
 
 	// in some storages like aws glacier, files list does not refreshed immediately
 	fmt.Printf("Waiting for files list actuality, seconds: %v, now: %v\n", waitForActualListSeconds, time.Now())
@@ -144,7 +243,7 @@ func CheckDeleteFile(t *testing.T, s storage.GenericStorage, fileSize int, useFi
 	defer deleteTempFile(t, sourceFilePath)
 
 	var fileStorageInfo map[string]string
-	fileStorageInfo, err = s.UploadFile(sourceFilePath, filepath.Base(sourceFilePath))
+	fileStorageInfo, err = s.UploadFile(context.Background(), sourceFilePath, filepath.Base(sourceFilePath))
 	if err != nil {
 		t.Fatalf("Test died. Step: UploadFile, Name: %v, error: %v\n", testName, err)
 	} else {
@@ -152,7 +251,7 @@ func CheckDeleteFile(t *testing.T, s storage.GenericStorage, fileSize int, useFi
 	}
 
 	sourceFileName := filepath.Base(sourceFilePath)
-	err = s.DeleteFile(fileStorageInfo)
+	err = s.DeleteFile(context.Background(), fileStorageInfo)
 	if err != nil {
 		t.Fatalf("Test died. Step: DeleteFile, Name: %v, error: %v\n", testName, err)
 	} else {
@@ -230,7 +329,7 @@ func deleteTempFile(t *testing.T, filePath string) error {
 
 func downloadFile(t *testing.T, s storage.GenericStorage, fileStorageInfo map[string]string, restoredFilePath string) error {
 	action := func() error {
-		return s.DownloadFile(fileStorageInfo, restoredFilePath)
+		return s.DownloadFile(context.Background(), fileStorageInfo, restoredFilePath)
 	}
 	return waitRequestInProgress(t, action, base.StorageRequestInProgressRetrySeconds, 0)
 }
@@ -243,7 +342,7 @@ func downloadFileToPipe(t *testing.T, s storage.GenericStorage, fileStorageInfo
 	defer fileWriter.Close()
 
 	action := func() error {
-		return s.DownloadFileToPipe(fileStorageInfo, fileWriter)
+		return s.DownloadFileToPipe(context.Background(), fileStorageInfo, fileWriter)
 	}
 	return waitRequestInProgress(t, action, base.StorageRequestInProgressRetrySeconds, 0)
 }
@@ -252,7 +351,7 @@ func getFilesList(t *testing.T, s storage.GenericStorage) ([]base.GenericStorage
 	filesList := []base.GenericStorageFileInfo{}
 	action := func() error {
 		var err error
-		filesList, err = s.GetFilesList()
+		filesList, err = s.GetFilesList(context.Background())
 		return err
 	}
 	err := waitRequestInProgress(t, action, base.StorageRequestInProgressRetrySeconds, 0)
@@ -22,6 +22,9 @@ import (
 type TestsConfig struct {
 	StorageGlacier map[string]string `yaml:"storage_glacier"`
 	StorageLocalFS map[string]string `yaml:"storage_localfs"`
+	StorageS3      map[string]string `yaml:"storage_s3"`
+	StorageSFTP    map[string]string `yaml:"storage_sftp"`
+	StorageWebDAV  map[string]string `yaml:"storage_webdav"`
 }
 
 func GetTestsConfig() (TestsConfig, error) {
@@ -146,7 +146,11 @@ func cmd_ArchivedList(w http.ResponseWriter, r *http.Request, plan core.BackupPl
 	localFiles := localFilesIndexByPlan[plan.Name]
 
 	basePath := r.FormValue("basePath")
-	archivedNodesMap := plan.GetArchivedNodesAllRevMap()
+	archivedNodesMap, err := plan.GetArchivedNodesAllRevMap()
+	if err != nil {
+		fmt.Fprintf(w, "Error occured while reading metafiles of plan \"%s\": %v", plan.Name, err)
+		return
+	}
 	workPathArchivedNodesMap := make(map[string]*NodeMetaInfoUI)
 	for p, nodes := range archivedNodesMap {
 		if basePath != "" && !base.IsPathInBasePath(basePath, p) {